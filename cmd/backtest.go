@@ -0,0 +1,353 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"citadel/internal/broker"
+	"citadel/internal/quant"
+	_ "citadel/internal/quant/strategies"
+	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
+	"github.com/jmoiron/sqlx"
+	"github.com/spf13/cobra"
+)
+
+var backtestCmd = &cobra.Command{
+	Use:   "backtest",
+	Short: "Run a backtest locally and print its metrics",
+	Long: `The backtest command runs any registered strategy over historical bars and
+prints its metrics, or writes the full result as JSON with --output.
+
+With --data, bars are read from files instead of Alpaca, so no network or
+credentials are needed. Files hold one symbol each and are looked up as
+
+  <data>/<timeframe>/<SYMBOL>.csv or .parquet   e.g. bars/1Day/AAPL.csv
+  <data>/<SYMBOL>.csv or .parquet               used for any timeframe
+
+Intraday timeframes fall back to resampling <data>/1Min files. Columns are
+matched by name: timestamp, open, high, low, close, and optionally volume,
+trade_count and vwap. Timestamps may be RFC3339, "YYYY-MM-DD HH:MM:SS" in
+UTC, a date, or Unix seconds.
+
+With --portfolio, several strategies are backtested as one book instead of
+--strategy. The file is JSON in the shape of POST /trading/backtest:
+
+  {"sleeves": [{"strategy": "rsi_reversion", "symbols": ["AAPL"]}, ...],
+   "allocation": {"method": "risk_parity", "rebalance": "monthly"}}`,
+	RunE: runBacktest,
+}
+
+func init() {
+	rootCmd.AddCommand(backtestCmd)
+
+	backtestCmd.Flags().String("data", "", "directory of bar files to use instead of Alpaca")
+	backtestCmd.Flags().String("strategy", "", "strategy ID (see GET /trading/strategies)")
+	backtestCmd.Flags().
+		String("portfolio", "", "JSON file of sleeves and allocation to backtest as one book")
+	backtestCmd.Flags().StringSlice("symbols", nil, "symbols to trade")
+	backtestCmd.Flags().
+		StringArray("param", nil, "strategy parameter as name=value (repeatable)")
+	backtestCmd.Flags().
+		String("start", "", "start date, RFC3339 or YYYY-MM-DD (default one year ago)")
+	backtestCmd.Flags().String("end", "", "end date, RFC3339 or YYYY-MM-DD (default now)")
+	backtestCmd.Flags().String("timeframe", "1Day", "bar timeframe, e.g. 1Min, 15Min, 1Hour, 1Day")
+	backtestCmd.Flags().Float64("capital", 100000, "starting capital")
+	backtestCmd.Flags().String("benchmark", "", "symbol to compare the equity curve against")
+	backtestCmd.Flags().Float64("risk-free-rate", 0, "annualized risk-free rate, e.g. 0.04")
+	backtestCmd.Flags().
+		String("output", "", "write the portfolio and metrics as JSON to this file (- for stdout)")
+	backtestCmd.MarkFlagsMutuallyExclusive("strategy", "portfolio")
+	backtestCmd.MarkFlagsOneRequired("strategy", "portfolio")
+}
+
+// marketDataSource returns a file source when --data is set, otherwise an
+// Alpaca client, cached through db when one is given.
+func marketDataSource(
+	ctx context.Context,
+	cmd *cobra.Command,
+	db *sqlx.DB,
+) (broker.MarketDataSource, error) {
+	if dir, _ := cmd.Flags().GetString("data"); dir != "" {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("--data %s is not a directory", dir)
+		}
+		return broker.NewFileSource(dir), nil
+	}
+
+	b, err := newBroker(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if db != nil {
+		b.EnableBarCache(db)
+	}
+	return b, nil
+}
+
+func runBacktest(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+
+	if path, _ := cmd.Flags().GetString("portfolio"); path != "" {
+		return runPortfolioBacktest(cmd, path)
+	}
+
+	strategyID, _ := cmd.Flags().GetString("strategy")
+	symbols, _ := cmd.Flags().GetStringSlice("symbols")
+	if len(symbols) == 0 {
+		return fmt.Errorf("--symbols is required with --strategy")
+	}
+	for i, sym := range symbols {
+		symbols[i] = strings.ToUpper(strings.TrimSpace(sym))
+	}
+
+	raw := make(map[string]interface{})
+	pairs, _ := cmd.Flags().GetStringArray("param")
+	for _, pair := range pairs {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("invalid --param %q, expected name=value", pair)
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid --param %q: %w", pair, err)
+		}
+		raw[strings.TrimSpace(name)] = v
+	}
+
+	strategy, params, err := quant.NewStrategy(strategyID, symbols, raw)
+	if err != nil {
+		return err
+	}
+
+	timeframe, start, end, err := backtestWindow(cmd)
+	if err != nil {
+		return err
+	}
+
+	data, err := marketDataSource(ctx, cmd, nil)
+	if err != nil {
+		return err
+	}
+
+	barsMap, err := quant.LoadBars(ctx, data, symbols, timeframe, start, end)
+	if err != nil {
+		return err
+	}
+
+	benchmark, err := benchmarkBars(cmd, data, timeframe, start, end)
+	if err != nil {
+		return err
+	}
+
+	capital, _ := cmd.Flags().GetFloat64("capital")
+	riskFreeRate, _ := cmd.Flags().GetFloat64("risk-free-rate")
+
+	engine := quant.NewEngine(capital, strategy, quant.NewRiskManagerFromParams(params))
+	engine.Timeframe = timeframe
+	if err := engine.Run(barsMap); err != nil {
+		return fmt.Errorf("backtest failed: %w", err)
+	}
+	engine.Portfolio.CalculateMetricsWith(quant.AnalyticsOptions{
+		RiskFreeRate: riskFreeRate,
+		Benchmark:    benchmark,
+	})
+
+	if output, _ := cmd.Flags().GetString("output"); output != "" {
+		return writeBacktestJSON(cmd, output, params, engine.Portfolio)
+	}
+	printMetrics(cmd, strategyID, symbols, params, engine.Portfolio.Metrics)
+	return nil
+}
+
+// backtestWindow parses the --timeframe, --start and --end flags.
+func backtestWindow(cmd *cobra.Command) (marketdata.TimeFrame, time.Time, time.Time, error) {
+	tfFlag, _ := cmd.Flags().GetString("timeframe")
+	timeframe, err := broker.ParseTimeFrame(tfFlag)
+	if err != nil {
+		return timeframe, time.Time{}, time.Time{}, err
+	}
+
+	end := time.Now()
+	start := end.AddDate(-1, 0, 0)
+	if s, _ := cmd.Flags().GetString("start"); s != "" {
+		if start, err = parseDateFlag(s); err != nil {
+			return timeframe, start, end, fmt.Errorf("invalid --start: %w", err)
+		}
+	}
+	if s, _ := cmd.Flags().GetString("end"); s != "" {
+		if end, err = parseDateFlag(s); err != nil {
+			return timeframe, start, end, fmt.Errorf("invalid --end: %w", err)
+		}
+	}
+	return timeframe, start, end, nil
+}
+
+// benchmarkBars fetches the --benchmark symbol's bars, if one is set.
+func benchmarkBars(
+	cmd *cobra.Command,
+	data broker.MarketDataSource,
+	timeframe marketdata.TimeFrame,
+	start, end time.Time,
+) ([]marketdata.Bar, error) {
+	sym, _ := cmd.Flags().GetString("benchmark")
+	if sym == "" {
+		return nil, nil
+	}
+	sym = strings.ToUpper(sym)
+	benchmark, err := data.GetBars(cmd.Context(), sym, timeframe, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch market data for %s: %w", sym, err)
+	}
+	return benchmark, nil
+}
+
+// portfolioFile is the --portfolio file.
+type portfolioFile struct {
+	Sleeves    []quant.SleeveSpec     `json:"sleeves"`
+	Allocation quant.AllocationConfig `json:"allocation"`
+}
+
+func runPortfolioBacktest(cmd *cobra.Command, path string) error {
+	ctx := cmd.Context()
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read --portfolio: %w", err)
+	}
+	var config portfolioFile
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return fmt.Errorf("invalid --portfolio %s: %w", path, err)
+	}
+
+	capital, _ := cmd.Flags().GetFloat64("capital")
+	book, err := quant.NewPortfolioEngine(capital, config.Sleeves, config.Allocation)
+	if err != nil {
+		return err
+	}
+
+	timeframe, start, end, err := backtestWindow(cmd)
+	if err != nil {
+		return err
+	}
+	for _, s := range book.Sleeves {
+		s.Engine.Timeframe = timeframe
+	}
+
+	data, err := marketDataSource(ctx, cmd, nil)
+	if err != nil {
+		return err
+	}
+
+	barsMap, err := quant.LoadBars(ctx, data, book.Symbols(), timeframe, start, end)
+	if err != nil {
+		return err
+	}
+
+	benchmark, err := benchmarkBars(cmd, data, timeframe, start, end)
+	if err != nil {
+		return err
+	}
+
+	if err := book.Run(barsMap); err != nil {
+		return fmt.Errorf("backtest failed: %w", err)
+	}
+	riskFreeRate, _ := cmd.Flags().GetFloat64("risk-free-rate")
+	result := book.Result(quant.AnalyticsOptions{
+		RiskFreeRate: riskFreeRate,
+		Benchmark:    benchmark,
+	})
+
+	if output, _ := cmd.Flags().GetString("output"); output != "" {
+		return writeJSON(cmd, output, result)
+	}
+	for _, s := range result.Sleeves {
+		printMetrics(cmd, s.Name, s.Symbols, s.Parameters, s.Portfolio.Metrics)
+		fmt.Fprintln(cmd.OutOrStdout())
+	}
+	printMetrics(cmd, "portfolio", book.Symbols(), nil, result.Portfolio.Metrics)
+	printCorrelation(cmd, result)
+	return nil
+}
+
+func writeBacktestJSON(
+	cmd *cobra.Command,
+	path string,
+	params quant.Params,
+	p *quant.Portfolio,
+) error {
+	return writeJSON(cmd, path, map[string]interface{}{
+		"parameters": params,
+		"portfolio":  p,
+	})
+}
+
+// writeJSON writes v as indented JSON to path, or to stdout for "-".
+func writeJSON(cmd *cobra.Command, path string, v interface{}) error {
+	out := cmd.OutOrStdout()
+	if path != "-" {
+		file, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer file.Close()
+		out = file
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func printMetrics(
+	cmd *cobra.Command,
+	strategyID string,
+	symbols []string,
+	params quant.Params,
+	m quant.Metrics,
+) {
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "strategy\t%s\n", strategyID)
+	fmt.Fprintf(w, "symbols\t%s\n", strings.Join(symbols, ","))
+	if params != nil {
+		paramsJSON, _ := json.Marshal(params)
+		fmt.Fprintf(w, "parameters\t%s\n", paramsJSON)
+	}
+	fmt.Fprintf(w, "total return\t%.2f%%\n", m.TotalReturn*100)
+	fmt.Fprintf(w, "cagr\t%.2f%%\n", m.CAGR*100)
+	fmt.Fprintf(w, "volatility\t%.2f%%\n", m.Volatility*100)
+	fmt.Fprintf(w, "sharpe\t%.2f\n", m.SharpeRatio)
+	fmt.Fprintf(w, "sortino\t%.2f\n", m.SortinoRatio)
+	fmt.Fprintf(w, "max drawdown\t%.2f%%\n", m.MaxDrawdown*100)
+	fmt.Fprintf(w, "trades\t%d\n", m.TotalTrades)
+	fmt.Fprintf(w, "win rate\t%.2f%%\n", m.WinRate*100)
+	fmt.Fprintf(w, "profit factor\t%.2f\n", m.ProfitFactor)
+	if m.Benchmark != nil {
+		fmt.Fprintf(w, "benchmark return\t%.2f%%\n", m.Benchmark.TotalReturn*100)
+		fmt.Fprintf(w, "alpha\t%.4f\n", m.Benchmark.Alpha)
+		fmt.Fprintf(w, "beta\t%.2f\n", m.Benchmark.Beta)
+	}
+}
+
+// printCorrelation prints the correlation of the sleeves' returns as a
+// matrix labelled by sleeve number.
+func printCorrelation(cmd *cobra.Command, result *quant.PortfolioResult) {
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "\ncorrelation")
+	for i, s := range result.Sleeves {
+		fmt.Fprintf(w, "%d %s", i+1, s.Name)
+		for _, c := range result.Correlation[i] {
+			fmt.Fprintf(w, "\t%.2f", c)
+		}
+		fmt.Fprintln(w)
+	}
+}
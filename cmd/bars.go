@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"citadel/internal/broker"
+	"citadel/internal/database"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var barsCmd = &cobra.Command{
+	Use:   "bars",
+	Short: "Manage the local historical bar cache",
+}
+
+var barsSyncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Download historical bars into the local cache",
+	Long: `The sync command fetches any bars missing from the local SQLite cache for
+a watchlist, so later backtests and optimizations can read them offline.
+Symbols come from --symbols, or from bars.watchlist in the config file.
+Intraday timeframes all sync the minute bars they are resampled from.`,
+	RunE: runBarsSync,
+}
+
+func init() {
+	rootCmd.AddCommand(barsCmd)
+	barsCmd.AddCommand(barsSyncCmd)
+
+	barsSyncCmd.Flags().String("db-path", "./citadel.db", "path to the SQLite database")
+	barsSyncCmd.Flags().
+		String("db-schema", "./schema/model.sql", "path to the database schema file")
+	barsSyncCmd.Flags().StringSlice("symbols", nil, "symbols to sync (default bars.watchlist)")
+	barsSyncCmd.Flags().String("timeframe", "1Day", "bar timeframe, e.g. 1Min, 15Min, 1Hour, 1Day")
+	barsSyncCmd.Flags().String("feed", "iex", "market data feed: iex, sip or delayed_sip")
+	barsSyncCmd.Flags().
+		String("start", "", "start date, RFC3339 or YYYY-MM-DD (default five years ago)")
+	barsSyncCmd.Flags().String("end", "", "end date, RFC3339 or YYYY-MM-DD (default now)")
+
+	_ = viper.BindPFlag("database.path", barsSyncCmd.Flags().Lookup("db-path"))
+	_ = viper.BindPFlag("database.schema", barsSyncCmd.Flags().Lookup("db-schema"))
+	_ = viper.BindPFlag("alpaca.feed", barsSyncCmd.Flags().Lookup("feed"))
+}
+
+func runBarsSync(cmd *cobra.Command, args []string) error {
+	symbols, _ := cmd.Flags().GetStringSlice("symbols")
+	if len(symbols) == 0 {
+		symbols = viper.GetStringSlice("bars.watchlist")
+	}
+	if len(symbols) == 0 {
+		return fmt.Errorf("no symbols given: pass --symbols or set bars.watchlist")
+	}
+
+	tfFlag, _ := cmd.Flags().GetString("timeframe")
+	timeframe, err := broker.ParseTimeFrame(tfFlag)
+	if err != nil {
+		return err
+	}
+
+	end := time.Now()
+	start := end.AddDate(-5, 0, 0)
+	if s, _ := cmd.Flags().GetString("start"); s != "" {
+		if start, err = parseDateFlag(s); err != nil {
+			return fmt.Errorf("invalid --start: %w", err)
+		}
+	}
+	if s, _ := cmd.Flags().GetString("end"); s != "" {
+		if end, err = parseDateFlag(s); err != nil {
+			return fmt.Errorf("invalid --end: %w", err)
+		}
+	}
+
+	db, err := database.New(viper.GetString("database.path"), viper.GetString("database.schema"))
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer db.Close()
+
+	ctx := cmd.Context()
+	b, err := newBroker(ctx)
+	if err != nil {
+		return err
+	}
+	b.EnableBarCache(db)
+
+	failed := 0
+	for _, sym := range symbols {
+		sym = strings.ToUpper(strings.TrimSpace(sym))
+		if err := b.SyncBars(ctx, sym, timeframe, start, end); err != nil {
+			slog.Error("failed to sync bars", "symbol", sym, "error", err)
+			failed++
+			continue
+		}
+		slog.Info("synced bars", "symbol", sym, "timeframe", timeframe.String(), "feed", b.Feed)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d symbols failed to sync", failed, len(symbols))
+	}
+	return nil
+}
+
+func parseDateFlag(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, s)
+}
@@ -5,13 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"citadel/internal/broker"
 	"citadel/internal/database"
 	"citadel/internal/quant"
-	"citadel/internal/quant/strategies"
-	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
+	_ "citadel/internal/quant/strategies"
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 	"github.com/spf13/cobra"
@@ -20,9 +20,13 @@ import (
 
 var gridSearchCmd = &cobra.Command{
 	Use:   "gridsearch",
-	Short: "Run grid search for backtest strategies",
-	Long:  `The gridsearch command runs various strategy permutations and saves them to the backtests table.`,
-	RunE:  runGridSearch,
+	Short: "Run a parameter optimization for a backtest strategy",
+	Long: `The gridsearch command reads an optimization spec (JSON or YAML) naming a
+strategy, parameter ranges, symbols, date range, objective and constraints.
+Every candidate is backtested across a worker pool, optionally with rolling
+walk-forward validation, and all runs are saved to the backtests table grouped
+under a named optimization.`,
+	RunE: runGridSearch,
 }
 
 func init() {
@@ -31,12 +35,46 @@ func init() {
 	gridSearchCmd.Flags().String("db-path", "./citadel.db", "path to the SQLite database")
 	gridSearchCmd.Flags().
 		String("db-schema", "./schema/model.sql", "path to the database schema file")
+	gridSearchCmd.Flags().String("spec", "", "path to the optimization spec (JSON or YAML)")
+	gridSearchCmd.Flags().
+		String("data", "", "directory of bar files to use instead of Alpaca (see backtest --help)")
+	_ = gridSearchCmd.MarkFlagRequired("spec")
 
 	_ = viper.BindPFlag("database.path", gridSearchCmd.Flags().Lookup("db-path"))
 	_ = viper.BindPFlag("database.schema", gridSearchCmd.Flags().Lookup("db-schema"))
 }
 
+// loadOptimizationSpec reads a JSON or YAML spec through viper and decodes it
+// via JSON so the spec's json tags apply to both formats.
+func loadOptimizationSpec(path string) (*quant.OptimizationSpec, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("failed to read spec: %w", err)
+	}
+
+	raw, err := json.Marshal(v.AllSettings())
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode spec: %w", err)
+	}
+
+	var spec quant.OptimizationSpec
+	if err := json.Unmarshal(raw, &spec); err != nil {
+		return nil, fmt.Errorf("failed to decode spec: %w", err)
+	}
+	if err := spec.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid spec: %w", err)
+	}
+	return &spec, nil
+}
+
 func runGridSearch(cmd *cobra.Command, args []string) error {
+	specPath, _ := cmd.Flags().GetString("spec")
+	spec, err := loadOptimizationSpec(specPath)
+	if err != nil {
+		return err
+	}
+
 	dbPath := viper.GetString("database.path")
 	dbSchema := viper.GetString("database.schema")
 
@@ -46,178 +84,169 @@ func runGridSearch(cmd *cobra.Command, args []string) error {
 	}
 	defer db.Close()
 
-	b := broker.New(
-		context.Background(),
-		viper.GetString("alpaca.key"),
-		viper.GetString("alpaca.secret"),
-		viper.GetString("alpaca.endpoint"),
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	data, err := marketDataSource(ctx, cmd, db)
+	if err != nil {
+		return err
+	}
+
+	start, end := spec.Range()
+	symbols := spec.AllSymbols()
+	if spec.Benchmark != "" {
+		symbols = append(symbols, spec.Benchmark)
+	}
+
+	slog.Info("fetching historical data for optimization", "symbols", symbols)
+
+	barsMap, err := quant.LoadBars(ctx, data, symbols, spec.BarTimeframe(), start, end)
+	if err != nil {
+		return err
+	}
+
+	specJSON, _ := json.Marshal(spec)
+	opt := database.Optimization{
+		OptimizationID: uuid.NewString(),
+		Name:           spec.Name,
+		Strategy:       spec.Strategy,
+		Spec:           string(specJSON),
+		Status:         "running",
+		CreatedAt:      time.Now(),
+	}
+	if err := database.CreateOptimization(ctx, db, &opt); err != nil {
+		return fmt.Errorf("failed to create optimization: %w", err)
+	}
+
+	slog.Info(
+		"starting optimization",
+		"optimization_id",
+		opt.OptimizationID,
+		"name",
+		spec.Name,
+		"strategy",
+		spec.Strategy,
 	)
 
-	symbols := []string{"AAPL", "MSFT", "SPY", "QQQ"}
-	end := time.Now()
-	start := end.AddDate(-2, 0, 0)
-	startingCapital := 100000.0
-
-	slog.Info("fetching historical data for grid search", "symbols", symbols)
-
-	barsMap := make(map[string][]marketdata.Bar)
-	for _, sym := range symbols {
-		bars, err := b.GetHistoricalBars(sym, start, end)
-		if err != nil {
-			return fmt.Errorf("failed to fetch market data for %s: %w", sym, err)
-		}
-		barsMap[sym] = bars
-	}
-
-	ctx := context.Background()
-
-	// SMA Crossover
-	smaShorts := []int{10, 20}
-	smaLongs := []int{50, 100, 200}
-	for _, short := range smaShorts {
-		for _, long := range smaLongs {
-			for _, sym := range symbols {
-				runAndSave(
-					ctx,
-					db,
-					barsMap,
-					sym,
-					start,
-					end,
-					startingCapital,
-					"sma_crossover",
-					map[string]interface{}{
-						"short_period": short,
-						"long_period":  long,
-					},
-				)
-			}
-		}
-	}
-
-	// RSI Reversion
-	rsiPeriods := []int{14, 21}
-	rsiOversolds := []float64{25, 30}
-	rsiOverboughts := []float64{70, 75}
-	for _, period := range rsiPeriods {
-		for _, oversold := range rsiOversolds {
-			for _, overbought := range rsiOverboughts {
-				for _, sym := range symbols {
-					runAndSave(
-						ctx,
-						db,
-						barsMap,
-						sym,
-						start,
-						end,
-						startingCapital,
-						"rsi_reversion",
-						map[string]interface{}{
-							"period":     period,
-							"oversold":   oversold,
-							"overbought": overbought,
-						},
-					)
-				}
-			}
-		}
-	}
-
-	// Bollinger Bands
-	bbPeriods := []int{20, 50}
-	bbStdDevs := []float64{2.0, 2.5}
-	for _, period := range bbPeriods {
-		for _, stdDev := range bbStdDevs {
-			for _, sym := range symbols {
-				runAndSave(
-					ctx,
-					db,
-					barsMap,
-					sym,
-					start,
-					end,
-					startingCapital,
-					"bollinger_bands",
-					map[string]interface{}{
-						"period":  period,
-						"std_dev": stdDev,
-					},
-				)
-			}
-		}
-	}
-
-	slog.Info("grid search completed successfully")
-	return nil
-}
+	// Saves happen on this goroutine; the workers only run backtests
+	results, runErr := quant.RunOptimization(ctx, spec, barsMap, func(t quant.Trial) {
+		saveTrial(context.Background(), db, opt.OptimizationID, spec, t)
+	})
 
-func runAndSave(
-	ctx context.Context,
-	db *sqlx.DB,
-	barsMap map[string][]marketdata.Bar,
-	sym string,
-	start, end time.Time,
-	capital float64,
-	strategyName string,
-	params map[string]interface{},
-) {
-	var strategy quant.Strategy
-	switch strategyName {
-	case "sma_crossover":
-		strategy = strategies.NewSMACrossover(
-			sym,
-			params["short_period"].(int),
-			params["long_period"].(int),
-		)
-	case "rsi_reversion":
-		strategy = strategies.NewRSIReversion(
-			sym,
-			params["period"].(int),
-			params["oversold"].(float64),
-			params["overbought"].(float64),
-		)
-	case "bollinger_bands":
-		strategy = strategies.NewBollingerBands(
-			sym,
-			params["period"].(int),
-			params["std_dev"].(float64),
+	status := "completed"
+	if runErr != nil {
+		status = "failed"
+		slog.Error("optimization stopped early", "error", runErr)
+	}
+
+	var bestParams *string
+	var bestObjective *float64
+	if params, objective, ok := spec.BestParameters(results); ok {
+		paramsJSON, _ := json.Marshal(params)
+		p := string(paramsJSON)
+		bestParams, bestObjective = &p, &objective
+		slog.Info(
+			"best parameters",
+			"parameters",
+			p,
+			spec.Objective,
+			objective,
+			"out_of_sample",
+			spec.WalkForward != nil,
 		)
+	} else {
+		slog.Warn("no parameter set satisfied the constraints")
 	}
 
-	rm := quant.NewDefaultRiskManager(0.05, 0.02)
-	engine := quant.NewEngine(capital, strategy, rm)
+	windowsJSON, _ := json.Marshal(results)
+	windows := string(windowsJSON)
+	if err := database.CompleteOptimization(
+		context.Background(),
+		db,
+		opt.OptimizationID,
+		status,
+		bestParams,
+		bestObjective,
+		&windows,
+	); err != nil {
+		return fmt.Errorf("failed to save optimization results: %w", err)
+	}
 
-	// Only pass the needed symbol
-	symMap := map[string][]marketdata.Bar{
-		sym: barsMap[sym],
+	if runErr != nil {
+		return runErr
 	}
+	slog.Info("optimization completed successfully", "optimization_id", opt.OptimizationID)
+	return nil
+}
 
-	if err := engine.Run(symMap); err != nil {
-		slog.Error("failed to run strategy", "strategy", strategyName, "symbol", sym, "error", err)
+func saveTrial(
+	ctx context.Context,
+	db *sqlx.DB,
+	optimizationID string,
+	spec *quant.OptimizationSpec,
+	t quant.Trial,
+) {
+	if t.Err != nil {
+		slog.Error(
+			"failed to run strategy",
+			"strategy",
+			spec.Strategy,
+			"symbols",
+			t.Symbols,
+			"error",
+			t.Err,
+		)
 		return
 	}
 
-	engine.Portfolio.CalculateMetrics()
-
-	paramsJSON, _ := json.Marshal(params)
-	symbolsJSON, _ := json.Marshal([]string{sym})
-	metricsJSON, _ := json.Marshal(engine.Portfolio.Metrics)
+	paramsJSON, _ := json.Marshal(t.Parameters)
+	symbolsJSON, _ := json.Marshal(t.Symbols)
+	metricsJSON, _ := json.Marshal(t.Metrics)
+	ledgerJSON, _ := json.Marshal(t.RoundTrips)
+	ledger := string(ledgerJSON)
+	sample := t.Sample
+	window := t.Window
+	fillsJSON, _ := json.Marshal(spec.Fills)
+	fills := string(fillsJSON)
+	marginJSON, _ := json.Marshal(spec.Margin)
+	margin := string(marginJSON)
+	riskJSON, _ := json.Marshal(quant.RiskConfigFromParams(t.Parameters))
+	risk := string(riskJSON)
 
 	record := database.BacktestRecord{
 		BacktestID:      uuid.NewString(),
-		Strategy:        strategyName,
+		Strategy:        spec.Strategy,
 		Symbols:         string(symbolsJSON),
-		StartDate:       start.Format(time.RFC3339),
-		EndDate:         end.Format(time.RFC3339),
-		StartingCapital: capital,
+		StartDate:       t.Start.Format(time.RFC3339),
+		EndDate:         t.End.Format(time.RFC3339),
+		StartingCapital: spec.StartingCapital,
 		Parameters:      string(paramsJSON),
 		Metrics:         string(metricsJSON),
+		Ledger:          &ledger,
+		OptimizationID:  &optimizationID,
+		Sample:          &sample,
+		WindowIndex:     &window,
+		Timeframe:       spec.Timeframe,
+		FillConfig:      &fills,
+		MarginConfig:    &margin,
+		RiskConfig:      &risk,
 	}
 
-	err := database.SaveBacktest(ctx, db, record)
-	if err != nil {
-		slog.Error("failed to save backtest", "strategy", strategyName, "symbol", sym, "error", err)
-	} else {
-		slog.Info("saved backtest", "strategy", strategyName, "symbol", sym)
+	if err := database.SaveBacktest(ctx, db, record); err != nil {
+		slog.Error("failed to save backtest", "strategy", spec.Strategy, "error", err)
+		return
 	}
+	slog.Debug(
+		"saved backtest",
+		"strategy",
+		spec.Strategy,
+		"symbols",
+		t.Symbols,
+		"sample",
+		t.Sample,
+		"window",
+		t.Window,
+		spec.Objective,
+		t.Objective,
+	)
 }
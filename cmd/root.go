@@ -1,12 +1,14 @@
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"strings"
 
+	"citadel/internal/broker"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -53,6 +55,9 @@ func init() {
 	if err := viper.BindEnv("alpaca.endpoint", "ALPACA_ENDPOINT"); err != nil {
 		slog.Error("failed to bind env", "key", "alpaca.endpoint", "error", err)
 	}
+	if err := viper.BindEnv("alpaca.feed", "ALPACA_FEED"); err != nil {
+		slog.Error("failed to bind env", "key", "alpaca.feed", "error", err)
+	}
 }
 
 func initializeConfig() error {
@@ -69,6 +74,7 @@ func initializeConfig() error {
 	viper.SetDefault("alpaca.endpoint", "https://paper-api.alpaca.markets")
 	viper.SetDefault("alpaca.key", "")
 	viper.SetDefault("alpaca.secret", "")
+	viper.SetDefault("alpaca.feed", "iex")
 
 	viper.SetEnvPrefix("CITADEL")
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
@@ -92,3 +98,19 @@ func initializeConfig() error {
 
 	return nil
 }
+
+// newBroker connects to Alpaca with the configured credentials and market
+// data feed.
+func newBroker(ctx context.Context) (*broker.Client, error) {
+	feed, err := broker.ParseFeed(viper.GetString("alpaca.feed"))
+	if err != nil {
+		return nil, err
+	}
+	return broker.New(
+		ctx,
+		viper.GetString("alpaca.key"),
+		viper.GetString("alpaca.secret"),
+		viper.GetString("alpaca.endpoint"),
+		feed,
+	), nil
+}
@@ -1,21 +1,32 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"citadel/internal/broker"
 	"citadel/internal/database"
 	"citadel/internal/email"
 	"citadel/internal/logger"
 	"citadel/internal/parser"
+	"citadel/internal/quant"
 	"citadel/route"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
+// shutdownTimeout bounds how long the server waits for requests to finish
+// and live engines to flush their state on shutdown.
+const shutdownTimeout = 30 * time.Second
+
 var serveCmd = &cobra.Command{
 	Use:   "serve",
 	Short: "Start the Citadel HTTP server",
@@ -29,10 +40,17 @@ func init() {
 	serveCmd.Flags().StringP("port", "p", "8080", "port to listen on")
 	serveCmd.Flags().String("db-path", "./citadel.db", "path to the SQLite database")
 	serveCmd.Flags().String("db-schema", "./schema/model.sql", "path to the database schema file")
+	serveCmd.Flags().
+		Bool("paper", false, "trade against an in-process paper broker instead of Alpaca")
+	serveCmd.Flags().Float64("paper-capital", 100000, "starting cash of the paper broker")
+	serveCmd.Flags().
+		String("data", "", "with --paper, directory of bar files to use instead of Alpaca")
 
 	_ = viper.BindPFlag("server.port", serveCmd.Flags().Lookup("port"))
 	_ = viper.BindPFlag("database.path", serveCmd.Flags().Lookup("db-path"))
 	_ = viper.BindPFlag("database.schema", serveCmd.Flags().Lookup("db-schema"))
+	_ = viper.BindPFlag("broker.paper", serveCmd.Flags().Lookup("paper"))
+	_ = viper.BindPFlag("broker.paper_capital", serveCmd.Flags().Lookup("paper-capital"))
 }
 
 func runServe(cmd *cobra.Command, args []string) error {
@@ -68,14 +86,18 @@ func runServe(cmd *cobra.Command, args []string) error {
 	signingKey := viper.GetString("hmac.signing_key")
 
 	// Initialize broker
-	b := broker.New(
-		ctx,
-		viper.GetString("alpaca.key"),
-		viper.GetString("alpaca.secret"),
-		viper.GetString("alpaca.endpoint"),
-	)
+	var b broker.Broker
+	if viper.GetBool("broker.paper") {
+		b, err = paperBroker(ctx, cmd, db)
+	} else {
+		b, err = alpacaBroker(ctx, db)
+	}
+	if err != nil {
+		return err
+	}
 
 	// Initialize route handlers
+	engines := quant.NewEngineManager(db)
 	handler := route.Initialize(ctx, route.Config{
 		Logger:     l,
 		DB:         db,
@@ -83,18 +105,76 @@ func runServe(cmd *cobra.Command, args []string) error {
 		Email:      emailClient,
 		SigningKey: signingKey,
 		Broker:     b,
+		Engines:    engines,
 	})
 
-	// Resume any running live engines
-	go route.ResumeLiveEngines(ctx, l, b, db)
+	// Resume any running live engines; they run until shutdown
+	go engines.Resume(context.WithoutCancel(ctx), l, b)
 
-	// Start HTTP server
+	// Start HTTP server. Requests see a context that ends on shutdown, so
+	// streams close instead of holding the shutdown up
 	port := viper.GetString("server.port")
+	requestCtx, endRequests := context.WithCancel(context.WithoutCancel(ctx))
+	defer endRequests()
+	server := &http.Server{
+		Addr:        ":" + port,
+		Handler:     handler,
+		BaseContext: func(net.Listener) context.Context { return requestCtx },
+	}
+	server.RegisterOnShutdown(endRequests)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
 	l.Info("server listening", "port", port)
 
-	if err := http.ListenAndServe(":"+port, handler); err != nil {
+	signals, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-serveErr:
 		return fmt.Errorf("server stopped: %w", err)
+	case <-signals.Done():
+	}
+
+	// Stop taking requests before the engines, so no session starts or
+	// stops mid-shutdown, then flush every session's state. Sessions stay
+	// running and resume on the next start.
+	l.Info("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		l.Error("failed to shut down http server", "error", err)
 	}
+	if err := engines.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to shut down live engines: %w", err)
+	}
+	l.Info("server stopped")
 
 	return nil
 }
+
+// alpacaBroker trades through Alpaca, with historical bars cached in db.
+func alpacaBroker(ctx context.Context, db *sqlx.DB) (broker.Broker, error) {
+	b, err := newBroker(ctx)
+	if err != nil {
+		return nil, err
+	}
+	b.EnableBarCache(db)
+	return b, nil
+}
+
+// paperBroker simulates trading in-process. It serves historical bars from
+// --data, or from Alpaca through the cache in db. Nothing streams bars to it,
+// so live sessions started against it wait for bars; replays are unaffected
+// since each runs on its own paper broker.
+func paperBroker(ctx context.Context, cmd *cobra.Command, db *sqlx.DB) (broker.Broker, error) {
+	data, err := marketDataSource(ctx, cmd, db)
+	if err != nil {
+		return nil, err
+	}
+	paper := broker.NewPaper(viper.GetFloat64("broker.paper_capital"))
+	paper.Data = data
+	slog.Info("trading against a paper broker", "cash", viper.GetFloat64("broker.paper_capital"))
+	return paper, nil
+}
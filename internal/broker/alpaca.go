@@ -2,11 +2,13 @@ package broker
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 	"strings"
 	"sync"
 	"time"
 
+	"citadel/internal/database"
 	"github.com/alpacahq/alpaca-trade-api-go/v3/alpaca"
 	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
 	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata/stream"
@@ -16,14 +18,21 @@ type Client struct {
 	alpaca     *alpaca.Client
 	marketdata *marketdata.Client
 	Stream     *stream.StocksClient
+	hub        *Hub
 
+	// Feed is the market data feed historical bars are requested from.
+	Feed marketdata.Feed
+
+	bars       *BarCache
+	calendar   *alpacaCalendar
 	loadAssets func() ([]alpaca.Asset, error)
 }
 
-func New(ctx context.Context, key, secret, endpoint string) *Client {
+// New connects to Alpaca, streaming and requesting market data from feed.
+func New(ctx context.Context, key, secret, endpoint string, feed marketdata.Feed) *Client {
 	endpoint = strings.TrimSuffix(endpoint, "/v2")
 	streamClient := stream.NewStocksClient(
-		marketdata.IEX,
+		feed,
 		stream.WithCredentials(key, secret),
 	)
 
@@ -38,7 +47,10 @@ func New(ctx context.Context, key, secret, endpoint string) *Client {
 			APISecret: secret,
 		}),
 		Stream: streamClient,
+		Feed:   feed,
+		hub:    NewHub(streamClient),
 	}
+	c.calendar = newAlpacaCalendar(c.alpaca, NYSE)
 
 	c.loadAssets = sync.OnceValues(func() ([]alpaca.Asset, error) {
 		return c.alpaca.GetAssets(alpaca.GetAssetsRequest{
@@ -55,6 +67,15 @@ func New(ctx context.Context, key, secret, endpoint string) *Client {
 	return c
 }
 
+// ParseFeed parses the name of a stock market data feed, e.g. "iex" or "sip".
+func ParseFeed(s string) (marketdata.Feed, error) {
+	switch feed := strings.ToLower(s); feed {
+	case marketdata.IEX, marketdata.SIP, marketdata.DelayedSIP:
+		return feed, nil
+	}
+	return "", fmt.Errorf("invalid feed %q", s)
+}
+
 func (c *Client) GetAccount() (*alpaca.Account, error) {
 	return c.alpaca.GetAccount()
 }
@@ -75,13 +96,69 @@ func (c *Client) GetPortfolioHistory(
 }
 
 func (c *Client) GetHistoricalBars(symbol string, start, end time.Time) ([]marketdata.Bar, error) {
+	return c.GetBars(context.Background(), symbol, marketdata.OneDay, start, end)
+}
+
+// GetBars returns bars for symbol at the given timeframe from the client's
+// feed, served from the bar cache when one is enabled. With the cache on, intraday
+// timeframes are resampled from cached minute bars so one download serves
+// every intraday resolution.
+func (c *Client) GetBars(
+	ctx context.Context,
+	symbol string,
+	timeframe marketdata.TimeFrame,
+	start, end time.Time,
+) ([]marketdata.Bar, error) {
 	req := marketdata.GetBarsRequest{
-		TimeFrame: marketdata.OneDay,
+		TimeFrame: timeframe,
 		Start:     start,
 		End:       end,
-		Feed:      marketdata.IEX,
+		Feed:      c.Feed,
+	}
+	if c.bars == nil {
+		return c.marketdata.GetBars(symbol, req)
+	}
+	req.TimeFrame = cachedTimeFrame(timeframe)
+	if req.TimeFrame == timeframe {
+		return c.bars.Get(ctx, symbol, req)
+	}
+
+	minutes, err := c.bars.Get(ctx, symbol, req)
+	if err != nil {
+		return nil, err
+	}
+	return Resample(minutes, timeframe), nil
+}
+
+// cachedTimeFrame is the series the bar cache stores timeframe in: minute
+// bars for every intraday timeframe, and timeframe itself otherwise.
+func cachedTimeFrame(timeframe marketdata.TimeFrame) marketdata.TimeFrame {
+	if Duration(timeframe) == 0 {
+		return timeframe
 	}
-	return c.marketdata.GetBars(symbol, req)
+	return marketdata.OneMin
+}
+
+// SyncBars fills the bar cache for symbol over [start, end) from the client's
+// feed without reading the bars back. Intraday timeframes sync the minute bars GetBars resamples
+// them from.
+func (c *Client) SyncBars(
+	ctx context.Context,
+	symbol string,
+	timeframe marketdata.TimeFrame,
+	start, end time.Time,
+) error {
+	if c.bars == nil {
+		return fmt.Errorf("bar cache is not enabled")
+	}
+	timeframe = cachedTimeFrame(timeframe)
+	key := database.BarKey{Symbol: symbol, Timeframe: timeframe.String(), Feed: c.Feed}
+	return c.bars.Sync(ctx, key, marketdata.GetBarsRequest{
+		TimeFrame: timeframe,
+		Start:     start,
+		End:       end,
+		Feed:      c.Feed,
+	})
 }
 
 // SearchAssets returns up to 20 active US equities matching the query
@@ -115,6 +192,16 @@ func (c *Client) SearchAssets(query string) ([]alpaca.Asset, error) {
 	return results, nil
 }
 
+// Calendar returns Alpaca's market calendar, falling back to NYSE for any year
+// Alpaca can't be asked about.
+func (c *Client) Calendar() Calendar {
+	return c.calendar
+}
+
+func (c *Client) GetClock() (*alpaca.Clock, error) {
+	return c.alpaca.GetClock()
+}
+
 func (c *Client) PlaceOrder(req alpaca.PlaceOrderRequest) (*alpaca.Order, error) {
 	return c.alpaca.PlaceOrder(req)
 }
@@ -123,6 +210,20 @@ func (c *Client) CancelOrder(orderID string) error {
 	return c.alpaca.CancelOrder(orderID)
 }
 
+func (c *Client) SubscribeBars(
+	handler func(stream.Bar),
+	symbols ...string,
+) (*Subscription[stream.Bar], error) {
+	return c.hub.SubscribeBars(handler, symbols...)
+}
+
+func (c *Client) SubscribeTrades(
+	handler func(stream.Trade),
+	symbols ...string,
+) (*Subscription[stream.Trade], error) {
+	return c.hub.SubscribeTrades(handler, symbols...)
+}
+
 func (c *Client) ConnectTradeUpdates(ctx context.Context, handler func(alpaca.TradeUpdate)) error {
 	return c.alpaca.StreamTradeUpdates(ctx, handler, alpaca.StreamTradeUpdatesRequest{})
 }
@@ -0,0 +1,213 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"citadel/internal/database"
+	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
+	"github.com/jmoiron/sqlx"
+)
+
+// settleDelay is how long after a range ends before it is trusted as final.
+// Bars inside it can still be revised (or not exist yet), so they are
+// fetched but not recorded as covered.
+const settleDelay = 24 * time.Hour
+
+// BarCache serves historical bars from SQLite and fetches only the parts of
+// a requested range that have never been downloaded.
+type BarCache struct {
+	db    *sqlx.DB
+	fetch func(symbol string, req marketdata.GetBarsRequest) ([]marketdata.Bar, error)
+	now   func() time.Time
+
+	// mu serializes syncs so concurrent requests don't download the same gap
+	// and overwrite each other's coverage
+	mu sync.Mutex
+}
+
+// NewBarCache caches the bars fetch downloads in db.
+func NewBarCache(
+	db *sqlx.DB,
+	fetch func(symbol string, req marketdata.GetBarsRequest) ([]marketdata.Bar, error),
+) *BarCache {
+	return &BarCache{db: db, fetch: fetch, now: time.Now}
+}
+
+// EnableBarCache routes historical bar requests through a SQLite cache.
+func (c *Client) EnableBarCache(db *sqlx.DB) {
+	c.bars = NewBarCache(db, c.marketdata.GetBars)
+}
+
+// Get returns bars for symbol in [req.Start, req.End), downloading any
+// uncovered gaps first.
+func (bc *BarCache) Get(
+	ctx context.Context,
+	symbol string,
+	req marketdata.GetBarsRequest,
+) ([]marketdata.Bar, error) {
+	key := database.BarKey{Symbol: symbol, Timeframe: req.TimeFrame.String(), Feed: req.Feed}
+
+	if err := bc.Sync(ctx, key, req); err != nil {
+		return nil, err
+	}
+
+	rows, err := database.GetBars(ctx, bc.db, key, req.Start, req.End)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cached bars: %w", err)
+	}
+
+	bars := make([]marketdata.Bar, len(rows))
+	for i, r := range rows {
+		bars[i] = marketdata.Bar{
+			Timestamp:  r.Timestamp,
+			Open:       r.Open,
+			High:       r.High,
+			Low:        r.Low,
+			Close:      r.Close,
+			Volume:     r.Volume,
+			TradeCount: r.TradeCount,
+			VWAP:       r.VWAP,
+		}
+	}
+	return bars, nil
+}
+
+// Sync downloads the parts of [req.Start, req.End) missing from the cache.
+func (bc *BarCache) Sync(
+	ctx context.Context,
+	key database.BarKey,
+	req marketdata.GetBarsRequest,
+) error {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	covered, err := database.GetBarCoverage(ctx, bc.db, key)
+	if err != nil {
+		return fmt.Errorf("failed to read bar coverage: %w", err)
+	}
+
+	gaps := missingRanges(covered, req.Start, req.End)
+	if len(gaps) == 0 {
+		return nil
+	}
+
+	settled := bc.now().Add(-settleDelay)
+	var rows []database.Bar
+	for _, gap := range gaps {
+		r := req
+		r.Start, r.End = gap.Start, gap.End
+		bars, err := bc.fetch(key.Symbol, r)
+		if err != nil {
+			return err
+		}
+		slog.Debug(
+			"fetched bars",
+			"symbol",
+			key.Symbol,
+			"timeframe",
+			key.Timeframe,
+			"start",
+			gap.Start,
+			"end",
+			gap.End,
+			"count",
+			len(bars),
+		)
+
+		for _, b := range bars {
+			rows = append(rows, database.Bar{
+				Timestamp:  b.Timestamp,
+				Open:       b.Open,
+				High:       b.High,
+				Low:        b.Low,
+				Close:      b.Close,
+				Volume:     b.Volume,
+				TradeCount: b.TradeCount,
+				VWAP:       b.VWAP,
+			})
+		}
+
+		if gap.End.After(settled) {
+			gap.End = settled
+		}
+		if gap.End.After(gap.Start) {
+			covered = append(covered, gap)
+		}
+	}
+
+	if err := database.SaveBars(ctx, bc.db, key, rows, mergeRanges(covered)); err != nil {
+		return fmt.Errorf("failed to save bars: %w", err)
+	}
+	return nil
+}
+
+// missingRanges returns the parts of [start, end) not inside any covered range.
+func missingRanges(covered []database.BarRange, start, end time.Time) []database.BarRange {
+	var gaps []database.BarRange
+	cursor := start
+	for _, r := range mergeRanges(covered) {
+		if !r.End.After(cursor) {
+			continue
+		}
+		if !r.Start.Before(end) {
+			break
+		}
+		if r.Start.After(cursor) {
+			gaps = append(gaps, database.BarRange{Start: cursor, End: r.Start})
+		}
+		cursor = r.End
+	}
+	if cursor.Before(end) {
+		gaps = append(gaps, database.BarRange{Start: cursor, End: end})
+	}
+	return gaps
+}
+
+// mergeRanges sorts ranges and joins any that overlap or touch.
+func mergeRanges(ranges []database.BarRange) []database.BarRange {
+	sorted := make([]database.BarRange, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start.Before(sorted[j].Start) })
+
+	var merged []database.BarRange
+	for _, r := range sorted {
+		if n := len(merged); n > 0 && !r.Start.After(merged[n-1].End) {
+			if r.End.After(merged[n-1].End) {
+				merged[n-1].End = r.End
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// ParseTimeFrame parses a timeframe such as "1Min", "15Min", "1Hour" or
+// "1Day" in the format marketdata.TimeFrame prints.
+func ParseTimeFrame(s string) (marketdata.TimeFrame, error) {
+	for _, unit := range []marketdata.TimeFrameUnit{
+		marketdata.Min,
+		marketdata.Hour,
+		marketdata.Day,
+		marketdata.Week,
+		marketdata.Month,
+	} {
+		n, ok := strings.CutSuffix(s, string(unit))
+		if !ok {
+			continue
+		}
+		v, err := strconv.Atoi(n)
+		if err != nil || v < 1 {
+			break
+		}
+		return marketdata.NewTimeFrame(v, unit), nil
+	}
+	return marketdata.TimeFrame{}, fmt.Errorf("invalid timeframe %q", s)
+}
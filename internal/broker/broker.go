@@ -0,0 +1,45 @@
+package broker
+
+import (
+	"context"
+
+	"github.com/alpacahq/alpaca-trade-api-go/v3/alpaca"
+	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata/stream"
+)
+
+// Broker is everything the trading routes and live engines need from a
+// brokerage: the account, orders, historical bars and the real-time bar and
+// trade update streams. Client talks to Alpaca; Paper simulates it in-process.
+type Broker interface {
+	MarketDataSource
+
+	GetAccount() (*alpaca.Account, error)
+	GetPositions() ([]alpaca.Position, error)
+	GetPortfolioHistory(period string, timeframe string) (*alpaca.PortfolioHistory, error)
+	SearchAssets(query string) ([]alpaca.Asset, error)
+
+	// Calendar is the exchange's trading calendar, and GetClock reports
+	// whether the market is open now.
+	Calendar() Calendar
+	GetClock() (*alpaca.Clock, error)
+
+	PlaceOrder(req alpaca.PlaceOrderRequest) (*alpaca.Order, error)
+	CancelOrder(orderID string) error
+
+	// SubscribeBars and SubscribeTrades share the broker's real-time streams
+	// through its Hub: every subscription gets the events for its symbols
+	// until it is closed, whoever else subscribes.
+	SubscribeBars(handler func(stream.Bar), symbols ...string) (*Subscription[stream.Bar], error)
+	SubscribeTrades(
+		handler func(stream.Trade),
+		symbols ...string,
+	) (*Subscription[stream.Trade], error)
+
+	// ConnectTradeUpdates delivers order events to handler until ctx is done.
+	ConnectTradeUpdates(ctx context.Context, handler func(alpaca.TradeUpdate)) error
+}
+
+var (
+	_ Broker = (*Client)(nil)
+	_ Broker = (*Paper)(nil)
+)
@@ -0,0 +1,286 @@
+package broker
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/v3/alpaca"
+)
+
+// MarketSession is one trading day's regular session.
+type MarketSession struct {
+	Date  string    `json:"date"` // New York date, YYYY-MM-DD
+	Open  time.Time `json:"open"`
+	Close time.Time `json:"close"`
+}
+
+// Contains reports whether t falls within the session.
+func (s MarketSession) Contains(t time.Time) bool {
+	return !t.Before(s.Open) && t.Before(s.Close)
+}
+
+// Calendar is an exchange's trading calendar.
+type Calendar interface {
+	// Session returns the regular session of the New York day t falls on,
+	// and false when the market doesn't open that day.
+	Session(t time.Time) (MarketSession, bool)
+}
+
+// IsOpen reports whether the market is in its regular session at t.
+func IsOpen(cal Calendar, t time.Time) bool {
+	s, ok := cal.Session(t)
+	return ok && s.Contains(t)
+}
+
+// NextSession returns the first session that hasn't closed by t: the one in
+// progress, or else the next to open.
+func NextSession(cal Calendar, t time.Time) (MarketSession, bool) {
+	day := t.In(newYork)
+	// The longest closure on record is a handful of days
+	for range 14 {
+		if s, ok := cal.Session(day); ok && t.Before(s.Close) {
+			return s, true
+		}
+		day = time.Date(day.Year(), day.Month(), day.Day()+1, 12, 0, 0, 0, newYork)
+	}
+	return MarketSession{}, false
+}
+
+// ClockAt is what Alpaca's clock would report at t according to cal.
+func ClockAt(cal Calendar, t time.Time) alpaca.Clock {
+	clock := alpaca.Clock{Timestamp: t, IsOpen: IsOpen(cal, t)}
+	s, ok := NextSession(cal, t)
+	if !ok {
+		return clock
+	}
+	clock.NextClose = s.Close
+	clock.NextOpen = s.Open
+	if !t.Before(s.Open) {
+		// Open now, so the next open is the following session's
+		if next, ok := NextSession(cal, s.Close); ok {
+			clock.NextOpen = next.Open
+		}
+	}
+	return clock
+}
+
+// NYSE is the New York Stock Exchange's calendar worked out offline, for when
+// Alpaca's isn't available: regular hours on weekdays, less the exchange's
+// holidays and with its 1pm early closes as its rules set them (Juneteenth is
+// observed from 2022), and less the one-off closures in unscheduledClosures.
+var NYSE Calendar = &holidayCalendar{years: make(map[int]holidayYear)}
+
+// unscheduledClosures are days the exchange closed outside its holiday rules.
+var unscheduledClosures = map[string]bool{
+	"2001-09-11": true, // September 11 attacks, through the 14th
+	"2001-09-12": true,
+	"2001-09-13": true,
+	"2001-09-14": true,
+	"2004-06-11": true, // National day of mourning for Ronald Reagan
+	"2007-01-02": true, // National day of mourning for Gerald Ford
+	"2012-10-29": true, // Hurricane Sandy
+	"2012-10-30": true,
+	"2018-12-05": true, // National day of mourning for George H. W. Bush
+	"2025-01-09": true, // National day of mourning for Jimmy Carter
+}
+
+type holidayCalendar struct {
+	mu    sync.Mutex
+	years map[int]holidayYear
+}
+
+// holidayYear is a year's holidays and early closes by New York date.
+type holidayYear struct {
+	closed map[string]bool
+	early  map[string]bool
+}
+
+func (c *holidayCalendar) Session(t time.Time) (MarketSession, bool) {
+	local := t.In(newYork)
+	switch local.Weekday() {
+	case time.Saturday, time.Sunday:
+		return MarketSession{}, false
+	}
+
+	date := local.Format(time.DateOnly)
+	year := c.year(local.Year())
+	if year.closed[date] || unscheduledClosures[date] {
+		return MarketSession{}, false
+	}
+
+	closeHour := 16
+	if year.early[date] {
+		closeHour = 13
+	}
+	y, m, d := local.Date()
+	return MarketSession{
+		Date:  date,
+		Open:  time.Date(y, m, d, 9, 30, 0, 0, newYork),
+		Close: time.Date(y, m, d, closeHour, 0, 0, 0, newYork),
+	}, true
+}
+
+func (c *holidayCalendar) year(y int) holidayYear {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if h, ok := c.years[y]; ok {
+		return h
+	}
+	h := nyseHolidays(y)
+	c.years[y] = h
+	return h
+}
+
+// nyseHolidays works out the exchange's holidays and early closes for year y.
+func nyseHolidays(y int) holidayYear {
+	h := holidayYear{closed: make(map[string]bool), early: make(map[string]bool)}
+	day := func(m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 12, 0, 0, 0, newYork)
+	}
+	add := func(t time.Time) { h.closed[t.Format(time.DateOnly)] = true }
+
+	// New Year's Day on a Saturday isn't made up on the Friday before, which
+	// is in the previous year
+	if newYear := day(time.January, 1); newYear.Weekday() != time.Saturday {
+		add(observed(newYear))
+	}
+	add(nthWeekday(y, time.January, time.Monday, 3))  // Martin Luther King Jr. Day
+	add(nthWeekday(y, time.February, time.Monday, 3)) // Washington's Birthday
+	add(easter(y).AddDate(0, 0, -2))                  // Good Friday
+	add(lastWeekday(y, time.May, time.Monday))        // Memorial Day
+	if y >= 2022 {
+		add(observed(day(time.June, 19))) // Juneteenth
+	}
+	add(observed(day(time.July, 4)))
+	add(nthWeekday(y, time.September, time.Monday, 1)) // Labor Day
+	thanksgiving := nthWeekday(y, time.November, time.Thursday, 4)
+	add(thanksgiving)
+	add(observed(day(time.December, 25)))
+
+	// Early closes fall on the trading days either side of some holidays
+	for _, t := range []time.Time{
+		day(time.July, 3),
+		thanksgiving.AddDate(0, 0, 1),
+		day(time.December, 24),
+	} {
+		date := t.Format(time.DateOnly)
+		if t.Weekday() != time.Saturday && t.Weekday() != time.Sunday && !h.closed[date] {
+			h.early[date] = true
+		}
+	}
+	return h
+}
+
+// observed moves a holiday on a weekend to the nearest weekday.
+func observed(t time.Time) time.Time {
+	switch t.Weekday() {
+	case time.Saturday:
+		return t.AddDate(0, 0, -1)
+	case time.Sunday:
+		return t.AddDate(0, 0, 1)
+	}
+	return t
+}
+
+// nthWeekday returns the nth wd of month m in year y.
+func nthWeekday(y int, m time.Month, wd time.Weekday, n int) time.Time {
+	t := time.Date(y, m, 1, 12, 0, 0, 0, newYork)
+	offset := (int(wd) - int(t.Weekday()) + 7) % 7
+	return t.AddDate(0, 0, offset+7*(n-1))
+}
+
+// lastWeekday returns the last wd of month m in year y.
+func lastWeekday(y int, m time.Month, wd time.Weekday) time.Time {
+	t := time.Date(y, m+1, 0, 12, 0, 0, 0, newYork)
+	offset := (int(t.Weekday()) - int(wd) + 7) % 7
+	return t.AddDate(0, 0, -offset)
+}
+
+// easter returns Easter Sunday of year y (the anonymous Gregorian algorithm).
+func easter(y int) time.Time {
+	a := y % 19
+	b, c := y/100, y%100
+	d, e := b/4, b%4
+	f := (b + 8) / 25
+	g := (b - f + 1) / 3
+	h := (19*a + b - d - g + 15) % 30
+	i, k := c/4, c%4
+	l := (32 + 2*e + 2*i - h - k) % 7
+	m := (a + 11*h + 22*l) / 451
+	month := (h + l - 7*m + 114) / 31
+	day := (h+l-7*m+114)%31 + 1
+	return time.Date(y, time.Month(month), day, 12, 0, 0, 0, newYork)
+}
+
+// alpacaCalendar is Alpaca's market calendar, fetched a year at a time. A
+// year Alpaca can't provide comes from the fallback instead.
+type alpacaCalendar struct {
+	client   *alpaca.Client
+	fallback Calendar
+
+	mu    sync.Mutex
+	years map[int]map[string]MarketSession // nil for a year that failed to load
+}
+
+func newAlpacaCalendar(client *alpaca.Client, fallback Calendar) *alpacaCalendar {
+	return &alpacaCalendar{
+		client:   client,
+		fallback: fallback,
+		years:    make(map[int]map[string]MarketSession),
+	}
+}
+
+func (c *alpacaCalendar) Session(t time.Time) (MarketSession, bool) {
+	local := t.In(newYork)
+	sessions := c.year(local.Year())
+	if sessions == nil {
+		return c.fallback.Session(t)
+	}
+	s, ok := sessions[local.Format(time.DateOnly)]
+	return s, ok
+}
+
+func (c *alpacaCalendar) year(y int) map[string]MarketSession {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if sessions, ok := c.years[y]; ok {
+		return sessions
+	}
+
+	days, err := c.client.GetCalendar(alpaca.GetCalendarRequest{
+		Start: time.Date(y, time.January, 1, 0, 0, 0, 0, newYork),
+		End:   time.Date(y, time.December, 31, 0, 0, 0, 0, newYork),
+	})
+	if err != nil || len(days) == 0 {
+		// Not retried, so a lookup per bar doesn't become a request per bar
+		slog.Warn("failed to load market calendar, using offline holidays",
+			"error", err, "year", y)
+		c.years[y] = nil
+		return nil
+	}
+
+	sessions := make(map[string]MarketSession, len(days))
+	for _, d := range days {
+		s, err := parseCalendarDay(d)
+		if err != nil {
+			slog.Warn("skipping malformed market calendar day", "error", err, "date", d.Date)
+			continue
+		}
+		sessions[s.Date] = s
+	}
+	c.years[y] = sessions
+	return sessions
+}
+
+func parseCalendarDay(d alpaca.CalendarDay) (MarketSession, error) {
+	open, err := time.ParseInLocation(time.DateOnly+" 15:04", d.Date+" "+d.Open, newYork)
+	if err != nil {
+		return MarketSession{}, err
+	}
+	close, err := time.ParseInLocation(time.DateOnly+" 15:04", d.Date+" "+d.Close, newYork)
+	if err != nil {
+		return MarketSession{}, err
+	}
+	return MarketSession{Date: d.Date, Open: open, Close: close}, nil
+}
@@ -0,0 +1,308 @@
+package broker
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/format"
+)
+
+// MarketDataSource supplies historical bars for backtests and optimizations.
+type MarketDataSource interface {
+	GetBars(
+		ctx context.Context,
+		symbol string,
+		timeframe marketdata.TimeFrame,
+		start, end time.Time,
+	) ([]marketdata.Bar, error)
+}
+
+var (
+	_ MarketDataSource = (*Client)(nil)
+	_ MarketDataSource = (*FileSource)(nil)
+)
+
+// FileSource reads bars from OHLCV files on disk, one file per symbol:
+//
+//	<dir>/<timeframe>/<SYMBOL>.csv   e.g. bars/1Day/AAPL.csv
+//	<dir>/<timeframe>/<SYMBOL>.parquet
+//	<dir>/<SYMBOL>.csv               used as-is for any timeframe
+//
+// When no file exists for an intraday timeframe, 1Min files are resampled.
+//
+// Columns are matched by name, case-insensitively: timestamp, open, high,
+// low and close are required; volume, trade_count and vwap are optional.
+// CSV files need a header row. Timestamps may be RFC3339, "2006-01-02
+// 15:04:05" (UTC), a date (midnight New York, like Alpaca daily bars) or
+// Unix seconds. Parquet timestamps may be a timestamp column or any of the
+// CSV string forms.
+type FileSource struct {
+	Dir string
+}
+
+func NewFileSource(dir string) *FileSource {
+	return &FileSource{Dir: dir}
+}
+
+// GetBars returns the bars for symbol in [start, end), oldest first.
+func (f *FileSource) GetBars(
+	ctx context.Context,
+	symbol string,
+	timeframe marketdata.TimeFrame,
+	start, end time.Time,
+) ([]marketdata.Bar, error) {
+	symbol = strings.ToUpper(symbol)
+
+	bars, err := f.load(filepath.Join(f.Dir, timeframe.String()), symbol)
+	if errors.Is(err, os.ErrNotExist) && Duration(timeframe) > 0 &&
+		timeframe != marketdata.OneMin {
+		bars, err = f.load(filepath.Join(f.Dir, marketdata.OneMin.String()), symbol)
+		if err == nil {
+			bars = Resample(inRange(bars, start, end), timeframe)
+		}
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		bars, err = f.load(f.Dir, symbol)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no bar file for %s %s in %s", symbol, timeframe, f.Dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return inRange(bars, start, end), nil
+}
+
+// load reads <dir>/<symbol>.csv or .parquet, whichever exists.
+func (f *FileSource) load(dir, symbol string) ([]marketdata.Bar, error) {
+	path := filepath.Join(dir, symbol+".csv")
+	if _, err := os.Stat(path); err == nil {
+		return readCSVBars(path)
+	}
+
+	path = filepath.Join(dir, symbol+".parquet")
+	if _, err := os.Stat(path); err == nil {
+		return readParquetBars(path)
+	}
+
+	return nil, os.ErrNotExist
+}
+
+func inRange(bars []marketdata.Bar, start, end time.Time) []marketdata.Bar {
+	sort.Slice(bars, func(i, j int) bool { return bars[i].Timestamp.Before(bars[j].Timestamp) })
+
+	out := make([]marketdata.Bar, 0, len(bars))
+	for _, b := range bars {
+		if !b.Timestamp.Before(start) && b.Timestamp.Before(end) {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+func readCSVBars(path string) ([]marketdata.Bar, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := csv.NewReader(file)
+	r.TrimLeadingSpace = true
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to read header: %w", path, err)
+	}
+	cols := make(map[string]int, len(header))
+	for i, name := range header {
+		cols[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"timestamp", "open", "high", "low", "close"} {
+		if _, ok := cols[name]; !ok {
+			return nil, fmt.Errorf("%s: missing %q column", path, name)
+		}
+	}
+
+	var bars []marketdata.Bar
+	for line := 2; ; line++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+
+		field := func(name string) string {
+			if i, ok := cols[name]; ok && i < len(rec) {
+				return strings.TrimSpace(rec[i])
+			}
+			return ""
+		}
+		float := func(name string) float64 {
+			if err != nil {
+				return 0
+			}
+			s := field(name)
+			if s == "" {
+				return 0
+			}
+			var v float64
+			if v, err = strconv.ParseFloat(s, 64); err != nil {
+				err = fmt.Errorf("%s: %w", name, err)
+			}
+			return v
+		}
+
+		var bar marketdata.Bar
+		bar.Timestamp, err = parseBarTime(field("timestamp"))
+		bar.Open = float("open")
+		bar.High = float("high")
+		bar.Low = float("low")
+		bar.Close = float("close")
+		bar.Volume = uint64(float("volume"))
+		bar.TradeCount = uint64(float("trade_count"))
+		bar.VWAP = float("vwap")
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		bars = append(bars, bar)
+	}
+	return bars, nil
+}
+
+func readParquetBars(path string) ([]marketdata.Bar, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := parquet.NewReader(file)
+	defer r.Close()
+
+	cols := make(map[string]int)
+	unit := time.Microsecond // the usual unit when the schema doesn't say
+	for i, field := range r.Schema().Fields() {
+		name := strings.ToLower(field.Name())
+		cols[name] = i
+		if lt := field.Type().LogicalType(); name == "timestamp" && lt != nil {
+			if ts, ok := lt.Value.(*format.TimestampType); ok && ts.Unit.Value != nil {
+				unit = ts.Unit.Value.Duration()
+			}
+		}
+	}
+	for _, name := range []string{"timestamp", "open", "high", "low", "close"} {
+		if _, ok := cols[name]; !ok {
+			return nil, fmt.Errorf("%s: missing %q column", path, name)
+		}
+	}
+
+	var bars []marketdata.Bar
+	rows := make([]parquet.Row, 256)
+	for {
+		n, err := r.ReadRows(rows)
+		for _, row := range rows[:n] {
+			bar, perr := parquetBar(row, cols, unit)
+			if perr != nil {
+				return nil, fmt.Errorf("%s: %w", path, perr)
+			}
+			bars = append(bars, bar)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return bars, nil
+}
+
+func parquetBar(row parquet.Row, cols map[string]int, unit time.Duration) (marketdata.Bar, error) {
+	value := func(name string) (parquet.Value, bool) {
+		i, ok := cols[name]
+		if !ok {
+			return parquet.Value{}, false
+		}
+		for _, v := range row {
+			if v.Column() == i && !v.IsNull() {
+				return v, true
+			}
+		}
+		return parquet.Value{}, false
+	}
+	number := func(name string) float64 {
+		v, ok := value(name)
+		if !ok {
+			return 0
+		}
+		switch v.Kind() {
+		case parquet.Float:
+			return float64(v.Float())
+		case parquet.Double:
+			return v.Double()
+		case parquet.Int32:
+			return float64(v.Int32())
+		case parquet.Int64:
+			return float64(v.Int64())
+		default:
+			f, _ := strconv.ParseFloat(v.String(), 64)
+			return f
+		}
+	}
+
+	var bar marketdata.Bar
+	ts, ok := value("timestamp")
+	if !ok {
+		return bar, fmt.Errorf("row without a timestamp")
+	}
+	switch ts.Kind() {
+	case parquet.Int64:
+		bar.Timestamp = time.Unix(0, ts.Int64()*int64(unit)).UTC()
+	default:
+		t, err := parseBarTime(ts.String())
+		if err != nil {
+			return bar, err
+		}
+		bar.Timestamp = t
+	}
+
+	bar.Open = number("open")
+	bar.High = number("high")
+	bar.Low = number("low")
+	bar.Close = number("close")
+	bar.Volume = uint64(number("volume"))
+	bar.TradeCount = uint64(number("trade_count"))
+	bar.VWAP = number("vwap")
+	return bar, nil
+}
+
+func parseBarTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.DateTime, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, newYork); err == nil {
+		return t, nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+}
@@ -0,0 +1,281 @@
+package broker
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata/stream"
+)
+
+// hubBuffer is how many events a subscription queues before it starts
+// dropping them.
+const hubBuffer = 1024
+
+// StreamSource is a real-time market data stream with one handler per
+// channel, like the Alpaca SDK: a later subscribe replaces the handler for
+// every symbol, and an unsubscribe ends the symbol for everyone.
+type StreamSource interface {
+	SubscribeToBars(handler func(stream.Bar), symbols ...string) error
+	UnsubscribeFromBars(symbols ...string) error
+	SubscribeToTrades(handler func(stream.Trade), symbols ...string) error
+	UnsubscribeFromTrades(symbols ...string) error
+}
+
+// Hub shares a StreamSource among any number of consumers. It holds one
+// upstream subscription per symbol and channel, kept while at least one
+// consumer wants it, and fans each event out to the consumers of its symbol.
+type Hub struct {
+	// opMu serializes subscribes and unsubscribes, including the upstream
+	// calls, which may block on the network. mu guards the subscriber sets
+	// read by dispatch.
+	opMu   sync.Mutex
+	mu     sync.RWMutex
+	bars   hubChannel[stream.Bar]
+	trades hubChannel[stream.Trade]
+}
+
+func NewHub(src StreamSource) *Hub {
+	h := &Hub{}
+	h.bars = hubChannel[stream.Bar]{
+		subs:        make(map[string]map[*Subscription[stream.Bar]]struct{}),
+		subscribe:   func(symbols ...string) error { return src.SubscribeToBars(h.dispatchBar, symbols...) },
+		unsubscribe: src.UnsubscribeFromBars,
+	}
+	h.trades = hubChannel[stream.Trade]{
+		subs: make(map[string]map[*Subscription[stream.Trade]]struct{}),
+		subscribe: func(symbols ...string) error {
+			return src.SubscribeToTrades(h.dispatchTrade, symbols...)
+		},
+		unsubscribe: src.UnsubscribeFromTrades,
+	}
+	return h
+}
+
+// SubscribeBars delivers minute bars for symbols to handler until the
+// subscription is closed.
+func (h *Hub) SubscribeBars(
+	handler func(stream.Bar),
+	symbols ...string,
+) (*Subscription[stream.Bar], error) {
+	return subscribe(h, &h.bars, handler, symbols)
+}
+
+// SubscribeTrades delivers trades for symbols to handler until the
+// subscription is closed.
+func (h *Hub) SubscribeTrades(
+	handler func(stream.Trade),
+	symbols ...string,
+) (*Subscription[stream.Trade], error) {
+	return subscribe(h, &h.trades, handler, symbols)
+}
+
+// Flush waits until every event dispatched so far has been handled, or
+// dropped, by every subscription. It must not be called from a handler.
+func (h *Hub) Flush() {
+	h.mu.RLock()
+	var subs []flusher
+	for _, set := range h.bars.subs {
+		for s := range set {
+			subs = append(subs, s)
+		}
+	}
+	for _, set := range h.trades.subs {
+		for s := range set {
+			subs = append(subs, s)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, s := range subs {
+		s.flush()
+	}
+}
+
+// Subscribers returns how many subscriptions want bars for symbol.
+func (h *Hub) Subscribers(symbol string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.bars.subs[strings.ToUpper(symbol)])
+}
+
+func (h *Hub) dispatchBar(bar stream.Bar) {
+	dispatch(h, &h.bars, bar.Symbol, bar)
+}
+
+func (h *Hub) dispatchTrade(trade stream.Trade) {
+	dispatch(h, &h.trades, trade.Symbol, trade)
+}
+
+// hubChannel is one kind of event the hub fans out, with its consumers by
+// symbol.
+type hubChannel[T any] struct {
+	subs        map[string]map[*Subscription[T]]struct{}
+	subscribe   func(symbols ...string) error
+	unsubscribe func(symbols ...string) error
+}
+
+func subscribe[T any](
+	h *Hub,
+	c *hubChannel[T],
+	handler func(T),
+	symbols []string,
+) (*Subscription[T], error) {
+	h.opMu.Lock()
+	defer h.opMu.Unlock()
+
+	s := &Subscription[T]{
+		handler: handler,
+		queue:   make(chan T, hubBuffer),
+		done:    make(chan struct{}),
+	}
+	s.idle = sync.NewCond(&s.mu)
+
+	// Only symbols nobody wanted yet need an upstream subscription
+	var added []string
+	h.mu.Lock()
+	for _, symbol := range symbols {
+		symbol = strings.ToUpper(symbol)
+		if _, dup := c.subs[symbol][s]; dup {
+			continue
+		}
+		if len(c.subs[symbol]) == 0 {
+			c.subs[symbol] = make(map[*Subscription[T]]struct{})
+			added = append(added, symbol)
+		}
+		c.subs[symbol][s] = struct{}{}
+		s.symbols = append(s.symbols, symbol)
+	}
+	h.mu.Unlock()
+
+	if len(added) > 0 {
+		if err := c.subscribe(added...); err != nil {
+			h.mu.Lock()
+			remove(c, s)
+			h.mu.Unlock()
+			return nil, err
+		}
+	}
+
+	s.unsubscribe = func() {
+		h.opMu.Lock()
+		defer h.opMu.Unlock()
+
+		h.mu.Lock()
+		unused := remove(c, s)
+		h.mu.Unlock()
+		if len(unused) > 0 {
+			c.unsubscribe(unused...)
+		}
+	}
+	go s.run()
+	return s, nil
+}
+
+// remove takes s out of c and returns the symbols nobody wants any more.
+func remove[T any](c *hubChannel[T], s *Subscription[T]) []string {
+	var unused []string
+	for _, symbol := range s.symbols {
+		delete(c.subs[symbol], s)
+		if len(c.subs[symbol]) == 0 {
+			delete(c.subs, symbol)
+			unused = append(unused, symbol)
+		}
+	}
+	return unused
+}
+
+func dispatch[T any](h *Hub, c *hubChannel[T], symbol string, event T) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for s := range c.subs[strings.ToUpper(symbol)] {
+		s.deliver(event)
+	}
+}
+
+type flusher interface {
+	flush()
+}
+
+// Subscription is one consumer of a hub channel. Events are queued for it
+// and passed to its handler on its own goroutine, so a slow consumer only
+// delays itself; once its queue is full, further events are dropped and
+// counted.
+type Subscription[T any] struct {
+	handler     func(T)
+	symbols     []string
+	queue       chan T
+	done        chan struct{}
+	closeOnce   sync.Once
+	unsubscribe func()
+	dropped     atomic.Uint64
+
+	// pending counts events queued or being handled, for flush
+	mu      sync.Mutex
+	idle    *sync.Cond
+	pending int
+	closed  bool
+}
+
+// Dropped returns how many events the subscription has lost to a full queue.
+func (s *Subscription[T]) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close ends the subscription. The upstream subscription for a symbol ends
+// with its last consumer. Events still queued are discarded; Close doesn't
+// wait for a handler that is running, so it may be called from one.
+func (s *Subscription[T]) Close() {
+	s.closeOnce.Do(func() {
+		s.unsubscribe()
+
+		s.mu.Lock()
+		s.closed = true
+		s.pending = 0
+		s.idle.Broadcast()
+		s.mu.Unlock()
+		close(s.done)
+	})
+}
+
+func (s *Subscription[T]) deliver(event T) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- event:
+		s.pending++
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+func (s *Subscription[T]) run() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case event := <-s.queue:
+			s.handler(event)
+
+			s.mu.Lock()
+			if s.pending > 0 {
+				s.pending--
+			}
+			if s.pending == 0 {
+				s.idle.Broadcast()
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *Subscription[T]) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.pending > 0 && !s.closed {
+		s.idle.Wait()
+	}
+}
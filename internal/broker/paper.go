@@ -0,0 +1,905 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/v3/alpaca"
+	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
+	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata/stream"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// Paper is an in-process simulated broker for tests and demos. It knows
+// nothing about the market until bars are handed to Publish. Each bar first
+// fills the orders resting on its symbol and then goes to the bar
+// subscribers, so an order placed while handling a bar fills against the
+// next one, as in a backtest.
+//
+// Market orders fill at the bar's open, limit orders when the bar trades at
+// or through the limit, and stop orders once the bar reaches the stop; a
+// trailing stop's stop follows the best price since it was placed. Bracket
+// and OTO orders hold their exits until the entry fills, and the exits of
+// those and of OCO orders cancel each other when one fills. Fills are always
+// complete. Order changes are reported to ConnectTradeUpdates
+// handlers as the same alpaca.TradeUpdate events Alpaca sends.
+type Paper struct {
+	// Data serves GetBars. Nil means no historical bars are available.
+	Data MarketDataSource
+
+	// TradingCalendar is returned by Calendar and drives GetClock. Nil means
+	// NYSE.
+	TradingCalendar Calendar
+
+	mu        sync.Mutex
+	start     float64
+	cash      float64
+	positions map[string]*paperPosition
+	prices    map[string]float64
+	orders    map[string]*paperOrder
+	open      []*paperOrder // resting orders, oldest first
+	history   []paperEquity
+	now       time.Time // timestamp of the latest bar
+
+	hub          *Hub
+	barHandler   func(stream.Bar)
+	barSymbols   map[string]bool
+	tradeHandler func(stream.Trade)
+	tradeSymbols map[string]bool
+	listeners    []paperListener
+	nextListener int
+	connected    chan struct{} // closed once a trade update handler connects
+}
+
+type paperPosition struct {
+	qty     float64 // negative when short
+	avgCost float64
+}
+
+type paperOrder struct {
+	order     alpaca.Order
+	day       string  // New York date a day order was placed on, if known
+	triggered bool    // a stop_limit order whose stop has been reached
+	hwm       float64 // a trailing stop's best price so far: high for a sell, low for a buy
+
+	// parent is the order a leg belongs to, and legs an order's exits, or an
+	// OCO order's other exit
+	parent *paperOrder
+	legs   []*paperOrder
+}
+
+type paperEquity struct {
+	timestamp time.Time
+	equity    float64
+}
+
+type paperListener struct {
+	id      int
+	handler func(alpaca.TradeUpdate)
+}
+
+func NewPaper(cash float64) *Paper {
+	p := &Paper{
+		start:        cash,
+		cash:         cash,
+		positions:    make(map[string]*paperPosition),
+		prices:       make(map[string]float64),
+		orders:       make(map[string]*paperOrder),
+		barSymbols:   make(map[string]bool),
+		tradeSymbols: make(map[string]bool),
+		connected:    make(chan struct{}),
+	}
+	p.hub = NewHub(paperStream{p})
+	return p
+}
+
+// clock is the simulated current time: the latest bar, or the wall clock
+// before any bar has been published.
+func (p *Paper) clock() time.Time {
+	if p.now.IsZero() {
+		return time.Now()
+	}
+	return p.now
+}
+
+func (p *Paper) equity() float64 {
+	equity := p.cash
+	for symbol, pos := range p.positions {
+		price, ok := p.prices[symbol]
+		if !ok {
+			price = pos.avgCost
+		}
+		equity += pos.qty * price
+	}
+	return equity
+}
+
+func (p *Paper) GetAccount() (*alpaca.Account, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var long, short float64
+	for symbol, pos := range p.positions {
+		value := pos.qty * p.prices[symbol]
+		if value > 0 {
+			long += value
+		} else {
+			short += value
+		}
+	}
+	equity := p.equity()
+
+	return &alpaca.Account{
+		ID:                   "paper",
+		AccountNumber:        "PA0000000000", // the PA prefix marks a paper account
+		Status:               "ACTIVE",
+		Currency:             "USD",
+		BuyingPower:          decimal.NewFromFloat(p.cash),
+		NonMarginBuyingPower: decimal.NewFromFloat(p.cash),
+		Cash:                 decimal.NewFromFloat(p.cash),
+		PortfolioValue:       decimal.NewFromFloat(equity),
+		ShortingEnabled:      true,
+		Multiplier:           decimal.NewFromInt(1),
+		Equity:               decimal.NewFromFloat(equity),
+		LastEquity:           decimal.NewFromFloat(equity),
+		LongMarketValue:      decimal.NewFromFloat(long),
+		ShortMarketValue:     decimal.NewFromFloat(short),
+		PositionMarketValue:  decimal.NewFromFloat(long + short),
+	}, nil
+}
+
+func (p *Paper) GetPositions() ([]alpaca.Position, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	positions := make([]alpaca.Position, 0, len(p.positions))
+	for symbol, pos := range p.positions {
+		price, ok := p.prices[symbol]
+		if !ok {
+			price = pos.avgCost
+		}
+		side := "long"
+		if pos.qty < 0 {
+			side = "short"
+		}
+		costBasis := pos.qty * pos.avgCost
+		unrealized := pos.qty * (price - pos.avgCost)
+
+		positions = append(positions, alpaca.Position{
+			AssetID:        symbol,
+			Symbol:         symbol,
+			Exchange:       "PAPER",
+			AssetClass:     alpaca.USEquity,
+			Qty:            decimal.NewFromFloat(pos.qty),
+			QtyAvailable:   decimal.NewFromFloat(pos.qty),
+			AvgEntryPrice:  decimal.NewFromFloat(pos.avgCost),
+			Side:           side,
+			MarketValue:    decimalPtr(pos.qty * price),
+			CostBasis:      decimal.NewFromFloat(costBasis),
+			UnrealizedPL:   decimalPtr(unrealized),
+			UnrealizedPLPC: decimalPtr(unrealized / math.Abs(costBasis)),
+			CurrentPrice:   decimalPtr(price),
+		})
+	}
+	sort.Slice(positions, func(i, j int) bool { return positions[i].Symbol < positions[j].Symbol })
+	return positions, nil
+}
+
+// GetPortfolioHistory returns the equity recorded at every published bar
+// timestamp. The period is ignored: the whole simulation is returned.
+func (p *Paper) GetPortfolioHistory(
+	period string,
+	timeframe string,
+) (*alpaca.PortfolioHistory, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h := &alpaca.PortfolioHistory{
+		BaseValue: decimal.NewFromFloat(p.start),
+		Timeframe: alpaca.TimeFrame(timeframe),
+	}
+	for _, point := range p.history {
+		pl := point.equity - p.start
+		h.Timestamp = append(h.Timestamp, point.timestamp.Unix())
+		h.Equity = append(h.Equity, decimal.NewFromFloat(point.equity))
+		h.ProfitLoss = append(h.ProfitLoss, decimal.NewFromFloat(pl))
+		h.ProfitLossPct = append(h.ProfitLossPct, decimal.NewFromFloat(pl/p.start))
+	}
+	return h, nil
+}
+
+func (p *Paper) GetBars(
+	ctx context.Context,
+	symbol string,
+	timeframe marketdata.TimeFrame,
+	start, end time.Time,
+) ([]marketdata.Bar, error) {
+	if p.Data == nil {
+		return nil, fmt.Errorf("paper broker has no market data source")
+	}
+	return p.Data.GetBars(ctx, symbol, timeframe, start, end)
+}
+
+// SearchAssets matches against the symbols the broker has seen in bars or
+// subscriptions.
+func (p *Paper) SearchAssets(query string) ([]alpaca.Asset, error) {
+	p.mu.Lock()
+	known := make(map[string]bool)
+	for symbol := range p.prices {
+		known[symbol] = true
+	}
+	for symbol := range p.barSymbols {
+		known[symbol] = true
+	}
+	p.mu.Unlock()
+
+	query = strings.ToUpper(strings.TrimSpace(query))
+	symbols := make([]string, 0, len(known))
+	for symbol := range known {
+		if strings.Contains(symbol, query) {
+			symbols = append(symbols, symbol)
+		}
+	}
+	sort.Strings(symbols)
+	if len(symbols) > 20 {
+		symbols = symbols[:20]
+	}
+
+	assets := make([]alpaca.Asset, 0, len(symbols))
+	for _, symbol := range symbols {
+		assets = append(assets, alpaca.Asset{
+			ID:           symbol,
+			Class:        alpaca.USEquity,
+			Exchange:     "PAPER",
+			Symbol:       symbol,
+			Name:         symbol,
+			Status:       alpaca.AssetActive,
+			Tradable:     true,
+			Shortable:    true,
+			Fractionable: true,
+		})
+	}
+	return assets, nil
+}
+
+func (p *Paper) Calendar() Calendar {
+	if p.TradingCalendar == nil {
+		return NYSE
+	}
+	return p.TradingCalendar
+}
+
+// GetClock reports the market's state at the simulated current time.
+func (p *Paper) GetClock() (*alpaca.Clock, error) {
+	p.mu.Lock()
+	now := p.clock()
+	p.mu.Unlock()
+	clock := ClockAt(p.Calendar(), now)
+	return &clock, nil
+}
+
+func (p *Paper) PlaceOrder(req alpaca.PlaceOrderRequest) (*alpaca.Order, error) {
+	if req.Qty == nil || !req.Qty.IsPositive() {
+		return nil, fmt.Errorf("qty must be positive")
+	}
+	if req.Side != alpaca.Buy && req.Side != alpaca.Sell {
+		return nil, fmt.Errorf("invalid side %q", req.Side)
+	}
+	switch req.Type {
+	case alpaca.Market:
+	case alpaca.Limit:
+		if req.LimitPrice == nil {
+			return nil, fmt.Errorf("limit_price is required for limit orders")
+		}
+	case alpaca.Stop:
+		if req.StopPrice == nil {
+			return nil, fmt.Errorf("stop_price is required for stop orders")
+		}
+	case alpaca.StopLimit:
+		if req.LimitPrice == nil || req.StopPrice == nil {
+			return nil, fmt.Errorf("limit_price and stop_price are required for stop_limit orders")
+		}
+	case alpaca.TrailingStop:
+		if (req.TrailPrice == nil) == (req.TrailPercent == nil) {
+			return nil, fmt.Errorf(
+				"one of trail_price or trail_percent is required for trailing_stop orders",
+			)
+		}
+	default:
+		return nil, fmt.Errorf("order type %q is not supported by the paper broker", req.Type)
+	}
+	if err := checkOrderClass(req); err != nil {
+		return nil, err
+	}
+	if req.OrderClass == "" {
+		req.OrderClass = alpaca.Simple
+	}
+	if req.TimeInForce == "" {
+		req.TimeInForce = alpaca.Day
+	}
+
+	p.mu.Lock()
+
+	symbol := strings.ToUpper(req.Symbol)
+	qty := req.Qty.InexactFloat64()
+	if req.Side == alpaca.Buy {
+		if err := p.checkBuyingPower(symbol, qty, req.LimitPrice); err != nil {
+			p.mu.Unlock()
+			return nil, err
+		}
+	}
+
+	now := p.clock()
+	clientOrderID := req.ClientOrderID
+	if clientOrderID == "" {
+		clientOrderID = uuid.New().String()
+	}
+	o := p.newOrder(req, clientOrderID, req.Type, req.Side, req.LimitPrice, req.StopPrice)
+	o.order.TrailPrice = req.TrailPrice
+	o.order.TrailPercent = req.TrailPercent
+	if req.Type == alpaca.TrailingStop {
+		o.hwm = p.prices[symbol]
+		o.order.HWM = decimalPtr(o.hwm)
+	}
+
+	exit := req.Side
+	if req.OrderClass != alpaca.OCO {
+		exit = alpaca.Buy
+		if req.Side == alpaca.Buy {
+			exit = alpaca.Sell
+		}
+	}
+	if req.StopLoss != nil {
+		o.legs = append(o.legs,
+			p.newOrder(req, uuid.New().String(), alpaca.Stop, exit, nil, req.StopLoss.StopPrice))
+	}
+	if req.TakeProfit != nil && req.OrderClass != alpaca.OCO {
+		o.legs = append(
+			o.legs,
+			p.newOrder(
+				req,
+				uuid.New().String(),
+				alpaca.Limit,
+				exit,
+				req.TakeProfit.LimitPrice,
+				nil,
+			),
+		)
+	}
+
+	// An OCO order's exits both work at once; other legs are held until
+	// the entry fills
+	updates := []alpaca.TradeUpdate{{At: now, Event: "new", Order: o.order}}
+	p.orders[o.order.ID] = o
+	p.open = append(p.open, o)
+	for _, leg := range o.legs {
+		leg.parent = o
+		p.orders[leg.order.ID] = leg
+		if req.OrderClass == alpaca.OCO {
+			p.open = append(p.open, leg)
+			updates = append(updates, alpaca.TradeUpdate{At: now, Event: "new", Order: leg.order})
+		} else {
+			leg.order.Status = "held"
+			leg.day = ""
+		}
+		o.order.Legs = append(o.order.Legs, leg.order)
+	}
+	updates[0].Order = o.order
+
+	order := o.order
+	listeners := p.listeners
+	p.mu.Unlock()
+
+	p.emit(listeners, updates)
+	return &order, nil
+}
+
+// checkOrderClass checks an order's exits are what its class calls for.
+func checkOrderClass(req alpaca.PlaceOrderRequest) error {
+	tp := req.TakeProfit != nil && req.TakeProfit.LimitPrice != nil
+	sl := req.StopLoss != nil && req.StopLoss.StopPrice != nil
+	switch req.OrderClass {
+	case "", alpaca.Simple:
+		if req.TakeProfit != nil || req.StopLoss != nil {
+			return fmt.Errorf("take_profit and stop_loss require a bracket, oto or oco order")
+		}
+		return nil
+	case alpaca.Bracket:
+		if !tp || !sl {
+			return fmt.Errorf("bracket orders require take_profit and stop_loss")
+		}
+	case alpaca.OTO:
+		if tp == sl {
+			return fmt.Errorf("oto orders require one of take_profit or stop_loss")
+		}
+	case alpaca.OCO:
+		if !tp || !sl {
+			return fmt.Errorf("oco orders require take_profit and stop_loss")
+		}
+		if req.Type != alpaca.Limit {
+			return fmt.Errorf("oco orders must be limit orders")
+		}
+		return nil
+	default:
+		return fmt.Errorf("order class %q is not supported by the paper broker", req.OrderClass)
+	}
+	if req.Type != alpaca.Market && req.Type != alpaca.Limit {
+		return fmt.Errorf("%s orders must be market or limit orders", req.OrderClass)
+	}
+	return nil
+}
+
+// newOrder builds a working order, or a leg, of req. It must be called with
+// p.mu held.
+func (p *Paper) newOrder(
+	req alpaca.PlaceOrderRequest,
+	clientOrderID string,
+	typ alpaca.OrderType,
+	side alpaca.Side,
+	limit, stop *decimal.Decimal,
+) *paperOrder {
+	now := p.clock()
+	symbol := strings.ToUpper(req.Symbol)
+	o := &paperOrder{
+		order: alpaca.Order{
+			ID:            uuid.New().String(),
+			ClientOrderID: clientOrderID,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+			SubmittedAt:   now,
+			AssetID:       symbol,
+			Symbol:        symbol,
+			AssetClass:    alpaca.USEquity,
+			OrderClass:    req.OrderClass,
+			Type:          typ,
+			Side:          side,
+			TimeInForce:   req.TimeInForce,
+			Status:        "new",
+			Qty:           req.Qty,
+			FilledQty:     decimal.Zero,
+			LimitPrice:    limit,
+			StopPrice:     stop,
+		},
+	}
+	if req.TimeInForce == alpaca.Day && !p.now.IsZero() {
+		o.day = p.now.In(newYork).Format(time.DateOnly)
+	}
+	return o
+}
+
+// group returns the orders that go with o: an order and its legs.
+func (o *paperOrder) group() []*paperOrder {
+	root := o
+	if o.parent != nil {
+		root = o.parent
+	}
+	return append([]*paperOrder{root}, root.legs...)
+}
+
+// working reports whether o may still fill, now or once its entry fills.
+func (o *paperOrder) working() bool {
+	return o.order.Status == "new" || o.order.Status == "held"
+}
+
+// closeGroup closes o with status and cancels the rest of its group still
+// working, as Alpaca does with an advanced order's legs.
+func (p *Paper) closeGroup(o *paperOrder, status string) []alpaca.TradeUpdate {
+	updates := []alpaca.TradeUpdate{p.close(o, status)}
+	for _, other := range o.group() {
+		if other != o && other.working() {
+			updates = append(updates, p.close(other, "canceled"))
+		}
+	}
+	return updates
+}
+
+// settle follows up the fill of o: a filled entry releases its held exits,
+// and a filled exit cancels the others.
+func (p *Paper) settle(o *paperOrder) []alpaca.TradeUpdate {
+	var updates []alpaca.TradeUpdate
+	if o.parent == nil && o.order.OrderClass != alpaca.OCO {
+		now := p.clock()
+		for _, leg := range o.legs {
+			if leg.order.Status != "held" {
+				continue
+			}
+			leg.order.Status = "new"
+			leg.order.UpdatedAt = now
+			if leg.order.TimeInForce == alpaca.Day {
+				leg.day = now.In(newYork).Format(time.DateOnly)
+			}
+			p.open = append(p.open, leg)
+			updates = append(updates, alpaca.TradeUpdate{At: now, Event: "new", Order: leg.order})
+		}
+		return updates
+	}
+	for _, other := range o.group() {
+		if other != o && other.working() {
+			updates = append(updates, p.close(other, "canceled"))
+		}
+	}
+	return updates
+}
+
+// checkBuyingPower rejects a buy that, together with the buys already
+// resting, would cost more than the cash on hand at the last known price.
+func (p *Paper) checkBuyingPower(symbol string, qty float64, limit *decimal.Decimal) error {
+	cost := func(symbol string, qty float64, limit *decimal.Decimal) float64 {
+		if limit != nil {
+			return qty * limit.InexactFloat64()
+		}
+		return qty * p.prices[symbol]
+	}
+
+	committed := cost(symbol, qty, limit)
+	for _, o := range p.open {
+		if o.order.Side == alpaca.Buy {
+			committed += cost(o.order.Symbol, o.order.Qty.InexactFloat64(), o.order.LimitPrice)
+		}
+	}
+	if committed > p.cash {
+		return fmt.Errorf("insufficient buying power")
+	}
+	return nil
+}
+
+func (p *Paper) CancelOrder(orderID string) error {
+	p.mu.Lock()
+
+	o, ok := p.orders[orderID]
+	if !ok {
+		p.mu.Unlock()
+		return fmt.Errorf("order not found")
+	}
+	if !o.working() {
+		p.mu.Unlock()
+		return fmt.Errorf("order is already in %q state", o.order.Status)
+	}
+
+	updates := p.closeGroup(o, "canceled")
+	listeners := p.listeners
+	p.mu.Unlock()
+
+	p.emit(listeners, updates)
+	return nil
+}
+
+// close finishes an unfilled order with the given status and removes it from
+// the resting orders.
+func (p *Paper) close(o *paperOrder, status string) alpaca.TradeUpdate {
+	now := p.clock()
+	o.order.Status = status
+	o.order.UpdatedAt = now
+	switch status {
+	case "canceled":
+		o.order.CanceledAt = &now
+	case "expired":
+		o.order.ExpiredAt = &now
+	}
+
+	for i, open := range p.open {
+		if open == o {
+			p.open = append(p.open[:i], p.open[i+1:]...)
+			break
+		}
+	}
+	return alpaca.TradeUpdate{At: now, Event: status, Order: o.order}
+}
+
+func (p *Paper) SubscribeBars(
+	handler func(stream.Bar),
+	symbols ...string,
+) (*Subscription[stream.Bar], error) {
+	return p.hub.SubscribeBars(handler, symbols...)
+}
+
+func (p *Paper) SubscribeTrades(
+	handler func(stream.Trade),
+	symbols ...string,
+) (*Subscription[stream.Trade], error) {
+	return p.hub.SubscribeTrades(handler, symbols...)
+}
+
+// paperStream is the simulation's upstream for its hub, with one handler per
+// channel like the Alpaca stream.
+type paperStream struct {
+	p *Paper
+}
+
+func (s paperStream) SubscribeToBars(handler func(stream.Bar), symbols ...string) error {
+	s.p.mu.Lock()
+	defer s.p.mu.Unlock()
+
+	s.p.barHandler = handler
+	for _, symbol := range symbols {
+		s.p.barSymbols[strings.ToUpper(symbol)] = true
+	}
+	return nil
+}
+
+func (s paperStream) UnsubscribeFromBars(symbols ...string) error {
+	s.p.mu.Lock()
+	defer s.p.mu.Unlock()
+
+	for _, symbol := range symbols {
+		delete(s.p.barSymbols, strings.ToUpper(symbol))
+	}
+	return nil
+}
+
+func (s paperStream) SubscribeToTrades(handler func(stream.Trade), symbols ...string) error {
+	s.p.mu.Lock()
+	defer s.p.mu.Unlock()
+
+	s.p.tradeHandler = handler
+	for _, symbol := range symbols {
+		s.p.tradeSymbols[strings.ToUpper(symbol)] = true
+	}
+	return nil
+}
+
+func (s paperStream) UnsubscribeFromTrades(symbols ...string) error {
+	s.p.mu.Lock()
+	defer s.p.mu.Unlock()
+
+	for _, symbol := range symbols {
+		delete(s.p.tradeSymbols, strings.ToUpper(symbol))
+	}
+	return nil
+}
+
+// ConnectTradeUpdates blocks until ctx is done, passing every order event to
+// handler. Any number of handlers may be connected at once.
+func (p *Paper) ConnectTradeUpdates(ctx context.Context, handler func(alpaca.TradeUpdate)) error {
+	p.mu.Lock()
+	p.nextListener++
+	id := p.nextListener
+	p.listeners = append(p.listeners, paperListener{id: id, handler: handler})
+	select {
+	case <-p.connected:
+	default:
+		close(p.connected)
+	}
+	p.mu.Unlock()
+
+	<-ctx.Done()
+
+	p.mu.Lock()
+	listeners := make([]paperListener, 0, len(p.listeners))
+	for _, l := range p.listeners {
+		if l.id != id {
+			listeners = append(listeners, l)
+		}
+	}
+	p.listeners = listeners
+	p.mu.Unlock()
+	return nil
+}
+
+// TradeUpdateListeners reports how many ConnectTradeUpdates calls are
+// active, so callers can wait for an engine to connect before publishing.
+func (p *Paper) TradeUpdateListeners() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.listeners)
+}
+
+// Publish feeds one minute bar into the simulation: resting orders for its
+// symbol are matched against it, then it is delivered to the bar and trade
+// subscribers. It returns once every subscriber has handled the bar, so a
+// simulation runs in lockstep. Bars should be published in timestamp order.
+func (p *Paper) Publish(bar stream.Bar) {
+	bar.Symbol = strings.ToUpper(bar.Symbol)
+
+	p.mu.Lock()
+	p.now = bar.Timestamp
+	updates := p.match(bar)
+	p.prices[bar.Symbol] = bar.Close
+	p.recordEquity(bar.Timestamp)
+
+	var barHandler func(stream.Bar)
+	if p.barSymbols[bar.Symbol] {
+		barHandler = p.barHandler
+	}
+	var tradeHandler func(stream.Trade)
+	if p.tradeSymbols[bar.Symbol] {
+		tradeHandler = p.tradeHandler
+	}
+	listeners := p.listeners
+	p.mu.Unlock()
+
+	p.emit(listeners, updates)
+	if barHandler != nil {
+		barHandler(bar)
+	}
+	if tradeHandler != nil {
+		tradeHandler(stream.Trade{
+			Symbol:    bar.Symbol,
+			Exchange:  "PAPER",
+			Price:     bar.Close,
+			Size:      uint32(min(bar.Volume, math.MaxUint32)),
+			Timestamp: bar.Timestamp,
+		})
+	}
+	p.hub.Flush()
+}
+
+// match tries every resting order for the bar's symbol against it and
+// returns the resulting events.
+func (p *Paper) match(bar stream.Bar) []alpaca.TradeUpdate {
+	var updates []alpaca.TradeUpdate
+	day := bar.Timestamp.In(newYork).Format(time.DateOnly)
+
+	for _, o := range append([]*paperOrder(nil), p.open...) {
+		if o.order.Symbol != bar.Symbol {
+			continue
+		}
+		if !o.working() {
+			continue // canceled along with an order matched before it
+		}
+		if o.day != "" && day > o.day && o.order.Type != alpaca.Market {
+			updates = append(updates, p.closeGroup(o, "expired")...)
+			continue
+		}
+
+		price, ok := o.fillPrice(bar)
+		if ok {
+			updates = append(updates, p.fill(o, price))
+			updates = append(updates, p.settle(o)...)
+			continue
+		}
+
+		switch o.order.TimeInForce {
+		case alpaca.IOC, alpaca.FOK:
+			updates = append(updates, p.closeGroup(o, "canceled")...)
+		}
+	}
+	return updates
+}
+
+// fillPrice returns the price o executes at within bar, if it executes.
+func (o *paperOrder) fillPrice(bar stream.Bar) (float64, bool) {
+	buy := o.order.Side == alpaca.Buy
+
+	if o.order.Type == alpaca.TrailingStop {
+		if o.hwm == 0 {
+			o.hwm = bar.Open
+		}
+		stop := o.trailingStop()
+		if buy && bar.High >= stop {
+			return math.Max(bar.Open, stop), true
+		}
+		if !buy && bar.Low <= stop {
+			return math.Min(bar.Open, stop), true
+		}
+		// The stop only moves once the bar has been matched against it
+		if buy {
+			o.hwm = math.Min(o.hwm, bar.Low)
+		} else {
+			o.hwm = math.Max(o.hwm, bar.High)
+		}
+		o.order.HWM = decimalPtr(o.hwm)
+		return 0, false
+	}
+
+	if o.order.Type == alpaca.Stop || (o.order.Type == alpaca.StopLimit && !o.triggered) {
+		stop := o.order.StopPrice.InexactFloat64()
+		if buy && bar.High < stop || !buy && bar.Low > stop {
+			return 0, false
+		}
+		if o.order.Type == alpaca.Stop {
+			if buy {
+				return math.Max(bar.Open, stop), true
+			}
+			return math.Min(bar.Open, stop), true
+		}
+		o.triggered = true
+	}
+
+	if o.order.LimitPrice == nil {
+		return bar.Open, true
+	}
+	limit := o.order.LimitPrice.InexactFloat64()
+	if buy && bar.Low > limit || !buy && bar.High < limit {
+		return 0, false
+	}
+	if buy {
+		return math.Min(bar.Open, limit), true
+	}
+	return math.Max(bar.Open, limit), true
+}
+
+// trailingStop returns where a trailing stop order's stop stands.
+func (o *paperOrder) trailingStop() float64 {
+	offset := 0.0
+	if o.order.TrailPrice != nil {
+		offset = o.order.TrailPrice.InexactFloat64()
+	} else if o.order.TrailPercent != nil {
+		offset = o.hwm * o.order.TrailPercent.InexactFloat64() / 100
+	}
+	if o.order.Side == alpaca.Buy {
+		return o.hwm + offset
+	}
+	return o.hwm - offset
+}
+
+// fill executes all of o at price, updating cash and the position.
+func (p *Paper) fill(o *paperOrder, price float64) alpaca.TradeUpdate {
+	qty := o.order.Qty.InexactFloat64()
+	signed := qty
+	if o.order.Side == alpaca.Sell {
+		signed = -qty
+	}
+
+	pos, ok := p.positions[o.order.Symbol]
+	if !ok {
+		pos = &paperPosition{}
+		p.positions[o.order.Symbol] = pos
+	}
+	switch {
+	case pos.qty == 0 || (pos.qty > 0) == (signed > 0):
+		pos.avgCost = (pos.avgCost*math.Abs(pos.qty) + price*qty) / (math.Abs(pos.qty) + qty)
+	case math.Abs(signed) > math.Abs(pos.qty):
+		pos.avgCost = price // flipped from long to short or back
+	}
+	pos.qty += signed
+	p.cash -= signed * price
+	if math.Abs(pos.qty) < 1e-9 {
+		delete(p.positions, o.order.Symbol)
+		pos.qty = 0
+	}
+
+	now := p.clock()
+	o.order.Status = "filled"
+	o.order.UpdatedAt = now
+	o.order.FilledAt = &now
+	o.order.FilledQty = *o.order.Qty
+	o.order.FilledAvgPrice = decimalPtr(price)
+	for i, open := range p.open {
+		if open == o {
+			p.open = append(p.open[:i], p.open[i+1:]...)
+			break
+		}
+	}
+
+	return alpaca.TradeUpdate{
+		At:          now,
+		Event:       "fill",
+		ExecutionID: uuid.New().String(),
+		Order:       o.order,
+		PositionQty: decimalPtr(pos.qty),
+		Price:       decimalPtr(price),
+		Qty:         o.order.Qty,
+		Timestamp:   &now,
+	}
+}
+
+// recordEquity keeps one equity point per timestamp, updated as the bars
+// for each symbol at that time arrive.
+func (p *Paper) recordEquity(ts time.Time) {
+	point := paperEquity{timestamp: ts, equity: p.equity()}
+	if n := len(p.history); n > 0 && p.history[n-1].timestamp.Equal(ts) {
+		p.history[n-1] = point
+		return
+	}
+	p.history = append(p.history, point)
+}
+
+func (p *Paper) emit(listeners []paperListener, updates []alpaca.TradeUpdate) {
+	for _, update := range updates {
+		for _, l := range listeners {
+			l.handler(update)
+		}
+	}
+}
+
+func decimalPtr(f float64) *decimal.Decimal {
+	d := decimal.NewFromFloat(f)
+	return &d
+}
@@ -0,0 +1,90 @@
+package broker
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
+	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata/stream"
+)
+
+// SymbolBar is a bar of the symbol it belongs to.
+type SymbolBar struct {
+	Symbol string
+	Bar    marketdata.Bar
+}
+
+// MergeBars merges the bars of every symbol into one stream. Bars at the same
+// time go in symbol order, so runs are repeatable.
+func MergeBars(bars map[string][]marketdata.Bar) []SymbolBar {
+	var all []SymbolBar
+	for symbol, symbolBars := range bars {
+		for _, bar := range symbolBars {
+			all = append(all, SymbolBar{Symbol: symbol, Bar: bar})
+		}
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		ti, tj := all[i].Bar.Timestamp, all[j].Bar.Timestamp
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return all[i].Symbol < all[j].Symbol
+	})
+	return all
+}
+
+// Replay publishes historical minute bars to p in timestamp order, speed
+// times faster than they happened; a speed of zero publishes them as fast as
+// possible. Bars at the same time go in symbol order, as in a backtest.
+// Gaps longer than a minute, such as overnight, are shortened to one minute
+// so a replay never stalls outside market hours.
+//
+// Replay waits for a trade update handler to connect before publishing, so
+// no fills are lost, and returns early with ctx's error if ctx is done.
+func (p *Paper) Replay(
+	ctx context.Context,
+	bars map[string][]marketdata.Bar,
+	speed float64,
+) error {
+	merged := MergeBars(bars)
+	all := make([]stream.Bar, len(merged))
+	for i, sb := range merged {
+		all[i] = stream.Bar{
+			Symbol:     sb.Symbol,
+			Open:       sb.Bar.Open,
+			High:       sb.Bar.High,
+			Low:        sb.Bar.Low,
+			Close:      sb.Bar.Close,
+			Volume:     sb.Bar.Volume,
+			Timestamp:  sb.Bar.Timestamp,
+			TradeCount: sb.Bar.TradeCount,
+			VWAP:       sb.Bar.VWAP,
+		}
+	}
+
+	select {
+	case <-p.connected:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	for i, bar := range all {
+		if i > 0 && speed > 0 {
+			gap := min(bar.Timestamp.Sub(all[i-1].Timestamp), time.Minute)
+			if gap > 0 {
+				select {
+				case <-time.After(time.Duration(float64(gap) / speed)):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		p.Publish(bar)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package broker
+
+import (
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
+)
+
+var newYork, _ = time.LoadLocation("America/New_York")
+
+// Duration returns the nominal length of an intraday timeframe, or 0 for
+// daily and longer timeframes whose length depends on the calendar.
+func Duration(tf marketdata.TimeFrame) time.Duration {
+	switch tf.Unit {
+	case marketdata.Min:
+		return time.Duration(tf.N) * time.Minute
+	case marketdata.Hour:
+		return time.Duration(tf.N) * time.Hour
+	default:
+		return 0
+	}
+}
+
+// Finer reports whether a is a shorter timeframe than b.
+func Finer(a, b marketdata.TimeFrame) bool {
+	rank := func(tf marketdata.TimeFrame) time.Duration {
+		if d := Duration(tf); d > 0 {
+			return d
+		}
+		switch tf.Unit {
+		case marketdata.Day:
+			return time.Duration(tf.N) * 24 * time.Hour
+		case marketdata.Week:
+			return time.Duration(tf.N) * 7 * 24 * time.Hour
+		default:
+			return time.Duration(tf.N) * 31 * 24 * time.Hour
+		}
+	}
+	return rank(a) < rank(b)
+}
+
+// bucketStart returns the start of the tf bar containing ts. Intraday bars
+// align to the clock; daily and longer bars align to New York calendar days,
+// matching the timestamps Alpaca gives its own daily bars.
+func bucketStart(ts time.Time, tf marketdata.TimeFrame) time.Time {
+	if d := Duration(tf); d > 0 {
+		return ts.Truncate(d)
+	}
+
+	local := ts.In(newYork)
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, newYork)
+	switch tf.Unit {
+	case marketdata.Week:
+		offset := (int(day.Weekday()) + 6) % 7 // weeks start on Monday
+		return day.AddDate(0, 0, -offset)
+	case marketdata.Month:
+		return time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, newYork)
+	default:
+		return day
+	}
+}
+
+// Resample aggregates bars, oldest first, into tf bars. The last bar may be
+// partial if the input ends mid-bucket.
+func Resample(bars []marketdata.Bar, tf marketdata.TimeFrame) []marketdata.Bar {
+	r := NewResampler(tf, 0)
+	var out []marketdata.Bar
+	for _, bar := range bars {
+		out = append(out, r.Add(bar)...)
+	}
+	if bar, ok := r.Flush(); ok {
+		out = append(out, bar)
+	}
+	return out
+}
+
+// Resampler incrementally aggregates bars of a finer timeframe into tf bars.
+type Resampler struct {
+	Timeframe marketdata.TimeFrame
+
+	base     time.Duration
+	current  marketdata.Bar
+	notional float64
+	open     bool
+}
+
+// NewResampler builds a resampler into tf. base is the duration of the
+// incoming bars; when known, a bar is emitted as soon as its last input bar
+// arrives instead of waiting for the first bar of the next bucket.
+func NewResampler(tf marketdata.TimeFrame, base time.Duration) *Resampler {
+	return &Resampler{Timeframe: tf, base: base}
+}
+
+// Add folds bar into the current bucket and returns any bars it completed.
+func (r *Resampler) Add(bar marketdata.Bar) []marketdata.Bar {
+	var done []marketdata.Bar
+
+	start := bucketStart(bar.Timestamp, r.Timeframe)
+	if r.open && !start.Equal(r.current.Timestamp) {
+		done = append(done, r.finish())
+	}
+
+	if !r.open {
+		r.current = marketdata.Bar{
+			Timestamp: start,
+			Open:      bar.Open,
+			High:      bar.High,
+			Low:       bar.Low,
+		}
+		r.notional = 0
+		r.open = true
+	}
+
+	c := &r.current
+	c.High = max(c.High, bar.High)
+	c.Low = min(c.Low, bar.Low)
+	c.Close = bar.Close
+	c.Volume += bar.Volume
+	c.TradeCount += bar.TradeCount
+	r.notional += bar.VWAP * float64(bar.Volume)
+
+	if d := Duration(r.Timeframe); d > 0 && r.base > 0 &&
+		!bar.Timestamp.Add(r.base).Before(start.Add(d)) {
+		done = append(done, r.finish())
+	}
+	return done
+}
+
+// Flush returns the partially built bar, if any, and resets the resampler.
+func (r *Resampler) Flush() (marketdata.Bar, bool) {
+	if !r.open {
+		return marketdata.Bar{}, false
+	}
+	return r.finish(), true
+}
+
+func (r *Resampler) finish() marketdata.Bar {
+	bar := r.current
+	if bar.Volume > 0 {
+		bar.VWAP = r.notional / float64(bar.Volume)
+	}
+	r.open = false
+	return bar
+}
@@ -16,15 +16,25 @@ type BacktestRecord struct {
 	StartingCapital float64   `json:"starting_capital" db:"starting_capital"`
 	Parameters      string    `json:"parameters"       db:"parameters"` // JSON string
 	Metrics         string    `json:"metrics"          db:"metrics"`    // JSON string
+	Ledger          *string   `json:"ledger"           db:"ledger"`     // JSON round trips
+	OptimizationID  *string   `json:"optimization_id"  db:"optimization_id"`
+	Sample          *string   `json:"sample"           db:"sample"` // full, in_sample or out_of_sample
+	WindowIndex     *int      `json:"window_index"     db:"window_index"`
+	Timeframe       string    `json:"timeframe"        db:"timeframe"`
+	FillConfig      *string   `json:"fill_config"      db:"fill_config"`   // JSON quant.FillConfig
+	MarginConfig    *string   `json:"margin_config"    db:"margin_config"` // JSON quant.MarginConfig
+	RiskConfig      *string   `json:"risk_config"      db:"risk_config"`   // JSON resolved quant.RiskConfig
 	CreatedAt       time.Time `json:"created_at"       db:"created_at"`
 }
 
 func SaveBacktest(ctx context.Context, db *sqlx.DB, record BacktestRecord) error {
 	query := `
 		INSERT INTO trading_backtests (
-			backtest_id, strategy, symbols, start_date, end_date, starting_capital, parameters, metrics
+			backtest_id, strategy, symbols, start_date, end_date, starting_capital, parameters, metrics, ledger,
+			optimization_id, sample, window_index, timeframe, fill_config, margin_config, risk_config
 		) VALUES (
-			:backtest_id, :strategy, :symbols, :start_date, :end_date, :starting_capital, :parameters, :metrics
+			:backtest_id, :strategy, :symbols, :start_date, :end_date, :starting_capital, :parameters, :metrics, :ledger,
+			:optimization_id, :sample, :window_index, :timeframe, :fill_config, :margin_config, :risk_config
 		)
 	`
 	_, err := db.NamedExecContext(ctx, query, record)
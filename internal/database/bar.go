@@ -0,0 +1,143 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+)
+
+// BarKey identifies one cached bar series.
+type BarKey struct {
+	Symbol    string
+	Timeframe string
+	Feed      string
+}
+
+type Bar struct {
+	Symbol     string    `db:"symbol"      json:"symbol"`
+	Timeframe  string    `db:"timeframe"   json:"timeframe"`
+	Feed       string    `db:"feed"        json:"feed"`
+	Timestamp  time.Time `db:"timestamp"   json:"timestamp"`
+	Open       float64   `db:"open"        json:"open"`
+	High       float64   `db:"high"        json:"high"`
+	Low        float64   `db:"low"         json:"low"`
+	Close      float64   `db:"close"       json:"close"`
+	Volume     uint64    `db:"volume"      json:"volume"`
+	TradeCount uint64    `db:"trade_count" json:"trade_count"`
+	VWAP       float64   `db:"vwap"        json:"vwap"`
+}
+
+// BarRange is a half-open [Start, End) interval already fetched for a series.
+type BarRange struct {
+	Start time.Time `db:"range_start" json:"start"`
+	End   time.Time `db:"range_end"   json:"end"`
+}
+
+// GetBars returns cached bars for key in [start, end), oldest first.
+// Timestamps are stored in UTC so they compare correctly as text.
+func GetBars(
+	ctx context.Context,
+	db *sqlx.DB,
+	key BarKey,
+	start, end time.Time,
+) ([]Bar, error) {
+	query, args, err := QB.Select("*").
+		From("market_bars").
+		Where(sq.Eq{"symbol": key.Symbol, "timeframe": key.Timeframe, "feed": key.Feed}).
+		Where(sq.GtOrEq{"timestamp": start.UTC()}).
+		Where(sq.Lt{"timestamp": end.UTC()}).
+		OrderBy("timestamp ASC").
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	var bars []Bar
+	err = db.SelectContext(ctx, &bars, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return bars, nil
+}
+
+// SaveBars upserts bars and replaces the coverage of their series with
+// ranges, in one transaction so a failed write never claims missing data.
+func SaveBars(
+	ctx context.Context,
+	db *sqlx.DB,
+	key BarKey,
+	bars []Bar,
+	ranges []BarRange,
+) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT OR REPLACE INTO market_bars (
+			symbol, timeframe, feed, timestamp, open, high, low, close, volume, trade_count, vwap
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, b := range bars {
+		_, err := stmt.ExecContext(ctx,
+			key.Symbol, key.Timeframe, key.Feed, b.Timestamp.UTC(),
+			b.Open, b.High, b.Low, b.Close, b.Volume, b.TradeCount, b.VWAP,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	query, args, err := QB.Delete("market_bar_coverage").
+		Where(sq.Eq{"symbol": key.Symbol, "timeframe": key.Timeframe, "feed": key.Feed}).
+		ToSql()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return err
+	}
+
+	for _, r := range ranges {
+		query, args, err := QB.Insert("market_bar_coverage").
+			Columns("symbol", "timeframe", "feed", "range_start", "range_end").
+			Values(key.Symbol, key.Timeframe, key.Feed, r.Start.UTC(), r.End.UTC()).
+			ToSql()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetBarCoverage returns the ranges already fetched for key, oldest first.
+func GetBarCoverage(ctx context.Context, db *sqlx.DB, key BarKey) ([]BarRange, error) {
+	query, args, err := QB.Select("range_start", "range_end").
+		From("market_bar_coverage").
+		Where(sq.Eq{"symbol": key.Symbol, "timeframe": key.Timeframe, "feed": key.Feed}).
+		OrderBy("range_start ASC").
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	var ranges []BarRange
+	err = db.SelectContext(ctx, &ranges, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return ranges, nil
+}
@@ -0,0 +1,56 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+)
+
+// EquitySnapshot is a live session's equity marked to market at one bar
+// timestamp.
+type EquitySnapshot struct {
+	SessionID string    `db:"session_id" json:"session_id"`
+	Timestamp time.Time `db:"timestamp"  json:"timestamp"`
+	Equity    float64   `db:"equity"     json:"equity"`
+}
+
+// SaveEquitySnapshot records a session's equity at a timestamp, replacing
+// any earlier snapshot for the same timestamp.
+func SaveEquitySnapshot(ctx context.Context, db *sqlx.DB, snapshot *EquitySnapshot) error {
+	query, args, err := QB.Insert("trading_equity_snapshots").
+		Columns("session_id", "timestamp", "equity").
+		Values(snapshot.SessionID, snapshot.Timestamp.UTC(), snapshot.Equity).
+		Suffix("ON CONFLICT (session_id, timestamp) DO UPDATE SET equity = excluded.equity").
+		ToSql()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// GetEquitySnapshots returns a session's equity curve, oldest first.
+func GetEquitySnapshots(
+	ctx context.Context,
+	db *sqlx.DB,
+	sessionID string,
+) ([]EquitySnapshot, error) {
+	query, args, err := QB.Select("*").
+		From("trading_equity_snapshots").
+		Where(sq.Eq{"session_id": sessionID}).
+		OrderBy("timestamp").
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := []EquitySnapshot{}
+	err = db.SelectContext(ctx, &snapshots, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
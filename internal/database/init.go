@@ -3,6 +3,7 @@ package database
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	sq "github.com/Masterminds/squirrel"
 	"github.com/jmoiron/sqlx"
@@ -46,5 +47,37 @@ func New(path, schemaPath string) (*sqlx.DB, error) {
 		return nil, fmt.Errorf("failed to initialize schema: %w", err)
 	}
 
+	if err := migrate(db); err != nil {
+		return nil, err
+	}
+
 	return db, nil
 }
+
+// columnMigrations adds columns introduced after a table was first created.
+// The schema file declares them too, so fresh databases already have them;
+// SQLite has no ADD COLUMN IF NOT EXISTS, hence the duplicate check.
+var columnMigrations = []string{
+	"ALTER TABLE trading_backtests ADD COLUMN ledger TEXT",
+	"ALTER TABLE trading_backtests ADD COLUMN optimization_id TEXT",
+	"ALTER TABLE trading_backtests ADD COLUMN sample TEXT",
+	"ALTER TABLE trading_backtests ADD COLUMN window_index INTEGER",
+	"ALTER TABLE trading_backtests ADD COLUMN timeframe TEXT NOT NULL DEFAULT '1Day'",
+	"ALTER TABLE trading_backtests ADD COLUMN fill_config TEXT",
+	"ALTER TABLE trading_backtests ADD COLUMN margin_config TEXT",
+	"ALTER TABLE trading_backtests ADD COLUMN risk_config TEXT",
+	"ALTER TABLE trading_sessions ADD COLUMN timeframe TEXT NOT NULL DEFAULT '1Min'",
+	"ALTER TABLE trading_sessions ADD COLUMN mode TEXT NOT NULL DEFAULT 'live'",
+	"ALTER TABLE trading_sessions ADD COLUMN risk_config TEXT",
+	"ALTER TABLE trading_orders ADD COLUMN parent_order_id TEXT",
+}
+
+func migrate(db *sqlx.DB) error {
+	for _, stmt := range columnMigrations {
+		if _, err := db.Exec(stmt); err != nil &&
+			!strings.Contains(err.Error(), "duplicate column name") {
+			return fmt.Errorf("failed to migrate schema (%s): %w", stmt, err)
+		}
+	}
+	return nil
+}
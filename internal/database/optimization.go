@@ -0,0 +1,122 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+)
+
+type Optimization struct {
+	OptimizationID string     `db:"optimization_id" json:"optimization_id"`
+	Name           string     `db:"name"            json:"name"`
+	Strategy       string     `db:"strategy"        json:"strategy"`
+	Spec           string     `db:"spec"            json:"spec"` // JSON optimization spec
+	Status         string     `db:"status"          json:"status"`
+	BestParameters *string    `db:"best_parameters" json:"best_parameters"` // JSON string
+	BestObjective  *float64   `db:"best_objective"  json:"best_objective"`
+	Windows        *string    `db:"windows"         json:"windows"` // JSON per-window winners
+	CreatedAt      time.Time  `db:"created_at"      json:"created_at"`
+	CompletedAt    *time.Time `db:"completed_at"    json:"completed_at"`
+}
+
+func CreateOptimization(ctx context.Context, db *sqlx.DB, opt *Optimization) error {
+	query, args, err := QB.Insert("trading_optimizations").
+		Columns("optimization_id", "name", "strategy", "spec", "status", "created_at").
+		Values(opt.OptimizationID, opt.Name, opt.Strategy, opt.Spec, opt.Status, opt.CreatedAt).
+		ToSql()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, query, args...)
+	return err
+}
+
+func CompleteOptimization(
+	ctx context.Context,
+	db *sqlx.DB,
+	optimizationID string,
+	status string,
+	bestParameters *string,
+	bestObjective *float64,
+	windows *string,
+) error {
+	query, args, err := QB.Update("trading_optimizations").
+		Set("status", status).
+		Set("best_parameters", bestParameters).
+		Set("best_objective", bestObjective).
+		Set("windows", windows).
+		Set("completed_at", time.Now()).
+		Where(sq.Eq{"optimization_id": optimizationID}).
+		ToSql()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, query, args...)
+	return err
+}
+
+func ListOptimizations(ctx context.Context, db *sqlx.DB) ([]Optimization, error) {
+	query, args, err := QB.Select("*").
+		From("trading_optimizations").
+		OrderBy("created_at DESC").
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	var opts []Optimization
+	err = db.SelectContext(ctx, &opts, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+func GetOptimization(
+	ctx context.Context,
+	db *sqlx.DB,
+	optimizationID string,
+) (*Optimization, error) {
+	query, args, err := QB.Select("*").
+		From("trading_optimizations").
+		Where(sq.Eq{"optimization_id": optimizationID}).
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	var opt Optimization
+	err = db.GetContext(ctx, &opt, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return &opt, nil
+}
+
+// GetOptimizationBacktests returns the runs of an optimization, out-of-sample
+// runs of each window first.
+func GetOptimizationBacktests(
+	ctx context.Context,
+	db *sqlx.DB,
+	optimizationID string,
+) ([]BacktestRecord, error) {
+	query, args, err := QB.Select("*").
+		From("trading_backtests").
+		Where(sq.Eq{"optimization_id": optimizationID}).
+		OrderBy("window_index ASC", "sample DESC", "created_at ASC").
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	var records []BacktestRecord
+	err = db.SelectContext(ctx, &records, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
@@ -0,0 +1,68 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+// OrderRejection is an order a live session's strategy wanted that never
+// reached the broker, or that the broker refused. Reason is machine-readable,
+// such as "max_gross_exposure"; Message explains it.
+type OrderRejection struct {
+	RejectionID string    `db:"rejection_id" json:"rejection_id"`
+	SessionID   string    `db:"session_id"   json:"session_id"`
+	Symbol      string    `db:"symbol"       json:"symbol"`
+	Side        string    `db:"side"         json:"side"`
+	Type        string    `db:"type"         json:"type"`
+	Qty         float64   `db:"qty"          json:"qty"`
+	Reason      string    `db:"reason"       json:"reason"`
+	Message     string    `db:"message"      json:"message"`
+	CreatedAt   time.Time `db:"created_at"   json:"created_at"`
+}
+
+func InsertOrderRejection(ctx context.Context, db *sqlx.DB, rejection *OrderRejection) error {
+	if rejection.RejectionID == "" {
+		rejection.RejectionID = uuid.New().String()
+	}
+	if rejection.CreatedAt.IsZero() {
+		rejection.CreatedAt = time.Now()
+	}
+
+	query, args, err := QB.Insert("trading_order_rejections").
+		Columns("rejection_id", "session_id", "symbol", "side", "type", "qty", "reason", "message", "created_at").
+		Values(rejection.RejectionID, rejection.SessionID, rejection.Symbol, rejection.Side, rejection.Type, rejection.Qty, rejection.Reason, rejection.Message, rejection.CreatedAt).
+		ToSql()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// ListOrderRejections returns a session's rejected orders, oldest first.
+func ListOrderRejections(
+	ctx context.Context,
+	db *sqlx.DB,
+	sessionID string,
+) ([]OrderRejection, error) {
+	query, args, err := QB.Select("*").
+		From("trading_order_rejections").
+		Where(sq.Eq{"session_id": sessionID}).
+		OrderBy("created_at", "rowid").
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rejections := []OrderRejection{}
+	err = db.SelectContext(ctx, &rejections, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return rejections, nil
+}
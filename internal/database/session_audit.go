@@ -0,0 +1,63 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+// SessionAudit is one lifecycle transition of a trading session: what was
+// done, the status it moved the session from and to, and who did it. UserID
+// is nil for transitions the server made itself, such as a restart.
+type SessionAudit struct {
+	AuditID    string    `db:"audit_id"    json:"audit_id"`
+	SessionID  string    `db:"session_id"  json:"session_id"`
+	Action     string    `db:"action"      json:"action"`
+	FromStatus *string   `db:"from_status" json:"from_status"`
+	ToStatus   string    `db:"to_status"   json:"to_status"`
+	Detail     *string   `db:"detail"      json:"detail"`
+	UserID     *string   `db:"user_id"     json:"user_id"`
+	CreatedAt  time.Time `db:"created_at"  json:"created_at"`
+}
+
+func InsertSessionAudit(ctx context.Context, db *sqlx.DB, audit *SessionAudit) error {
+	if audit.AuditID == "" {
+		audit.AuditID = uuid.New().String()
+	}
+	if audit.CreatedAt.IsZero() {
+		audit.CreatedAt = time.Now()
+	}
+
+	query, args, err := QB.Insert("trading_session_audit").
+		Columns("audit_id", "session_id", "action", "from_status", "to_status", "detail", "user_id", "created_at").
+		Values(audit.AuditID, audit.SessionID, audit.Action, audit.FromStatus, audit.ToStatus, audit.Detail, audit.UserID, audit.CreatedAt).
+		ToSql()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// ListSessionAudit returns a session's lifecycle transitions, oldest first.
+func ListSessionAudit(ctx context.Context, db *sqlx.DB, sessionID string) ([]SessionAudit, error) {
+	query, args, err := QB.Select("*").
+		From("trading_session_audit").
+		Where(sq.Eq{"session_id": sessionID}).
+		OrderBy("created_at", "rowid").
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	audits := []SessionAudit{}
+	err = db.SelectContext(ctx, &audits, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return audits, nil
+}
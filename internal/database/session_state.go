@@ -0,0 +1,161 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+)
+
+// SessionState is the latest snapshot of a live session's portfolio.
+type SessionState struct {
+	SessionID     string    `db:"session_id"     json:"session_id"`
+	Cash          float64   `db:"cash"           json:"cash"`
+	StrategyState *string   `db:"strategy_state" json:"strategy_state"` // JSON, strategy specific
+	Discrepancies *string   `db:"discrepancies"  json:"discrepancies"`  // JSON, from the last resume
+	UpdatedAt     time.Time `db:"updated_at"     json:"updated_at"`
+}
+
+type SessionPosition struct {
+	SessionID string    `db:"session_id" json:"session_id"`
+	Symbol    string    `db:"symbol"     json:"symbol"`
+	Qty       float64   `db:"qty"        json:"qty"`
+	AvgPrice  float64   `db:"avg_price"  json:"avg_price"`
+	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// SaveSessionState replaces a session's snapshot with state and positions.
+// Discrepancies recorded on resume are left as they are.
+func SaveSessionState(
+	ctx context.Context,
+	db *sqlx.DB,
+	state *SessionState,
+	positions []SessionPosition,
+) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query, args, err := QB.Insert("trading_session_state").
+		Columns("session_id", "cash", "strategy_state", "updated_at").
+		Values(state.SessionID, state.Cash, state.StrategyState, state.UpdatedAt).
+		Suffix(`ON CONFLICT (session_id) DO UPDATE SET
+			cash = excluded.cash,
+			strategy_state = excluded.strategy_state,
+			updated_at = excluded.updated_at`).
+		ToSql()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return err
+	}
+
+	query, args, err = QB.Delete("trading_session_positions").
+		Where(sq.Eq{"session_id": state.SessionID}).
+		ToSql()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return err
+	}
+
+	if len(positions) > 0 {
+		insert := QB.Insert("trading_session_positions").
+			Columns("session_id", "symbol", "qty", "avg_price", "updated_at")
+		for _, p := range positions {
+			insert = insert.Values(state.SessionID, p.Symbol, p.Qty, p.AvgPrice, state.UpdatedAt)
+		}
+		query, args, err = insert.ToSql()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func GetSessionState(ctx context.Context, db *sqlx.DB, sessionID string) (*SessionState, error) {
+	query, args, err := QB.Select("*").
+		From("trading_session_state").
+		Where(sq.Eq{"session_id": sessionID}).
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	var state SessionState
+	err = db.GetContext(ctx, &state, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func GetSessionPositions(
+	ctx context.Context,
+	db *sqlx.DB,
+	sessionID string,
+) ([]SessionPosition, error) {
+	query, args, err := QB.Select("*").
+		From("trading_session_positions").
+		Where(sq.Eq{"session_id": sessionID}).
+		OrderBy("symbol").
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	positions := []SessionPosition{}
+	err = db.SelectContext(ctx, &positions, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return positions, nil
+}
+
+// ListSessionPositions returns the latest snapshot positions of every
+// session, for reconciling them against the broker account.
+func ListSessionPositions(ctx context.Context, db *sqlx.DB) ([]SessionPosition, error) {
+	query, args, err := QB.Select("*").
+		From("trading_session_positions").
+		OrderBy("session_id", "symbol").
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	positions := []SessionPosition{}
+	err = db.SelectContext(ctx, &positions, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return positions, nil
+}
+
+// SetSessionDiscrepancies records what a resume found wrong with a session,
+// or clears it when discrepancies is nil.
+func SetSessionDiscrepancies(
+	ctx context.Context,
+	db *sqlx.DB,
+	sessionID string,
+	discrepancies *string,
+) error {
+	query, args, err := QB.Update("trading_session_state").
+		Set("discrepancies", discrepancies).
+		Where(sq.Eq{"session_id": sessionID}).
+		ToSql()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, query, args...)
+	return err
+}
@@ -15,6 +15,9 @@ type TradingSession struct {
 	Symbols         string     `db:"symbols"          json:"symbols"`
 	StartingCapital float64    `db:"starting_capital" json:"starting_capital"`
 	Parameters      string     `db:"parameters"       json:"parameters"`
+	Timeframe       string     `db:"timeframe"        json:"timeframe"`
+	Mode            string     `db:"mode"             json:"mode"` // live or replay
+	RiskConfig      *string    `db:"risk_config"      json:"risk_config"`
 	StartedAt       time.Time  `db:"started_at"       json:"started_at"`
 	EndedAt         *time.Time `db:"ended_at"         json:"ended_at"`
 }
@@ -30,14 +33,15 @@ type TradingOrder struct {
 	FilledQty     float64   `db:"filled_qty"      json:"filled_qty"`
 	AvgPrice      *float64  `db:"avg_price"       json:"avg_price"`
 	Status        string    `db:"status"          json:"status"`
+	ParentOrderID *string   `db:"parent_order_id" json:"parent_order_id"` // the order an exit leg belongs to
 	CreatedAt     time.Time `db:"created_at"      json:"created_at"`
 	UpdatedAt     time.Time `db:"updated_at"      json:"updated_at"`
 }
 
 func CreateTradingSession(ctx context.Context, db *sqlx.DB, session *TradingSession) error {
 	query, args, err := QB.Insert("trading_sessions").
-		Columns("session_id", "strategy", "status", "symbols", "starting_capital", "parameters", "started_at").
-		Values(session.SessionID, session.Strategy, session.Status, session.Symbols, session.StartingCapital, session.Parameters, session.StartedAt).
+		Columns("session_id", "strategy", "status", "symbols", "starting_capital", "parameters", "timeframe", "mode", "risk_config", "started_at").
+		Values(session.SessionID, session.Strategy, session.Status, session.Symbols, session.StartingCapital, session.Parameters, session.Timeframe, session.Mode, session.RiskConfig, session.StartedAt).
 		ToSql()
 	if err != nil {
 		return err
@@ -61,15 +65,67 @@ func UpdateTradingSessionStatus(ctx context.Context, db *sqlx.DB, sessionID, sta
 	return err
 }
 
+// SetTradingSessionStatus changes the status of a session that carries on,
+// such as one paused or resumed, without ending it.
+func SetTradingSessionStatus(ctx context.Context, db *sqlx.DB, sessionID, status string) error {
+	query, args, err := QB.Update("trading_sessions").
+		Set("status", status).
+		Where(sq.Eq{"session_id": sessionID}).
+		ToSql()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// UpdateTradingSessionParameters replaces a session's strategy parameters.
+func UpdateTradingSessionParameters(
+	ctx context.Context,
+	db *sqlx.DB,
+	sessionID, parameters string,
+) error {
+	query, args, err := QB.Update("trading_sessions").
+		Set("parameters", parameters).
+		Where(sq.Eq{"session_id": sessionID}).
+		ToSql()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// UpdateTradingSessionRiskConfig replaces a session's risk configuration.
+func UpdateTradingSessionRiskConfig(
+	ctx context.Context,
+	db *sqlx.DB,
+	sessionID, riskConfig string,
+) error {
+	query, args, err := QB.Update("trading_sessions").
+		Set("risk_config", riskConfig).
+		Where(sq.Eq{"session_id": sessionID}).
+		ToSql()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, query, args...)
+	return err
+}
+
 func InsertTradingOrder(ctx context.Context, db *sqlx.DB, order *TradingOrder) error {
 	query, args, err := QB.Insert("trading_orders").
 		Columns(
 			"order_id", "session_id", "client_order_id", "symbol", "side", "type",
-			"qty", "filled_qty", "avg_price", "status", "created_at", "updated_at",
+			"qty", "filled_qty", "avg_price", "status", "parent_order_id", "created_at", "updated_at",
 		).
 		Values(
 			order.OrderID, order.SessionID, order.ClientOrderID, order.Symbol, order.Side, order.Type,
-			order.Qty, order.FilledQty, order.AvgPrice, order.Status, order.CreatedAt, order.UpdatedAt,
+			order.Qty, order.FilledQty, order.AvgPrice, order.Status, order.ParentOrderID,
+			order.CreatedAt, order.UpdatedAt,
 		).
 		ToSql()
 	if err != nil {
@@ -0,0 +1,552 @@
+package quant
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"citadel/internal/broker"
+	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
+)
+
+// Allocation methods for AllocationConfig.Method.
+const (
+	AllocateEqualWeight = "equal_weight"
+	AllocateRiskParity  = "risk_parity"
+	AllocateFixed       = "fixed"
+)
+
+// Rebalancing schedules for AllocationConfig.Rebalance. A rebalance happens
+// at the close of the first bar of each new period, in exchange time.
+const (
+	RebalanceNever     = "never"
+	RebalanceDaily     = "daily"
+	RebalanceWeekly    = "weekly"
+	RebalanceMonthly   = "monthly"
+	RebalanceQuarterly = "quarterly"
+)
+
+// AllocationConfig chooses how a portfolio backtest divides its capital
+// between sleeves and how often it restores those weights.
+type AllocationConfig struct {
+	Method    string `json:"method"`    // equal_weight (default), risk_parity or fixed
+	Rebalance string `json:"rebalance"` // never, daily, weekly, monthly (default) or quarterly
+	Lookback  int    `json:"lookback"`  // returns risk parity measures volatility over; default 60
+}
+
+// SleeveSpec is one strategy instance in a portfolio backtest.
+type SleeveSpec struct {
+	Name       string                 `json:"name"` // default "<strategy> <symbols>"
+	Strategy   string                 `json:"strategy"`
+	Symbols    []string               `json:"symbols"`
+	Parameters map[string]interface{} `json:"parameters"`
+	Risk       json.RawMessage        `json:"risk"`   // RiskConfig over the risk parameters
+	Weight     float64                `json:"weight"` // share of capital under fixed allocation
+}
+
+// Allocator divides a portfolio's capital between its sleeves.
+type Allocator interface {
+	// Weights returns each sleeve's share of the capital, summing to one.
+	// returns holds each sleeve's per-bar returns so far, net of
+	// rebalancing; they are empty for the initial allocation.
+	Weights(returns [][]float64) []float64
+}
+
+// NewAllocator builds the allocator config describes for sleeves.
+func NewAllocator(config AllocationConfig, sleeves []SleeveSpec) (Allocator, error) {
+	switch config.Method {
+	case "", AllocateEqualWeight:
+		return EqualWeight{}, nil
+	case AllocateRiskParity:
+		if config.Lookback == 0 {
+			config.Lookback = 60
+		}
+		if config.Lookback < 2 {
+			return nil, fmt.Errorf("risk parity lookback must be at least 2 bars")
+		}
+		return RiskParity{Lookback: config.Lookback}, nil
+	case AllocateFixed:
+		weights := make([]float64, len(sleeves))
+		for i, s := range sleeves {
+			if s.Weight <= 0 {
+				return nil, fmt.Errorf(
+					"fixed allocation requires a positive weight for every sleeve",
+				)
+			}
+			weights[i] = s.Weight
+		}
+		return FixedWeights{Targets: weights}, nil
+	default:
+		return nil, fmt.Errorf("unknown allocation method %q", config.Method)
+	}
+}
+
+// EqualWeight gives every sleeve the same capital.
+type EqualWeight struct{}
+
+func (EqualWeight) Weights(returns [][]float64) []float64 {
+	return equalWeights(len(returns))
+}
+
+func equalWeights(n int) []float64 {
+	weights := make([]float64, n)
+	for i := range weights {
+		weights[i] = 1 / float64(n)
+	}
+	return weights
+}
+
+// FixedWeights gives each sleeve its target's share of the sum of the
+// targets.
+type FixedWeights struct {
+	Targets []float64
+}
+
+func (a FixedWeights) Weights(returns [][]float64) []float64 {
+	return normalize(a.Targets)
+}
+
+// RiskParity weights sleeves by the inverse of their volatility over the
+// last Lookback returns, so each contributes about the same risk. Until a
+// sleeve has a measurable volatility it gets the average of the others'
+// weights, and with none measurable the split is equal.
+type RiskParity struct {
+	Lookback int
+}
+
+func (a RiskParity) Weights(returns [][]float64) []float64 {
+	inverse := make([]float64, len(returns))
+	var sum float64
+	var measured int
+	for i, r := range returns {
+		if len(r) > a.Lookback {
+			r = r[len(r)-a.Lookback:]
+		}
+		if vol := stdDev(r); len(r) >= 2 && vol > 0 {
+			inverse[i] = 1 / vol
+			sum += inverse[i]
+			measured++
+		}
+	}
+	if measured == 0 {
+		return equalWeights(len(returns))
+	}
+	for i := range inverse {
+		if inverse[i] == 0 {
+			inverse[i] = sum / float64(measured)
+		}
+	}
+	return normalize(inverse)
+}
+
+// normalize scales weights to sum to one.
+func normalize(weights []float64) []float64 {
+	var sum float64
+	for _, w := range weights {
+		sum += w
+	}
+	out := make([]float64, len(weights))
+	for i, w := range weights {
+		out[i] = w / sum
+	}
+	return out
+}
+
+// Sleeve is one strategy in a portfolio backtest, trading its own share of
+// the capital through its own engine.
+type Sleeve struct {
+	Name       string
+	Strategy   string
+	Symbols    []string
+	Parameters Params
+	Engine     *Engine
+
+	symbols map[string]bool
+	post    float64 // equity after the last bar's rebalancing
+	nav     float64
+	returns []float64
+	growth  []EquitySnapshot
+	capital []EquitySnapshot
+}
+
+// Rebalance records the weights a portfolio backtest was reset to.
+type Rebalance struct {
+	Timestamp time.Time `json:"timestamp"`
+	Weights   []float64 `json:"weights"`
+}
+
+// PortfolioEngine backtests several strategies as one book. Each sleeve
+// trades in its own portfolio, fed the bars of its symbols from a shared
+// stream, and the Allocator sets how the capital is split between them.
+// Rebalancing scales each sleeve's positions and cash to its new weight, so
+// what it holds stays in proportion.
+type PortfolioEngine struct {
+	Sleeves         []*Sleeve
+	Allocator       Allocator
+	Rebalance       string
+	StartingCapital float64
+
+	// WarmupUntil is passed to every sleeve's engine; see Engine.
+	WarmupUntil time.Time
+
+	Rebalances []Rebalance
+	equity     []EquitySnapshot
+}
+
+// NewPortfolioEngine builds a sleeve for each spec, with its strategy and
+// risk manager, and the allocator config describes. The sleeves' engines
+// take the default fill model, margin and ledger, which callers may change
+// before Run.
+func NewPortfolioEngine(
+	capital float64,
+	specs []SleeveSpec,
+	config AllocationConfig,
+) (*PortfolioEngine, error) {
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("at least one sleeve is required")
+	}
+	switch config.Rebalance {
+	case "":
+		config.Rebalance = RebalanceMonthly
+	case RebalanceNever, RebalanceDaily, RebalanceWeekly, RebalanceMonthly, RebalanceQuarterly:
+	default:
+		return nil, fmt.Errorf("unknown rebalance schedule %q", config.Rebalance)
+	}
+	allocator, err := NewAllocator(config, specs)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &PortfolioEngine{
+		Allocator:       allocator,
+		Rebalance:       config.Rebalance,
+		StartingCapital: capital,
+	}
+	for i, spec := range specs {
+		symbols := make([]string, len(spec.Symbols))
+		for j, sym := range spec.Symbols {
+			symbols[j] = strings.ToUpper(sym)
+		}
+		strategy, params, err := NewStrategy(spec.Strategy, symbols, spec.Parameters)
+		if err != nil {
+			return nil, fmt.Errorf("sleeve %d: %w", i+1, err)
+		}
+		rm, err := NewRiskManager(params, spec.Risk)
+		if err != nil {
+			return nil, fmt.Errorf("sleeve %d: %w", i+1, err)
+		}
+
+		name := spec.Name
+		if name == "" {
+			name = spec.Strategy + " " + strings.Join(symbols, ",")
+		}
+		sleeve := &Sleeve{
+			Name:       name,
+			Strategy:   spec.Strategy,
+			Symbols:    symbols,
+			Parameters: params,
+			Engine:     NewEngine(0, strategy, rm),
+			symbols:    make(map[string]bool, len(symbols)),
+		}
+		for _, sym := range symbols {
+			sleeve.symbols[sym] = true
+		}
+		p.Sleeves = append(p.Sleeves, sleeve)
+	}
+	return p, nil
+}
+
+// Symbols returns every symbol the sleeves trade, once each.
+func (p *PortfolioEngine) Symbols() []string {
+	var symbols []string
+	seen := make(map[string]bool)
+	for _, s := range p.Sleeves {
+		for _, sym := range s.Symbols {
+			if !seen[sym] {
+				seen[sym] = true
+				symbols = append(symbols, sym)
+			}
+		}
+	}
+	return symbols
+}
+
+// Run allocates the starting capital and steps every sleeve through the bars
+// of its symbols, rebalancing on the schedule.
+func (p *PortfolioEngine) Run(barsMap map[string][]marketdata.Bar) error {
+	if len(barsMap) == 0 {
+		return fmt.Errorf("no bars provided for backtest")
+	}
+
+	weights := p.weights()
+	for i, s := range p.Sleeves {
+		s.Engine.WarmupUntil = p.WarmupUntil
+		if err := s.Engine.start(); err != nil {
+			return fmt.Errorf("sleeve %s: %w", s.Name, err)
+		}
+		s.Engine.Portfolio.Cash = weights[i] * p.StartingCapital
+		s.post, s.nav = s.Engine.Portfolio.Cash, s.Engine.Portfolio.Cash
+		s.returns, s.growth, s.capital = nil, nil, nil
+	}
+	p.Rebalances = []Rebalance{}
+	p.equity = nil
+
+	period := ""
+	bars := broker.MergeBars(barsMap)
+	for i, sb := range bars {
+		for _, s := range p.Sleeves {
+			if s.symbols[sb.Symbol] {
+				s.Engine.step(sb, endOfSlice(bars, i, s.symbols))
+			}
+		}
+
+		// The book is settled once every bar at this time has been seen
+		ts := sb.Bar.Timestamp
+		if i+1 < len(bars) && bars[i+1].Bar.Timestamp.Equal(ts) || ts.Before(p.WarmupUntil) {
+			continue
+		}
+		for _, s := range p.Sleeves {
+			s.markGrowth(ts)
+		}
+		if next := rebalancePeriod(p.Rebalance, ts); next != period {
+			if period != "" {
+				p.rebalance(ts)
+			}
+			period = next
+		}
+		p.record(ts)
+	}
+	return nil
+}
+
+// weights asks the allocator for the sleeves' weights given their returns
+// so far.
+func (p *PortfolioEngine) weights() []float64 {
+	returns := make([][]float64, len(p.Sleeves))
+	for i, s := range p.Sleeves {
+		returns[i] = s.returns
+	}
+	return p.Allocator.Weights(returns)
+}
+
+// rebalance resets every sleeve to its weight of the book's equity at ts.
+// Positions are traded at the close, with the sleeve's slippage and
+// commission, and cash moves between sleeves to settle what is left.
+func (p *PortfolioEngine) rebalance(ts time.Time) {
+	weights := p.weights()
+
+	total := p.total()
+	for i, s := range p.Sleeves {
+		if equity := s.equity(); equity > 0 {
+			s.Engine.resize(weights[i]*total/equity, ts)
+		}
+	}
+
+	// Trading costs are shared in proportion to the weights
+	total = p.total()
+	for i, s := range p.Sleeves {
+		s.Engine.Portfolio.Cash += weights[i]*total - s.equity()
+	}
+	p.Rebalances = append(p.Rebalances, Rebalance{Timestamp: ts, Weights: weights})
+}
+
+func (p *PortfolioEngine) total() float64 {
+	var total float64
+	for _, s := range p.Sleeves {
+		total += s.equity()
+	}
+	return total
+}
+
+// record logs every sleeve's capital and the book's equity at ts.
+func (p *PortfolioEngine) record(ts time.Time) {
+	for _, s := range p.Sleeves {
+		s.post = s.equity()
+		s.capital = append(s.capital, EquitySnapshot{Timestamp: ts, Equity: s.post})
+	}
+	p.equity = append(p.equity, EquitySnapshot{Timestamp: ts, Equity: p.total()})
+}
+
+// equity is the sleeve's value at the latest prices it has seen.
+func (s *Sleeve) equity() float64 {
+	return s.Engine.Portfolio.CalculateEquity(s.Engine.prices)
+}
+
+// markGrowth books the sleeve's return since the last bar, before any
+// rebalancing at ts moves capital in or out.
+func (s *Sleeve) markGrowth(ts time.Time) {
+	r := 0.0
+	if s.post > 0 {
+		r = s.equity()/s.post - 1
+	}
+	s.returns = append(s.returns, r)
+	s.nav *= 1 + r
+	s.growth = append(s.growth, EquitySnapshot{Timestamp: ts, Equity: s.nav})
+}
+
+// resize scales every position and working order by k at the latest prices,
+// booking the trades without margin checks as a rebalance must go through.
+func (e *Engine) resize(k float64, ts time.Time) {
+	for _, o := range e.working {
+		o.Quantity *= k
+	}
+	e.syncOpenOrders()
+
+	symbols := make([]string, 0, len(e.Portfolio.Positions))
+	for symbol, qty := range e.Portfolio.Positions {
+		if qty != 0 {
+			symbols = append(symbols, symbol)
+		}
+	}
+	sort.Strings(symbols)
+
+	for _, symbol := range symbols {
+		qty := (k - 1) * e.Portfolio.Positions[symbol]
+		if math.Abs(qty) < 1e-9 {
+			continue
+		}
+		side := Buy
+		if qty < 0 {
+			side, qty = Sell, -qty
+		}
+		price := e.FillModel.Slippage(side, e.prices[symbol])
+		e.Portfolio.bookFill(Trade{
+			Timestamp:  ts,
+			Symbol:     symbol,
+			Side:       side,
+			Quantity:   qty,
+			Price:      price,
+			Commission: e.FillModel.Commission(qty, price),
+			Rebalance:  true,
+		})
+	}
+}
+
+// RebalanceDue reports whether ts falls in a later period of schedule than
+// last, the time of the previous rebalance. With no previous rebalance it is
+// always due.
+func RebalanceDue(schedule string, last, ts time.Time) bool {
+	return last.IsZero() || rebalancePeriod(schedule, ts) != rebalancePeriod(schedule, last)
+}
+
+// rebalancePeriod names the period of schedule that ts falls in, or "" when
+// the schedule never rebalances.
+func rebalancePeriod(schedule string, ts time.Time) string {
+	t := ts.In(marketLocation)
+	switch schedule {
+	case RebalanceDaily:
+		return t.Format(time.DateOnly)
+	case RebalanceWeekly:
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	case RebalanceMonthly:
+		return t.Format("2006-01")
+	case RebalanceQuarterly:
+		return fmt.Sprintf("%d-Q%d", t.Year(), (int(t.Month())-1)/3+1)
+	}
+	return ""
+}
+
+// SleeveResult is one sleeve's share of a portfolio backtest. Its portfolio's
+// equity log is the sleeve's growth net of rebalancing, as if it had kept its
+// first allocation, so its metrics measure the strategy alone; Capital is
+// what it actually had to trade with.
+type SleeveResult struct {
+	Name       string           `json:"name"`
+	Strategy   string           `json:"strategy"`
+	Symbols    []string         `json:"symbols"`
+	Parameters Params           `json:"parameters"`
+	Capital    []EquitySnapshot `json:"capital"`
+	Portfolio  *Portfolio       `json:"portfolio"`
+}
+
+// PortfolioResult is the outcome of a portfolio backtest: the combined book,
+// each sleeve, the correlation of the sleeves' returns, and the rebalances.
+type PortfolioResult struct {
+	Portfolio   *Portfolio     `json:"portfolio"`
+	Sleeves     []SleeveResult `json:"sleeves"`
+	Correlation [][]float64    `json:"correlation"`
+	Rebalances  []Rebalance    `json:"rebalances"`
+}
+
+// Result computes metrics for the book and every sleeve after Run.
+func (p *PortfolioEngine) Result(opts AnalyticsOptions) *PortfolioResult {
+	book := NewPortfolio(0)
+	book.EquityLog = p.equity
+	book.Ledger.Matching = p.Sleeves[0].Engine.Portfolio.Ledger.Matching
+
+	result := &PortfolioResult{Portfolio: book, Rebalances: p.Rebalances}
+	returns := make([][]float64, 0, len(p.Sleeves))
+	for _, s := range p.Sleeves {
+		sp := s.Engine.Portfolio
+		sp.EquityLog = s.growth
+		sp.CalculateMetricsWith(opts)
+		result.Sleeves = append(result.Sleeves, SleeveResult{
+			Name:       s.Name,
+			Strategy:   s.Strategy,
+			Symbols:    s.Symbols,
+			Parameters: s.Parameters,
+			Capital:    s.capital,
+			Portfolio:  sp,
+		})
+		returns = append(returns, s.returns)
+
+		book.Cash += sp.Cash
+		for symbol, qty := range sp.Positions {
+			book.Positions[symbol] += qty
+		}
+		book.Trades = append(book.Trades, sp.Trades...)
+		book.BorrowFees += sp.BorrowFees
+		book.MarginCalls += sp.MarginCalls
+		if sp.Ledger != nil {
+			book.Ledger.RoundTrips = append(book.Ledger.RoundTrips, sp.Ledger.RoundTrips...)
+		}
+	}
+	sort.SliceStable(book.Trades, func(i, j int) bool {
+		return book.Trades[i].Timestamp.Before(book.Trades[j].Timestamp)
+	})
+	sort.SliceStable(book.Ledger.RoundTrips, func(i, j int) bool {
+		return book.Ledger.RoundTrips[i].ExitTime.Before(book.Ledger.RoundTrips[j].ExitTime)
+	})
+	book.CalculateMetricsWith(opts)
+
+	result.Correlation = correlations(returns)
+	return result
+}
+
+// correlations is the matrix of Pearson correlations between the series,
+// which must be the same length. A series that never moves is uncorrelated
+// with the others.
+func correlations(series [][]float64) [][]float64 {
+	matrix := make([][]float64, len(series))
+	for i := range series {
+		matrix[i] = make([]float64, len(series))
+		matrix[i][i] = 1
+		for j := 0; j < i; j++ {
+			c := correlation(series[i], series[j])
+			matrix[i][j], matrix[j][i] = c, c
+		}
+	}
+	return matrix
+}
+
+func correlation(a, b []float64) float64 {
+	if len(a) != len(b) || len(a) < 2 {
+		return 0
+	}
+	ma, mb := mean(a), mean(b)
+	var cov, va, vb float64
+	for i := range a {
+		da, db := a[i]-ma, b[i]-mb
+		cov += da * db
+		va += da * da
+		vb += db * db
+	}
+	if va == 0 || vb == 0 {
+		return 0
+	}
+	return cov / math.Sqrt(va*vb)
+}
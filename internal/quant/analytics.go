@@ -0,0 +1,281 @@
+package quant
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
+)
+
+const (
+	tradingDaysPerYear = 252.0
+	// tradingDay is the length of a regular US equity session.
+	tradingDay = 6*time.Hour + 30*time.Minute
+)
+
+type AnalyticsOptions struct {
+	RiskFreeRate float64          // annualized, e.g. 0.04
+	Benchmark    []marketdata.Bar // optional, compared against the equity curve
+}
+
+type MonthlyReturn struct {
+	Year   int     `json:"year"`
+	Month  int     `json:"month"`
+	Return float64 `json:"return"`
+}
+
+type BenchmarkStats struct {
+	TotalReturn      float64 `json:"total_return"`
+	Alpha            float64 `json:"alpha"` // annualized Jensen's alpha
+	Beta             float64 `json:"beta"`
+	Correlation      float64 `json:"correlation"`
+	TrackingError    float64 `json:"tracking_error"`
+	InformationRatio float64 `json:"information_ratio"`
+}
+
+// inferPeriodsPerYear estimates how many equity snapshots make up a year from
+// the median spacing between them. Intraday spacing is scaled to the regular
+// session rather than the 24h clock.
+func inferPeriodsPerYear(log []EquitySnapshot) float64 {
+	if len(log) < 2 {
+		return tradingDaysPerYear
+	}
+
+	gaps := make([]time.Duration, 0, len(log)-1)
+	for i := 1; i < len(log); i++ {
+		if gap := log[i].Timestamp.Sub(log[i-1].Timestamp); gap > 0 {
+			gaps = append(gaps, gap)
+		}
+	}
+	if len(gaps) == 0 {
+		return tradingDaysPerYear
+	}
+	sort.Slice(gaps, func(i, j int) bool { return gaps[i] < gaps[j] })
+	median := gaps[len(gaps)/2]
+
+	switch {
+	case median >= 25*24*time.Hour:
+		return 12
+	case median >= 5*24*time.Hour:
+		return 52
+	case median >= 20*time.Hour:
+		return tradingDaysPerYear
+	default:
+		return tradingDaysPerYear * float64(tradingDay) / float64(median)
+	}
+}
+
+func periodReturns(log []EquitySnapshot) []float64 {
+	returns := make([]float64, 0, len(log))
+	for i := 1; i < len(log); i++ {
+		prev := log[i-1].Equity
+		if prev == 0 {
+			returns = append(returns, 0)
+			continue
+		}
+		returns = append(returns, (log[i].Equity-prev)/prev)
+	}
+	return returns
+}
+
+func mean(xs []float64) float64 {
+	if len(xs) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, x := range xs {
+		sum += x
+	}
+	return sum / float64(len(xs))
+}
+
+func stdDev(xs []float64) float64 {
+	if len(xs) == 0 {
+		return 0
+	}
+	m := mean(xs)
+	variance := 0.0
+	for _, x := range xs {
+		variance += math.Pow(x-m, 2)
+	}
+	return math.Sqrt(variance / float64(len(xs)))
+}
+
+func sharpe(returns []float64, rfPerPeriod, ppy float64) float64 {
+	sd := stdDev(returns)
+	if sd == 0 {
+		return 0
+	}
+	return (mean(returns) - rfPerPeriod) / sd * math.Sqrt(ppy)
+}
+
+// sortino is sharpe with only returns below the risk-free rate counted as risk.
+func sortino(returns []float64, rfPerPeriod, ppy float64) float64 {
+	if len(returns) == 0 {
+		return 0
+	}
+	downside := 0.0
+	for _, r := range returns {
+		if d := r - rfPerPeriod; d < 0 {
+			downside += d * d
+		}
+	}
+	dd := math.Sqrt(downside / float64(len(returns)))
+	if dd == 0 {
+		return 0
+	}
+	return (mean(returns) - rfPerPeriod) / dd * math.Sqrt(ppy)
+}
+
+func cagr(log []EquitySnapshot) float64 {
+	first := log[0]
+	last := log[len(log)-1]
+	years := last.Timestamp.Sub(first.Timestamp).Hours() / (24 * 365.25)
+	if years <= 0 || first.Equity <= 0 || last.Equity <= 0 {
+		return 0
+	}
+	return math.Pow(last.Equity/first.Equity, 1/years) - 1
+}
+
+type drawdownStats struct {
+	maxDrawdown float64
+	longest     time.Duration // longest time spent below a prior peak
+	recovery    time.Duration // trough of the max drawdown to its recovery
+	recovered   bool
+}
+
+func drawdowns(log []EquitySnapshot) drawdownStats {
+	var stats drawdownStats
+
+	peak := log[0].Equity
+	peakTime := log[0].Timestamp
+	underwater := false
+	var trough time.Time
+
+	for _, snap := range log[1:] {
+		if snap.Equity >= peak {
+			// Back at the high-water mark, so the underwater spell is over
+			if d := snap.Timestamp.Sub(peakTime); underwater && d > stats.longest {
+				stats.longest = d
+			}
+			if !trough.IsZero() && !stats.recovered {
+				stats.recovery = snap.Timestamp.Sub(trough)
+				stats.recovered = true
+			}
+			peak = snap.Equity
+			peakTime = snap.Timestamp
+			underwater = false
+			continue
+		}
+
+		underwater = true
+		if peak > 0 {
+			if dd := (peak - snap.Equity) / peak; dd > stats.maxDrawdown {
+				stats.maxDrawdown = dd
+				trough = snap.Timestamp
+				stats.recovered = false
+			}
+		}
+	}
+
+	// Still underwater at the end of the log
+	if d := log[len(log)-1].Timestamp.Sub(peakTime); underwater && d > stats.longest {
+		stats.longest = d
+	}
+	return stats
+}
+
+func monthlyReturns(log []EquitySnapshot) []MonthlyReturn {
+	result := make([]MonthlyReturn, 0)
+
+	base := log[0].Equity
+	var current MonthlyReturn
+	var last float64
+
+	for i, snap := range log {
+		ts := snap.Timestamp.In(marketLocation)
+		if i == 0 {
+			current = MonthlyReturn{Year: ts.Year(), Month: int(ts.Month())}
+		} else if ts.Year() != current.Year || int(ts.Month()) != current.Month {
+			if base != 0 {
+				current.Return = last/base - 1
+			}
+			result = append(result, current)
+			base = last
+			current = MonthlyReturn{Year: ts.Year(), Month: int(ts.Month())}
+		}
+		last = snap.Equity
+	}
+
+	if base != 0 {
+		current.Return = last/base - 1
+	}
+	return append(result, current)
+}
+
+// benchmarkStats aligns the benchmark's closes to the equity log, carrying the
+// last close forward, and regresses the strategy's returns against it.
+func benchmarkStats(
+	log []EquitySnapshot,
+	bars []marketdata.Bar,
+	rfPerPeriod, ppy float64,
+) *BenchmarkStats {
+	sorted := make([]marketdata.Bar, len(bars))
+	copy(sorted, bars)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp.Before(sorted[j].Timestamp)
+	})
+
+	var strat, bench []float64
+	var prevBench, firstBench, lastBench float64
+	j := 0
+	for i, snap := range log {
+		for j < len(sorted) && !sorted[j].Timestamp.After(snap.Timestamp) {
+			lastBench = sorted[j].Close
+			j++
+		}
+		if lastBench == 0 {
+			continue
+		}
+		if firstBench == 0 {
+			firstBench = lastBench
+		}
+		if prevBench != 0 && i > 0 && log[i-1].Equity != 0 {
+			strat = append(strat, (snap.Equity-log[i-1].Equity)/log[i-1].Equity)
+			bench = append(bench, (lastBench-prevBench)/prevBench)
+		}
+		prevBench = lastBench
+	}
+
+	stats := &BenchmarkStats{}
+	if firstBench != 0 {
+		stats.TotalReturn = lastBench/firstBench - 1
+	}
+	if len(strat) < 2 {
+		return stats
+	}
+
+	ms, mb := mean(strat), mean(bench)
+	cov, varB, varS := 0.0, 0.0, 0.0
+	active := make([]float64, len(strat))
+	for i := range strat {
+		cov += (strat[i] - ms) * (bench[i] - mb)
+		varB += (bench[i] - mb) * (bench[i] - mb)
+		varS += (strat[i] - ms) * (strat[i] - ms)
+		active[i] = strat[i] - bench[i]
+	}
+
+	if varB > 0 {
+		stats.Beta = cov / varB
+	}
+	if varB > 0 && varS > 0 {
+		stats.Correlation = cov / math.Sqrt(varB*varS)
+	}
+	stats.Alpha = (ms - rfPerPeriod - stats.Beta*(mb-rfPerPeriod)) * ppy
+	stats.TrackingError = stdDev(active) * math.Sqrt(ppy)
+	if stats.TrackingError > 0 {
+		stats.InformationRatio = mean(active) * ppy / stats.TrackingError
+	}
+	return stats
+}
@@ -0,0 +1,33 @@
+package quant
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"citadel/internal/broker"
+	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
+)
+
+// LoadBars fetches bars for every symbol from src, failing on the first
+// symbol that can't be loaded.
+func LoadBars(
+	ctx context.Context,
+	src broker.MarketDataSource,
+	symbols []string,
+	timeframe marketdata.TimeFrame,
+	start, end time.Time,
+) (map[string][]marketdata.Bar, error) {
+	bars := make(map[string][]marketdata.Bar, len(symbols))
+	for _, sym := range symbols {
+		if _, ok := bars[sym]; ok {
+			continue
+		}
+		b, err := src.GetBars(ctx, sym, timeframe, start, end)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch market data for %s: %w", sym, err)
+		}
+		bars[sym] = b
+	}
+	return bars, nil
+}
@@ -2,9 +2,10 @@ package quant
 
 import (
 	"fmt"
-	"sort"
 	"time"
 
+	"citadel/internal/broker"
+
 	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
 )
 
@@ -12,87 +13,351 @@ type Engine struct {
 	Portfolio   *Portfolio
 	Strategy    Strategy
 	RiskManager RiskManager
+	FillModel   FillModel
+
+	// Timeframe is the resolution of the bars passed to Run. Zero means daily.
+	Timeframe marketdata.TimeFrame
+
+	// WarmupUntil feeds bars before this time to the strategy so indicators
+	// have history, but discards its orders and leaves them out of the
+	// equity log.
+	WarmupUntil time.Time
+
+	// Calendar marks where trading days begin for the strategy and risk
+	// manager, if they are SessionListeners. Nil means broker.NYSE.
+	Calendar broker.Calendar
+
+	// Run state
+	working       []*WorkingOrder
+	groups        int // exit groups handed out
+	feed          *barFeed
+	slices        sliceFeed
+	prices        map[string]float64
+	lastTimestamp *time.Time
+	clock         sessionClock
 }
 
 func NewEngine(startingCash float64, strategy Strategy, rm RiskManager) *Engine {
 	if rm == nil {
-		rm = NewDefaultRiskManager(0, 0)
+		rm = NewRuleRiskManager(RiskConfig{})
 	}
 	return &Engine{
 		Portfolio:   NewPortfolio(startingCash),
 		Strategy:    strategy,
 		RiskManager: rm,
+		FillModel:   NewFillModel(FillConfig{}),
 	}
 }
 
-type symbolBar struct {
-	Symbol string
-	Bar    marketdata.Bar
-}
-
 func (e *Engine) Run(barsMap map[string][]marketdata.Bar) error {
 	if len(barsMap) == 0 {
 		return fmt.Errorf("no bars provided for backtest")
 	}
+	if err := e.start(); err != nil {
+		return err
+	}
+	bars := broker.MergeBars(barsMap)
+	for i, sb := range bars {
+		e.step(sb, endOfSlice(bars, i, nil))
+	}
+	return nil
+}
+
+// endOfSlice reports whether bars[i] is the last bar at its time for any of
+// symbols, or for any symbol when symbols is nil.
+func endOfSlice(bars []broker.SymbolBar, i int, symbols map[string]bool) bool {
+	ts := bars[i].Bar.Timestamp
+	for j := i + 1; j < len(bars) && bars[j].Bar.Timestamp.Equal(ts); j++ {
+		if symbols == nil || symbols[bars[j].Symbol] {
+			return false
+		}
+	}
+	return true
+}
+
+// start readies the engine and its strategy for a run.
+func (e *Engine) start() error {
+	base := e.Timeframe
+	if base.N == 0 {
+		base = marketdata.OneDay
+	}
+	feed, err := newBarFeed(e.Strategy, base)
+	if err != nil {
+		return err
+	}
 
 	e.Strategy.Initialize(e.Portfolio)
+	e.feed = feed
+	e.slices = sliceFeed{}
+	e.working = nil
+	e.groups = 0
+	e.prices = make(map[string]float64)
+	e.lastTimestamp = nil
+	e.clock = sessionClock{cal: e.Calendar}
+	if e.clock.cal == nil {
+		e.clock.cal = broker.NYSE
+	}
+	return nil
+}
 
-	var allBars []symbolBar
-	for symbol, bars := range barsMap {
-		for _, bar := range bars {
-			allBars = append(allBars, symbolBar{Symbol: symbol, Bar: bar})
+// step moves the simulation forward by one bar. last marks the final bar at
+// its time, after which a SliceStrategy sees the whole slice.
+func (e *Engine) step(sb broker.SymbolBar, last bool) {
+	if session, ok := e.clock.advance(sb.Bar.Timestamp); ok {
+		openSession(session, e.Strategy, e.RiskManager)
+	}
+	if o, ok := e.RiskManager.(BarObserver); ok {
+		o.ObserveBar(sb.Symbol, sb.Bar)
+	}
+
+	if sb.Bar.Timestamp.Before(e.WarmupUntil) {
+		e.prices[sb.Symbol] = sb.Bar.Close
+		e.Strategy.OnBar(sb.Symbol, sb.Bar, e.Portfolio)
+		if e.feed != nil {
+			e.feed.dispatch(sb.Symbol, sb.Bar, e.Portfolio)
 		}
+		e.Portfolio.PendingOrders = []OrderIntent{}
+		e.Portfolio.cancels = nil
+		return
 	}
 
-	sort.Slice(allBars, func(i, j int) bool {
-		return allBars[i].Bar.Timestamp.Before(allBars[j].Bar.Timestamp)
-	})
+	if e.Portfolio.Ledger != nil {
+		e.Portfolio.Ledger.Observe(sb.Symbol, sb.Bar)
+	}
 
-	prices := make(map[string]float64)
+	// Orders resting from earlier bars get the first shot at this bar
+	e.matchWorking(sb.Symbol, sb.Bar)
 
-	var lastTimestamp *time.Time
+	// Update current price before making decisions
+	e.prices[sb.Symbol] = sb.Bar.Close
+	e.Portfolio.Mark(sb.Symbol, sb.Bar.Close)
 
-	for _, sb := range allBars {
-		// Update current price before making decisions
-		prices[sb.Symbol] = sb.Bar.Close
+	e.Strategy.OnBar(sb.Symbol, sb.Bar, e.Portfolio)
+	if e.feed != nil {
+		e.feed.dispatch(sb.Symbol, sb.Bar, e.Portfolio)
+	}
+	e.slices.add(e.Strategy, sb.Symbol, sb.Bar)
+	if last {
+		e.slices.deliver(e.Strategy, e.Portfolio)
+	}
+	e.processCancels()
 
-		e.Strategy.OnBar(sb.Symbol, sb.Bar, e.Portfolio)
+	e.RiskManager.EvaluatePortfolio(e.Portfolio, e.prices)
+
+	// Orders approved earlier in the batch are checked as if filled, so
+	// entries on the same bar can't together exceed a limit
+	var batch []*WorkingOrder
+	for _, intent := range e.Portfolio.PendingOrders {
+		if intent.Validate() != nil {
+			continue
+		}
+		unfilled := make(map[string]float64)
+		for _, o := range batch {
+			unfilled[o.Symbol] += o.signedQuantity()
+		}
+		approved, err := e.RiskManager.EvaluateOrder(
+			intent,
+			e.Portfolio.projected(unfilled, e.prices),
+			e.prices,
+		)
+		if err != nil {
+			continue
+		}
+
+		var orders []*WorkingOrder
+		price := e.prices[approved.Symbol]
+		if approved.Class() == ClassOCO {
+			orders = e.placeExits(approved, approved.Quantity, sb.Bar.Timestamp, price)
+		} else {
+			o := newWorkingOrder(approved, sb.Bar.Timestamp, price)
+			e.working = append(e.working, o)
+			orders = append(orders, o)
+			batch = append(batch, o)
+		}
+
+		if !e.FillModel.NextBar() {
+			// Same-bar fills only see the close, so treat it as a flat bar
+			for _, o := range orders {
+				e.tryFill(o, marketdata.Bar{
+					Timestamp: sb.Bar.Timestamp,
+					Open:      price,
+					High:      price,
+					Low:       price,
+					Close:     price,
+				})
+			}
+		}
+	}
+	e.Portfolio.PendingOrders = []OrderIntent{}
+	e.syncOpenOrders()
 
-		e.RiskManager.EvaluatePortfolio(e.Portfolio, prices)
+	if e.Portfolio.MarginDeficit(e.prices) > 0 {
+		e.liquidate(e.prices, sb.Bar.Timestamp)
+	}
+
+	// Record equity at most once per timestamp to avoid duplication
+	if e.lastTimestamp == nil || !e.lastTimestamp.Equal(sb.Bar.Timestamp) {
+		if e.lastTimestamp != nil {
+			e.Portfolio.ChargeBorrowFees(e.prices, sb.Bar.Timestamp.Sub(*e.lastTimestamp))
+		}
+		equity := e.Portfolio.CalculateEquity(e.prices)
+		e.Portfolio.EquityLog = append(e.Portfolio.EquityLog, EquitySnapshot{
+			Timestamp: sb.Bar.Timestamp,
+			Equity:    equity,
+		})
+		t := sb.Bar.Timestamp
+		e.lastTimestamp = &t
+	}
+}
+
+// matchWorking tries every resting order for symbol against bar, dropping
+// orders that fill or whose time in force has lapsed.
+func (e *Engine) matchWorking(symbol string, bar marketdata.Bar) {
+	for _, o := range e.working {
+		if o.Symbol != symbol || !bar.Timestamp.After(o.SubmittedAt) {
+			continue
+		}
+		if o.expired(bar) {
+			o.Quantity = 0
+			continue
+		}
+		e.tryFill(o, bar)
+		o.updateMark(bar)
+	}
+	e.syncOpenOrders()
+}
+
+// tryFill executes o against bar if the fill model allows it. Filled and
+// unaffordable orders are marked done by zeroing their quantity.
+func (e *Engine) tryFill(o *WorkingOrder, bar marketdata.Bar) {
+	if o.Quantity <= 0 {
+		return
+	}
+	o.attempts++
+
+	raw, ok := e.FillModel.Match(o, bar)
+	if !ok {
+		if o.TimeInForce == "ioc" || o.TimeInForce == "fok" {
+			o.Quantity = 0
+		}
+		return
+	}
+
+	price := e.FillModel.Slippage(o.Side, raw)
+	qty := o.Quantity
+	fee := e.FillModel.Commission(qty, price)
+
+	// Size down to what cash and margin can cover, e.g. after a gap
+	if maxQty := e.Portfolio.MaxQuantity(o.Symbol, o.Side, price, fee); qty > maxQty {
+		qty = maxQty
+		fee = e.FillModel.Commission(qty, price)
+	}
+
+	if qty > 0 {
+		e.Portfolio.ApplyFill(Trade{
+			Timestamp:  bar.Timestamp,
+			Symbol:     o.Symbol,
+			Side:       o.Side,
+			Quantity:   qty,
+			Price:      price,
+			Commission: fee,
+		})
+	}
+	o.Quantity = 0
 
-		var approvedOrders []OrderIntent
-		for _, intent := range e.Portfolio.PendingOrders {
-			approved, err := e.RiskManager.EvaluateOrder(intent, e.Portfolio, prices)
-			if err == nil {
-				approvedOrders = append(approvedOrders, approved)
+	if qty <= 0 {
+		return
+	}
+	if o.group != 0 {
+		// One exit filled, so the others are canceled
+		for _, other := range e.working {
+			if other.group == o.group {
+				other.Quantity = 0
 			}
 		}
+	}
+	if class := o.Class(); class == ClassBracket || class == ClassOTO {
+		e.placeExits(o.OrderIntent, qty, bar.Timestamp, price)
+	}
+}
+
+// placeExits puts the exits of intent for qty in the book as a group. They
+// become eligible to fill from the bar after ts; the stop-loss comes first,
+// so a bar that reaches both is taken to have stopped out.
+func (e *Engine) placeExits(
+	intent OrderIntent,
+	qty float64,
+	ts time.Time,
+	price float64,
+) []*WorkingOrder {
+	e.groups++
+	var orders []*WorkingOrder
+	for _, exit := range intent.exits(qty) {
+		o := newWorkingOrder(exit, ts, price)
+		o.group = e.groups
+		orders = append(orders, o)
+	}
+	e.working = append(e.working, orders...)
+	return orders
+}
+
+// liquidate answers a margin call by closing positions, largest first, at the
+// current price until the maintenance requirement is met again.
+func (e *Engine) liquidate(prices map[string]float64, ts time.Time) {
+	e.Portfolio.MarginCalls++
+
+	for _, symbol := range e.Portfolio.liquidationOrder(prices) {
+		if e.Portfolio.MarginDeficit(prices) <= 0 {
+			return
+		}
 
-		for _, intent := range approvedOrders {
-			if intent.Side == Buy {
-				e.Portfolio.Buy(
-					intent.Symbol,
-					intent.Quantity,
-					prices[intent.Symbol],
-					sb.Bar.Timestamp,
-				)
-			} else if intent.Side == Sell {
-				e.Portfolio.Sell(intent.Symbol, intent.Quantity, prices[intent.Symbol], sb.Bar.Timestamp)
+		qty := e.Portfolio.Positions[symbol]
+		side := Sell
+		if qty < 0 {
+			side = Buy
+			qty = -qty
+		}
+
+		price := e.FillModel.Slippage(side, prices[symbol])
+		// Closing a position never needs margin, so this cannot be refused
+		e.Portfolio.ApplyFill(Trade{
+			Timestamp:  ts,
+			Symbol:     symbol,
+			Side:       side,
+			Quantity:   qty,
+			Price:      price,
+			Commission: e.FillModel.Commission(qty, price),
+		})
+	}
+}
+
+// processCancels removes working orders for every symbol the strategy asked
+// to cancel during OnBar.
+func (e *Engine) processCancels() {
+	for _, symbol := range e.Portfolio.cancels {
+		for _, o := range e.working {
+			if symbol == "" || o.Symbol == symbol {
+				o.Quantity = 0
 			}
 		}
-		e.Portfolio.PendingOrders = []OrderIntent{}
+	}
+	e.Portfolio.cancels = nil
+	e.syncOpenOrders()
+}
 
-		// Record equity at most once per timestamp to avoid duplication
-		if lastTimestamp == nil || !lastTimestamp.Equal(sb.Bar.Timestamp) {
-			equity := e.Portfolio.CalculateEquity(prices)
-			e.Portfolio.EquityLog = append(e.Portfolio.EquityLog, EquitySnapshot{
-				Timestamp: sb.Bar.Timestamp,
-				Equity:    equity,
-			})
-			t := sb.Bar.Timestamp
-			lastTimestamp = &t
+// syncOpenOrders drops finished orders and mirrors the rest onto the
+// portfolio so strategies can inspect them.
+func (e *Engine) syncOpenOrders() {
+	open := e.working[:0]
+	for _, o := range e.working {
+		if o.Quantity > 0 {
+			open = append(open, o)
 		}
 	}
+	e.working = open
 
-	return nil
+	e.Portfolio.OpenOrders = make([]WorkingOrder, 0, len(open))
+	for _, o := range open {
+		e.Portfolio.OpenOrders = append(e.Portfolio.OpenOrders, *o)
+	}
 }
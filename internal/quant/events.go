@@ -0,0 +1,100 @@
+package quant
+
+import (
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventBar           EventType = "bar"            // a bar reached the strategy
+	EventSignal        EventType = "signal"         // the strategy submitted an order intent
+	EventOrder         EventType = "order"          // an order was sent to the broker
+	EventOrderRejected EventType = "order_rejected" // an intent was refused before reaching the broker
+	EventFill          EventType = "fill"           // a fill was booked to the session
+	EventRiskHalt      EventType = "risk_halt"      // the risk manager blocked the strategy
+	EventEquity        EventType = "equity"         // the session's equity was marked to market
+	EventStatus        EventType = "status"         // the session stopped, completed or failed
+)
+
+// Event is something a live engine did, published to its session's
+// subscribers. Data depends on Type: a bar, an order intent, an order, a
+// trade or an equity snapshot, or a map with the details.
+type Event struct {
+	Type      EventType   `json:"type"`
+	SessionID string      `json:"session_id"`
+	Time      time.Time   `json:"time"`
+	Symbol    string      `json:"symbol,omitempty"`
+	Data      interface{} `json:"data,omitempty"`
+}
+
+// EventHub fans engine events out to subscribers by session. Publishing
+// never blocks: a subscriber that falls behind misses events.
+type EventHub struct {
+	mu   sync.RWMutex
+	subs map[string]map[chan Event]struct{}
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{subs: make(map[string]map[chan Event]struct{})}
+}
+
+// Subscribe returns a channel of the session's events, buffering up to size,
+// and a function that ends the subscription.
+func (h *EventHub) Subscribe(sessionID string, size int) (<-chan Event, func()) {
+	ch := make(chan Event, size)
+
+	h.mu.Lock()
+	if h.subs[sessionID] == nil {
+		h.subs[sessionID] = make(map[chan Event]struct{})
+	}
+	h.subs[sessionID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			delete(h.subs[sessionID], ch)
+			if len(h.subs[sessionID]) == 0 {
+				delete(h.subs, sessionID)
+			}
+		})
+	}
+}
+
+// Publish delivers event to the subscribers of its session.
+func (h *EventHub) Publish(event Event) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for ch := range h.subs[event.SessionID] {
+		select {
+		case ch <- event:
+		default:
+			// subscriber is full, drop rather than stall the engine
+		}
+	}
+}
+
+// Subscribers returns how many subscriptions the session has.
+func (h *EventHub) Subscribers(sessionID string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.subs[sessionID])
+}
+
+// emit publishes an event for the engine's session when it has a hub.
+func (e *LiveEngine) emit(t EventType, ts time.Time, symbol string, data interface{}) {
+	if e.Events == nil {
+		return
+	}
+	e.Events.Publish(Event{
+		Type:      t,
+		SessionID: e.SessionID,
+		Time:      ts,
+		Symbol:    symbol,
+		Data:      data,
+	})
+}
@@ -0,0 +1,225 @@
+package quant
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
+)
+
+type FillTiming string
+
+const (
+	// FillOnClose fills market orders at the close of the bar that produced them.
+	FillOnClose FillTiming = "close"
+	// FillOnNextOpen fills market orders at the open of the following bar.
+	FillOnNextOpen FillTiming = "next_open"
+)
+
+// FillConfig describes how the backtest engine simulates executions. The zero
+// value fills market orders at the current close with no costs.
+type FillConfig struct {
+	Timing             FillTiming `json:"timing"`
+	SlippageFixed      float64    `json:"slippage_fixed"`       // price units per share
+	SlippagePct        float64    `json:"slippage_pct"`         // fraction of price, e.g. 0.0005
+	CommissionPerShare float64    `json:"commission_per_share"` // charged on every filled share
+	CommissionPerOrder float64    `json:"commission_per_order"` // flat fee per fill
+	CommissionMin      float64    `json:"commission_min"`       // floor applied to the total fee
+}
+
+// Validate reports whether c has a supported timing and no negative costs,
+// which would pay the strategy to trade. Empty timing means FillOnClose.
+func (c FillConfig) Validate() error {
+	switch c.Timing {
+	case "", FillOnClose, FillOnNextOpen:
+	default:
+		return fmt.Errorf(
+			"unknown fills timing %q, expected %s or %s",
+			c.Timing,
+			FillOnClose,
+			FillOnNextOpen,
+		)
+	}
+
+	costs := []struct {
+		name  string
+		value float64
+	}{
+		{"slippage_fixed", c.SlippageFixed},
+		{"slippage_pct", c.SlippagePct},
+		{"commission_per_share", c.CommissionPerShare},
+		{"commission_per_order", c.CommissionPerOrder},
+		{"commission_min", c.CommissionMin},
+	}
+	for _, cost := range costs {
+		if cost.value < 0 {
+			return fmt.Errorf("fills %s must not be negative, got %v", cost.name, cost.value)
+		}
+	}
+	return nil
+}
+
+// FillModel decides whether a working order executes against a bar, and what
+// it costs when it does.
+type FillModel interface {
+	// NextBar reports whether newly approved orders must wait for the next bar
+	// before they are eligible to fill.
+	NextBar() bool
+	// Match returns the raw execution price of o against bar, before slippage.
+	Match(o *WorkingOrder, bar marketdata.Bar) (float64, bool)
+	// Slippage adjusts an execution price against the side of the order.
+	Slippage(side TradeSide, price float64) float64
+	// Commission returns the fee charged for filling qty shares at price.
+	Commission(qty, price float64) float64
+}
+
+// WorkingOrder is an approved order resting in the simulated order book.
+type WorkingOrder struct {
+	OrderIntent
+	SubmittedAt time.Time `json:"submitted_at"`
+
+	// mark is the high (sell) or low (buy) water mark used by trailing stops.
+	mark float64
+	// session is the trading date a day order is valid for, set on the first
+	// bar after submission.
+	session  string
+	attempts int
+	// group links the exits of one order, which cancel each other; 0 for
+	// none.
+	group int
+}
+
+func newWorkingOrder(intent OrderIntent, ts time.Time, price float64) *WorkingOrder {
+	return &WorkingOrder{OrderIntent: intent, SubmittedAt: ts, mark: price}
+}
+
+// StopTrigger returns the price at which a stop or trailing stop order
+// becomes a market order.
+func (o *WorkingOrder) StopTrigger() (float64, bool) {
+	switch o.Type {
+	case Stop:
+		if o.StopPrice == nil {
+			return 0, false
+		}
+		return *o.StopPrice, true
+	case TrailingStop:
+		var offset float64
+		switch {
+		case o.TrailingPrice != nil:
+			offset = *o.TrailingPrice
+		case o.TrailingPct != nil:
+			offset = o.mark * *o.TrailingPct / 100
+		default:
+			return 0, false
+		}
+		if o.Side == Sell {
+			return o.mark - offset, true
+		}
+		return o.mark + offset, true
+	}
+	return 0, false
+}
+
+// updateMark ratchets the trailing water mark after a bar has been matched.
+func (o *WorkingOrder) updateMark(bar marketdata.Bar) {
+	if o.Side == Sell && bar.High > o.mark {
+		o.mark = bar.High
+	} else if o.Side == Buy && (o.mark == 0 || bar.Low < o.mark) {
+		o.mark = bar.Low
+	}
+}
+
+// expired reports whether the order's time in force has lapsed by bar. It is
+// called before the order is matched against bar.
+func (o *WorkingOrder) expired(bar marketdata.Bar) bool {
+	switch o.TimeInForce {
+	case "gtc":
+		return false
+	case "ioc", "fok":
+		return o.attempts > 0
+	default: // day
+		date := tradingDate(bar.Timestamp)
+		if o.session == "" {
+			o.session = date
+		}
+		return date != o.session
+	}
+}
+
+var marketLocation = func() *time.Location {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}()
+
+func tradingDate(ts time.Time) string {
+	return ts.In(marketLocation).Format(time.DateOnly)
+}
+
+// SimulatedFills is the default FillModel. Limit and stop orders are
+// triggered against the bar's high and low, and fill at the better of the
+// open or the order price when the bar gaps through it.
+type SimulatedFills struct {
+	Config FillConfig
+}
+
+func NewFillModel(config FillConfig) *SimulatedFills {
+	if config.Timing == "" {
+		config.Timing = FillOnClose
+	}
+	return &SimulatedFills{Config: config}
+}
+
+func (f *SimulatedFills) NextBar() bool {
+	return f.Config.Timing == FillOnNextOpen
+}
+
+func (f *SimulatedFills) Match(o *WorkingOrder, bar marketdata.Bar) (float64, bool) {
+	switch o.Type {
+	case Limit:
+		if o.LimitPrice == nil {
+			return 0, false
+		}
+		limit := *o.LimitPrice
+		if o.Side == Buy && bar.Low <= limit {
+			return math.Min(bar.Open, limit), true
+		}
+		if o.Side == Sell && bar.High >= limit {
+			return math.Max(bar.Open, limit), true
+		}
+		return 0, false
+	case Stop, TrailingStop:
+		stop, ok := o.StopTrigger()
+		if !ok {
+			return 0, false
+		}
+		if o.Side == Buy && bar.High >= stop {
+			return math.Max(bar.Open, stop), true
+		}
+		if o.Side == Sell && bar.Low <= stop {
+			return math.Min(bar.Open, stop), true
+		}
+		return 0, false
+	default:
+		return bar.Open, true
+	}
+}
+
+func (f *SimulatedFills) Slippage(side TradeSide, price float64) float64 {
+	slip := f.Config.SlippageFixed + price*f.Config.SlippagePct
+	if side == Buy {
+		return price + slip
+	}
+	return math.Max(price-slip, 0)
+}
+
+func (f *SimulatedFills) Commission(qty, price float64) float64 {
+	fee := f.Config.CommissionPerOrder + qty*f.Config.CommissionPerShare
+	if fee < f.Config.CommissionMin {
+		fee = f.Config.CommissionMin
+	}
+	return fee
+}
@@ -0,0 +1,231 @@
+package quant
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
+)
+
+type LotMatching string
+
+const (
+	FIFO LotMatching = "fifo"
+	LIFO LotMatching = "lifo"
+)
+
+// Validate reports whether m is a supported matching method. Empty means
+// FIFO.
+func (m LotMatching) Validate() error {
+	switch m {
+	case "", FIFO, LIFO:
+		return nil
+	}
+	return fmt.Errorf("unknown lot_matching %q, expected %s or %s", m, FIFO, LIFO)
+}
+
+type Direction string
+
+const (
+	Long  Direction = "long"
+	Short Direction = "short"
+)
+
+// RoundTrip is a closed trade: an entry paired with the exit that closed it.
+// PnL and excursions are in dollars for the matched quantity, net of the
+// commissions attributable to it.
+type RoundTrip struct {
+	Symbol         string    `json:"symbol"`
+	Direction      Direction `json:"direction"`
+	Quantity       float64   `json:"quantity"`
+	EntryTime      time.Time `json:"entry_time"`
+	ExitTime       time.Time `json:"exit_time"`
+	EntryPrice     float64   `json:"entry_price"`
+	ExitPrice      float64   `json:"exit_price"`
+	Commission     float64   `json:"commission"`
+	PnL            float64   `json:"pnl"`
+	ReturnPct      float64   `json:"return_pct"`
+	HoldingSeconds float64   `json:"holding_seconds"`
+	MAE            float64   `json:"mae"` // worst unrealized P&L while open, <= 0
+	MFE            float64   `json:"mfe"` // best unrealized P&L while open, >= 0
+}
+
+type lot struct {
+	qty        float64 // signed, negative for shorts
+	price      float64
+	feePerUnit float64
+	time       time.Time
+	high       float64
+	low        float64
+}
+
+// Ledger pairs fills into round trips as they are booked.
+type Ledger struct {
+	Matching   LotMatching `json:"matching"`
+	RoundTrips []RoundTrip `json:"round_trips"`
+
+	open map[string][]*lot
+}
+
+func NewLedger(matching LotMatching) *Ledger {
+	if matching == "" {
+		matching = FIFO
+	}
+	return &Ledger{
+		Matching:   matching,
+		RoundTrips: make([]RoundTrip, 0),
+		open:       make(map[string][]*lot),
+	}
+}
+
+// Record books a fill, closing open lots on the opposite side before opening
+// a new lot with whatever quantity is left.
+func (l *Ledger) Record(t Trade) {
+	if t.Quantity <= 0 {
+		return
+	}
+	if l.open == nil {
+		l.open = make(map[string][]*lot)
+	}
+	if t.Rebalance {
+		l.scale(t)
+		return
+	}
+
+	sign := 1.0
+	if t.Side == Sell {
+		sign = -1.0
+	}
+	remaining := t.Quantity
+	feePerUnit := t.Commission / t.Quantity
+
+	for remaining > 1e-9 {
+		lots := l.open[t.Symbol]
+		if len(lots) == 0 || math.Signbit(lots[0].qty) == math.Signbit(sign) {
+			break
+		}
+
+		idx := 0
+		if l.Matching == LIFO {
+			idx = len(lots) - 1
+		}
+		open := lots[idx]
+
+		qty := math.Min(remaining, math.Abs(open.qty))
+		l.close(t, open, qty, feePerUnit)
+
+		remaining -= qty
+		open.qty += sign * qty
+		if math.Abs(open.qty) < 1e-9 {
+			l.open[t.Symbol] = append(lots[:idx], lots[idx+1:]...)
+		}
+	}
+
+	if remaining > 1e-9 {
+		l.open[t.Symbol] = append(l.open[t.Symbol], &lot{
+			qty:        sign * remaining,
+			price:      t.Price,
+			feePerUnit: feePerUnit,
+			time:       t.Timestamp,
+			high:       t.Price,
+			low:        t.Price,
+		})
+	}
+}
+
+// scale grows or shrinks symbol's open lots in proportion by a rebalance
+// trade, keeping their entry prices and times.
+func (l *Ledger) scale(t Trade) {
+	held := 0.0
+	for _, open := range l.open[t.Symbol] {
+		held += open.qty
+	}
+	if math.Abs(held) < 1e-9 {
+		return
+	}
+
+	qty := t.Quantity
+	if t.Side == Sell {
+		qty = -qty
+	}
+	k := (held + qty) / held
+	if math.Abs(held+qty) < 1e-9 || k < 0 {
+		k = 0
+	}
+
+	lots := l.open[t.Symbol][:0]
+	for _, open := range l.open[t.Symbol] {
+		open.qty *= k
+		if math.Abs(open.qty) >= 1e-9 {
+			lots = append(lots, open)
+		}
+	}
+	l.open[t.Symbol] = lots
+}
+
+// AvgEntryPrice is the quantity-weighted entry price of symbol's open lots,
+// or zero when there are none.
+func (l *Ledger) AvgEntryPrice(symbol string) float64 {
+	var qty, cost float64
+	for _, open := range l.open[symbol] {
+		qty += math.Abs(open.qty)
+		cost += math.Abs(open.qty) * open.price
+	}
+	if qty == 0 {
+		return 0
+	}
+	return cost / qty
+}
+
+func (l *Ledger) close(t Trade, open *lot, qty, exitFeePerUnit float64) {
+	direction := Long
+	if open.qty < 0 {
+		direction = Short
+	}
+
+	high := math.Max(open.high, t.Price)
+	low := math.Min(open.low, t.Price)
+
+	var gross, mae, mfe float64
+	if direction == Long {
+		gross = (t.Price - open.price) * qty
+		mae = (low - open.price) * qty
+		mfe = (high - open.price) * qty
+	} else {
+		gross = (open.price - t.Price) * qty
+		mae = (open.price - high) * qty
+		mfe = (open.price - low) * qty
+	}
+
+	commission := (open.feePerUnit + exitFeePerUnit) * qty
+	pnl := gross - commission
+
+	l.RoundTrips = append(l.RoundTrips, RoundTrip{
+		Symbol:         t.Symbol,
+		Direction:      direction,
+		Quantity:       qty,
+		EntryTime:      open.time,
+		ExitTime:       t.Timestamp,
+		EntryPrice:     open.price,
+		ExitPrice:      t.Price,
+		Commission:     commission,
+		PnL:            pnl,
+		ReturnPct:      pnl / (open.price * qty),
+		HoldingSeconds: t.Timestamp.Sub(open.time).Seconds(),
+		MAE:            math.Min(mae, 0),
+		MFE:            math.Max(mfe, 0),
+	})
+}
+
+// Observe widens the price range seen by every open lot in symbol, which is
+// what MAE and MFE are measured against.
+func (l *Ledger) Observe(symbol string, bar marketdata.Bar) {
+	if bar.High <= 0 || bar.Low <= 0 {
+		return
+	}
+	for _, open := range l.open[symbol] {
+		open.high = math.Max(open.high, bar.High)
+		open.low = math.Min(open.low, bar.Low)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"sort"
 	"time"
 
 	"citadel/internal/broker"
@@ -15,36 +16,95 @@ import (
 	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata/stream"
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
-	"github.com/shopspring/decimal"
 )
 
 type LiveEngine struct {
 	Portfolio       *Portfolio
 	Strategy        Strategy
-	Broker          *broker.Client
+	StrategyID      string
+	Broker          broker.Broker
 	DB              *sqlx.DB
 	SessionID       string
 	Symbols         []string
 	StartingCapital float64
 	Parameters      string
 	RiskManager     RiskManager
-	latestPrices    map[string]float64
+
+	// Risk is the session's risk configuration as JSON, layered over its
+	// parameters' (see ParseRiskConfig). Empty means the parameters' alone.
+	Risk string
+
+	// Events, when set, receives what the engine does as it runs.
+	Events       *EventHub
+	latestPrices map[string]float64
+
+	// Timeframe is the resolution passed to the strategy's OnBar. The stream
+	// delivers minute bars, which are resampled when this is coarser. Zero
+	// means minute bars.
+	Timeframe  marketdata.TimeFrame
+	resamplers map[string]*broker.Resampler
+
+	// StartedBy is the user who started the session, for its audit trail.
+	StartedBy string
+
+	// Calendar decides when the market is open. Nil means the broker's.
+	Calendar broker.Calendar
+
+	// FlattenBeforeClose, when positive, closes the session's positions this
+	// long before each session's close; the strategy doesn't trade again
+	// until the next session. QueueOffHours holds orders the strategy submits
+	// outside regular hours until the next open instead of rejecting them.
+	// Both are set from the session's parameters.
+	FlattenBeforeClose time.Duration
+	QueueOffHours      bool
+
+	// Mode is ModeLive for sessions on the real market and ModeReplay for
+	// sessions replaying historical bars through a paper broker.
+	Mode string
+
+	// Discrepancies lists what Resume and ReconcileBroker found wrong with
+	// the session's state after a restart.
+	Discrepancies []Discrepancy
+
+	// Everything below belongs to the event loop; see run.
+	status            string                   // the session's status, e.g. StatusRunning
+	orders            map[string]*sessionOrder // orders this session placed, by broker ID
+	savedState        []byte                   // strategy state to restore after Initialize
+	barsSinceSnapshot int
+	logger            *slog.Logger
+	bars              *broker.Subscription[stream.Bar]
+	feed              *barFeed
+	slices            sliceFeed
+	finished          bool // finish has recorded the session's final status
+	clock             sessionClock
+	lastBar           time.Time     // timestamp of the latest bar
+	flattening        string        // date of the session being flattened for the close
+	queued            []OrderIntent // orders held for the next open
+
+	inbox  *inbox
+	cancel context.CancelFunc
+	done   chan struct{} // closed when the event loop exits
 }
 
+const (
+	ModeLive   = "live"
+	ModeReplay = "replay"
+)
+
 func NewLiveEngine(
 	db *sqlx.DB,
-	b *broker.Client,
+	b broker.Broker,
 	startingCash float64,
 	strategy Strategy,
 	symbols []string,
-	parameters map[string]interface{},
+	parameters Params,
 	rm RiskManager,
 ) *LiveEngine {
 	if rm == nil {
-		rm = NewDefaultRiskManager(0, 0)
+		rm = NewRuleRiskManager(RiskConfig{})
 	}
 	bParams, _ := json.Marshal(parameters)
-	return &LiveEngine{
+	e := &LiveEngine{
 		Portfolio:       NewPortfolio(startingCash),
 		Strategy:        strategy,
 		Broker:          b,
@@ -55,7 +115,20 @@ func NewLiveEngine(
 		Parameters:      string(bParams),
 		RiskManager:     rm,
 		latestPrices:    make(map[string]float64),
+		Mode:            ModeLive,
+		status:          StatusRunning,
+		orders:          make(map[string]*sessionOrder),
+		inbox:           newInbox(),
+		done:            make(chan struct{}),
 	}
+	e.setHours(parameters)
+	return e
+}
+
+// setHours applies the trading hours parameters.
+func (e *LiveEngine) setHours(params Params) {
+	e.FlattenBeforeClose = time.Duration(params.Int("flatten_minutes_before_close")) * time.Minute
+	e.QueueOffHours = params.Int("queue_off_hours_orders") == 1
 }
 
 // Ensure paper trading
@@ -78,58 +151,177 @@ func (e *LiveEngine) Start(ctx context.Context, logger *slog.Logger) error {
 		return err
 	}
 
+	if err := e.createSession(ctx); err != nil {
+		return err
+	}
+
+	ctx, e.cancel = context.WithCancel(ctx)
+	return e.startEngine(ctx, logger)
+}
+
+func (e *LiveEngine) createSession(ctx context.Context) error {
 	bSymbols, _ := json.Marshal(e.Symbols)
+	strategyID := e.StrategyID
+	if strategyID == "" {
+		strategyID = e.Strategy.Name()
+	}
+
 	session := &database.TradingSession{
 		SessionID:       e.SessionID,
-		Strategy:        e.Strategy.Name(),
-		Status:          "running",
+		Strategy:        strategyID,
+		Status:          e.status,
 		Symbols:         string(bSymbols),
 		StartingCapital: e.StartingCapital,
 		Parameters:      e.Parameters,
+		Timeframe:       e.timeframe().String(),
+		Mode:            e.Mode,
 		StartedAt:       time.Now(),
 	}
+	if e.Risk != "" {
+		session.RiskConfig = &e.Risk
+	}
 	if err := database.CreateTradingSession(ctx, e.DB, session); err != nil {
 		return err
 	}
-
-	return e.startEngine(ctx, logger)
+	return RecordSessionAudit(ctx, e.DB, e.SessionID, ActionStart, "", e.status, e.StartedBy, nil)
 }
 
+// Resume restarts a session recorded by Start. The portfolio is rebuilt from
+// the session's order history and checked against its last snapshot.
 func (e *LiveEngine) Resume(ctx context.Context, logger *slog.Logger) error {
 	if err := e.checkPaperTrading(); err != nil {
 		return err
 	}
 
-	return e.startEngine(ctx, logger)
+	if err := e.restore(ctx); err != nil {
+		return fmt.Errorf("failed to restore session state: %w", err)
+	}
+	for _, d := range e.Discrepancies {
+		logger.Warn("session state differs from its order history",
+			"session", e.SessionID, "source", d.Source, "symbol", d.Symbol,
+			"expected", d.Expected, "actual", d.Actual)
+	}
+	e.logger = logger
+	if err := e.saveSnapshot(ctx); err != nil {
+		return fmt.Errorf("failed to save session state: %w", err)
+	}
+	var detail interface{}
+	if len(e.Discrepancies) > 0 {
+		detail = map[string]interface{}{"discrepancies": e.Discrepancies}
+	}
+	err := RecordSessionAudit(ctx, e.DB, e.SessionID, ActionRestart, e.status, e.status, "", detail)
+	if err != nil {
+		logger.Error("failed to record session audit", "error", err, "session", e.SessionID)
+	}
+
+	ctx, e.cancel = context.WithCancel(ctx)
+	if err := e.startEngine(ctx, logger); err != nil {
+		return err
+	}
+	// A liquidation cut off by the restart carries on
+	e.do(func() { e.continueLiquidation(ctx) })
+	return nil
+}
+
+// StartReplay runs the engine as a session over historical minute bars
+// instead of the live market. The bars are published through a paper broker,
+// so orders take the same path as in a live session and are persisted the
+// same way. speed is passed to broker.Paper.Replay. The session is recorded
+// with ModeReplay and marked completed once the bars run out.
+func (e *LiveEngine) StartReplay(
+	ctx context.Context,
+	logger *slog.Logger,
+	bars map[string][]marketdata.Bar,
+	speed float64,
+) error {
+	paper := broker.NewPaper(e.StartingCapital)
+	e.Broker = paper
+	e.Mode = ModeReplay
+
+	if err := e.createSession(ctx); err != nil {
+		return err
+	}
+
+	ctx, e.cancel = context.WithCancel(ctx)
+	if err := e.startEngine(ctx, logger); err != nil {
+		// The event loop isn't running, so finish here
+		e.finish(context.WithoutCancel(ctx), ActionFail, StatusFailed, "")
+		return err
+	}
+
+	go func() {
+		err := paper.Replay(ctx, bars, speed)
+		switch {
+		case ctx.Err() != nil:
+			// Stopped or shut down before the end; the loop has recorded it
+		case err != nil:
+			logger.Error("replay failed", "error", err, "session", e.SessionID)
+			e.do(func() { e.finish(context.WithoutCancel(ctx), ActionFail, StatusFailed, "") })
+		default:
+			logger.Info("replay completed", "session", e.SessionID)
+			e.do(func() {
+				e.finish(context.WithoutCancel(ctx), ActionComplete, StatusCompleted, "")
+			})
+		}
+	}()
+	return nil
+}
+
+// Done is closed once the engine's event loop has exited: it was stopped or
+// shut down, or its replay has finished.
+func (e *LiveEngine) Done() <-chan struct{} {
+	return e.done
+}
+
+func (e *LiveEngine) timeframe() marketdata.TimeFrame {
+	if e.Timeframe.N == 0 {
+		return marketdata.OneMin
+	}
+	return e.Timeframe
+}
+
+// resample turns a streamed minute bar into the bars OnBar should see at the
+// engine's timeframe, which is none until a coarser bar completes.
+func (e *LiveEngine) resample(symbol string, bar marketdata.Bar) []marketdata.Bar {
+	tf := e.timeframe()
+	if tf == marketdata.OneMin {
+		return []marketdata.Bar{bar}
+	}
+
+	r, ok := e.resamplers[symbol]
+	if !ok {
+		r = broker.NewResampler(tf, time.Minute)
+		e.resamplers[symbol] = r
+	}
+	return r.Add(bar)
 }
 
 func (e *LiveEngine) startEngine(ctx context.Context, logger *slog.Logger) error {
+	var err error
+	if e.feed, err = newBarFeed(e.Strategy, e.timeframe()); err != nil {
+		return err
+	}
+	e.resamplers = make(map[string]*broker.Resampler)
+	e.logger = logger
+	if e.Calendar == nil {
+		e.Calendar = e.Broker.Calendar()
+	}
+	e.clock = sessionClock{cal: e.Calendar}
+
 	// Initialize Strategy
 	e.Strategy.Initialize(e.Portfolio)
+	e.restoreStrategy(logger)
 
-	// Subscribe to Market Data
-	err := e.Broker.Stream.SubscribeToBars(func(bar stream.Bar) {
-		logger.Info("received live bar", "symbol", bar.Symbol, "close", bar.Close)
-		e.latestPrices[bar.Symbol] = bar.Close
-
-		if err := e.RiskManager.EvaluatePortfolio(e.Portfolio, e.latestPrices); err != nil {
-			logger.Warn("Risk Halt", "error", err)
-			return // block new logic
-		}
+	go e.run(ctx)
 
-		e.Strategy.OnBar(bar.Symbol, marketdata.Bar{
-			Timestamp:  bar.Timestamp,
-			Open:       bar.Open,
-			High:       bar.High,
-			Low:        bar.Low,
-			Close:      bar.Close,
-			Volume:     bar.Volume,
-			TradeCount: bar.TradeCount,
-			VWAP:       bar.VWAP,
-		}, e.Portfolio)
-		e.processPendingOrders(ctx, logger)
+	// Subscribe to Market Data. The handler waits for the loop to take the
+	// bar, so a paper broker's Publish returns once the engine has acted on it
+	e.bars, err = e.Broker.SubscribeBars(func(sb stream.Bar) {
+		e.do(func() { e.handleBar(ctx, sb) })
 	}, e.Symbols...)
 	if err != nil {
+		e.cancel()
+		<-e.done
 		return err
 	}
 
@@ -137,9 +329,12 @@ func (e *LiveEngine) startEngine(ctx context.Context, logger *slog.Logger) error
 	go func() {
 		err := e.Broker.ConnectTradeUpdates(ctx, func(update alpaca.TradeUpdate) {
 			logger.Info("trade update", "event", update.Event, "order_id", update.Order.ID)
-			e.handleTradeUpdate(ctx, logger, update)
+			if !e.inbox.post(func() { e.handleTradeUpdate(ctx, logger, update) }) {
+				logger.Warn("trade update after the engine stopped",
+					"order_id", update.Order.ID, "session", e.SessionID)
+			}
 		})
-		if err != nil {
+		if err != nil && ctx.Err() == nil {
 			logger.Error("failed to connect trade updates", "error", err, "session", e.SessionID)
 		}
 	}()
@@ -148,73 +343,314 @@ func (e *LiveEngine) startEngine(ctx context.Context, logger *slog.Logger) error
 	return nil
 }
 
-func (e *LiveEngine) Stop(ctx context.Context) {
-	database.UpdateTradingSessionStatus(ctx, e.DB, e.SessionID, "stopped")
-	if e.Broker != nil && e.Broker.Stream != nil {
-		e.Broker.Stream.UnsubscribeFromBars(e.Symbols...)
+// handleBar marks the portfolio to a streamed minute bar and runs the
+// strategy on it.
+func (e *LiveEngine) handleBar(ctx context.Context, sb stream.Bar) {
+	if ctx.Err() != nil {
+		return // queued before the engine stopped
+	}
+	logger := e.logger
+	logger.Info("received live bar", "symbol", sb.Symbol, "close", sb.Close)
+	var equity *database.EquitySnapshot
+	defer func() {
+		if equity != nil {
+			if err := database.SaveEquitySnapshot(ctx, e.DB, equity); err != nil {
+				logger.Error("failed to save equity snapshot", "error", err)
+			}
+		}
+		e.barsSinceSnapshot++
+		if e.barsSinceSnapshot >= snapshotEvery {
+			if err := e.saveSnapshot(ctx); err != nil {
+				logger.Error("failed to save session state", "error", err)
+			}
+		}
+	}()
+
+	bar := marketdata.Bar{
+		Timestamp:  sb.Timestamp,
+		Open:       sb.Open,
+		High:       sb.High,
+		Low:        sb.Low,
+		Close:      sb.Close,
+		Volume:     sb.Volume,
+		TradeCount: sb.TradeCount,
+		VWAP:       sb.VWAP,
+	}
+	e.emit(EventBar, sb.Timestamp, sb.Symbol, bar)
+
+	e.latestPrices[sb.Symbol] = sb.Close
+	e.Portfolio.Mark(sb.Symbol, sb.Close)
+	if sb.Timestamp.After(e.lastBar) {
+		e.lastBar = sb.Timestamp
+	}
+	var logged bool
+	if logged, equity = e.recordEquity(sb.Timestamp); logged {
+		e.emit(EventEquity, sb.Timestamp, "", e.Portfolio.EquityLog[len(e.Portfolio.EquityLog)-1])
+	}
+
+	if session, ok := e.clock.advance(sb.Timestamp); ok {
+		openSession(session, e.Strategy, e.RiskManager)
+	}
+	if o, ok := e.RiskManager.(BarObserver); ok {
+		o.ObserveBar(sb.Symbol, bar)
+	}
+
+	if e.status == StatusLiquidating {
+		e.continueLiquidation(ctx)
+		return // the strategy is done with
+	}
+
+	closing := e.closing(sb.Timestamp)
+	if closing {
+		e.flattenForClose(ctx)
+	}
+
+	if err := e.RiskManager.EvaluatePortfolio(e.Portfolio, e.latestPrices); err != nil {
+		logger.Warn("Risk Halt", "error", err)
+		e.emit(EventRiskHalt, sb.Timestamp, "", map[string]string{
+			"reason":  RejectionReason(err),
+			"message": err.Error(),
+		})
+		return // block new logic
+	}
+
+	e.syncOpenOrders()
+	for _, b := range e.resample(sb.Symbol, bar) {
+		if e.slices.stale(b.Timestamp) {
+			// A symbol had no bar then, so the strategy goes without it
+			e.slices.deliver(e.Strategy, e.Portfolio)
+		}
+		e.Strategy.OnBar(sb.Symbol, b, e.Portfolio)
+		if e.feed != nil {
+			e.feed.dispatch(sb.Symbol, b, e.Portfolio)
+		}
+		e.slices.add(e.Strategy, sb.Symbol, b)
+	}
+	if len(e.slices.bars) == len(e.Symbols) {
+		e.slices.deliver(e.Strategy, e.Portfolio)
+	}
+	for _, symbol := range e.Portfolio.cancels {
+		e.cancelOrders(symbol)
+	}
+	e.Portfolio.cancels = nil
+	if e.status == StatusPaused || closing {
+		// The strategy keeps its indicators current but doesn't trade
+		e.Portfolio.PendingOrders = []OrderIntent{}
+		return
+	}
+	e.processPendingOrders(ctx, logger, sb.Timestamp)
+}
+
+// syncOpenOrders mirrors the session's unfilled broker orders, and those
+// held for the next open, onto the portfolio so the strategy can see them.
+func (e *LiveEngine) syncOpenOrders() {
+	ids := make([]string, 0, len(e.orders))
+	for id, o := range e.orders {
+		if o.open {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	open := make([]WorkingOrder, 0, len(ids)+len(e.queued))
+	for _, id := range ids {
+		o := e.orders[id]
+		open = append(open, WorkingOrder{OrderIntent: OrderIntent{
+			Symbol:   o.symbol,
+			Side:     o.side,
+			Type:     o.typ,
+			Quantity: o.qty - o.filled,
+		}})
+	}
+	for _, intent := range e.queued {
+		open = append(open, WorkingOrder{OrderIntent: intent})
 	}
+	e.Portfolio.OpenOrders = open
 }
 
-func (e *LiveEngine) processPendingOrders(ctx context.Context, logger *slog.Logger) {
-	if len(e.Portfolio.PendingOrders) == 0 {
+// Stop ends the session as stopped, on behalf of actor, and waits for the
+// event loop to exit.
+func (e *LiveEngine) Stop(ctx context.Context, actor string) {
+	e.do(func() {
+		if !e.finished {
+			e.finish(ctx, ActionStop, StatusStopped, actor)
+		}
+	})
+	<-e.done
+}
+
+// finish records the session's final state and status, releases its
+// subscriptions and ends the event loop. It runs on the loop; a finished
+// replay keeps its status when stopped later.
+func (e *LiveEngine) finish(ctx context.Context, action, status, actor string) {
+	e.finished = true
+	e.closeBars()
+	if err := e.saveSnapshot(ctx); err != nil {
+		e.logger.Error("failed to save session state", "error", err, "session", e.SessionID)
+	}
+	e.transition(ctx, action, status, actor, nil)
+	if e.cancel != nil {
+		e.cancel()
+	}
+}
+
+func (e *LiveEngine) processPendingOrders(
+	ctx context.Context,
+	logger *slog.Logger,
+	ts time.Time,
+) {
+	if len(e.Portfolio.PendingOrders) == 0 && len(e.queued) == 0 {
+		return
+	}
+	pending := e.Portfolio.PendingOrders
+	e.Portfolio.PendingOrders = []OrderIntent{}
+	for _, intent := range pending {
+		e.emit(EventSignal, ts, intent.Symbol, intent)
+	}
+
+	if !broker.IsOpen(e.Calendar, ts) {
+		for _, intent := range pending {
+			if e.QueueOffHours {
+				e.queued = append(e.queued, intent)
+				continue
+			}
+			logger.Warn("order rejected outside market hours", "symbol", intent.Symbol)
+			e.reject(ctx, ts, intent, RejectMarketClosed, ErrMarketClosed)
+		}
 		return
 	}
 
+	// Orders held since the last close go first, checked against the
+	// latest prices
+	pending = append(e.queued, pending...)
+	e.queued = nil
+
+	// Each order is checked as if those approved before it had filled, so
+	// entries submitted together can't together exceed a limit
 	var approvedOrders []OrderIntent
-	for _, intent := range e.Portfolio.PendingOrders {
-		approved, err := e.RiskManager.EvaluateOrder(intent, e.Portfolio, e.latestPrices)
+	unfilled := make(map[string]float64)
+	for _, intent := range pending {
+		if err := intent.Validate(); err != nil {
+			logger.Warn("invalid order", "symbol", intent.Symbol, "error", err)
+			e.reject(ctx, ts, intent, RejectInvalidOrder, err)
+			continue
+		}
+		approved, err := e.RiskManager.EvaluateOrder(
+			intent,
+			e.Portfolio.projected(unfilled, e.latestPrices),
+			e.latestPrices,
+		)
 		if err != nil {
 			logger.Warn("order rejected by risk manager", "symbol", intent.Symbol, "error", err)
+			e.reject(ctx, ts, intent, RejectionReason(err), err)
 			continue
 		}
 		approvedOrders = append(approvedOrders, approved)
+		if approved.Class() != ClassOCO {
+			unfilled[approved.Symbol] += approved.signedQuantity()
+		}
 	}
 
 	for _, intent := range approvedOrders {
-		req := alpaca.PlaceOrderRequest{
-			Symbol: intent.Symbol,
-			Qty: func(q float64) *decimal.Decimal { d := decimal.NewFromFloat(q); return &d }(
-				intent.Quantity,
-			),
-			Side:        alpaca.Side(intent.Side),
-			Type:        alpaca.OrderType(intent.Type),
-			TimeInForce: alpaca.Day,
-		}
+		e.placeOrder(ctx, ts, intent)
+	}
+}
 
-		if intent.LimitPrice != nil {
-			d := decimal.NewFromFloat(*intent.LimitPrice)
-			req.LimitPrice = &d
-		}
-		if intent.StopPrice != nil {
-			d := decimal.NewFromFloat(*intent.StopPrice)
-			req.StopPrice = &d
-		}
+// placeOrder sends intent to the broker for the session, within what its
+// sub-account holds, and records the order.
+func (e *LiveEngine) placeOrder(ctx context.Context, ts time.Time, intent OrderIntent) {
+	intent, err := e.checkSubAccount(intent)
+	if err != nil {
+		e.logger.Warn(
+			"order rejected",
+			"symbol",
+			intent.Symbol,
+			"error",
+			err,
+			"session",
+			e.SessionID,
+		)
+		e.reject(ctx, ts, intent, RejectSubAccount, err)
+		return
+	}
 
-		order, err := e.Broker.PlaceOrder(req)
-		if err != nil {
-			logger.Error("failed to place live order", "error", err, "symbol", intent.Symbol)
-			continue
-		}
+	req := NewOrderRequest(intent)
+	req.ClientOrderID = NewClientOrderID(e.SessionID)
 
-		// Persist to DB
-		dbOrder := &database.TradingOrder{
-			OrderID:   order.ID,
-			SessionID: e.SessionID,
-			Symbol:    order.Symbol,
-			Side:      string(order.Side),
-			Type:      string(order.Type),
-			Qty:       order.Qty.InexactFloat64(),
-			Status:    "new",
-			CreatedAt: order.CreatedAt,
-			UpdatedAt: order.UpdatedAt,
-		}
-		if err := database.InsertTradingOrder(ctx, e.DB, dbOrder); err != nil {
-			logger.Error("failed to save order to db", "error", err)
-		}
+	order, err := e.Broker.PlaceOrder(req)
+	if err != nil {
+		e.logger.Error("failed to place live order", "error", err, "symbol", intent.Symbol)
+		e.reject(ctx, ts, intent, RejectBroker, err)
+		return
+	}
+	e.emit(EventOrder, ts, intent.Symbol, map[string]interface{}{
+		"order_id":        order.ID,
+		"client_order_id": order.ClientOrderID,
+		"intent":          intent,
+	})
+	e.track(ctx, order, order.ID)
+	// The broker places an order's exits as orders of their own
+	for i := range order.Legs {
+		e.track(ctx, &order.Legs[i], order.ID)
 	}
+}
 
-	// Clear pending
-	e.Portfolio.PendingOrders = []OrderIntent{}
+// track records an order the session placed, or an exit of the order group.
+func (e *LiveEngine) track(ctx context.Context, order *alpaca.Order, group string) {
+	price := e.latestPrices[order.Symbol]
+	if order.LimitPrice != nil {
+		price = order.LimitPrice.InexactFloat64()
+	} else if order.StopPrice != nil {
+		price = order.StopPrice.InexactFloat64()
+	}
+	e.orders[order.ID] = &sessionOrder{
+		symbol: order.Symbol,
+		side:   TradeSide(order.Side),
+		typ:    OrderType(order.Type),
+		qty:    order.Qty.InexactFloat64(),
+		price:  price,
+		open:   true,
+		group:  group,
+		held:   order.Status == "held",
+	}
+
+	record := e.tradingOrder(order)
+	if group != order.ID {
+		record.ParentOrderID = &group
+		record.Status = order.Status
+	}
+	if err := database.InsertTradingOrder(ctx, e.DB, record); err != nil {
+		e.logger.Error("failed to save order to db", "error", err)
+	}
+}
+
+// reject reports and records an intent refused for reason before it reached
+// the broker, or by the broker.
+func (e *LiveEngine) reject(
+	ctx context.Context,
+	ts time.Time,
+	intent OrderIntent,
+	reason string,
+	err error,
+) {
+	e.emit(EventOrderRejected, ts, intent.Symbol, map[string]interface{}{
+		"intent":  intent,
+		"reason":  reason,
+		"message": err.Error(),
+	})
+	rejection := &database.OrderRejection{
+		SessionID: e.SessionID,
+		Symbol:    intent.Symbol,
+		Side:      string(intent.Side),
+		Type:      string(intent.Type),
+		Qty:       intent.Quantity,
+		Reason:    reason,
+		Message:   err.Error(),
+		CreatedAt: ts,
+	}
+	if err := database.InsertOrderRejection(ctx, e.DB, rejection); err != nil {
+		e.logger.Error("failed to save order rejection", "error", err, "session", e.SessionID)
+	}
 }
 
 func (e *LiveEngine) handleTradeUpdate(
@@ -236,8 +672,20 @@ func (e *LiveEngine) handleTradeUpdate(
 		logger.Error("failed to update order in db", "error", err)
 	}
 
-	// Log fills
-	if update.Event == "fill" || update.Event == "partial_fill" {
+	// Book fills into the session's portfolio
+	trade, adopted := e.applyUpdate(update)
+	if adopted {
+		order := update.Order
+		err := database.InsertTradingOrder(ctx, e.DB, e.tradingOrder(&order))
+		if err == nil {
+			err = database.UpdateTradingOrder(ctx, e.DB, orderID, filledQty, avgPrice, status)
+		}
+		if err != nil {
+			logger.Error("failed to save order to db", "error", err)
+		}
+	}
+	if trade != nil {
+		e.emit(EventFill, trade.Timestamp, trade.Symbol, trade)
 		logger.Info(
 			"order filled",
 			"symbol",
@@ -247,5 +695,29 @@ func (e *LiveEngine) handleTradeUpdate(
 			"price",
 			avgPrice,
 		)
+		if err := e.saveSnapshot(ctx); err != nil {
+			logger.Error("failed to save session state", "error", err)
+		}
+	}
+	e.continueLiquidation(ctx)
+	if e.flattening != "" && e.flattening == e.clock.date {
+		e.closeOut(ctx)
+	}
+}
+
+// tradingOrder is the database record of an order the session placed.
+func (e *LiveEngine) tradingOrder(order *alpaca.Order) *database.TradingOrder {
+	clientOrderID := order.ClientOrderID
+	return &database.TradingOrder{
+		OrderID:       order.ID,
+		SessionID:     e.SessionID,
+		ClientOrderID: &clientOrderID,
+		Symbol:        order.Symbol,
+		Side:          string(order.Side),
+		Type:          string(order.Type),
+		Qty:           order.Qty.InexactFloat64(),
+		Status:        "new",
+		CreatedAt:     order.CreatedAt,
+		UpdatedAt:     order.UpdatedAt,
 	}
 }
@@ -0,0 +1,442 @@
+package quant
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"citadel/internal/database"
+
+	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
+	"github.com/jmoiron/sqlx"
+)
+
+// Session statuses. A running session trades; a paused one keeps its feed,
+// its fills and its strategy's indicators up to date but drops the
+// strategy's orders; a liquidating one closes its positions and then stops.
+// The rest are final.
+const (
+	StatusRunning     = "running"
+	StatusPaused      = "paused"
+	StatusLiquidating = "liquidating"
+	StatusStopped     = "stopped"
+	StatusCompleted   = "completed"
+	StatusFailed      = "failed"
+)
+
+// Lifecycle actions recorded in a session's audit trail.
+const (
+	ActionStart            = "start"
+	ActionPause            = "pause"
+	ActionResume           = "resume"
+	ActionLiquidate        = "liquidate"
+	ActionLiquidated       = "liquidated"
+	ActionStop             = "stop"
+	ActionComplete         = "complete"
+	ActionFail             = "fail"
+	ActionUpdateParameters = "update_parameters"
+	ActionUpdateRisk       = "update_risk"
+	ActionRestart          = "restart"   // resumed by the server after a restart
+	ActionShutdown         = "shutdown"  // left running while the server shut down
+	ActionInterrupt        = "interrupt" // a replay cut off by a restart
+)
+
+// ErrInvalidTransition is returned for a lifecycle action the session's
+// status doesn't allow, such as pausing a paused session.
+var ErrInvalidTransition = errors.New("invalid session transition")
+
+// FinalStatus reports whether a session in status has ended.
+func FinalStatus(status string) bool {
+	switch status {
+	case StatusStopped, StatusCompleted, StatusFailed:
+		return true
+	}
+	return false
+}
+
+// StatusChange is the data of an EventStatus event.
+type StatusChange struct {
+	Status string `json:"status"`
+	Action string `json:"action"`
+}
+
+// RecordSessionAudit adds a transition to a session's audit trail. actor is
+// the user who asked for it, or "" for the server; detail, when not nil, is
+// stored as JSON.
+func RecordSessionAudit(
+	ctx context.Context,
+	db *sqlx.DB,
+	sessionID, action, from, to, actor string,
+	detail interface{},
+) error {
+	audit := &database.SessionAudit{
+		SessionID: sessionID,
+		Action:    action,
+		ToStatus:  to,
+	}
+	if from != "" {
+		audit.FromStatus = &from
+	}
+	if actor != "" {
+		audit.UserID = &actor
+	}
+	if detail != nil {
+		data, err := json.Marshal(detail)
+		if err != nil {
+			return err
+		}
+		str := string(data)
+		audit.Detail = &str
+	}
+	return database.InsertSessionAudit(ctx, db, audit)
+}
+
+// Status returns the session's current status.
+func (e *LiveEngine) Status() string {
+	var status string
+	e.do(func() { status = e.status })
+	return status
+}
+
+// transition moves the session to status because of action, recording both
+// in the session's audit trail and publishing the change. It runs on the
+// event loop.
+func (e *LiveEngine) transition(
+	ctx context.Context,
+	action, status, actor string,
+	detail interface{},
+) {
+	from := e.status
+	e.status = status
+
+	var err error
+	switch {
+	case FinalStatus(status):
+		err = database.UpdateTradingSessionStatus(ctx, e.DB, e.SessionID, status)
+	case status != from:
+		err = database.SetTradingSessionStatus(ctx, e.DB, e.SessionID, status)
+	}
+	if err != nil {
+		e.logger.Error("failed to update session status", "error", err, "session", e.SessionID)
+	}
+	if err := RecordSessionAudit(ctx, e.DB, e.SessionID, action, from, status, actor, detail); err != nil {
+		e.logger.Error("failed to record session audit", "error", err, "session", e.SessionID)
+	}
+	e.emit(EventStatus, time.Now(), "", StatusChange{Status: status, Action: action})
+}
+
+// Pause stops the strategy's orders from reaching the broker. Bars still
+// reach the strategy, so its indicators stay current, and open orders may
+// still fill.
+func (e *LiveEngine) Pause(ctx context.Context, actor string) error {
+	return e.lifecycle(func() error {
+		if e.status != StatusRunning {
+			return fmt.Errorf("%w: session is %s", ErrInvalidTransition, e.status)
+		}
+		e.transition(ctx, ActionPause, StatusPaused, actor, nil)
+		return nil
+	})
+}
+
+// Unpause lets a paused session's strategy trade again.
+func (e *LiveEngine) Unpause(ctx context.Context, actor string) error {
+	return e.lifecycle(func() error {
+		if e.status != StatusPaused {
+			return fmt.Errorf("%w: session is %s", ErrInvalidTransition, e.status)
+		}
+		e.transition(ctx, ActionResume, StatusRunning, actor, nil)
+		return nil
+	})
+}
+
+// Liquidate closes the session: its open orders are canceled, its positions
+// are closed with market orders, and once it is flat the session stops.
+func (e *LiveEngine) Liquidate(ctx context.Context, actor string) error {
+	return e.lifecycle(func() error {
+		if e.status != StatusRunning && e.status != StatusPaused {
+			return fmt.Errorf("%w: session is %s", ErrInvalidTransition, e.status)
+		}
+		e.transition(ctx, ActionLiquidate, StatusLiquidating, actor, nil)
+		e.cancelOrders("")
+		e.continueLiquidation(ctx)
+		return nil
+	})
+}
+
+// continueLiquidation moves a liquidating session towards flat and stops it
+// once it holds nothing. It runs on the event loop after every bar and order
+// update, so a fill that beat a cancel is closed out too.
+func (e *LiveEngine) continueLiquidation(ctx context.Context) {
+	if e.status != StatusLiquidating {
+		return
+	}
+	if e.closeOut(ctx) {
+		e.finish(ctx, ActionLiquidated, StatusStopped, "")
+	}
+}
+
+// cancelOrders asks the broker to cancel the session's open orders for
+// symbol, or all of them when symbol is empty. Canceling an order takes its
+// exits with it, and canceling an exit the others, so each group is
+// canceled once, through the order the exits belong to while it is open.
+func (e *LiveEngine) cancelOrders(symbol string) {
+	canceled := make(map[string]bool) // groups
+	cancel := func(id string) {
+		group := e.orders[id].group
+		canceled[group] = true
+		if err := e.Broker.CancelOrder(id); err != nil {
+			e.logger.Warn("failed to cancel order",
+				"error", err, "order_id", id, "session", e.SessionID)
+			return
+		}
+		for _, o := range e.orders {
+			if o.group == group && o.open {
+				o.canceling = true
+			}
+		}
+	}
+	wanted := func(o *sessionOrder) bool {
+		return o.open && !o.canceling && (symbol == "" || o.symbol == symbol)
+	}
+
+	for id, o := range e.orders {
+		if wanted(o) && o.group == id {
+			cancel(id)
+		}
+	}
+	for id, o := range e.orders {
+		if wanted(o) && !canceled[o.group] {
+			cancel(id)
+		}
+	}
+}
+
+// closeOut works the session towards flat: once none of its orders are open
+// it places market orders closing whatever it still holds, stamped with the
+// latest bar's time so a replay records them in its own timeline. It reports
+// whether the session is flat.
+func (e *LiveEngine) closeOut(ctx context.Context) bool {
+	for _, o := range e.orders {
+		if o.open {
+			return false // wait for cancels and exits to settle
+		}
+	}
+
+	ts := e.lastBar
+	if ts.IsZero() {
+		ts = time.Now() // no bar yet since the session started
+	}
+	flat := true
+	for symbol, qty := range e.Portfolio.Positions {
+		if math.Abs(qty) < 1e-9 {
+			continue
+		}
+		flat = false
+		intent := OrderIntent{
+			Symbol:   symbol,
+			Side:     Sell,
+			Type:     Market,
+			Quantity: math.Abs(qty),
+		}
+		if qty < 0 {
+			intent.Side = Buy
+		}
+		e.placeOrder(ctx, ts, intent)
+	}
+	return flat
+}
+
+// UpdateParameters applies new strategy and risk parameters to the running
+// session. raw is merged over the session's current parameters and
+// validated like a new session's. The strategy is rebuilt with them and
+// takes over the old one's state, so its indicators carry on where they
+// were; a lookback made longer fills in as new bars arrive. The resolved
+// parameters are returned.
+func (e *LiveEngine) UpdateParameters(
+	ctx context.Context,
+	raw map[string]interface{},
+	actor string,
+) (Params, error) {
+	var params Params
+	err := e.lifecycle(func() error {
+		if e.status != StatusRunning && e.status != StatusPaused {
+			return fmt.Errorf("%w: session is %s", ErrInvalidTransition, e.status)
+		}
+		var err error
+		params, err = e.updateParameters(ctx, raw, actor)
+		return err
+	})
+	return params, err
+}
+
+func (e *LiveEngine) updateParameters(
+	ctx context.Context,
+	raw map[string]interface{},
+	actor string,
+) (Params, error) {
+	spec, ok := LookupStrategy(e.StrategyID)
+	if !ok {
+		return nil, fmt.Errorf("unknown strategy %q", e.StrategyID)
+	}
+	old, ok := e.Strategy.(StatefulStrategy)
+	if !ok {
+		return nil, fmt.Errorf("strategy %s can't take new parameters while running", spec.ID)
+	}
+
+	merged := make(map[string]interface{})
+	if e.Parameters != "" {
+		if err := json.Unmarshal([]byte(e.Parameters), &merged); err != nil {
+			return nil, err
+		}
+	}
+	for name, v := range raw {
+		merged[name] = v
+	}
+	strategy, params, err := spec.Build(e.Symbols, merged)
+	if err != nil {
+		return nil, err
+	}
+	risk, err := ParseRiskConfig(params, []byte(e.Risk))
+	if err != nil {
+		return nil, err
+	}
+	next, ok := strategy.(StatefulStrategy)
+	if !ok {
+		return nil, fmt.Errorf("strategy %s can't take new parameters while running", spec.ID)
+	}
+	state, err := old.MarshalState()
+	if err != nil {
+		return nil, fmt.Errorf("failed to save strategy state: %w", err)
+	}
+	next.Initialize(e.Portfolio)
+	if err := next.UnmarshalState(state); err != nil {
+		return nil, fmt.Errorf("strategy state doesn't fit the new parameters: %w", err)
+	}
+
+	// Keep the feed, and the coarser bars it is building, unless the
+	// strategy now wants different timeframes
+	if !sameTimeframes(e.Strategy, strategy) {
+		if e.feed, err = newBarFeed(strategy, e.timeframe()); err != nil {
+			return nil, err
+		}
+	}
+
+	previous := e.Parameters
+	if previous == "" {
+		previous = "null"
+	}
+	bParams, _ := json.Marshal(params)
+	e.Strategy = strategy
+	e.Parameters = string(bParams)
+	if rm, ok := e.RiskManager.(*RuleRiskManager); ok {
+		// In place, so a triggered halt and the equity peak survive
+		rm.Configure(risk)
+	}
+	e.setHours(params)
+
+	if err := database.UpdateTradingSessionParameters(ctx, e.DB, e.SessionID, e.Parameters); err != nil {
+		e.logger.Error("failed to save session parameters", "error", err, "session", e.SessionID)
+	}
+	e.transition(ctx, ActionUpdateParameters, e.status, actor, map[string]json.RawMessage{
+		"from": json.RawMessage(previous),
+		"to":   json.RawMessage(e.Parameters),
+	})
+	if err := e.saveSnapshot(ctx); err != nil {
+		e.logger.Error("failed to save session state", "error", err, "session", e.SessionID)
+	}
+	return params, nil
+}
+
+// UpdateRisk changes the session's risk configuration. raw holds the
+// RiskConfig fields to change, merged over the session's configuration,
+// such as {"kill_switch": true} to stop new entries at once. The rules keep
+// what they have tracked. The resulting configuration is returned.
+func (e *LiveEngine) UpdateRisk(
+	ctx context.Context,
+	raw map[string]json.RawMessage,
+	actor string,
+) (RiskConfig, error) {
+	var cfg RiskConfig
+	err := e.lifecycle(func() error {
+		rm, ok := e.RiskManager.(*RuleRiskManager)
+		if !ok {
+			return fmt.Errorf("session's risk manager can't be reconfigured")
+		}
+
+		merged := make(map[string]json.RawMessage)
+		if e.Risk != "" {
+			if err := json.Unmarshal([]byte(e.Risk), &merged); err != nil {
+				return err
+			}
+		}
+		for name, v := range raw {
+			merged[name] = v
+		}
+		risk, _ := json.Marshal(merged)
+
+		var params Params
+		if err := json.Unmarshal([]byte(e.Parameters), &params); err != nil {
+			return err
+		}
+		var err error
+		if cfg, err = ParseRiskConfig(params, risk); err != nil {
+			return err
+		}
+
+		previous := e.Risk
+		if previous == "" {
+			previous = "null"
+		}
+		e.Risk = string(risk)
+		rm.Configure(cfg)
+		if err := database.UpdateTradingSessionRiskConfig(ctx, e.DB, e.SessionID, e.Risk); err != nil {
+			e.logger.Error(
+				"failed to save session risk config",
+				"error",
+				err,
+				"session",
+				e.SessionID,
+			)
+		}
+		e.transition(ctx, ActionUpdateRisk, e.status, actor, map[string]json.RawMessage{
+			"from": json.RawMessage(previous),
+			"to":   json.RawMessage(e.Risk),
+		})
+		return nil
+	})
+	return cfg, err
+}
+
+// lifecycle runs fn on the event loop, failing if the engine has stopped.
+func (e *LiveEngine) lifecycle(fn func() error) error {
+	err := ErrEngineNotFound
+	e.do(func() {
+		if e.finished {
+			return
+		}
+		err = fn()
+	})
+	return err
+}
+
+func sameTimeframes(a, b Strategy) bool {
+	var af, bf []marketdata.TimeFrame
+	if m, ok := a.(MultiTimeframeStrategy); ok {
+		af = m.Timeframes()
+	}
+	if m, ok := b.(MultiTimeframeStrategy); ok {
+		bf = m.Timeframes()
+	}
+	if len(af) != len(bf) {
+		return false
+	}
+	for i := range af {
+		if af[i] != bf[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,144 @@
+package quant
+
+import (
+	"context"
+	"sync"
+)
+
+// A live engine's portfolio, strategy and orders belong to its event loop.
+// Bars, trade updates and commands such as Stop are posted to the engine's
+// inbox and run on the loop one at a time, in the order they arrived, so
+// nothing else needs to lock the session's state.
+
+// inbox is an unbounded queue of work for an event loop. Posting never
+// blocks, so work can be posted from the loop itself, as the paper broker
+// does when it reports an order from PlaceOrder.
+type inbox struct {
+	mu     sync.Mutex
+	queue  []func()
+	ready  chan struct{}
+	closed bool
+}
+
+func newInbox() *inbox {
+	return &inbox{ready: make(chan struct{}, 1)}
+}
+
+// post queues fn, returning false once the inbox is closed.
+func (q *inbox) post(fn func()) bool {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return false
+	}
+	q.queue = append(q.queue, fn)
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// take returns the queued work and empties the queue.
+func (q *inbox) take() []func() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	queued := q.queue
+	q.queue = nil
+	return queued
+}
+
+// close refuses further work and returns what was still queued.
+func (q *inbox) close() []func() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	queued := q.queue
+	q.queue = nil
+	return queued
+}
+
+// run is the engine's event loop. It runs posted work until ctx ends, then
+// runs what is left, so no caller of do is stranded, and flushes the
+// session's state unless finish already recorded it.
+func (e *LiveEngine) run(ctx context.Context) {
+	defer close(e.done)
+	for {
+		select {
+		case <-e.inbox.ready:
+			for _, fn := range e.inbox.take() {
+				fn()
+			}
+		case <-ctx.Done():
+			for _, fn := range e.inbox.close() {
+				fn()
+			}
+			if !e.finished {
+				e.flush(context.WithoutCancel(ctx))
+			}
+			return
+		}
+	}
+}
+
+// do runs fn on the event loop and waits for it. Once the loop has exited,
+// fn runs on the caller's goroutine instead, as nothing else touches the
+// engine's state by then.
+func (e *LiveEngine) do(fn func()) {
+	ran := make(chan struct{})
+	if e.inbox.post(func() {
+		defer close(ran)
+		fn()
+	}) {
+		<-ran
+		return
+	}
+	<-e.done
+	fn()
+}
+
+// flush saves the session's state and releases its market data without
+// ending the session, which stays running to be resumed on the next start.
+func (e *LiveEngine) flush(ctx context.Context) {
+	e.closeBars()
+	if err := e.saveSnapshot(ctx); err != nil {
+		e.logger.Error("failed to save session state", "error", err, "session", e.SessionID)
+		return
+	}
+	err := RecordSessionAudit(ctx, e.DB, e.SessionID, ActionShutdown, e.status, e.status, "", nil)
+	if err != nil {
+		e.logger.Error("failed to record session audit", "error", err, "session", e.SessionID)
+	}
+	e.logger.Info("live engine shut down", "session", e.SessionID)
+}
+
+// closeBars ends the engine's bar subscription, reporting any bars the
+// engine fell too far behind to receive.
+func (e *LiveEngine) closeBars() {
+	if e.bars == nil {
+		return
+	}
+	e.bars.Close()
+	if dropped := e.bars.Dropped(); dropped > 0 {
+		e.logger.Warn("session fell behind and dropped bars",
+			"dropped", dropped, "session", e.SessionID)
+	}
+}
+
+// Shutdown stops the engine without ending its session: the loop finishes
+// what it was given, the session's state is flushed, and the session stays
+// running so that it resumes on the next start. It waits for the loop to
+// exit or ctx to end.
+func (e *LiveEngine) Shutdown(ctx context.Context) error {
+	if e.cancel != nil {
+		e.cancel()
+	}
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,350 @@
+package quant
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sort"
+	"sync"
+
+	"citadel/internal/broker"
+	"citadel/internal/database"
+
+	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	ErrEngineNotFound = errors.New("session not found or already stopped")
+	ErrShuttingDown   = errors.New("live engines are shutting down")
+)
+
+// EngineManager runs the server's live engines and tracks them by session.
+// Engines it starts outlive the request that started them; Shutdown stops
+// them all with their state flushed, leaving their sessions to resume.
+type EngineManager struct {
+	DB *sqlx.DB
+
+	// Events receives the events of every engine the manager runs.
+	Events *EventHub
+
+	mu      sync.RWMutex
+	engines map[string]*LiveEngine
+	closed  bool
+}
+
+func NewEngineManager(db *sqlx.DB) *EngineManager {
+	return &EngineManager{
+		DB:      db,
+		Events:  NewEventHub(),
+		engines: make(map[string]*LiveEngine),
+	}
+}
+
+// Start starts e as a new live session.
+func (m *EngineManager) Start(ctx context.Context, logger *slog.Logger, e *LiveEngine) error {
+	if m.isClosed() {
+		return ErrShuttingDown
+	}
+	e.Events = m.Events
+	if err := e.Start(context.WithoutCancel(ctx), logger); err != nil {
+		return err
+	}
+	return m.add(e)
+}
+
+// StartReplay starts e as a session replaying bars; see
+// LiveEngine.StartReplay. The manager forgets it once the replay ends.
+func (m *EngineManager) StartReplay(
+	ctx context.Context,
+	logger *slog.Logger,
+	e *LiveEngine,
+	bars map[string][]marketdata.Bar,
+	speed float64,
+) error {
+	if m.isClosed() {
+		return ErrShuttingDown
+	}
+	e.Events = m.Events
+	if err := e.StartReplay(context.WithoutCancel(ctx), logger, bars, speed); err != nil {
+		return err
+	}
+	return m.add(e)
+}
+
+// Get returns the running engine of a session.
+func (m *EngineManager) Get(sessionID string) (*LiveEngine, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	e, ok := m.engines[sessionID]
+	return e, ok
+}
+
+// List returns the running engines ordered by session ID.
+func (m *EngineManager) List() []*LiveEngine {
+	m.mu.RLock()
+	engines := make([]*LiveEngine, 0, len(m.engines))
+	for _, e := range m.engines {
+		engines = append(engines, e)
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(engines, func(i, j int) bool {
+		return engines[i].SessionID < engines[j].SessionID
+	})
+	return engines
+}
+
+// Stop ends a running session as stopped on behalf of actor, the user
+// asking for it.
+func (m *EngineManager) Stop(ctx context.Context, sessionID, actor string) error {
+	e, ok := m.Get(sessionID)
+	if !ok {
+		return ErrEngineNotFound
+	}
+	e.Stop(ctx, actor)
+	m.remove(e)
+	return nil
+}
+
+// Pause pauses a running session; see LiveEngine.Pause.
+func (m *EngineManager) Pause(ctx context.Context, sessionID, actor string) error {
+	e, ok := m.Get(sessionID)
+	if !ok {
+		return ErrEngineNotFound
+	}
+	return e.Pause(ctx, actor)
+}
+
+// Unpause lets a paused session trade again.
+func (m *EngineManager) Unpause(ctx context.Context, sessionID, actor string) error {
+	e, ok := m.Get(sessionID)
+	if !ok {
+		return ErrEngineNotFound
+	}
+	return e.Unpause(ctx, actor)
+}
+
+// Liquidate closes out a session and stops it; see LiveEngine.Liquidate.
+func (m *EngineManager) Liquidate(ctx context.Context, sessionID, actor string) error {
+	e, ok := m.Get(sessionID)
+	if !ok {
+		return ErrEngineNotFound
+	}
+	return e.Liquidate(ctx, actor)
+}
+
+// UpdateParameters applies new parameters to a session; see
+// LiveEngine.UpdateParameters.
+func (m *EngineManager) UpdateParameters(
+	ctx context.Context,
+	sessionID string,
+	raw map[string]interface{},
+	actor string,
+) (Params, error) {
+	e, ok := m.Get(sessionID)
+	if !ok {
+		return nil, ErrEngineNotFound
+	}
+	return e.UpdateParameters(ctx, raw, actor)
+}
+
+// UpdateRisk changes a session's risk configuration; see
+// LiveEngine.UpdateRisk.
+func (m *EngineManager) UpdateRisk(
+	ctx context.Context,
+	sessionID string,
+	raw map[string]json.RawMessage,
+	actor string,
+) (RiskConfig, error) {
+	e, ok := m.Get(sessionID)
+	if !ok {
+		return RiskConfig{}, ErrEngineNotFound
+	}
+	return e.UpdateRisk(ctx, raw, actor)
+}
+
+// Shutdown stops every engine without ending its session, flushing each
+// session's state, and refuses new ones. It returns once all the engines
+// have stopped or ctx ends, whichever is first.
+func (m *EngineManager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	m.closed = true
+	m.mu.Unlock()
+
+	engines := m.List()
+	errs := make([]error, len(engines))
+	var wg sync.WaitGroup
+	for i, e := range engines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if errs[i] = e.Shutdown(ctx); errs[i] == nil {
+				m.remove(e)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Resume restarts the live sessions left running, paused or liquidating by a
+// previous server, such as one that crashed or was shut down, with broker b,
+// then reconciles them with the broker's positions. Each carries on in the
+// status it had. Replay sessions can't resume and are marked stopped. The
+// resumed engines run until ctx ends or they are stopped.
+func (m *EngineManager) Resume(ctx context.Context, logger *slog.Logger, b broker.Broker) {
+	sessions, err := database.ListTradingSessions(ctx, m.DB)
+	if err != nil {
+		logger.Error("failed to list trading sessions for resume", "error", err)
+		return
+	}
+
+	var resumed []*LiveEngine
+	for _, session := range sessions {
+		if FinalStatus(session.Status) {
+			continue
+		}
+		if _, ok := m.Get(session.SessionID); ok {
+			continue // already running here
+		}
+
+		// A replay's paper broker lived in memory, so there is nothing to resume
+		if session.Mode == ModeReplay {
+			logger.Warn("stopping interrupted replay session", "session", session.SessionID)
+			database.UpdateTradingSessionStatus(ctx, m.DB, session.SessionID, StatusStopped)
+			err := RecordSessionAudit(ctx, m.DB, session.SessionID, ActionInterrupt,
+				session.Status, StatusStopped, "", nil)
+			if err != nil {
+				logger.Error(
+					"failed to record session audit",
+					"error",
+					err,
+					"session",
+					session.SessionID,
+				)
+			}
+			continue
+		}
+
+		e, err := m.rebuild(b, &session)
+		if err != nil {
+			logger.Error("failed to rebuild session", "error", err, "session", session.SessionID)
+			continue
+		}
+
+		if m.isClosed() {
+			return
+		}
+		e.Events = m.Events
+		if err := e.Resume(ctx, logger); err != nil {
+			logger.Error("failed to resume live engine", "error", err, "session", session.SessionID)
+			continue
+		}
+		if err := m.add(e); err != nil {
+			return
+		}
+		resumed = append(resumed, e)
+
+		logger.Info("successfully resumed live engine", "session", session.SessionID)
+	}
+
+	if len(resumed) == 0 {
+		return
+	}
+	if err := ReconcileBroker(ctx, m.DB, b, resumed); err != nil {
+		logger.Error("failed to reconcile sessions with broker positions", "error", err)
+		return
+	}
+	for _, e := range resumed {
+		for _, d := range e.Discrepancies {
+			if d.Source != "broker" {
+				continue
+			}
+			logger.Warn("broker position differs from session positions",
+				"session", e.SessionID, "symbol", d.Symbol,
+				"expected", d.Expected, "actual", d.Actual)
+		}
+	}
+}
+
+// rebuild builds an engine for a recorded session from its strategy,
+// symbols, parameters and timeframe.
+func (m *EngineManager) rebuild(
+	b broker.Broker,
+	session *database.TradingSession,
+) (*LiveEngine, error) {
+	var symbols []string
+	if err := json.Unmarshal([]byte(session.Symbols), &symbols); err != nil {
+		return nil, err
+	}
+
+	var params map[string]interface{}
+	if session.Parameters != "" {
+		if err := json.Unmarshal([]byte(session.Parameters), &params); err != nil {
+			return nil, err
+		}
+	}
+
+	spec, ok := LookupStrategy(session.Strategy)
+	if !ok {
+		return nil, errors.New("unknown strategy " + session.Strategy)
+	}
+
+	strategy, resolved, err := spec.Build(symbols, params)
+	if err != nil {
+		return nil, err
+	}
+
+	var risk []byte
+	if session.RiskConfig != nil {
+		risk = []byte(*session.RiskConfig)
+	}
+	rm, err := NewRiskManager(resolved, risk)
+	if err != nil {
+		return nil, err
+	}
+	e := NewLiveEngine(m.DB, b, session.StartingCapital, strategy, symbols, resolved, rm)
+	e.Risk = string(risk)
+	e.StrategyID = spec.ID
+	e.SessionID = session.SessionID
+	e.status = session.Status
+	if tf, err := broker.ParseTimeFrame(session.Timeframe); err == nil {
+		e.Timeframe = tf
+	}
+	return e, nil
+}
+
+// add tracks a started engine until its event loop exits. An engine started
+// while the manager shut down is shut down too.
+func (m *EngineManager) add(e *LiveEngine) error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		e.Shutdown(context.Background())
+		return ErrShuttingDown
+	}
+	m.engines[e.SessionID] = e
+	m.mu.Unlock()
+
+	go func() {
+		<-e.Done()
+		m.remove(e)
+	}()
+	return nil
+}
+
+func (m *EngineManager) remove(e *LiveEngine) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.engines[e.SessionID] == e {
+		delete(m.engines, e.SessionID)
+	}
+}
+
+func (m *EngineManager) isClosed() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.closed
+}
@@ -0,0 +1,430 @@
+package quant
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"time"
+
+	"citadel/internal/broker"
+	"citadel/internal/database"
+
+	"github.com/alpacahq/alpaca-trade-api-go/v3/alpaca"
+	"github.com/jmoiron/sqlx"
+)
+
+// snapshotEvery is how many bars a live session handles between snapshots
+// of its state. Fills and stops always snapshot.
+const snapshotEvery = 30
+
+// Discrepancy is a difference between what a session's order history says it
+// holds and what another record says. Source is "snapshot" for the session's
+// last saved state and "broker" for the brokerage account. An empty Symbol
+// means cash.
+type Discrepancy struct {
+	Source   string  `json:"source"`
+	Symbol   string  `json:"symbol"`
+	Expected float64 `json:"expected"`
+	Actual   float64 `json:"actual"`
+}
+
+// sessionOrder is an order a session placed: what it asked for, whether it
+// can still fill, and how much of its fills the session has booked.
+type sessionOrder struct {
+	symbol string
+	side   TradeSide
+	typ    OrderType
+	qty    float64
+	price  float64 // limit or last price when placed, for reserving cash
+	filled float64
+	cost   float64
+	open   bool
+
+	// group is the ID of the order this is an exit of, or else its own. An
+	// order's exits are canceled with it and cancel each other.
+	group     string
+	held      bool // an exit waiting for its entry to fill
+	canceling bool // asked to be canceled, awaiting the broker
+}
+
+// orderClosed reports whether an order in status can no longer fill.
+func orderClosed(status string) bool {
+	switch status {
+	case "filled", "canceled", "expired", "rejected", "done_for_day", "replaced":
+		return true
+	}
+	return false
+}
+
+// applyUpdate records update against the session's order and books the part
+// of any fill not yet booked, returning the trade booked if there was one.
+// Updates are attributed by order ID or, for an order placed but not recorded
+// before a restart, by its client order ID, in which case adopted is true.
+// Updates for other sessions' orders are ignored.
+func (e *LiveEngine) applyUpdate(update alpaca.TradeUpdate) (trade *Trade, adopted bool) {
+	o, ok := e.orders[update.Order.ID]
+	if !ok {
+		if SessionFromClientOrderID(update.Order.ClientOrderID) != e.SessionID {
+			return nil, false
+		}
+		o = &sessionOrder{
+			symbol: update.Order.Symbol,
+			side:   TradeSide(update.Order.Side),
+			typ:    OrderType(update.Order.Type),
+			group:  update.Order.ID,
+		}
+		if update.Order.Qty != nil {
+			o.qty = update.Order.Qty.InexactFloat64()
+		}
+		e.orders[update.Order.ID] = o
+		adopted = true
+	}
+	o.open = !orderClosed(string(update.Order.Status))
+	o.held = update.Order.Status == "held"
+
+	if update.Order.FilledAvgPrice == nil {
+		return nil, adopted
+	}
+	filledQty := update.Order.FilledQty.InexactFloat64()
+	qty := filledQty - o.filled
+	if qty <= 1e-9 {
+		return nil, adopted // already booked, e.g. a repeated event
+	}
+
+	// The order reports the average over all its fills, so back out the
+	// price of this one from what was booked before
+	cost := update.Order.FilledAvgPrice.InexactFloat64() * filledQty
+	price := (cost - o.cost) / qty
+
+	ts := update.At
+	if update.Timestamp != nil {
+		ts = *update.Timestamp
+	}
+	trade = &Trade{
+		Timestamp: ts,
+		Symbol:    o.symbol,
+		Side:      o.side,
+		Quantity:  qty,
+		Price:     price,
+	}
+	e.Portfolio.bookFill(*trade)
+	o.filled, o.cost = filledQty, cost
+	return trade, adopted
+}
+
+// recordEquity logs the session's equity at ts, marked to the latest prices.
+// Like a backtest it keeps one point per timestamp, so bars for other symbols
+// at the same time update it. It reports whether ts was logged, which it
+// isn't for a bar older than the last one, and returns the previous point
+// once ts has moved past it, as that point is final and can be persisted.
+func (e *LiveEngine) recordEquity(ts time.Time) (logged bool, done *database.EquitySnapshot) {
+	equity := e.Portfolio.CalculateEquity(e.latestPrices)
+	log := e.Portfolio.EquityLog
+	switch n := len(log); {
+	case n > 0 && log[n-1].Timestamp.Equal(ts):
+		log[n-1].Equity = equity
+	case n > 0 && ts.Before(log[n-1].Timestamp):
+		return false, nil
+	default:
+		e.Portfolio.EquityLog = append(log, EquitySnapshot{Timestamp: ts, Equity: equity})
+		if n > 0 {
+			done = e.equitySnapshot(log[n-1])
+		}
+	}
+	return true, done
+}
+
+// equitySnapshot is the database record of one point of the equity log.
+func (e *LiveEngine) equitySnapshot(point EquitySnapshot) *database.EquitySnapshot {
+	return &database.EquitySnapshot{
+		SessionID: e.SessionID,
+		Timestamp: point.Timestamp,
+		Equity:    point.Equity,
+	}
+}
+
+// saveSnapshot writes the session's cash, positions and strategy state.
+func (e *LiveEngine) saveSnapshot(ctx context.Context) error {
+	state := &database.SessionState{
+		SessionID: e.SessionID,
+		Cash:      e.Portfolio.Cash,
+		UpdatedAt: time.Now(),
+	}
+
+	strategyState := e.savedState
+	if strategyState == nil {
+		if s, ok := e.Strategy.(StatefulStrategy); ok {
+			var err error
+			if strategyState, err = s.MarshalState(); err != nil {
+				return fmt.Errorf("failed to save strategy state: %w", err)
+			}
+		}
+	}
+	if strategyState != nil {
+		str := string(strategyState)
+		state.StrategyState = &str
+	}
+
+	var positions []database.SessionPosition
+	for symbol, qty := range e.Portfolio.Positions {
+		if qty == 0 {
+			continue
+		}
+		positions = append(positions, database.SessionPosition{
+			Symbol:   symbol,
+			Qty:      qty,
+			AvgPrice: e.Portfolio.Ledger.AvgEntryPrice(symbol),
+		})
+	}
+	e.barsSinceSnapshot = 0
+
+	if err := database.SaveSessionState(ctx, e.DB, state, positions); err != nil {
+		return err
+	}
+	// The latest equity point is still open to updates, so it is saved with
+	// the state; it is saved again once a later bar closes it
+	if n := len(e.Portfolio.EquityLog); n > 0 {
+		return database.SaveEquitySnapshot(ctx, e.DB, e.equitySnapshot(e.Portfolio.EquityLog[n-1]))
+	}
+	return nil
+}
+
+// restore rebuilds the portfolio by replaying the fills in the session's
+// order history and reloads its equity curve, then compares the result with
+// the last snapshot. The snapshot's strategy state is kept for
+// restoreStrategy.
+func (e *LiveEngine) restore(ctx context.Context) error {
+	orders, err := database.GetTradingSessionOrders(ctx, e.DB, e.SessionID)
+	if err != nil {
+		return err
+	}
+	e.Portfolio, e.orders = replayOrders(e.StartingCapital, orders)
+	if e.Portfolio.EquityLog, err = loadEquityLog(ctx, e.DB, e.SessionID); err != nil {
+		return err
+	}
+
+	e.Discrepancies = nil
+	state, err := database.GetSessionState(ctx, e.DB, e.SessionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil // never snapshotted, e.g. stopped before its first bar
+	}
+	if err != nil {
+		return err
+	}
+	if state.StrategyState != nil {
+		e.savedState = []byte(*state.StrategyState)
+	}
+
+	if math.Abs(state.Cash-e.Portfolio.Cash) > 0.01 {
+		e.Discrepancies = append(e.Discrepancies, Discrepancy{
+			Source:   "snapshot",
+			Expected: e.Portfolio.Cash,
+			Actual:   state.Cash,
+		})
+	}
+
+	positions, err := database.GetSessionPositions(ctx, e.DB, e.SessionID)
+	if err != nil {
+		return err
+	}
+	snapshot := make(map[string]float64, len(positions))
+	for _, p := range positions {
+		snapshot[p.Symbol] = p.Qty
+	}
+	e.Discrepancies = append(
+		e.Discrepancies,
+		comparePositions("snapshot", e.Portfolio.Positions, snapshot)...)
+	return nil
+}
+
+// restoreStrategy hands the saved strategy state, if any, to a freshly
+// initialized strategy. A strategy that can't take it starts cold.
+func (e *LiveEngine) restoreStrategy(logger *slog.Logger) {
+	state := e.savedState
+	e.savedState = nil
+	s, ok := e.Strategy.(StatefulStrategy)
+	if state == nil || !ok {
+		return
+	}
+	if err := s.UnmarshalState(state); err != nil {
+		logger.Warn("failed to restore strategy state, starting fresh",
+			"error", err, "session", e.SessionID)
+		e.Strategy.Initialize(e.Portfolio)
+	}
+}
+
+// LoadPerformance rebuilds a session's portfolio from its orders and equity
+// snapshots and calculates its metrics, the same Metrics a backtest reports.
+func LoadPerformance(
+	ctx context.Context,
+	db *sqlx.DB,
+	session *database.TradingSession,
+) (*Portfolio, error) {
+	orders, err := database.GetTradingSessionOrders(ctx, db, session.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	p, _ := replayOrders(session.StartingCapital, orders)
+	if p.EquityLog, err = loadEquityLog(ctx, db, session.SessionID); err != nil {
+		return nil, err
+	}
+	p.CalculateMetrics()
+	return p, nil
+}
+
+func loadEquityLog(ctx context.Context, db *sqlx.DB, sessionID string) ([]EquitySnapshot, error) {
+	snapshots, err := database.GetEquitySnapshots(ctx, db, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	log := make([]EquitySnapshot, len(snapshots))
+	for i, s := range snapshots {
+		log[i] = EquitySnapshot{Timestamp: s.Timestamp, Equity: s.Equity}
+	}
+	return log, nil
+}
+
+// replayOrders rebuilds a session's portfolio from its order history by
+// booking each order's fills in the order they were placed.
+func replayOrders(
+	startingCapital float64,
+	orders []database.TradingOrder,
+) (*Portfolio, map[string]*sessionOrder) {
+	sort.SliceStable(orders, func(i, j int) bool {
+		return orders[i].CreatedAt.Before(orders[j].CreatedAt)
+	})
+
+	p := NewPortfolio(startingCapital)
+	tracked := make(map[string]*sessionOrder, len(orders))
+	for _, o := range orders {
+		so := &sessionOrder{
+			symbol: o.Symbol,
+			side:   TradeSide(o.Side),
+			typ:    OrderType(o.Type),
+			qty:    o.Qty,
+			open:   !orderClosed(o.Status),
+			group:  o.OrderID,
+			held:   o.Status == "held",
+		}
+		if o.ParentOrderID != nil {
+			so.group = *o.ParentOrderID
+		}
+		tracked[o.OrderID] = so
+		if o.FilledQty <= 0 || o.AvgPrice == nil {
+			continue
+		}
+		p.bookFill(Trade{
+			Timestamp: o.UpdatedAt,
+			Symbol:    o.Symbol,
+			Side:      TradeSide(o.Side),
+			Quantity:  o.FilledQty,
+			Price:     *o.AvgPrice,
+		})
+		so.filled, so.cost = o.FilledQty, o.FilledQty**o.AvgPrice
+	}
+	return p, tracked
+}
+
+// comparePositions lists the symbols whose quantities differ between
+// expected and actual.
+func comparePositions(source string, expected, actual map[string]float64) []Discrepancy {
+	symbols := make(map[string]bool)
+	for symbol := range expected {
+		symbols[symbol] = true
+	}
+	for symbol := range actual {
+		symbols[symbol] = true
+	}
+
+	var out []Discrepancy
+	for symbol := range symbols {
+		if math.Abs(expected[symbol]-actual[symbol]) > 1e-6 {
+			out = append(out, Discrepancy{
+				Source:   source,
+				Symbol:   symbol,
+				Expected: expected[symbol],
+				Actual:   actual[symbol],
+			})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Symbol < out[j].Symbol })
+	return out
+}
+
+// ReconcileBroker compares the positions held by the broker account with
+// the sum of what the sessions trading it believe they hold: the resumed
+// engines plus the last snapshot of every other live session. A mismatched
+// symbol is added to the discrepancies of each engine trading it, and each
+// engine's discrepancies are saved with its state.
+func ReconcileBroker(
+	ctx context.Context,
+	db *sqlx.DB,
+	b broker.Broker,
+	engines []*LiveEngine,
+) error {
+	positions, err := b.GetPositions()
+	if err != nil {
+		return err
+	}
+	actual := make(map[string]float64, len(positions))
+	for _, p := range positions {
+		actual[p.Symbol] = p.Qty.InexactFloat64()
+	}
+
+	sessions, err := database.ListTradingSessions(ctx, db)
+	if err != nil {
+		return err
+	}
+	live := make(map[string]bool, len(sessions))
+	for _, s := range sessions {
+		live[s.SessionID] = s.Mode != ModeReplay
+	}
+
+	expected := make(map[string]float64)
+	resumed := make(map[string]bool, len(engines))
+	for _, e := range engines {
+		resumed[e.SessionID] = true
+		e.do(func() {
+			for symbol, qty := range e.Portfolio.Positions {
+				expected[symbol] += qty
+			}
+		})
+	}
+	snapshots, err := database.ListSessionPositions(ctx, db)
+	if err != nil {
+		return err
+	}
+	for _, p := range snapshots {
+		if live[p.SessionID] && !resumed[p.SessionID] {
+			expected[p.Symbol] += p.Qty
+		}
+	}
+
+	mismatched := comparePositions("broker", expected, actual)
+	for _, e := range engines {
+		var discrepancies *string
+		e.do(func() {
+			for _, d := range mismatched {
+				for _, symbol := range e.Symbols {
+					if symbol == d.Symbol {
+						e.Discrepancies = append(e.Discrepancies, d)
+					}
+				}
+			}
+			if len(e.Discrepancies) > 0 {
+				data, _ := json.Marshal(e.Discrepancies)
+				str := string(data)
+				discrepancies = &str
+			}
+		})
+		if err := database.SetSessionDiscrepancies(ctx, db, e.SessionID, discrepancies); err != nil {
+			return err
+		}
+	}
+	return nil
+}
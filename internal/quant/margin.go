@@ -0,0 +1,147 @@
+package quant
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// MarginConfig controls short selling and leverage. The zero value is a cash
+// account: no shorts and every purchase fully funded.
+type MarginConfig struct {
+	AllowShort        bool    `json:"allow_short"`
+	InitialMargin     float64 `json:"initial_margin"`     // equity required per $ of new exposure, e.g. 0.5
+	MaintenanceMargin float64 `json:"maintenance_margin"` // equity/gross exposure below which positions are liquidated
+	BorrowFeeRate     float64 `json:"borrow_fee_rate"`    // annualized rate charged on short market value
+}
+
+// Validate reports whether m's margin requirements are fractions of exposure
+// that a position can meet, with maintenance no stricter than initial
+// margin, and whether its borrow fee is a charge rather than a rebate.
+func (m MarginConfig) Validate() error {
+	if m.InitialMargin < 0 || m.InitialMargin > 1 {
+		return fmt.Errorf("initial_margin must be between 0 and 1, got %v", m.InitialMargin)
+	}
+	if m.MaintenanceMargin < 0 || m.MaintenanceMargin > 1 {
+		return fmt.Errorf("maintenance_margin must be between 0 and 1, got %v", m.MaintenanceMargin)
+	}
+	if m.MaintenanceMargin > m.initial() {
+		return fmt.Errorf(
+			"maintenance_margin %v must not exceed initial_margin %v",
+			m.MaintenanceMargin,
+			m.initial(),
+		)
+	}
+	if m.BorrowFeeRate < 0 {
+		return fmt.Errorf("borrow_fee_rate must not be negative, got %v", m.BorrowFeeRate)
+	}
+	return nil
+}
+
+func (m MarginConfig) initial() float64 {
+	if m.InitialMargin <= 0 {
+		return 1
+	}
+	return m.InitialMargin
+}
+
+// GrossExposure returns the absolute market value of all positions.
+func (p *Portfolio) GrossExposure(prices map[string]float64) float64 {
+	gross := 0.0
+	for symbol, qty := range p.Positions {
+		if price, ok := prices[symbol]; ok {
+			gross += math.Abs(qty) * price
+		}
+	}
+	return gross
+}
+
+// BuyingPower returns the dollar value of new exposure the portfolio can open
+// under its initial margin requirement.
+func (p *Portfolio) BuyingPower(prices map[string]float64) float64 {
+	excess := p.CalculateEquity(prices) - p.Margin.initial()*p.GrossExposure(prices)
+	return math.Max(excess, 0) / p.Margin.initial()
+}
+
+// MaxQuantity returns the largest quantity of symbol that can be traded on
+// side at price, after paying fee, without breaching initial margin. Closing
+// an existing position is always allowed.
+func (p *Portfolio) MaxQuantity(symbol string, side TradeSide, price, fee float64) float64 {
+	if price <= 0 {
+		return 0
+	}
+
+	pos := p.Positions[symbol]
+	closing := 0.0
+	if side == Buy && pos < 0 {
+		closing = -pos
+	} else if side == Sell && pos > 0 {
+		closing = pos
+	}
+	if side == Sell && !p.Margin.AllowShort {
+		return closing
+	}
+
+	marks := p.markPrices()
+	marks[symbol] = price
+	im := p.Margin.initial()
+	excess := p.CalculateEquity(marks) - im*p.GrossExposure(marks)
+	// Closing shares release their margin before any new exposure is opened
+	excess += closing * price * im
+	excess -= fee
+	if excess <= 0 {
+		return closing
+	}
+	return closing + excess/(im*price)
+}
+
+// MarginDeficit returns how far equity is below the maintenance requirement,
+// or zero when the account is in good standing.
+func (p *Portfolio) MarginDeficit(prices map[string]float64) float64 {
+	if p.Margin.MaintenanceMargin <= 0 {
+		return 0
+	}
+	required := p.Margin.MaintenanceMargin * p.GrossExposure(prices)
+	return math.Max(required-p.CalculateEquity(prices), 0)
+}
+
+// ChargeBorrowFees deducts the borrow cost of open shorts for the elapsed
+// period and returns the amount charged.
+func (p *Portfolio) ChargeBorrowFees(prices map[string]float64, elapsed time.Duration) float64 {
+	if p.Margin.BorrowFeeRate <= 0 || elapsed <= 0 {
+		return 0
+	}
+
+	shortValue := 0.0
+	for symbol, qty := range p.Positions {
+		if qty < 0 {
+			shortValue += -qty * prices[symbol]
+		}
+	}
+
+	fee := shortValue * p.Margin.BorrowFeeRate * elapsed.Hours() / (24 * 365)
+	p.Cash -= fee
+	p.BorrowFees += fee
+	return fee
+}
+
+// liquidationOrder returns the open positions ordered by descending market
+// value, the order in which a margin call closes them.
+func (p *Portfolio) liquidationOrder(prices map[string]float64) []string {
+	var symbols []string
+	for symbol, qty := range p.Positions {
+		if qty != 0 {
+			symbols = append(symbols, symbol)
+		}
+	}
+	sort.Slice(symbols, func(i, j int) bool {
+		vi := math.Abs(p.Positions[symbols[i]]) * prices[symbols[i]]
+		vj := math.Abs(p.Positions[symbols[j]]) * prices[symbols[j]]
+		if vi != vj {
+			return vi > vj
+		}
+		return symbols[i] < symbols[j]
+	})
+	return symbols
+}
@@ -0,0 +1,72 @@
+package quant
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"citadel/internal/broker"
+)
+
+// ErrMarketClosed rejects an order a live session's strategy submits outside
+// regular hours, unless the session queues such orders for the next open.
+var ErrMarketClosed = errors.New("market is closed")
+
+// SessionListener is implemented by strategies and risk managers that keep to
+// the trading calendar. The engines call OnSessionOpen with each trading
+// day's regular session before that day's first bar reaches the strategy, so
+// a daily limit can reset or a strategy can plan around an early close.
+type SessionListener interface {
+	OnSessionOpen(session broker.MarketSession)
+}
+
+// sessionClock follows bars from one trading day to the next.
+type sessionClock struct {
+	cal  broker.Calendar
+	date string // the trading day last begun
+}
+
+// advance returns the session ts falls on and whether ts begins it. Bars on
+// days the market is closed begin nothing.
+func (c *sessionClock) advance(ts time.Time) (broker.MarketSession, bool) {
+	s, ok := c.cal.Session(ts)
+	if !ok || s.Date == c.date {
+		return s, false
+	}
+	c.date = s.Date
+	return s, true
+}
+
+// openSession tells whichever of listeners are SessionListeners that session
+// has begun.
+func openSession(session broker.MarketSession, listeners ...interface{}) {
+	for _, l := range listeners {
+		if sl, ok := l.(SessionListener); ok {
+			sl.OnSessionOpen(session)
+		}
+	}
+}
+
+// closing reports whether ts falls within FlattenBeforeClose of the close of
+// its session.
+func (e *LiveEngine) closing(ts time.Time) bool {
+	if e.FlattenBeforeClose <= 0 {
+		return false
+	}
+	s, ok := e.Calendar.Session(ts)
+	return ok && s.Contains(ts) && !ts.Before(s.Close.Add(-e.FlattenBeforeClose))
+}
+
+// flattenForClose closes out the session ahead of the close. The first bar
+// of the session to arrive in the window cancels its open orders; that bar,
+// later ones and order updates then work it towards flat, as closeOut does.
+func (e *LiveEngine) flattenForClose(ctx context.Context) {
+	if e.flattening != e.clock.date {
+		e.flattening = e.clock.date
+		e.queued = nil
+		e.logger.Info("flattening session before the close",
+			"session", e.SessionID, "date", e.flattening)
+		e.cancelOrders("")
+	}
+	e.closeOut(ctx)
+}
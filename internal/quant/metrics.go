@@ -11,9 +11,30 @@ type Metrics struct {
 	WinRate      float64 `json:"win_rate"`
 	TotalTrades  int     `json:"total_trades"`
 	ProfitFactor float64 `json:"profit_factor"`
+	Expectancy   float64 `json:"expectancy"`
+	AverageWin   float64 `json:"average_win"`
+	AverageLoss  float64 `json:"average_loss"`
+	TotalFills   int     `json:"total_fills"`
+
+	PeriodsPerYear         float64         `json:"periods_per_year"`
+	RiskFreeRate           float64         `json:"risk_free_rate"`
+	CAGR                   float64         `json:"cagr"`
+	Volatility             float64         `json:"volatility"`
+	SortinoRatio           float64         `json:"sortino_ratio"`
+	CalmarRatio            float64         `json:"calmar_ratio"`
+	LongestDrawdownSeconds float64         `json:"longest_drawdown_seconds"`
+	TimeToRecoverySeconds  *float64        `json:"time_to_recovery_seconds"` // nil if never recovered
+	MonthlyReturns         []MonthlyReturn `json:"monthly_returns"`
+	Benchmark              *BenchmarkStats `json:"benchmark,omitempty"`
 }
 
 func (p *Portfolio) CalculateMetrics() {
+	p.CalculateMetricsWith(AnalyticsOptions{})
+}
+
+// CalculateMetricsWith computes metrics annualized to the bar frequency of
+// the equity log, against the given risk-free rate and optional benchmark.
+func (p *Portfolio) CalculateMetricsWith(opts AnalyticsOptions) {
 	if len(p.EquityLog) < 2 {
 		p.Metrics = Metrics{}
 		return
@@ -25,86 +46,91 @@ func (p *Portfolio) CalculateMetrics() {
 	// 1. Total Return
 	totalReturn := (endingEquity - startingEquity) / startingEquity
 
-	// 2. Max Drawdown
-	peak := startingEquity
-	maxDrawdown := 0.0
-
-	var returns []float64
-
-	for i := 1; i < len(p.EquityLog); i++ {
-		current := p.EquityLog[i].Equity
-		prev := p.EquityLog[i-1].Equity
-
-		// Update peak
-		if current > peak {
-			peak = current
-		}
-
-		// Calculate drawdown from peak
-		drawdown := (peak - current) / peak
-		if drawdown > maxDrawdown {
-			maxDrawdown = drawdown
-		}
+	// 2. Per-period returns, annualized to the inferred bar frequency
+	returns := periodReturns(p.EquityLog)
+	ppy := inferPeriodsPerYear(p.EquityLog)
+	rfPerPeriod := opts.RiskFreeRate / ppy
 
-		// Calculate daily return for Sharpe
-		dailyReturn := (current - prev) / prev
-		returns = append(returns, dailyReturn)
+	p.Metrics = Metrics{
+		TotalReturn:    totalReturn,
+		TotalFills:     fills(p.Trades),
+		PeriodsPerYear: ppy,
+		RiskFreeRate:   opts.RiskFreeRate,
+		Volatility:     stdDev(returns) * math.Sqrt(ppy),
+		SharpeRatio:    sharpe(returns, rfPerPeriod, ppy),
+		SortinoRatio:   sortino(returns, rfPerPeriod, ppy),
+		CAGR:           cagr(p.EquityLog),
+		MonthlyReturns: monthlyReturns(p.EquityLog),
 	}
 
-	// 3. Sharpe Ratio (Annualized, assuming 252 trading days and 0% risk-free rate)
-	meanReturn := 0.0
-	for _, r := range returns {
-		meanReturn += r
+	// 3. Drawdown depth, duration and recovery
+	dd := drawdowns(p.EquityLog)
+	p.Metrics.MaxDrawdown = dd.maxDrawdown
+	p.Metrics.LongestDrawdownSeconds = dd.longest.Seconds()
+	if dd.recovered {
+		secs := dd.recovery.Seconds()
+		p.Metrics.TimeToRecoverySeconds = &secs
+	}
+	if dd.maxDrawdown > 0 {
+		p.Metrics.CalmarRatio = p.Metrics.CAGR / dd.maxDrawdown
 	}
-	meanReturn /= float64(len(returns))
 
-	variance := 0.0
-	for _, r := range returns {
-		variance += math.Pow(r-meanReturn, 2)
+	if len(opts.Benchmark) > 0 {
+		p.Metrics.Benchmark = benchmarkStats(p.EquityLog, opts.Benchmark, rfPerPeriod, ppy)
 	}
-	variance /= float64(len(returns))
 
-	stdDev := math.Sqrt(variance)
+	// 4. Trade-level statistics from closed round trips
+	if p.Ledger != nil {
+		p.Metrics.applyRoundTrips(p.Ledger.RoundTrips)
+	}
+}
 
-	sharpeRatio := 0.0
-	if stdDev > 0 {
-		sharpeRatio = (meanReturn / stdDev) * math.Sqrt(252.0)
+func (m *Metrics) applyRoundTrips(trips []RoundTrip) {
+	m.TotalTrades = len(trips)
+	if len(trips) == 0 {
+		return
 	}
 
-	// 4. Additional Metrics (Win Rate, Total Trades, Profit Factor based on daily returns)
-	winningDays := 0
+	wins := 0
+	losses := 0
 	grossProfit := 0.0
 	grossLoss := 0.0
-
-	for _, r := range returns {
-		if r > 0 {
-			winningDays++
-			grossProfit += r
-		} else if r < 0 {
-			grossLoss += math.Abs(r)
+	netPnL := 0.0
+
+	for _, t := range trips {
+		netPnL += t.PnL
+		if t.PnL > 0 {
+			wins++
+			grossProfit += t.PnL
+		} else if t.PnL < 0 {
+			losses++
+			grossLoss += math.Abs(t.PnL)
 		}
 	}
 
-	winRate := 0.0
-	if len(returns) > 0 {
-		winRate = float64(winningDays) / float64(len(returns))
+	m.WinRate = float64(wins) / float64(len(trips))
+	m.Expectancy = netPnL / float64(len(trips))
+	if wins > 0 {
+		m.AverageWin = grossProfit / float64(wins)
+	}
+	if losses > 0 {
+		m.AverageLoss = grossLoss / float64(losses)
 	}
 
-	profitFactor := 0.0
 	if grossLoss > 0 {
-		profitFactor = grossProfit / grossLoss
+		m.ProfitFactor = grossProfit / grossLoss
 	} else if grossProfit > 0 {
-		profitFactor = 999.0 // arbitrarily high
+		m.ProfitFactor = 999.0 // arbitrarily high
 	}
+}
 
-	totalTrades := len(p.Trades)
-
-	p.Metrics = Metrics{
-		TotalReturn:  totalReturn,
-		MaxDrawdown:  maxDrawdown,
-		SharpeRatio:  sharpeRatio,
-		WinRate:      winRate,
-		TotalTrades:  totalTrades,
-		ProfitFactor: profitFactor,
+// fills counts the trades that filled orders, leaving out rebalance resizes.
+func fills(trades []Trade) int {
+	n := 0
+	for _, t := range trades {
+		if !t.Rebalance {
+			n++
+		}
 	}
+	return n
 }
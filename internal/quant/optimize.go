@@ -0,0 +1,639 @@
+package quant
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"citadel/internal/broker"
+	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
+)
+
+const (
+	GridSearch   = "grid"
+	RandomSearch = "random"
+
+	SampleFull        = "full"
+	SampleInSample    = "in_sample"
+	SampleOutOfSample = "out_of_sample"
+)
+
+// ParamRange is the search space for one parameter: either an explicit list
+// of values, or Min..Max walked by Step (grid) or sampled uniformly (random).
+type ParamRange struct {
+	Values []float64 `json:"values"`
+	Min    float64   `json:"min"`
+	Max    float64   `json:"max"`
+	Step   float64   `json:"step"`
+}
+
+// Constraint rejects trials whose metric falls outside [Min, Max].
+type Constraint struct {
+	Metric string   `json:"metric"`
+	Min    *float64 `json:"min"`
+	Max    *float64 `json:"max"`
+}
+
+// WalkForward splits the date range into rolling in-sample windows used for
+// selection, each followed by an out-of-sample window used for evaluation.
+type WalkForward struct {
+	InSampleDays    int `json:"in_sample_days"`
+	OutOfSampleDays int `json:"out_of_sample_days"`
+	StepDays        int `json:"step_days"` // defaults to OutOfSampleDays
+}
+
+type OptimizationSpec struct {
+	Name            string                `json:"name"`
+	Strategy        string                `json:"strategy"`
+	Symbols         []string              `json:"symbols"`
+	Universes       [][]string            `json:"universes"` // overrides Symbols grouping
+	Start           string                `json:"start"`
+	End             string                `json:"end"`
+	StartingCapital float64               `json:"starting_capital"`
+	Timeframe       string                `json:"timeframe"` // default 1Day
+	Search          string                `json:"search"`
+	Samples         int                   `json:"samples"`
+	Seed            uint64                `json:"seed"`
+	Parameters      map[string]ParamRange `json:"parameters"`
+	Objective       string                `json:"objective"`
+	Minimize        bool                  `json:"minimize"`
+	Constraints     []Constraint          `json:"constraints"`
+	Workers         int                   `json:"workers"`
+	WalkForward     *WalkForward          `json:"walk_forward"`
+	RiskFreeRate    float64               `json:"risk_free_rate"`
+	Benchmark       string                `json:"benchmark"`
+	Fills           FillConfig            `json:"fills"`
+	Margin          MarginConfig          `json:"margin"`
+
+	start     time.Time
+	end       time.Time
+	timeframe marketdata.TimeFrame
+	spec      StrategySpec
+}
+
+// Trial is one backtest run within an optimization.
+type Trial struct {
+	Window     int         `json:"window"`
+	Sample     string      `json:"sample"`
+	Symbols    []string    `json:"symbols"`
+	Start      time.Time   `json:"start"`
+	End        time.Time   `json:"end"`
+	Parameters Params      `json:"parameters"`
+	Metrics    Metrics     `json:"metrics"`
+	Objective  float64     `json:"objective"`
+	Feasible   bool        `json:"feasible"`
+	RoundTrips []RoundTrip `json:"-"`
+	Err        error       `json:"-"`
+	raw        map[string]interface{}
+}
+
+// WindowResult pairs the best in-sample trial of a window with its
+// out-of-sample evaluation. OutOfSample is nil when walk-forward is off or no
+// in-sample trial satisfied the constraints.
+type WindowResult struct {
+	Index       int      `json:"index"`
+	Symbols     []string `json:"symbols"`
+	Best        *Trial   `json:"best"`
+	OutOfSample *Trial   `json:"out_of_sample"`
+}
+
+// Validate parses dates, resolves the strategy and applies defaults.
+func (s *OptimizationSpec) Validate() error {
+	spec, ok := LookupStrategy(s.Strategy)
+	if !ok {
+		return fmt.Errorf("unknown strategy %q", s.Strategy)
+	}
+	s.spec = spec
+	s.Strategy = spec.ID
+
+	var err error
+	if s.start, err = parseSpecTime(s.Start); err != nil {
+		return fmt.Errorf("invalid start: %w", err)
+	}
+	if s.end, err = parseSpecTime(s.End); err != nil {
+		return fmt.Errorf("invalid end: %w", err)
+	}
+	if !s.end.After(s.start) {
+		return fmt.Errorf("end must be after start")
+	}
+	if s.Timeframe == "" {
+		s.Timeframe = marketdata.OneDay.String()
+	}
+	if s.timeframe, err = broker.ParseTimeFrame(s.Timeframe); err != nil {
+		return err
+	}
+
+	if err := s.Fills.Validate(); err != nil {
+		return err
+	}
+	if err := s.Margin.Validate(); err != nil {
+		return err
+	}
+
+	for i, sym := range s.Symbols {
+		s.Symbols[i] = strings.ToUpper(sym)
+	}
+	s.Benchmark = strings.ToUpper(s.Benchmark)
+	for _, u := range s.Universes {
+		for i, sym := range u {
+			u[i] = strings.ToUpper(sym)
+		}
+	}
+	if len(s.Universes) == 0 {
+		if len(s.Symbols) == 0 {
+			return fmt.Errorf("symbols required")
+		}
+		if spec.MinSymbols > 1 {
+			s.Universes = [][]string{s.Symbols}
+		} else {
+			for _, sym := range s.Symbols {
+				s.Universes = append(s.Universes, []string{sym})
+			}
+		}
+	}
+	for _, u := range s.Universes {
+		if len(u) < spec.MinSymbols {
+			return fmt.Errorf("strategy %s requires at least %d symbols", spec.ID, spec.MinSymbols)
+		}
+	}
+
+	if s.Name == "" {
+		s.Name = fmt.Sprintf("%s %s", spec.ID, time.Now().Format(time.DateTime))
+	}
+	if s.StartingCapital <= 0 {
+		s.StartingCapital = 100000
+	}
+	if s.Search == "" {
+		s.Search = GridSearch
+	}
+	if s.Search != GridSearch && s.Search != RandomSearch {
+		return fmt.Errorf("search must be %q or %q", GridSearch, RandomSearch)
+	}
+	if s.Search == RandomSearch && s.Samples <= 0 {
+		s.Samples = 50
+	}
+	if s.Objective == "" {
+		s.Objective = "sharpe_ratio"
+	}
+	if _, err := metricValue(Metrics{}, s.Objective); err != nil {
+		return err
+	}
+	for _, c := range s.Constraints {
+		if _, err := metricValue(Metrics{}, c.Metric); err != nil {
+			return err
+		}
+	}
+	if s.Workers <= 0 {
+		s.Workers = 4
+	}
+
+	if wf := s.WalkForward; wf != nil {
+		if wf.InSampleDays <= 0 || wf.OutOfSampleDays <= 0 {
+			return fmt.Errorf("walk_forward requires in_sample_days and out_of_sample_days")
+		}
+		if wf.StepDays <= 0 {
+			wf.StepDays = wf.OutOfSampleDays
+		}
+	}
+
+	// Resolve once up front so bad parameter names fail before any data is fetched
+	_, err = s.Candidates()
+	return err
+}
+
+// AllSymbols returns every symbol referenced by the spec's universes.
+func (s *OptimizationSpec) AllSymbols() []string {
+	seen := make(map[string]bool)
+	var symbols []string
+	for _, u := range s.Universes {
+		for _, sym := range u {
+			if !seen[sym] {
+				seen[sym] = true
+				symbols = append(symbols, sym)
+			}
+		}
+	}
+	return symbols
+}
+
+// Range returns the parsed date range of the spec.
+func (s *OptimizationSpec) Range() (time.Time, time.Time) {
+	return s.start, s.end
+}
+
+// BarTimeframe returns the parsed bar timeframe of the spec.
+func (s *OptimizationSpec) BarTimeframe() marketdata.TimeFrame {
+	return s.timeframe
+}
+
+// Candidates expands the parameter ranges into the parameter sets to try.
+func (s *OptimizationSpec) Candidates() ([]map[string]interface{}, error) {
+	names := make([]string, 0, len(s.Parameters))
+	for name := range s.Parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	types := make(map[string]ParamType)
+	for _, p := range s.spec.AllParams() {
+		types[p.Name] = p.Type
+	}
+	for _, name := range names {
+		if _, ok := types[name]; !ok {
+			return nil, fmt.Errorf("unknown parameter %q for strategy %s", name, s.spec.ID)
+		}
+	}
+
+	var candidates []map[string]interface{}
+	if s.Search == RandomSearch {
+		rng := rand.New(rand.NewPCG(s.Seed, s.Seed))
+		for range s.Samples {
+			c := make(map[string]interface{}, len(names))
+			for _, name := range names {
+				c[name] = s.Parameters[name].sample(rng, types[name])
+			}
+			candidates = append(candidates, c)
+		}
+	} else {
+		candidates = []map[string]interface{}{{}}
+		for _, name := range names {
+			values := s.Parameters[name].values(types[name])
+			next := make([]map[string]interface{}, 0, len(candidates)*len(values))
+			for _, c := range candidates {
+				for _, v := range values {
+					nc := make(map[string]interface{}, len(c)+1)
+					for k, cv := range c {
+						nc[k] = cv
+					}
+					nc[name] = v
+					next = append(next, nc)
+				}
+			}
+			candidates = next
+		}
+	}
+
+	// Drop combinations the strategy rejects, e.g. short_period >= long_period
+	valid := candidates[:0]
+	for _, c := range candidates {
+		if _, _, err := s.spec.Build(s.Universes[0], c); err == nil {
+			valid = append(valid, c)
+		}
+	}
+	if len(valid) == 0 {
+		return nil, fmt.Errorf("no valid parameter combinations")
+	}
+	return valid, nil
+}
+
+func (r ParamRange) values(t ParamType) []float64 {
+	if len(r.Values) > 0 {
+		return r.Values
+	}
+	if r.Step <= 0 || r.Max <= r.Min {
+		return []float64{r.Min}
+	}
+	var values []float64
+	for v := r.Min; v <= r.Max+r.Step*1e-9; v += r.Step {
+		if t == IntParam {
+			v = math.Round(v)
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+func (r ParamRange) sample(rng *rand.Rand, t ParamType) float64 {
+	if len(r.Values) > 0 {
+		return r.Values[rng.IntN(len(r.Values))]
+	}
+	v := r.Min + rng.Float64()*(r.Max-r.Min)
+	if r.Step > 0 {
+		v = r.Min + math.Round((v-r.Min)/r.Step)*r.Step
+	}
+	if t == IntParam {
+		v = math.Round(v)
+	}
+	return v
+}
+
+type window struct {
+	index      int
+	isStart    time.Time
+	isEnd      time.Time
+	oosEnd     time.Time
+	hasOOS     bool
+	warmupFrom time.Time
+}
+
+func (s *OptimizationSpec) windows() []window {
+	if s.WalkForward == nil {
+		return []window{{isStart: s.start, isEnd: s.end}}
+	}
+
+	wf := s.WalkForward
+	var windows []window
+	for t := s.start; ; t = t.AddDate(0, 0, wf.StepDays) {
+		isEnd := t.AddDate(0, 0, wf.InSampleDays)
+		if !isEnd.Before(s.end) {
+			break
+		}
+		oosEnd := isEnd.AddDate(0, 0, wf.OutOfSampleDays)
+		if oosEnd.After(s.end) {
+			oosEnd = s.end
+		}
+		windows = append(windows, window{
+			index:   len(windows),
+			isStart: t,
+			isEnd:   isEnd,
+			oosEnd:  oosEnd,
+			hasOOS:  true,
+		})
+	}
+	return windows
+}
+
+type trialJob struct {
+	trial     Trial
+	bars      map[string][]marketdata.Bar
+	benchmark []marketdata.Bar
+	warmup    time.Time
+}
+
+// RunOptimization evaluates every candidate on every window and universe in
+// parallel. onTrial is called from the calling goroutine for each finished
+// trial, so it may safely write to the database.
+func RunOptimization(
+	ctx context.Context,
+	spec *OptimizationSpec,
+	bars map[string][]marketdata.Bar,
+	onTrial func(Trial),
+) ([]WindowResult, error) {
+	candidates, err := spec.Candidates()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []WindowResult
+	for _, w := range spec.windows() {
+		for _, universe := range spec.Universes {
+			sample := SampleFull
+			if w.hasOOS {
+				sample = SampleInSample
+			}
+
+			var jobs []trialJob
+			for _, c := range candidates {
+				jobs = append(jobs, trialJob{
+					trial: Trial{
+						Window:  w.index,
+						Sample:  sample,
+						Symbols: universe,
+						Start:   w.isStart,
+						End:     w.isEnd,
+						raw:     c,
+					},
+					bars:      sliceBars(bars, universe, w.isStart, w.isEnd),
+					benchmark: sliceBars(bars, []string{spec.Benchmark}, w.isStart, w.isEnd)[spec.Benchmark],
+				})
+			}
+
+			trials := spec.runTrials(ctx, jobs, onTrial)
+			if err := ctx.Err(); err != nil {
+				return results, err
+			}
+
+			result := WindowResult{Index: w.index, Symbols: universe, Best: spec.best(trials)}
+			if w.hasOOS && result.Best != nil {
+				oos := spec.runTrials(ctx, []trialJob{{
+					trial: Trial{
+						Window:  w.index,
+						Sample:  SampleOutOfSample,
+						Symbols: universe,
+						Start:   w.isEnd,
+						End:     w.oosEnd,
+						raw:     result.Best.raw,
+					},
+					// In-sample bars warm up indicators for the out-of-sample run
+					bars:      sliceBars(bars, universe, w.isStart, w.oosEnd),
+					benchmark: sliceBars(bars, []string{spec.Benchmark}, w.isEnd, w.oosEnd)[spec.Benchmark],
+					warmup:    w.isEnd,
+				}}, onTrial)
+				if len(oos) == 1 {
+					result.OutOfSample = &oos[0]
+				}
+			}
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+func (s *OptimizationSpec) runTrials(
+	ctx context.Context,
+	jobs []trialJob,
+	onTrial func(Trial),
+) []Trial {
+	in := make(chan trialJob)
+	out := make(chan Trial)
+
+	var wg sync.WaitGroup
+	for range min(s.Workers, len(jobs)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range in {
+				out <- s.runTrial(job)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(in)
+		for _, job := range jobs {
+			select {
+			case in <- job:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	trials := make([]Trial, 0, len(jobs))
+	for t := range out {
+		if onTrial != nil {
+			onTrial(t)
+		}
+		trials = append(trials, t)
+	}
+	return trials
+}
+
+func (s *OptimizationSpec) runTrial(job trialJob) Trial {
+	t := job.trial
+
+	strategy, params, err := s.spec.Build(t.Symbols, t.raw)
+	if err != nil {
+		t.Err = err
+		return t
+	}
+	t.Parameters = params
+
+	engine := NewEngine(s.StartingCapital, strategy, NewRiskManagerFromParams(params))
+	engine.Timeframe = s.timeframe
+	engine.FillModel = NewFillModel(s.Fills)
+	engine.Portfolio.Margin = s.Margin
+	engine.WarmupUntil = job.warmup
+	if err := engine.Run(job.bars); err != nil {
+		t.Err = err
+		return t
+	}
+
+	engine.Portfolio.CalculateMetricsWith(AnalyticsOptions{
+		RiskFreeRate: s.RiskFreeRate,
+		Benchmark:    job.benchmark,
+	})
+	t.Metrics = engine.Portfolio.Metrics
+	t.RoundTrips = engine.Portfolio.Ledger.RoundTrips
+	t.Objective, _ = metricValue(t.Metrics, s.Objective)
+	t.Feasible = s.feasible(t.Metrics)
+	return t
+}
+
+func (s *OptimizationSpec) feasible(m Metrics) bool {
+	for _, c := range s.Constraints {
+		v, err := metricValue(m, c.Metric)
+		if err != nil {
+			return false
+		}
+		if c.Min != nil && v < *c.Min {
+			return false
+		}
+		if c.Max != nil && v > *c.Max {
+			return false
+		}
+	}
+	return true
+}
+
+// best returns the feasible trial with the best objective, or nil.
+func (s *OptimizationSpec) best(trials []Trial) *Trial {
+	var best *Trial
+	for i := range trials {
+		t := &trials[i]
+		if t.Err != nil || !t.Feasible {
+			continue
+		}
+		if best == nil || s.better(t.Objective, best.Objective) {
+			best = t
+		}
+	}
+	return best
+}
+
+func (s *OptimizationSpec) better(a, b float64) bool {
+	if s.Minimize {
+		return a < b
+	}
+	return a > b
+}
+
+// BestParameters picks the parameter set to deploy. With walk-forward it is
+// the set with the best mean out-of-sample objective across windows;
+// otherwise it is the best full-sample trial.
+func (s *OptimizationSpec) BestParameters(results []WindowResult) (Params, float64, bool) {
+	type agg struct {
+		params Params
+		sum    float64
+		n      int
+	}
+	groups := make(map[string]*agg)
+	var keys []string
+
+	for _, r := range results {
+		t := r.Best
+		if s.WalkForward != nil {
+			t = r.OutOfSample
+		}
+		if t == nil || t.Err != nil {
+			continue
+		}
+		b, _ := json.Marshal(t.Parameters)
+		key := string(b)
+		if groups[key] == nil {
+			groups[key] = &agg{params: t.Parameters}
+			keys = append(keys, key)
+		}
+		groups[key].sum += t.Objective
+		groups[key].n++
+	}
+
+	var best *agg
+	bestMean := 0.0
+	for _, key := range keys {
+		g := groups[key]
+		m := g.sum / float64(g.n)
+		if best == nil || s.better(m, bestMean) {
+			best, bestMean = g, m
+		}
+	}
+	if best == nil {
+		return nil, 0, false
+	}
+	return best.params, bestMean, true
+}
+
+// metricValue reads a numeric metric by its JSON name, e.g. "sharpe_ratio".
+func metricValue(m Metrics, name string) (float64, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return 0, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return 0, err
+	}
+	v, ok := fields[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown metric %q", name)
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return 0, fmt.Errorf("metric %q is not numeric", name)
+	}
+	return f, nil
+}
+
+func sliceBars(
+	bars map[string][]marketdata.Bar,
+	symbols []string,
+	from, to time.Time,
+) map[string][]marketdata.Bar {
+	out := make(map[string][]marketdata.Bar, len(symbols))
+	for _, sym := range symbols {
+		for _, bar := range bars[sym] {
+			if !bar.Timestamp.Before(from) && bar.Timestamp.Before(to) {
+				out[sym] = append(out[sym], bar)
+			}
+		}
+	}
+	return out
+}
+
+func parseSpecTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, s)
+}
@@ -1,10 +1,18 @@
 package quant
 
-import "time"
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/v3/alpaca"
+	"github.com/shopspring/decimal"
+)
 
 type (
 	OrderType   string
 	OrderStatus string
+	OrderClass  string
 )
 
 const (
@@ -18,18 +26,223 @@ const (
 	StatusPartial  OrderStatus = "partially_filled"
 	StatusRejected OrderStatus = "rejected"
 	StatusCanceled OrderStatus = "canceled"
+
+	// A bracket order's entry carries a take-profit and a stop-loss exit, an
+	// OTO's one of them. The exits are placed once the entry fills and are
+	// one-cancels-other: when one fills, the other is canceled. An OCO order
+	// is the two exits alone, for a position already held; its Type and
+	// LimitPrice are ignored.
+	ClassSimple  OrderClass = "simple"
+	ClassBracket OrderClass = "bracket"
+	ClassOTO     OrderClass = "oto"
+	ClassOCO     OrderClass = "oco"
 )
 
 type OrderIntent struct {
-	Symbol        string
-	Side          TradeSide
-	Type          OrderType
-	Quantity      float64
-	LimitPrice    *float64
-	StopPrice     *float64
-	TrailingPrice *float64
-	TrailingPct   *float64
-	TimeInForce   string // day, gtc, etc
+	Symbol        string    `json:"symbol"`
+	Side          TradeSide `json:"side"`
+	Type          OrderType `json:"type"`
+	Quantity      float64   `json:"quantity"`
+	LimitPrice    *float64  `json:"limit_price,omitempty"`
+	StopPrice     *float64  `json:"stop_price,omitempty"`
+	TrailingPrice *float64  `json:"trailing_price,omitempty"`
+	TrailingPct   *float64  `json:"trailing_pct,omitempty"`  // percent, e.g. 1.5 trails 1.5% behind the mark
+	TimeInForce   string    `json:"time_in_force,omitempty"` // day, gtc, ioc, fok; empty means day
+
+	// OrderClass is empty for a simple order, or a bracket or OTO when exits
+	// are attached; see ClassBracket. TakeProfit is the limit price of the
+	// take-profit exit and StopLoss the stop price of the stop-loss exit.
+	OrderClass OrderClass `json:"order_class,omitempty"`
+	TakeProfit *float64   `json:"take_profit,omitempty"`
+	StopLoss   *float64   `json:"stop_loss,omitempty"`
+}
+
+// Class returns the intent's order class, working it out from its exits
+// when OrderClass is empty.
+func (o OrderIntent) Class() OrderClass {
+	switch {
+	case o.OrderClass != "":
+		return o.OrderClass
+	case o.TakeProfit != nil && o.StopLoss != nil:
+		return ClassBracket
+	case o.TakeProfit != nil || o.StopLoss != nil:
+		return ClassOTO
+	}
+	return ClassSimple
+}
+
+// Validate checks that the intent describes an order Alpaca would accept.
+func (o OrderIntent) Validate() error {
+	if o.Symbol == "" {
+		return errors.New("symbol required")
+	}
+	if o.Side != Buy && o.Side != Sell {
+		return fmt.Errorf("invalid side %q", o.Side)
+	}
+	if o.Quantity <= 0 {
+		return errors.New("quantity must be positive")
+	}
+
+	class := o.Class()
+	if class == ClassOCO {
+		if o.TakeProfit == nil || o.StopLoss == nil {
+			return errors.New("an oco order requires take_profit and stop_loss")
+		}
+		return o.checkExits(o.Side == Sell)
+	}
+
+	switch o.Type {
+	case Market:
+	case Limit:
+		if o.LimitPrice == nil {
+			return errors.New("limit_price is required for limit orders")
+		}
+	case Stop:
+		if o.StopPrice == nil {
+			return errors.New("stop_price is required for stop orders")
+		}
+	case TrailingStop:
+		if (o.TrailingPrice == nil) == (o.TrailingPct == nil) {
+			return errors.New("trailing stop orders require one of trailing_price or trailing_pct")
+		}
+	default:
+		return fmt.Errorf("invalid order type %q", o.Type)
+	}
+
+	switch class {
+	case ClassSimple:
+		if o.TakeProfit != nil || o.StopLoss != nil {
+			return errors.New("a simple order can't carry exits")
+		}
+		return nil
+	case ClassBracket:
+		if o.TakeProfit == nil || o.StopLoss == nil {
+			return errors.New("a bracket order requires take_profit and stop_loss")
+		}
+	case ClassOTO:
+		if (o.TakeProfit == nil) == (o.StopLoss == nil) {
+			return errors.New("an oto order requires one of take_profit or stop_loss")
+		}
+	default:
+		return fmt.Errorf("invalid order class %q", class)
+	}
+	if o.Type != Market && o.Type != Limit {
+		return fmt.Errorf("a %s entry must be a market or limit order", class)
+	}
+	return o.checkExits(o.Side == Buy)
+}
+
+// checkExits checks the exit prices are positive and, for exits closing a
+// long position (or a short when long is false), on the right sides of each
+// other.
+func (o OrderIntent) checkExits(long bool) error {
+	if o.TakeProfit != nil && *o.TakeProfit <= 0 || o.StopLoss != nil && *o.StopLoss <= 0 {
+		return errors.New("exit prices must be positive")
+	}
+	if o.TakeProfit == nil || o.StopLoss == nil {
+		return nil
+	}
+	if long && *o.StopLoss >= *o.TakeProfit {
+		return errors.New("stop_loss must be below take_profit when closing a long position")
+	}
+	if !long && *o.StopLoss <= *o.TakeProfit {
+		return errors.New("stop_loss must be above take_profit when closing a short position")
+	}
+	return nil
+}
+
+// exits returns the orders that close what the intent's entry opens, stop
+// loss first, sized for qty. An OCO's exits are the order itself.
+func (o OrderIntent) exits(qty float64) []OrderIntent {
+	side := Sell
+	if o.Side == Sell {
+		side = Buy
+	}
+	if o.Class() == ClassOCO {
+		side = o.Side
+	}
+
+	var exits []OrderIntent
+	if o.StopLoss != nil {
+		stop := *o.StopLoss
+		exits = append(exits, OrderIntent{
+			Symbol:      o.Symbol,
+			Side:        side,
+			Type:        Stop,
+			Quantity:    qty,
+			StopPrice:   &stop,
+			TimeInForce: o.TimeInForce,
+		})
+	}
+	if o.TakeProfit != nil {
+		limit := *o.TakeProfit
+		exits = append(exits, OrderIntent{
+			Symbol:      o.Symbol,
+			Side:        side,
+			Type:        Limit,
+			Quantity:    qty,
+			LimitPrice:  &limit,
+			TimeInForce: o.TimeInForce,
+		})
+	}
+	return exits
+}
+
+// NewOrderRequest maps intent onto Alpaca's order request. An intent with
+// exits becomes an order of its class, so the broker places and cancels
+// them; an OCO is sent as its take-profit limit with the stop-loss attached.
+func NewOrderRequest(intent OrderIntent) alpaca.PlaceOrderRequest {
+	price := func(f float64) *decimal.Decimal { d := decimal.NewFromFloat(f); return &d }
+
+	req := alpaca.PlaceOrderRequest{
+		Symbol:      intent.Symbol,
+		Qty:         price(intent.Quantity),
+		Side:        alpaca.Side(intent.Side),
+		Type:        alpaca.OrderType(intent.Type),
+		TimeInForce: alpaca.Day,
+	}
+	if intent.TimeInForce != "" {
+		req.TimeInForce = alpaca.TimeInForce(intent.TimeInForce)
+	}
+
+	if intent.LimitPrice != nil {
+		req.LimitPrice = price(*intent.LimitPrice)
+	}
+	if intent.StopPrice != nil {
+		req.StopPrice = price(*intent.StopPrice)
+	}
+	if intent.TrailingPrice != nil {
+		req.TrailPrice = price(*intent.TrailingPrice)
+	}
+	if intent.TrailingPct != nil {
+		req.TrailPercent = price(*intent.TrailingPct)
+	}
+
+	class := intent.Class()
+	if class == ClassSimple {
+		return req
+	}
+	req.OrderClass = alpaca.OrderClass(class)
+	if intent.TakeProfit != nil {
+		req.TakeProfit = &alpaca.TakeProfit{LimitPrice: price(*intent.TakeProfit)}
+	}
+	if intent.StopLoss != nil {
+		req.StopLoss = &alpaca.StopLoss{StopPrice: price(*intent.StopLoss)}
+	}
+	if class == ClassOCO {
+		req.Type = alpaca.Limit
+		req.LimitPrice = req.TakeProfit.LimitPrice
+		req.StopPrice = nil
+	}
+	return req
+}
+
+// signedQuantity returns the intent's quantity, negative for sells.
+func (o OrderIntent) signedQuantity() float64 {
+	if o.Side == Sell {
+		return -o.Quantity
+	}
+	return o.Quantity
 }
 
 type OrderRecord struct {
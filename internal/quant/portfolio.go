@@ -1,6 +1,7 @@
 package quant
 
 import (
+	"math"
 	"time"
 )
 
@@ -12,11 +13,15 @@ const (
 )
 
 type Trade struct {
-	Timestamp time.Time `json:"timestamp"`
-	Symbol    string    `json:"symbol"`
-	Side      TradeSide `json:"side"`
-	Quantity  float64   `json:"quantity"`
-	Price     float64   `json:"price"`
+	Timestamp  time.Time `json:"timestamp"`
+	Symbol     string    `json:"symbol"`
+	Side       TradeSide `json:"side"`
+	Quantity   float64   `json:"quantity"`
+	Price      float64   `json:"price"`
+	Commission float64   `json:"commission"`
+	// Rebalance marks a trade that only resized a portfolio sleeve; it keeps
+	// the position's lots open instead of closing or opening round trips.
+	Rebalance bool `json:"rebalance,omitempty"`
 }
 
 type Portfolio struct {
@@ -26,6 +31,14 @@ type Portfolio struct {
 	EquityLog     []EquitySnapshot   `json:"equity_log"`
 	Metrics       Metrics            `json:"metrics"`
 	PendingOrders []OrderIntent      `json:"pending_orders"`
+	OpenOrders    []WorkingOrder     `json:"open_orders"`
+	Margin        MarginConfig       `json:"margin"`
+	BorrowFees    float64            `json:"borrow_fees"`
+	MarginCalls   int                `json:"margin_calls"`
+	Ledger        *Ledger            `json:"ledger"`
+
+	cancels []string
+	marks   map[string]float64
 }
 
 type EquitySnapshot struct {
@@ -40,40 +53,106 @@ func NewPortfolio(startingCash float64) *Portfolio {
 		Trades:        make([]Trade, 0),
 		EquityLog:     make([]EquitySnapshot, 0),
 		PendingOrders: make([]OrderIntent, 0),
+		OpenOrders:    make([]WorkingOrder, 0),
+		Ledger:        NewLedger(FIFO),
+		marks:         make(map[string]float64),
+	}
+}
+
+// Mark records the latest known price of symbol, used for margin checks when
+// fills are booked.
+func (p *Portfolio) Mark(symbol string, price float64) {
+	if p.marks == nil {
+		p.marks = make(map[string]float64)
+	}
+	p.marks[symbol] = price
+}
+
+func (p *Portfolio) markPrices() map[string]float64 {
+	marks := make(map[string]float64, len(p.marks))
+	for symbol, price := range p.marks {
+		marks[symbol] = price
 	}
+	return marks
 }
 
+// SubmitOrder queues an order intent. Strategies must use this rather than
+// Buy/Sell so that the engine can run it through the risk manager and fill it
+// (backtest) or route it to the broker (live).
 func (p *Portfolio) SubmitOrder(intent OrderIntent) {
 	p.PendingOrders = append(p.PendingOrders, intent)
 }
 
-func (p *Portfolio) Buy(symbol string, qty float64, price float64, ts time.Time) {
-	cost := qty * price
-	if p.Cash >= cost {
-		p.Cash -= cost
-		p.Positions[symbol] += qty
-		p.Trades = append(p.Trades, Trade{
-			Timestamp: ts,
-			Symbol:    symbol,
-			Side:      Buy,
-			Quantity:  qty,
-			Price:     price,
-		})
+// CancelOrders requests cancellation of every open order for symbol, or of
+// all open orders when symbol is empty. Cancels are processed by the engine
+// after the strategy's OnBar returns.
+func (p *Portfolio) CancelOrders(symbol string) {
+	p.cancels = append(p.cancels, symbol)
+}
+
+// HasOrders reports whether symbol has an order submitted this bar or still
+// open, so a strategy doesn't enter again while its entry awaits a fill.
+func (p *Portfolio) HasOrders(symbol string) bool {
+	for _, intent := range p.PendingOrders {
+		if intent.Symbol == symbol {
+			return true
+		}
+	}
+	for _, o := range p.OpenOrders {
+		if o.Symbol == symbol {
+			return true
+		}
 	}
+	return false
+}
+
+func (p *Portfolio) Buy(symbol string, qty float64, price float64, ts time.Time) {
+	p.ApplyFill(Trade{Timestamp: ts, Symbol: symbol, Side: Buy, Quantity: qty, Price: price})
 }
 
 func (p *Portfolio) Sell(symbol string, qty float64, price float64, ts time.Time) {
-	if p.Positions[symbol] >= qty {
-		p.Positions[symbol] -= qty
-		p.Cash += qty * price
-		p.Trades = append(p.Trades, Trade{
-			Timestamp: ts,
-			Symbol:    symbol,
-			Side:      Sell,
-			Quantity:  qty,
-			Price:     price,
-		})
+	p.ApplyFill(Trade{Timestamp: ts, Symbol: symbol, Side: Sell, Quantity: qty, Price: price})
+}
+
+// ApplyFill books an executed trade, including its commission, and reports
+// whether the portfolio could afford it. Positions are signed: selling more
+// than is held opens a short when the margin config allows it.
+func (p *Portfolio) ApplyFill(t Trade) bool {
+	if t.Side != Buy && t.Side != Sell {
+		return false
+	}
+	maxQty := p.MaxQuantity(t.Symbol, t.Side, t.Price, t.Commission)
+	if t.Quantity > maxQty*(1+1e-9) {
+		return false
+	}
+
+	p.bookFill(t)
+	return true
+}
+
+// bookFill records t without checking that it is affordable, for fills a
+// broker has already executed.
+func (p *Portfolio) bookFill(t Trade) {
+	if t.Side == Buy {
+		p.Cash -= t.Quantity*t.Price + t.Commission
+		p.Positions[t.Symbol] += t.Quantity
+	} else {
+		p.Cash += t.Quantity*t.Price - t.Commission
+		p.Positions[t.Symbol] -= t.Quantity
+	}
+	if math.Abs(p.Positions[t.Symbol]) < 1e-9 {
+		p.Positions[t.Symbol] = 0
 	}
+	p.Mark(t.Symbol, t.Price)
+	p.Trades = append(p.Trades, t)
+	if p.Ledger != nil {
+		p.Ledger.Record(t)
+	}
+}
+
+// Equity is the portfolio's value marked to the latest prices it has seen.
+func (p *Portfolio) Equity() float64 {
+	return p.CalculateEquity(p.marks)
 }
 
 func (p *Portfolio) CalculateEquity(prices map[string]float64) float64 {
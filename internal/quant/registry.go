@@ -0,0 +1,270 @@
+package quant
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type ParamType string
+
+const (
+	IntParam   ParamType = "int"
+	FloatParam ParamType = "float"
+)
+
+// ParamSpec describes one tunable strategy parameter.
+type ParamSpec struct {
+	Name        string    `json:"name"`
+	Type        ParamType `json:"type"`
+	Default     float64   `json:"default"`
+	Min         float64   `json:"min"`
+	Max         float64   `json:"max"`
+	Description string    `json:"description"`
+}
+
+// Params holds resolved parameter values keyed by name.
+type Params map[string]float64
+
+func (p Params) Int(name string) int {
+	return int(p[name])
+}
+
+func (p Params) Float(name string) float64 {
+	return p[name]
+}
+
+// StrategyFactory builds a strategy for symbols from resolved params.
+type StrategyFactory func(symbols []string, params Params) (Strategy, error)
+
+// StrategySpec is a registered strategy: its identity, parameter schema and
+// constructor.
+type StrategySpec struct {
+	ID          string          `json:"id"`
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	MinSymbols  int             `json:"min_symbols"`
+	Params      []ParamSpec     `json:"parameters"`
+	Factory     StrategyFactory `json:"-"`
+}
+
+// RiskParams are accepted by every strategy. They configure its risk manager
+// and, for live sessions, its trading hours.
+var RiskParams = []ParamSpec{
+	{
+		Name:        "max_position_size_pct",
+		Type:        FloatParam,
+		Default:     0.05,
+		Min:         0,
+		Max:         1,
+		Description: "Largest position as a fraction of equity (0 disables the limit)",
+	},
+	{
+		Name:        "daily_stop_loss_pct",
+		Type:        FloatParam,
+		Default:     0.02,
+		Min:         0,
+		Max:         1,
+		Description: "Drawdown from the day's peak equity that halts new entries until the next session (0 disables the halt)",
+	},
+	{
+		Name:        "flatten_minutes_before_close",
+		Type:        IntParam,
+		Default:     0,
+		Min:         0,
+		Max:         390,
+		Description: "Minutes before the close at which a live session closes its positions until the next session (0 disables)",
+	},
+	{
+		Name:        "queue_off_hours_orders",
+		Type:        IntParam,
+		Default:     0,
+		Min:         0,
+		Max:         1,
+		Description: "1 holds a live session's orders submitted outside regular hours until the next open; 0 rejects them",
+	},
+}
+
+var (
+	registry   = make(map[string]StrategySpec)
+	registryMu sync.RWMutex
+)
+
+// RegisterStrategy adds spec to the registry. It panics on a duplicate or
+// incomplete registration, which is a programming error.
+func RegisterStrategy(spec StrategySpec) {
+	if spec.ID == "" || spec.Factory == nil {
+		panic("quant: strategy registration requires an ID and a factory")
+	}
+	if spec.MinSymbols < 1 {
+		spec.MinSymbols = 1
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[spec.ID]; ok {
+		panic("quant: strategy registered twice: " + spec.ID)
+	}
+	registry[spec.ID] = spec
+}
+
+// LookupStrategy finds a strategy by ID. Sessions saved before the registry
+// stored the display name, so that is accepted as a fallback.
+func LookupStrategy(idOrName string) (StrategySpec, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	if spec, ok := registry[idOrName]; ok {
+		return spec, true
+	}
+	for _, spec := range registry {
+		if strings.EqualFold(spec.Name, idOrName) {
+			return spec, true
+		}
+	}
+	return StrategySpec{}, false
+}
+
+// Strategies returns every registered strategy ordered by ID.
+func Strategies() []StrategySpec {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	specs := make([]StrategySpec, 0, len(registry))
+	for _, spec := range registry {
+		specs = append(specs, spec)
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].ID < specs[j].ID })
+	return specs
+}
+
+// AllParams is the strategy's own parameters followed by the shared risk and
+// sizing parameters. A strategy may declare a shared parameter itself to
+// give it a different default, which replaces the shared one.
+func (s StrategySpec) AllParams() []ParamSpec {
+	all := make([]ParamSpec, 0, len(s.Params)+len(RiskParams)+len(SizingParams))
+	all = append(all, s.Params...)
+	for _, shared := range [][]ParamSpec{RiskParams, SizingParams} {
+		for _, p := range shared {
+			if !s.declares(p.Name) {
+				all = append(all, p)
+			}
+		}
+	}
+	return all
+}
+
+func (s StrategySpec) declares(name string) bool {
+	for _, p := range s.Params {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve validates raw parameters against the strategy's schema and the
+// shared risk and sizing parameters, filling in defaults for anything
+// missing.
+func (s StrategySpec) Resolve(raw map[string]interface{}) (Params, error) {
+	all := s.AllParams()
+	specs := make(map[string]ParamSpec, len(all))
+	params := make(Params, len(all))
+	for _, p := range all {
+		specs[p.Name] = p
+		params[p.Name] = p.Default
+	}
+
+	names := make([]string, 0, len(raw))
+	for name := range raw {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		spec, ok := specs[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown parameter %q for strategy %s", name, s.ID)
+		}
+
+		v, err := toFloat(raw[name])
+		if err != nil {
+			return nil, fmt.Errorf("parameter %q: %w", name, err)
+		}
+		if spec.Type == IntParam && v != math.Trunc(v) {
+			return nil, fmt.Errorf("parameter %q must be an integer, got %v", name, v)
+		}
+		if v < spec.Min || v > spec.Max {
+			return nil, fmt.Errorf(
+				"parameter %q out of range: %v not in [%v, %v]",
+				name,
+				v,
+				spec.Min,
+				spec.Max,
+			)
+		}
+		params[name] = v
+	}
+
+	return params, nil
+}
+
+// Build resolves raw parameters and constructs the strategy for symbols.
+func (s StrategySpec) Build(
+	symbols []string,
+	raw map[string]interface{},
+) (Strategy, Params, error) {
+	if len(symbols) < s.MinSymbols {
+		return nil, nil, fmt.Errorf("strategy %s requires at least %d symbols", s.ID, s.MinSymbols)
+	}
+
+	params, err := s.Resolve(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	strategy, err := s.Factory(symbols, params)
+	if err != nil {
+		return nil, nil, err
+	}
+	return strategy, params, nil
+}
+
+// NewStrategy looks up id and builds it for symbols.
+func NewStrategy(
+	id string,
+	symbols []string,
+	raw map[string]interface{},
+) (Strategy, Params, error) {
+	spec, ok := LookupStrategy(id)
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown strategy %q", id)
+	}
+	return spec.Build(symbols, raw)
+}
+
+// NewRiskManagerFromParams builds the risk manager the resolved risk
+// parameters describe.
+func NewRiskManagerFromParams(params Params) *RuleRiskManager {
+	return NewRuleRiskManager(RiskConfigFromParams(params))
+}
+
+func toFloat(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case float32:
+		return float64(n), nil
+	case int:
+		return float64(n), nil
+	case int64:
+		return float64(n), nil
+	case json.Number:
+		return n.Float64()
+	default:
+		return 0, fmt.Errorf("expected a number, got %T", v)
+	}
+}
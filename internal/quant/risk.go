@@ -1,6 +1,17 @@
 package quant
 
-import "fmt"
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"citadel/internal/broker"
+
+	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
+)
 
 type RiskManager interface {
 	EvaluateOrder(
@@ -11,89 +22,710 @@ type RiskManager interface {
 	EvaluatePortfolio(p *Portfolio, currentPrices map[string]float64) error
 }
 
-type DefaultRiskManager struct {
-	MaxPositionSizePct float64
-	DailyStopLossPct   float64
+// BarObserver is implemented by risk managers that follow the market bar by
+// bar, to measure volatility or limit orders per minute. The engines pass
+// every bar to ObserveBar before evaluating anything on it.
+type BarObserver interface {
+	ObserveBar(symbol string, bar marketdata.Bar)
+}
 
-	peakEquity float64
-	halted     bool
+// Reasons a risk rule, or the live engine, refuses an order. They are stable
+// and meant for machines; the accompanying message is for people.
+const (
+	RejectKillSwitch      = "kill_switch"
+	RejectGrossExposure   = "max_gross_exposure"
+	RejectNetExposure     = "max_net_exposure"
+	RejectPositionSize    = "max_position_size"
+	RejectSectorExposure  = "max_sector_exposure"
+	RejectOpenPositions   = "max_open_positions"
+	RejectOrderRate       = "max_orders_per_minute"
+	RejectDailyLoss       = "daily_loss_limit"
+	RejectWeeklyLoss      = "weekly_loss_limit"
+	RejectVolatility      = "volatility_sizing"
+	RejectStopOutCooldown = "stop_out_cooldown"
+	RejectMarketClosed    = "market_closed"
+	RejectInvalidOrder    = "invalid_order"
+	RejectSubAccount      = "sub_account"
+	RejectBroker          = "broker"
+	RejectRiskLimit       = "risk_limit" // a risk manager's error that gave no reason
+)
+
+// RiskRejection is why a risk rule refused an order or halted the strategy.
+type RiskRejection struct {
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+func (r *RiskRejection) Error() string {
+	return r.Message
 }
 
-func NewDefaultRiskManager(maxPositionSizePct, dailyStopLossPct float64) *DefaultRiskManager {
-	return &DefaultRiskManager{
-		MaxPositionSizePct: maxPositionSizePct,
-		DailyStopLossPct:   dailyStopLossPct,
+func rejection(reason, format string, args ...interface{}) *RiskRejection {
+	return &RiskRejection{Reason: reason, Message: fmt.Sprintf(format, args...)}
+}
+
+// RejectionReason returns the machine-readable reason for err, a risk
+// manager's refusal.
+func RejectionReason(err error) string {
+	var r *RiskRejection
+	if errors.As(err, &r) {
+		return r.Reason
 	}
+	return RejectRiskLimit
 }
 
-func (rm *DefaultRiskManager) EvaluateOrder(
-	intent OrderIntent,
-	p *Portfolio,
-	currentPrices map[string]float64,
-) (OrderIntent, error) {
-	if rm.halted && intent.Side == Buy {
-		return intent, fmt.Errorf("risk halt triggered: blocking new entries")
+// RiskConfig configures a RuleRiskManager. Zero values disable a limit.
+// Fractions are of the portfolio's equity.
+type RiskConfig struct {
+	// KillSwitch refuses every order that opens or grows a position.
+	KillSwitch bool `json:"kill_switch"`
+
+	MaxGrossExposurePct float64 `json:"max_gross_exposure_pct"` // long plus short
+	MaxNetExposurePct   float64 `json:"max_net_exposure_pct"`   // long less short, either way
+	MaxPositionPct      float64 `json:"max_position_pct"`       // any one symbol
+
+	// SymbolCaps overrides MaxPositionPct for particular symbols.
+	SymbolCaps map[string]float64 `json:"symbol_caps,omitempty"`
+
+	// Sectors assigns symbols to sectors, and SectorCaps caps the gross
+	// exposure of each sector.
+	Sectors    map[string]string  `json:"sectors,omitempty"`
+	SectorCaps map[string]float64 `json:"sector_caps,omitempty"`
+
+	MaxOpenPositions   int     `json:"max_open_positions"`
+	MaxOrderNotional   float64 `json:"max_order_notional"` // dollars; larger orders are cut down to it
+	MaxOrdersPerMinute int     `json:"max_orders_per_minute"`
+
+	// Loss limits halt new entries once equity falls this far below its
+	// peak for the trading day or week, until the next one begins.
+	DailyLossLimitPct  float64 `json:"daily_loss_limit_pct"`
+	WeeklyLossLimitPct float64 `json:"weekly_loss_limit_pct"`
+
+	VolatilitySizing VolatilitySizing `json:"volatility_sizing"`
+
+	// StopOutCooldownMinutes refuses new entries in a symbol for this long
+	// after a round trip in it closes at a loss.
+	StopOutCooldownMinutes float64 `json:"stop_out_cooldown_minutes"`
+}
+
+// VolatilitySizing caps a position so that a move of one standard deviation
+// of its recent bar-to-bar returns costs at most RiskPct of equity. Symbols
+// with fewer than Lookback returns yet aren't capped.
+type VolatilitySizing struct {
+	RiskPct  float64 `json:"risk_pct"`
+	Lookback int     `json:"lookback"` // default 20
+}
+
+// RiskConfigFromParams is the configuration the shared risk parameters
+// describe.
+func RiskConfigFromParams(params Params) RiskConfig {
+	return RiskConfig{
+		MaxPositionPct:    params.Float("max_position_size_pct"),
+		DailyLossLimitPct: params.Float("daily_stop_loss_pct"),
 	}
+}
 
-	if intent.Side != Buy {
-		return intent, nil
+// ParseRiskConfig layers raw, a JSON object of RiskConfig fields, over the
+// configuration params describe, and validates the result. Empty raw leaves
+// the params' configuration as it is.
+func ParseRiskConfig(params Params, raw []byte) (RiskConfig, error) {
+	cfg := RiskConfigFromParams(params)
+	if len(bytes.TrimSpace(raw)) > 0 && !bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&cfg); err != nil {
+			return RiskConfig{}, fmt.Errorf("invalid risk config: %w", err)
+		}
 	}
+	return cfg, cfg.Validate()
+}
 
-	if rm.MaxPositionSizePct <= 0 {
-		return intent, nil // No limit
+func (c RiskConfig) Validate() error {
+	limits := map[string]float64{
+		"max_gross_exposure_pct":     c.MaxGrossExposurePct,
+		"max_net_exposure_pct":       c.MaxNetExposurePct,
+		"max_position_pct":           c.MaxPositionPct,
+		"daily_loss_limit_pct":       c.DailyLossLimitPct,
+		"weekly_loss_limit_pct":      c.WeeklyLossLimitPct,
+		"volatility_sizing.risk_pct": c.VolatilitySizing.RiskPct,
+		"max_order_notional":         c.MaxOrderNotional,
+		"stop_out_cooldown_minutes":  c.StopOutCooldownMinutes,
+		"max_open_positions":         float64(c.MaxOpenPositions),
+		"max_orders_per_minute":      float64(c.MaxOrdersPerMinute),
+		"volatility_sizing.lookback": float64(c.VolatilitySizing.Lookback),
 	}
+	for name, v := range limits {
+		if v < 0 || math.IsNaN(v) {
+			return fmt.Errorf("risk config %s must not be negative", name)
+		}
+	}
+	for _, limit := range []struct {
+		name string
+		v    float64
+	}{
+		{"daily_loss_limit_pct", c.DailyLossLimitPct},
+		{"weekly_loss_limit_pct", c.WeeklyLossLimitPct},
+	} {
+		if limit.v > 1 {
+			return fmt.Errorf("risk config %s must be at most 1", limit.name)
+		}
+	}
+	if c.VolatilitySizing.Lookback == 1 {
+		return errors.New("risk config volatility_sizing.lookback must be at least 2")
+	}
+	for symbol, cap := range c.SymbolCaps {
+		if cap < 0 {
+			return fmt.Errorf("risk config symbol_caps.%s must not be negative", symbol)
+		}
+	}
+	for sector, cap := range c.SectorCaps {
+		if cap < 0 {
+			return fmt.Errorf("risk config sector_caps.%s must not be negative", sector)
+		}
+	}
+	return nil
+}
 
-	equity := p.CalculateEquity(currentPrices)
-	maxPositionDollar := equity * rm.MaxPositionSizePct
+// RiskContext is what a rule sees of the portfolio when it is consulted.
+type RiskContext struct {
+	Portfolio *Portfolio
+	Prices    map[string]float64
+	Equity    float64
+	Now       time.Time // the latest bar's time
+}
+
+// projected returns a copy of p as it would stand once the signed
+// quantities in unfilled traded at prices, for checking an order against the
+// others approved with it.
+func (p *Portfolio) projected(unfilled, prices map[string]float64) *Portfolio {
+	if len(unfilled) == 0 {
+		return p
+	}
+	q := *p
+	q.Positions = make(map[string]float64, len(p.Positions)+len(unfilled))
+	for symbol, qty := range p.Positions {
+		q.Positions[symbol] = qty
+	}
+	for symbol, qty := range unfilled {
+		q.Positions[symbol] += qty
+		q.Cash -= qty * prices[symbol]
+	}
+	return &q
+}
 
-	currentPrice := currentPrices[intent.Symbol]
-	if currentPrice <= 0 {
-		return intent, nil // fallback if price unknown
+// price is the price intent is expected to trade at, or 0 if unknown.
+func (c *RiskContext) price(intent OrderIntent) float64 {
+	if intent.LimitPrice != nil {
+		return *intent.LimitPrice
 	}
+	return c.Prices[intent.Symbol]
+}
+
+// RiskRule is one check of a RuleRiskManager. CheckOrder is only consulted
+// for orders that open or grow a position; it returns the order, possibly
+// with a smaller quantity, or a *RiskRejection.
+//
+// A rule may also implement PortfolioRule, BarObserver or SessionListener.
+type RiskRule interface {
+	CheckOrder(c *RiskContext, intent OrderIntent) (OrderIntent, error)
+}
+
+// PortfolioRule is a RiskRule that also watches the portfolio as a whole.
+// An error halts the strategy for the bar.
+type PortfolioRule interface {
+	CheckPortfolio(c *RiskContext) error
+}
 
-	currentPositionQty := p.Positions[intent.Symbol]
-	currentPositionDollar := currentPositionQty * currentPrice
+// RuleRiskManager is a RiskManager made of rules, each consulted in turn.
+// Orders that only shrink a position always pass.
+type RuleRiskManager struct {
+	Rules []RiskRule
 
-	requestedDollar := intent.Quantity * currentPrice
-	newPositionDollar := currentPositionDollar + requestedDollar
+	config RiskConfig
+	now    time.Time
+}
 
-	if newPositionDollar > maxPositionDollar {
-		allowedDollar := maxPositionDollar - currentPositionDollar
-		if allowedDollar <= 0 {
-			return intent, fmt.Errorf("max position size reached for %s", intent.Symbol)
+// NewRuleRiskManager builds the standard rules, configured by cfg.
+func NewRuleRiskManager(cfg RiskConfig) *RuleRiskManager {
+	m := &RuleRiskManager{
+		Rules: []RiskRule{
+			&killSwitch{},
+			&lossLimit{reason: RejectDailyLoss, period: "day"},
+			&lossLimit{reason: RejectWeeklyLoss, period: "week"},
+			&stopOutCooldown{until: make(map[string]time.Time)},
+			&openPositionLimit{},
+			&positionLimit{},
+			&sectorLimit{},
+			&exposureLimit{},
+			&volatilitySizing{returns: make(map[string][]float64), last: make(map[string]float64)},
+			&orderNotionalLimit{},
+			&orderRateLimit{},
+		},
+	}
+	m.Configure(cfg)
+	return m
+}
+
+// NewRiskManager builds the risk manager for a strategy's resolved params
+// and a JSON risk config layered over them; see ParseRiskConfig.
+func NewRiskManager(params Params, raw []byte) (*RuleRiskManager, error) {
+	cfg, err := ParseRiskConfig(params, raw)
+	if err != nil {
+		return nil, err
+	}
+	return NewRuleRiskManager(cfg), nil
+}
+
+// Config returns the manager's configuration.
+func (m *RuleRiskManager) Config() RiskConfig {
+	return m.config
+}
+
+// Configure reconfigures the standard rules in place, so what they have
+// tracked, such as the day's peak equity and recent orders, carries on.
+func (m *RuleRiskManager) Configure(cfg RiskConfig) {
+	m.config = cfg
+	for _, r := range m.Rules {
+		if c, ok := r.(interface{ configure(RiskConfig) }); ok {
+			c.configure(cfg)
+		}
+	}
+}
+
+func (m *RuleRiskManager) ObserveBar(symbol string, bar marketdata.Bar) {
+	if bar.Timestamp.After(m.now) {
+		m.now = bar.Timestamp
+	}
+	for _, r := range m.Rules {
+		if o, ok := r.(BarObserver); ok {
+			o.ObserveBar(symbol, bar)
 		}
-		// Modify intent quantity to fit the limit
-		allowedQty := allowedDollar / currentPrice
-		intent.Quantity = allowedQty
+	}
+}
+
+func (m *RuleRiskManager) OnSessionOpen(session broker.MarketSession) {
+	for _, r := range m.Rules {
+		if l, ok := r.(SessionListener); ok {
+			l.OnSessionOpen(session)
+		}
+	}
+}
+
+func (m *RuleRiskManager) context(p *Portfolio, prices map[string]float64) *RiskContext {
+	return &RiskContext{
+		Portfolio: p,
+		Prices:    prices,
+		Equity:    p.CalculateEquity(prices),
+		Now:       m.now,
+	}
+}
+
+func (m *RuleRiskManager) EvaluateOrder(
+	intent OrderIntent,
+	p *Portfolio,
+	currentPrices map[string]float64,
+) (OrderIntent, error) {
+	if reduces(p.Positions[intent.Symbol], intent) {
+		return intent, nil
 	}
 
+	c := m.context(p, currentPrices)
+	for _, r := range m.Rules {
+		var err error
+		if intent, err = r.CheckOrder(c, intent); err != nil {
+			return intent, err
+		}
+	}
+	for _, r := range m.Rules {
+		if rec, ok := r.(interface {
+			approved(*RiskContext, OrderIntent)
+		}); ok {
+			rec.approved(c, intent)
+		}
+	}
 	return intent, nil
 }
 
-func (rm *DefaultRiskManager) EvaluatePortfolio(
+// EvaluatePortfolio runs every PortfolioRule, returning the first breach.
+func (m *RuleRiskManager) EvaluatePortfolio(
 	p *Portfolio,
 	currentPrices map[string]float64,
 ) error {
-	if rm.DailyStopLossPct <= 0 {
-		return nil
+	c := m.context(p, currentPrices)
+	var breach error
+	for _, r := range m.Rules {
+		if pr, ok := r.(PortfolioRule); ok {
+			// Every rule sees every bar, even after a breach
+			if err := pr.CheckPortfolio(c); err != nil && breach == nil {
+				breach = err
+			}
+		}
 	}
+	return breach
+}
 
-	equity := p.CalculateEquity(currentPrices)
+// reduces reports whether intent only shrinks a position of qty.
+func reduces(qty float64, intent OrderIntent) bool {
+	next := qty + intent.signedQuantity()
+	return next == 0 || (math.Abs(next) <= math.Abs(qty) && math.Signbit(next) == math.Signbit(qty))
+}
 
-	// Initialize peak equity
-	if rm.peakEquity == 0 || equity > rm.peakEquity {
-		rm.peakEquity = equity
+// limitPosition fits intent so the position it leaves is within [lo, hi],
+// rejecting it for reason when no quantity in its direction fits.
+func limitPosition(
+	intent OrderIntent,
+	qty, lo, hi float64,
+	reason, format string,
+	args ...interface{},
+) (OrderIntent, error) {
+	room := hi - qty // a buy can add this much
+	if intent.Side == Sell {
+		room = qty - lo
+	}
+	if room <= 1e-9 {
+		return intent, rejection(reason, format, args...)
 	}
+	intent.Quantity = math.Min(intent.Quantity, room)
+	return intent, nil
+}
+
+type killSwitch struct {
+	engaged bool
+}
+
+func (r *killSwitch) configure(cfg RiskConfig) { r.engaged = cfg.KillSwitch }
 
-	drawdown := (rm.peakEquity - equity) / rm.peakEquity
-	if drawdown >= rm.DailyStopLossPct {
-		rm.halted = true
-		return fmt.Errorf(
-			"daily stop-loss triggered: drawdown %.2f%% >= %.2f%%",
-			drawdown*100,
-			rm.DailyStopLossPct*100,
-		)
+func (r *killSwitch) CheckOrder(c *RiskContext, intent OrderIntent) (OrderIntent, error) {
+	if r.engaged {
+		return intent, rejection(RejectKillSwitch, "kill switch engaged: blocking new entries")
 	}
+	return intent, nil
+}
+
+// lossLimit halts new entries once equity falls maxPct below its peak for
+// the period, a trading day or week, until the next period begins.
+type lossLimit struct {
+	reason string
+	period string // day or week
+	maxPct float64
 
+	current    string  // the period being tracked
+	peak       float64 // highest equity in the period
+	lastEquity float64 // as of the latest CheckPortfolio
+	halted     bool
+}
+
+func (r *lossLimit) configure(cfg RiskConfig) {
+	r.maxPct = cfg.DailyLossLimitPct
+	if r.period == "week" {
+		r.maxPct = cfg.WeeklyLossLimitPct
+	}
+}
+
+// OnSessionOpen starts a new period when the session begins one: the peak
+// is reset to the equity carried over from the previous close and any halt
+// is lifted.
+func (r *lossLimit) OnSessionOpen(session broker.MarketSession) {
+	key := session.Date
+	if r.period == "week" {
+		year, week := session.Open.ISOWeek()
+		key = fmt.Sprintf("%d-W%02d", year, week)
+	}
+	if key == r.current {
+		return
+	}
+	r.current = key
+	r.peak = r.lastEquity
+	r.halted = false
+}
+
+func (r *lossLimit) CheckPortfolio(c *RiskContext) error {
+	r.lastEquity = c.Equity
+	if r.maxPct <= 0 {
+		return nil
+	}
+	if r.peak == 0 || c.Equity > r.peak {
+		r.peak = c.Equity
+	}
+	drawdown := (r.peak - c.Equity) / r.peak
+	if drawdown >= r.maxPct {
+		r.halted = true
+		return rejection(r.reason, "%s loss limit triggered: drawdown %.2f%% >= %.2f%%",
+			map[string]string{"day": "daily", "week": "weekly"}[r.period],
+			drawdown*100, r.maxPct*100)
+	}
+	return nil
+}
+
+func (r *lossLimit) CheckOrder(c *RiskContext, intent OrderIntent) (OrderIntent, error) {
+	if r.halted && r.maxPct > 0 {
+		return intent, rejection(r.reason, "%s loss limit reached: blocking new entries",
+			map[string]string{"day": "daily", "week": "weekly"}[r.period])
+	}
+	return intent, nil
+}
+
+// stopOutCooldown refuses new entries in a symbol for a while after a round
+// trip in it closes at a loss.
+type stopOutCooldown struct {
+	cooldown time.Duration
+	seen     int // round trips of the ledger already looked at
+	until    map[string]time.Time
+}
+
+func (r *stopOutCooldown) configure(cfg RiskConfig) {
+	r.cooldown = time.Duration(cfg.StopOutCooldownMinutes * float64(time.Minute))
+}
+
+func (r *stopOutCooldown) CheckPortfolio(c *RiskContext) error {
+	r.scan(c.Portfolio)
 	return nil
 }
+
+func (r *stopOutCooldown) scan(p *Portfolio) {
+	if p.Ledger == nil {
+		return
+	}
+	if r.seen > len(p.Ledger.RoundTrips) {
+		r.seen = 0 // a new ledger
+	}
+	for _, rt := range p.Ledger.RoundTrips[r.seen:] {
+		if rt.PnL < 0 {
+			r.until[rt.Symbol] = rt.ExitTime.Add(r.cooldown)
+		}
+	}
+	r.seen = len(p.Ledger.RoundTrips)
+}
+
+func (r *stopOutCooldown) CheckOrder(c *RiskContext, intent OrderIntent) (OrderIntent, error) {
+	r.scan(c.Portfolio)
+	if r.cooldown <= 0 {
+		return intent, nil
+	}
+	if until, ok := r.until[intent.Symbol]; ok && c.Now.Before(until) {
+		return intent, rejection(RejectStopOutCooldown,
+			"%s stopped out; no new entries until %s", intent.Symbol, until.Format(time.RFC3339))
+	}
+	return intent, nil
+}
+
+type openPositionLimit struct {
+	max int
+}
+
+func (r *openPositionLimit) configure(cfg RiskConfig) { r.max = cfg.MaxOpenPositions }
+
+func (r *openPositionLimit) CheckOrder(c *RiskContext, intent OrderIntent) (OrderIntent, error) {
+	if r.max <= 0 || math.Abs(c.Portfolio.Positions[intent.Symbol]) > 1e-9 {
+		return intent, nil
+	}
+	open := 0
+	for _, qty := range c.Portfolio.Positions {
+		if math.Abs(qty) > 1e-9 {
+			open++
+		}
+	}
+	if open >= r.max {
+		return intent, rejection(RejectOpenPositions,
+			"%d positions already open, the most allowed", open)
+	}
+	return intent, nil
+}
+
+// positionLimit caps each symbol's position, by default at maxPct of equity.
+type positionLimit struct {
+	maxPct float64
+	caps   map[string]float64
+}
+
+func (r *positionLimit) configure(cfg RiskConfig) {
+	r.maxPct = cfg.MaxPositionPct
+	r.caps = cfg.SymbolCaps
+}
+
+func (r *positionLimit) CheckOrder(c *RiskContext, intent OrderIntent) (OrderIntent, error) {
+	pct := r.maxPct
+	if cap, ok := r.caps[intent.Symbol]; ok {
+		pct = cap
+	}
+	price := c.price(intent)
+	if pct <= 0 || price <= 0 {
+		return intent, nil // no limit, or the price is unknown
+	}
+	limit := c.Equity * pct / price
+	return limitPosition(intent, c.Portfolio.Positions[intent.Symbol], -limit, limit,
+		RejectPositionSize, "max position size reached for %s", intent.Symbol)
+}
+
+// sectorLimit caps the gross exposure of each sector.
+type sectorLimit struct {
+	sectors map[string]string
+	caps    map[string]float64
+}
+
+func (r *sectorLimit) configure(cfg RiskConfig) {
+	r.sectors = cfg.Sectors
+	r.caps = cfg.SectorCaps
+}
+
+func (r *sectorLimit) CheckOrder(c *RiskContext, intent OrderIntent) (OrderIntent, error) {
+	sector, ok := r.sectors[intent.Symbol]
+	if !ok {
+		return intent, nil
+	}
+	pct := r.caps[sector]
+	price := c.price(intent)
+	if pct <= 0 || price <= 0 {
+		return intent, nil
+	}
+
+	// What the sector's other symbols hold leaves the rest for this one
+	others := 0.0
+	for symbol, qty := range c.Portfolio.Positions {
+		if symbol != intent.Symbol && r.sectors[symbol] == sector {
+			others += math.Abs(qty) * c.Prices[symbol]
+		}
+	}
+	limit := (c.Equity*pct - others) / price
+	return limitPosition(intent, c.Portfolio.Positions[intent.Symbol], -limit, limit,
+		RejectSectorExposure, "max exposure reached for sector %s", sector)
+}
+
+// exposureLimit caps the portfolio's gross and net exposure.
+type exposureLimit struct {
+	grossPct float64
+	netPct   float64
+}
+
+func (r *exposureLimit) configure(cfg RiskConfig) {
+	r.grossPct = cfg.MaxGrossExposurePct
+	r.netPct = cfg.MaxNetExposurePct
+}
+
+func (r *exposureLimit) CheckOrder(c *RiskContext, intent OrderIntent) (OrderIntent, error) {
+	price := c.price(intent)
+	if price <= 0 {
+		return intent, nil
+	}
+	qty := c.Portfolio.Positions[intent.Symbol]
+
+	var gross, net float64 // of the other symbols
+	for symbol, q := range c.Portfolio.Positions {
+		if symbol != intent.Symbol {
+			gross += math.Abs(q) * c.Prices[symbol]
+			net += q * c.Prices[symbol]
+		}
+	}
+
+	var err error
+	if r.grossPct > 0 {
+		limit := (c.Equity*r.grossPct - gross) / price
+		intent, err = limitPosition(intent, qty, -limit, limit,
+			RejectGrossExposure, "max gross exposure reached")
+		if err != nil {
+			return intent, err
+		}
+	}
+	if r.netPct > 0 {
+		lo := (-c.Equity*r.netPct - net) / price
+		hi := (c.Equity*r.netPct - net) / price
+		intent, err = limitPosition(intent, qty, lo, hi,
+			RejectNetExposure, "max net exposure reached")
+	}
+	return intent, err
+}
+
+// volatilitySizing caps positions by the volatility of recent returns; see
+// VolatilitySizing.
+type volatilitySizing struct {
+	riskPct  float64
+	lookback int
+
+	last    map[string]float64   // latest close by symbol
+	returns map[string][]float64 // latest returns by symbol, oldest first
+}
+
+func (r *volatilitySizing) configure(cfg RiskConfig) {
+	r.riskPct = cfg.VolatilitySizing.RiskPct
+	r.lookback = cfg.VolatilitySizing.Lookback
+	if r.lookback == 0 {
+		r.lookback = 20
+	}
+}
+
+func (r *volatilitySizing) ObserveBar(symbol string, bar marketdata.Bar) {
+	if last := r.last[symbol]; last > 0 {
+		returns := append(r.returns[symbol], bar.Close/last-1)
+		if len(returns) > 256 {
+			returns = returns[len(returns)-256:]
+		}
+		r.returns[symbol] = returns
+	}
+	r.last[symbol] = bar.Close
+}
+
+func (r *volatilitySizing) CheckOrder(c *RiskContext, intent OrderIntent) (OrderIntent, error) {
+	returns := r.returns[intent.Symbol]
+	price := c.price(intent)
+	if r.riskPct <= 0 || len(returns) < r.lookback || price <= 0 {
+		return intent, nil
+	}
+	vol := stdDev(returns[len(returns)-r.lookback:])
+	if vol <= 0 {
+		return intent, nil
+	}
+	limit := c.Equity * r.riskPct / (price * vol)
+	return limitPosition(intent, c.Portfolio.Positions[intent.Symbol], -limit, limit,
+		RejectVolatility, "%s position already at its volatility-scaled size", intent.Symbol)
+}
+
+// orderNotionalLimit cuts orders down to a maximum dollar value rather than
+// refusing them.
+type orderNotionalLimit struct {
+	max float64
+}
+
+func (r *orderNotionalLimit) configure(cfg RiskConfig) { r.max = cfg.MaxOrderNotional }
+
+func (r *orderNotionalLimit) CheckOrder(c *RiskContext, intent OrderIntent) (OrderIntent, error) {
+	price := c.price(intent)
+	if r.max <= 0 || price <= 0 || intent.Quantity*price <= r.max {
+		return intent, nil
+	}
+	intent.Quantity = r.max / price
+	return intent, nil
+}
+
+// orderRateLimit refuses orders beyond max in any minute of bar time.
+type orderRateLimit struct {
+	max    int
+	recent []time.Time // approved orders in the last minute
+}
+
+func (r *orderRateLimit) configure(cfg RiskConfig) { r.max = cfg.MaxOrdersPerMinute }
+
+func (r *orderRateLimit) prune(now time.Time) {
+	i := 0
+	for i < len(r.recent) && !r.recent[i].After(now.Add(-time.Minute)) {
+		i++
+	}
+	r.recent = r.recent[i:]
+}
+
+func (r *orderRateLimit) CheckOrder(c *RiskContext, intent OrderIntent) (OrderIntent, error) {
+	if r.max <= 0 {
+		return intent, nil
+	}
+	r.prune(c.Now)
+	if len(r.recent) >= r.max {
+		return intent, rejection(RejectOrderRate, "%d orders in the last minute, the most allowed",
+			len(r.recent))
+	}
+	return intent, nil
+}
+
+func (r *orderRateLimit) approved(c *RiskContext, _ OrderIntent) {
+	if r.max > 0 {
+		r.recent = append(r.recent, c.Now)
+	}
+}
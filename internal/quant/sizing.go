@@ -0,0 +1,339 @@
+package quant
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
+)
+
+// Sizing methods, chosen with the sizer parameter.
+const (
+	SizeAllIn = iota
+	SizeFixedNotional
+	SizeFixedFraction
+	SizeVolatilityATR
+	SizeVolatilityStdDev
+	SizeKelly
+)
+
+// SizingParams are accepted by every strategy. They pick and configure the
+// Sizer its entries are sized with.
+var SizingParams = []ParamSpec{
+	{
+		Name:    "sizer",
+		Type:    IntParam,
+		Default: SizeAllIn,
+		Min:     SizeAllIn,
+		Max:     SizeKelly,
+		Description: fmt.Sprintf(
+			"How entries are sized: %d all available cash, %d fixed notional, %d fixed fraction of equity, %d volatility target by ATR, %d volatility target by standard deviation, %d fractional Kelly",
+			SizeAllIn,
+			SizeFixedNotional,
+			SizeFixedFraction,
+			SizeVolatilityATR,
+			SizeVolatilityStdDev,
+			SizeKelly,
+		),
+	},
+	{
+		Name:        "size_notional",
+		Type:        FloatParam,
+		Default:     10000,
+		Min:         0,
+		Max:         1e9,
+		Description: "Dollars per entry for the fixed notional sizer",
+	},
+	{
+		Name:        "size_fraction",
+		Type:        FloatParam,
+		Default:     0.1,
+		Min:         0,
+		Max:         1,
+		Description: "Fraction of equity per entry for the fixed fraction sizer, and for the Kelly sizer until it has enough trades",
+	},
+	{
+		Name:        "vol_target",
+		Type:        FloatParam,
+		Default:     0.01,
+		Min:         0,
+		Max:         1,
+		Description: "Fraction of equity a typical one-bar move in the position should be worth, for the volatility sizers",
+	},
+	{
+		Name:        "vol_period",
+		Type:        IntParam,
+		Default:     20,
+		Min:         2,
+		Max:         500,
+		Description: "Bars in the volatility sizers' ATR or standard deviation",
+	},
+	{
+		Name:        "kelly_fraction",
+		Type:        FloatParam,
+		Default:     0.5,
+		Min:         0,
+		Max:         1,
+		Description: "Fraction of the full Kelly bet the Kelly sizer takes",
+	},
+	{
+		Name:        "kelly_min_trades",
+		Type:        IntParam,
+		Default:     20,
+		Min:         1,
+		Max:         10000,
+		Description: "Closed trades the Kelly sizer needs before it trusts its win rate and payoff",
+	},
+	{
+		Name:        "whole_shares",
+		Type:        IntParam,
+		Default:     0,
+		Min:         0,
+		Max:         1,
+		Description: "1 rounds entries down to whole shares, for assets that aren't fractionable",
+	},
+}
+
+// Sizer decides how many shares a strategy's entry trades. Strategies pass
+// it every bar they handle and ask it for a quantity when they enter.
+type Sizer interface {
+	// Observe records a bar, for sizers that measure volatility.
+	Observe(symbol string, bar marketdata.Bar)
+	// Reset forgets everything observed, as Strategy.Initialize does.
+	Reset()
+	// Size returns the shares of symbol to trade at price. budget is the
+	// most the strategy will commit, e.g. its free cash, and caps the
+	// position's value.
+	Size(symbol string, price, budget float64, p *Portfolio) float64
+}
+
+// StatefulSizer is a Sizer whose history is saved with its strategy's state,
+// so a resumed live session doesn't have to measure volatility again.
+type StatefulSizer interface {
+	Sizer
+	MarshalState() ([]byte, error)
+	UnmarshalState(data []byte) error
+}
+
+// NewSizer builds the sizer the resolved sizing parameters describe.
+func NewSizer(params Params) Sizer {
+	var s Sizer
+	switch params.Int("sizer") {
+	case SizeFixedNotional:
+		s = FixedNotional{Notional: params.Float("size_notional")}
+	case SizeFixedFraction:
+		s = FixedFraction{Fraction: params.Float("size_fraction")}
+	case SizeVolatilityATR, SizeVolatilityStdDev:
+		s = &VolatilityTarget{
+			Target: params.Float("vol_target"),
+			Period: params.Int("vol_period"),
+			StdDev: params.Int("sizer") == SizeVolatilityStdDev,
+		}
+	case SizeKelly:
+		s = Kelly{
+			Fraction:  params.Float("kelly_fraction"),
+			MinTrades: params.Int("kelly_min_trades"),
+			Fallback:  params.Float("size_fraction"),
+		}
+	default: // SizeAllIn
+		s = AllIn{}
+	}
+	if params.Int("whole_shares") == 1 {
+		s = WholeShares{Sizer: s}
+	}
+	return s
+}
+
+// stateless supplies the Sizer methods that sizers without history ignore.
+type stateless struct{}
+
+func (stateless) Observe(string, marketdata.Bar) {}
+
+func (stateless) Reset() {}
+
+// shares converts a dollar amount to shares, capped at the budget.
+func shares(notional, price, budget float64) float64 {
+	if price <= 0 || notional <= 0 {
+		return 0
+	}
+	return math.Min(notional, budget) / price
+}
+
+// AllIn spends the whole budget on every entry.
+type AllIn struct{ stateless }
+
+func (AllIn) Size(symbol string, price, budget float64, p *Portfolio) float64 {
+	return shares(budget, price, budget)
+}
+
+// FixedNotional buys the same dollar amount every time.
+type FixedNotional struct {
+	stateless
+	Notional float64
+}
+
+func (s FixedNotional) Size(symbol string, price, budget float64, p *Portfolio) float64 {
+	return shares(s.Notional, price, budget)
+}
+
+// FixedFraction puts a fixed fraction of equity into every entry, so
+// positions grow and shrink with the account.
+type FixedFraction struct {
+	stateless
+	Fraction float64
+}
+
+func (s FixedFraction) Size(symbol string, price, budget float64, p *Portfolio) float64 {
+	return shares(s.Fraction*p.Equity(), price, budget)
+}
+
+// VolatilityTarget sizes positions inversely to the symbol's volatility, so
+// a typical one-bar move is worth Target of equity. Volatility is the
+// average true range over Period bars, or with StdDev the standard deviation
+// of the bar-to-bar change in the close. Until Period bars have been seen
+// it sizes nothing.
+type VolatilityTarget struct {
+	Target float64
+	Period int
+	StdDev bool
+
+	bars map[string][]marketdata.Bar
+}
+
+func (s *VolatilityTarget) Observe(symbol string, bar marketdata.Bar) {
+	if s.bars == nil {
+		s.bars = make(map[string][]marketdata.Bar)
+	}
+	// One extra bar supplies the previous close for the first range or change
+	bars := append(s.bars[symbol], bar)
+	if len(bars) > s.Period+1 {
+		bars = bars[len(bars)-s.Period-1:]
+	}
+	s.bars[symbol] = bars
+}
+
+func (s *VolatilityTarget) Reset() {
+	s.bars = nil
+}
+
+func (s *VolatilityTarget) Size(symbol string, price, budget float64, p *Portfolio) float64 {
+	vol := s.volatility(symbol)
+	if vol <= 0 {
+		return 0
+	}
+	return shares(s.Target*p.Equity()/vol*price, price, budget)
+}
+
+// volatility is the dollar move per share the sizer expects in a bar, or
+// zero without enough history.
+func (s *VolatilityTarget) volatility(symbol string) float64 {
+	bars := s.bars[symbol]
+	if len(bars) <= s.Period {
+		return 0
+	}
+
+	moves := make([]float64, 0, s.Period)
+	for i := 1; i < len(bars); i++ {
+		prev := bars[i-1].Close
+		if s.StdDev {
+			moves = append(moves, bars[i].Close-prev)
+			continue
+		}
+		moves = append(moves, math.Max(
+			bars[i].High-bars[i].Low,
+			math.Max(math.Abs(bars[i].High-prev), math.Abs(bars[i].Low-prev)),
+		))
+	}
+	if s.StdDev {
+		return stdDev(moves)
+	}
+	return mean(moves)
+}
+
+type volatilityTargetState struct {
+	Bars map[string][]marketdata.Bar `json:"bars"`
+}
+
+func (s *VolatilityTarget) MarshalState() ([]byte, error) {
+	return json.Marshal(volatilityTargetState{Bars: s.bars})
+}
+
+func (s *VolatilityTarget) UnmarshalState(data []byte) error {
+	var state volatilityTargetState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	s.bars = state.Bars
+	return nil
+}
+
+// Kelly bets Fraction of the Kelly criterion worked out from the round trips
+// in the portfolio's ledger: the win rate less the loss rate over the ratio
+// of the average win to the average loss. Until MinTrades have closed it
+// puts Fallback of equity into each entry.
+type Kelly struct {
+	stateless
+	Fraction  float64
+	MinTrades int
+	Fallback  float64
+}
+
+func (s Kelly) Size(symbol string, price, budget float64, p *Portfolio) float64 {
+	if p.Ledger == nil || len(p.Ledger.RoundTrips) < s.MinTrades {
+		return shares(s.Fallback*p.Equity(), price, budget)
+	}
+	return shares(s.Fraction*kellyFraction(p.Ledger.RoundTrips)*p.Equity(), price, budget)
+}
+
+// kellyFraction is the full Kelly bet for the trades' returns, between zero
+// and one.
+func kellyFraction(trips []RoundTrip) float64 {
+	var wins, losses []float64
+	for _, t := range trips {
+		if t.ReturnPct > 0 {
+			wins = append(wins, t.ReturnPct)
+		} else {
+			losses = append(losses, -t.ReturnPct)
+		}
+	}
+	if len(wins) == 0 {
+		return 0
+	}
+	if len(losses) == 0 || mean(losses) == 0 {
+		return 1
+	}
+
+	winRate := float64(len(wins)) / float64(len(trips))
+	payoff := mean(wins) / mean(losses)
+	return math.Max(0, math.Min(1, winRate-(1-winRate)/payoff))
+}
+
+// WholeShares rounds another sizer's quantities down to whole shares, for
+// assets that can't be traded fractionally.
+type WholeShares struct {
+	Sizer
+}
+
+func (s WholeShares) Size(symbol string, price, budget float64, p *Portfolio) float64 {
+	return math.Floor(s.Sizer.Size(symbol, price, budget, p) + 1e-9)
+}
+
+func (s WholeShares) MarshalState() ([]byte, error) {
+	if inner, ok := s.Sizer.(StatefulSizer); ok {
+		return inner.MarshalState()
+	}
+	return nil, nil
+}
+
+func (s WholeShares) UnmarshalState(data []byte) error {
+	if inner, ok := s.Sizer.(StatefulSizer); ok {
+		return inner.UnmarshalState(data)
+	}
+	return nil
+}
+
+var (
+	_ StatefulSizer = (*VolatilityTarget)(nil)
+	_ StatefulSizer = WholeShares{}
+)
@@ -1,6 +1,7 @@
 package strategies
 
 import (
+	"encoding/json"
 	"math"
 
 	"citadel/internal/quant"
@@ -8,10 +9,44 @@ import (
 	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
 )
 
+func init() {
+	quant.RegisterStrategy(quant.StrategySpec{
+		ID:          "bollinger_bands",
+		Name:        "Bollinger Bands",
+		Description: "Buys a close below the lower band and sells a close above the upper band",
+		Params: append([]quant.ParamSpec{
+			{
+				Name:        "period",
+				Type:        quant.IntParam,
+				Default:     20,
+				Min:         2,
+				Max:         200,
+				Description: "Bars in the moving average and standard deviation",
+			},
+			{
+				Name:        "std_dev",
+				Type:        quant.FloatParam,
+				Default:     2,
+				Min:         0.5,
+				Max:         5,
+				Description: "Band width in standard deviations",
+			},
+		}, exitParams...),
+		Factory: func(symbols []string, params quant.Params) (quant.Strategy, error) {
+			s := NewBollingerBands(symbols[0], params.Int("period"), params.Float("std_dev"))
+			s.Exits = exitsFromParams(params)
+			s.Sizer = quant.NewSizer(params)
+			return s, nil
+		},
+	})
+}
+
 type BollingerBands struct {
 	Symbol  string
 	Period  int
 	StdDev  float64
+	Exits   Exits
+	Sizer   quant.Sizer
 	history []float64
 }
 
@@ -20,6 +55,7 @@ func NewBollingerBands(symbol string, period int, stdDev float64) *BollingerBand
 		Symbol:  symbol,
 		Period:  period,
 		StdDev:  stdDev,
+		Sizer:   quant.AllIn{},
 		history: make([]float64, 0),
 	}
 }
@@ -30,12 +66,14 @@ func (s *BollingerBands) Name() string {
 
 func (s *BollingerBands) Initialize(p *quant.Portfolio) {
 	s.history = make([]float64, 0)
+	s.Sizer.Reset()
 }
 
 func (s *BollingerBands) OnBar(symbol string, bar marketdata.Bar, p *quant.Portfolio) {
 	if symbol != s.Symbol {
 		return
 	}
+	s.Sizer.Observe(symbol, bar)
 
 	s.history = append(s.history, bar.Close)
 
@@ -61,12 +99,34 @@ func (s *BollingerBands) OnBar(symbol string, bar marketdata.Bar, p *quant.Portf
 
 	currentPosition := p.Positions[s.Symbol]
 
-	if bar.Close < lowerBand && currentPosition == 0 {
-		qty := p.Cash / bar.Close
-		if qty > 0 {
-			p.Buy(s.Symbol, qty, bar.Close, bar.Timestamp)
+	if bar.Close < lowerBand && currentPosition == 0 && !p.HasOrders(s.Symbol) {
+		qty := s.Sizer.Size(s.Symbol, bar.Close, p.Cash, p)
+		if entry, ok := s.Exits.buy(s.Symbol, qty, bar.Close); ok {
+			p.SubmitOrder(entry)
 		}
 	} else if bar.Close > upperBand && currentPosition > 0 {
-		p.Sell(s.Symbol, currentPosition, bar.Close, bar.Timestamp)
+		s.Exits.sell(p, s.Symbol, currentPosition)
+	}
+}
+
+type bollingerBandsState struct {
+	History []float64       `json:"history"`
+	Sizer   json.RawMessage `json:"sizer,omitempty"`
+}
+
+func (s *BollingerBands) MarshalState() ([]byte, error) {
+	sizer, err := sizerState(s.Sizer)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(bollingerBandsState{History: tail(s.history, s.Period), Sizer: sizer})
+}
+
+func (s *BollingerBands) UnmarshalState(data []byte) error {
+	var state bollingerBandsState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
 	}
+	s.history = append(make([]float64, 0, len(state.History)), state.History...)
+	return restoreSizer(s.Sizer, state.Sizer)
 }
@@ -0,0 +1,127 @@
+package strategies
+
+import (
+	"sort"
+	"time"
+
+	"citadel/internal/quant"
+
+	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
+)
+
+func init() {
+	quant.RegisterStrategy(quant.StrategySpec{
+		ID:          "dual_momentum",
+		Name:        "Dual Momentum",
+		Description: "Holds the risky symbols with the best momentum while their return beats min_return, and the last symbol, the safe asset, otherwise",
+		MinSymbols:  2,
+		Params: append([]quant.ParamSpec{
+			{
+				Name:        "lookback",
+				Type:        quant.IntParam,
+				Default:     126,
+				Min:         2,
+				Max:         756,
+				Description: "Bars of return momentum is measured over",
+			},
+			{
+				Name:        "top",
+				Type:        quant.IntParam,
+				Default:     1,
+				Min:         1,
+				Max:         50,
+				Description: "Risky symbols held at once, equally weighted",
+			},
+			{
+				Name:        "min_return",
+				Type:        quant.FloatParam,
+				Default:     0,
+				Min:         -1,
+				Max:         1,
+				Description: "Return over the lookback a risky symbol needs to be held instead of the safe asset",
+			},
+		}, rotationParams...),
+		Factory: func(symbols []string, params quant.Params) (quant.Strategy, error) {
+			s := NewDualMomentum(
+				symbols,
+				params.Int("lookback"),
+				params.Int("top"),
+				params.Float("min_return"),
+			)
+			if err := s.configure(params); err != nil {
+				return nil, err
+			}
+			return s, nil
+		},
+	})
+}
+
+// DualMomentum ranks its risky symbols, all but the last, by their return
+// over Lookback bars (relative momentum) and holds the best Top of them
+// while their return exceeds MinReturn (absolute momentum). Each slot that a
+// risky symbol can't fill goes to the safe asset, the last symbol.
+type DualMomentum struct {
+	rotation
+	Safe      string
+	Lookback  int
+	Top       int
+	MinReturn float64
+}
+
+func NewDualMomentum(symbols []string, lookback, top int, minReturn float64) *DualMomentum {
+	return &DualMomentum{
+		rotation:  newRotation(symbols, lookback+1),
+		Safe:      symbols[len(symbols)-1],
+		Lookback:  lookback,
+		Top:       top,
+		MinReturn: minReturn,
+	}
+}
+
+func (s *DualMomentum) Name() string {
+	return "Dual Momentum"
+}
+
+func (s *DualMomentum) Initialize(p *quant.Portfolio) {
+	s.reset()
+}
+
+func (s *DualMomentum) OnBar(symbol string, bar marketdata.Bar, p *quant.Portfolio) {
+	s.observe(symbol, bar)
+}
+
+func (s *DualMomentum) OnBarSlice(
+	ts time.Time,
+	bars map[string]marketdata.Bar,
+	p *quant.Portfolio,
+) {
+	if !s.due(ts) {
+		return
+	}
+
+	type ranked struct {
+		symbol string
+		ret    float64
+	}
+	var risky []ranked
+	for _, symbol := range s.Symbols[:len(s.Symbols)-1] {
+		if ret, ok := s.momentum(symbol, s.Lookback, 0); ok {
+			risky = append(risky, ranked{symbol, ret})
+		}
+	}
+	if len(risky) == 0 {
+		return // still warming up
+	}
+	sort.SliceStable(risky, func(i, j int) bool { return risky[i].ret > risky[j].ret })
+
+	slots := min(s.Top, len(s.Symbols)-1)
+	weights := make(map[string]float64)
+	for i := 0; i < slots; i++ {
+		if i < len(risky) && risky[i].ret > s.MinReturn {
+			weights[risky[i].symbol] += 1 / float64(slots)
+		} else {
+			weights[s.Safe] += 1 / float64(slots)
+		}
+	}
+	s.rebalance(ts, weights, p)
+}
@@ -0,0 +1,97 @@
+package strategies
+
+import (
+	"math"
+
+	"citadel/internal/quant"
+)
+
+// exitParams are the protective exits a strategy can attach to its entries.
+var exitParams = []quant.ParamSpec{
+	{
+		Name:        "stop_loss_pct",
+		Type:        quant.FloatParam,
+		Default:     0,
+		Min:         0,
+		Max:         0.5,
+		Description: "Stop-loss below the entry price as a fraction of it (0 disables)",
+	},
+	{
+		Name:        "take_profit_pct",
+		Type:        quant.FloatParam,
+		Default:     0,
+		Min:         0,
+		Max:         5,
+		Description: "Take-profit above the entry price as a fraction of it (0 disables)",
+	},
+}
+
+// Exits attaches a stop-loss and a take-profit, each a fraction of the
+// entry price away from it, to a strategy's long entries. Zero leaves one
+// out.
+type Exits struct {
+	StopLossPct   float64
+	TakeProfitPct float64
+}
+
+func exitsFromParams(params quant.Params) Exits {
+	return Exits{
+		StopLossPct:   params.Float("stop_loss_pct"),
+		TakeProfitPct: params.Float("take_profit_pct"),
+	}
+}
+
+func (x Exits) enabled() bool {
+	return x.StopLossPct > 0 || x.TakeProfitPct > 0
+}
+
+// buy returns a market buy of qty at about price, with the exits attached,
+// and whether there is anything to buy. Brokers only take whole shares in
+// orders with exits, so qty is rounded down, and a budget short of one share
+// buys nothing. The exits are good until canceled so they outlast the day.
+func (x Exits) buy(symbol string, qty, price float64) (quant.OrderIntent, bool) {
+	intent := quant.OrderIntent{
+		Symbol:   symbol,
+		Side:     quant.Buy,
+		Type:     quant.Market,
+		Quantity: qty,
+	}
+	if !x.enabled() {
+		return intent, qty > 0
+	}
+
+	intent.Quantity = math.Floor(qty)
+	if intent.Quantity < 1 {
+		return intent, false
+	}
+	intent.TimeInForce = "gtc"
+	if x.StopLossPct > 0 {
+		stop := roundPrice(price * (1 - x.StopLossPct))
+		intent.StopLoss = &stop
+	}
+	if x.TakeProfitPct > 0 {
+		limit := roundPrice(price * (1 + x.TakeProfitPct))
+		intent.TakeProfit = &limit
+	}
+	return intent, true
+}
+
+// sell closes a long position of qty, first canceling the exits still
+// working for it so they can't fire on shares already sold.
+func (x Exits) sell(p *quant.Portfolio, symbol string, qty float64) {
+	if x.enabled() {
+		p.CancelOrders(symbol)
+	}
+	p.SubmitOrder(quant.OrderIntent{
+		Symbol:   symbol,
+		Side:     quant.Sell,
+		Type:     quant.Market,
+		Quantity: qty,
+	})
+}
+
+// roundPrice rounds to the cent, the finest increment brokers accept for
+// prices of a dollar or more.
+func roundPrice(price float64) float64 {
+	return math.Round(price*100) / 100
+}
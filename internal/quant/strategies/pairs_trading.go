@@ -1,6 +1,8 @@
 package strategies
 
 import (
+	"encoding/json"
+	"fmt"
 	"math"
 
 	"citadel/internal/quant"
@@ -8,12 +10,59 @@ import (
 	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
 )
 
+func init() {
+	quant.RegisterStrategy(quant.StrategySpec{
+		ID:          "pairs_trading",
+		Name:        "Pairs Trading",
+		Description: "Trades mean reversion in the price spread between two symbols",
+		MinSymbols:  2,
+		Params: []quant.ParamSpec{
+			{
+				Name:        "period",
+				Type:        quant.IntParam,
+				Default:     20,
+				Min:         2,
+				Max:         500,
+				Description: "Bars in the spread's rolling mean and standard deviation",
+			},
+			{
+				Name:        "entry_z",
+				Type:        quant.FloatParam,
+				Default:     2,
+				Min:         0,
+				Max:         10,
+				Description: "Spread z-score beyond which to enter",
+			},
+			{
+				Name:        "exit_z",
+				Type:        quant.FloatParam,
+				Default:     0,
+				Min:         0,
+				Max:         10,
+				Description: "Spread z-score within which to exit",
+			},
+		},
+		Factory: func(symbols []string, params quant.Params) (quant.Strategy, error) {
+			s := NewPairsTrading(
+				symbols[0],
+				symbols[1],
+				params.Int("period"),
+				params.Float("entry_z"),
+				params.Float("exit_z"),
+			)
+			s.Sizer = quant.NewSizer(params)
+			return s, nil
+		},
+	})
+}
+
 type PairsTrading struct {
 	SymbolA string
 	SymbolB string
 	Period  int
 	EntryZ  float64
 	ExitZ   float64
+	Sizer   quant.Sizer
 
 	historyA []float64
 	historyB []float64
@@ -31,6 +80,7 @@ func NewPairsTrading(symbolA, symbolB string, period int, entryZ, exitZ float64)
 		Period:   period,
 		EntryZ:   entryZ,
 		ExitZ:    exitZ,
+		Sizer:    quant.AllIn{},
 		historyA: make([]float64, 0),
 		historyB: make([]float64, 0),
 	}
@@ -45,6 +95,7 @@ func (s *PairsTrading) Initialize(p *quant.Portfolio) {
 	s.historyB = make([]float64, 0)
 	s.hasA = false
 	s.hasB = false
+	s.Sizer.Reset()
 }
 
 func (s *PairsTrading) OnBar(symbol string, bar marketdata.Bar, p *quant.Portfolio) {
@@ -57,6 +108,7 @@ func (s *PairsTrading) OnBar(symbol string, bar marketdata.Bar, p *quant.Portfol
 	} else {
 		return
 	}
+	s.Sizer.Observe(symbol, bar)
 
 	if !s.hasA || !s.hasB {
 		return
@@ -97,38 +149,120 @@ func (s *PairsTrading) OnBar(symbol string, bar marketdata.Bar, p *quant.Portfol
 	currentSpread := s.latestA - s.latestB
 	zScore := (currentSpread - mean) / stdDev
 
-	posA := p.Positions[s.SymbolA]
-	posB := p.Positions[s.SymbolB]
-
-	if zScore < -s.EntryZ {
-		// A is underpriced. Sell B, Buy A.
-		if posB > 0 {
-			p.Sell(s.SymbolB, posB, s.latestB, bar.Timestamp)
-		}
-		if posA == 0 {
-			qty := p.Cash / s.latestA
-			if qty > 0 {
-				p.Buy(s.SymbolA, qty, s.latestA, bar.Timestamp)
-			}
-		}
-	} else if zScore > s.EntryZ {
-		// B is underpriced. Sell A, Buy B.
-		if posA > 0 {
-			p.Sell(s.SymbolA, posA, s.latestA, bar.Timestamp)
-		}
-		if posB == 0 {
-			qty := p.Cash / s.latestB
-			if qty > 0 {
-				p.Buy(s.SymbolB, qty, s.latestB, bar.Timestamp)
-			}
-		}
-	} else if math.Abs(zScore) < s.ExitZ {
+	switch {
+	case zScore < -s.EntryZ:
+		// A is underpriced relative to B. Long A, short (or exit) B.
+		s.enter(p, s.SymbolA, s.latestA, s.SymbolB, s.latestB)
+	case zScore > s.EntryZ:
+		// B is underpriced relative to A. Long B, short (or exit) A.
+		s.enter(p, s.SymbolB, s.latestB, s.SymbolA, s.latestA)
+	case math.Abs(zScore) < s.ExitZ:
 		// Mean reversion happened, exit positions
-		if posA > 0 {
-			p.Sell(s.SymbolA, posA, s.latestA, bar.Timestamp)
-		}
-		if posB > 0 {
-			p.Sell(s.SymbolB, posB, s.latestB, bar.Timestamp)
+		s.rebalance(p, s.SymbolA, 0)
+		s.rebalance(p, s.SymbolB, 0)
+	}
+}
+
+// enter positions the book long the cheap leg, sized by the sizer. When the
+// portfolio allows shorting each leg may take half the equity and the rich
+// leg is shorted, sized the same way up to the long leg's value; otherwise
+// any long in it is closed to fund the entry.
+func (s *PairsTrading) enter(
+	p *quant.Portfolio,
+	long string,
+	longPrice float64,
+	short string,
+	shortPrice float64,
+) {
+	if p.HasOrders(long) || p.HasOrders(short) {
+		return // the last entry is still working
+	}
+	posLong := p.Positions[long]
+	posShort := p.Positions[short]
+
+	if p.Margin.AllowShort {
+		if posLong > 0 && posShort < 0 {
+			return // already positioned
 		}
+		equity := p.CalculateEquity(map[string]float64{
+			s.SymbolA: s.latestA,
+			s.SymbolB: s.latestB,
+		})
+		qty := s.Sizer.Size(long, longPrice, equity/2, p)
+		// Short leg first so its proceeds are booked before the long leg fills
+		s.rebalance(p, short, -s.Sizer.Size(short, shortPrice, qty*longPrice, p))
+		s.rebalance(p, long, qty)
+		return
+	}
+
+	cash := p.Cash
+	if posShort > 0 {
+		cash += posShort * shortPrice // proceeds are available once the sell fills
+	}
+	s.rebalance(p, short, 0)
+	if posLong == 0 {
+		s.rebalance(p, long, s.Sizer.Size(long, longPrice, cash, p))
+	}
+}
+
+// rebalance queues a market order moving symbol's position to target.
+func (s *PairsTrading) rebalance(p *quant.Portfolio, symbol string, target float64) {
+	delta := target - p.Positions[symbol]
+	if math.Abs(delta) < 1e-9 {
+		return
+	}
+
+	side := quant.Buy
+	if delta < 0 {
+		side = quant.Sell
+		delta = -delta
+	}
+	p.SubmitOrder(quant.OrderIntent{
+		Symbol:   symbol,
+		Side:     side,
+		Type:     quant.Market,
+		Quantity: delta,
+	})
+}
+
+type pairsTradingState struct {
+	HistoryA []float64 `json:"history_a"`
+	HistoryB []float64 `json:"history_b"`
+	LatestA  float64   `json:"latest_a"`
+	LatestB  float64   `json:"latest_b"`
+	HasA     bool      `json:"has_a"`
+	HasB     bool      `json:"has_b"`
+
+	Sizer json.RawMessage `json:"sizer,omitempty"`
+}
+
+func (s *PairsTrading) MarshalState() ([]byte, error) {
+	sizer, err := sizerState(s.Sizer)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(pairsTradingState{
+		HistoryA: tail(s.historyA, s.Period),
+		HistoryB: tail(s.historyB, s.Period),
+		LatestA:  s.latestA,
+		LatestB:  s.latestB,
+		HasA:     s.hasA,
+		HasB:     s.hasB,
+		Sizer:    sizer,
+	})
+}
+
+func (s *PairsTrading) UnmarshalState(data []byte) error {
+	var state pairsTradingState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	if len(state.HistoryA) != len(state.HistoryB) {
+		return fmt.Errorf("pair histories differ in length")
 	}
+	s.historyA = append(make([]float64, 0, len(state.HistoryA)), state.HistoryA...)
+	s.historyB = append(make([]float64, 0, len(state.HistoryB)), state.HistoryB...)
+	s.latestA, s.latestB = state.LatestA, state.LatestB
+	s.hasA, s.hasB = state.HasA, state.HasB
+	return restoreSizer(s.Sizer, state.Sizer)
 }
@@ -0,0 +1,188 @@
+package strategies
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"citadel/internal/quant"
+
+	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
+)
+
+// rotationParams are shared by the strategies that rotate between their
+// symbols on a schedule.
+var rotationParams = []quant.ParamSpec{
+	{
+		Name:        "rebalance",
+		Type:        quant.IntParam,
+		Default:     3,
+		Min:         1,
+		Max:         4,
+		Description: "When to rebalance: 1 daily, 2 weekly, 3 monthly, 4 quarterly",
+	},
+	{
+		Name:        "rebalance_band",
+		Type:        quant.FloatParam,
+		Default:     0,
+		Min:         0,
+		Max:         0.5,
+		Description: "Fraction of equity below which a rebalancing trade is skipped",
+	},
+	{
+		// Rotations hold their targets whole, up to all of equity in one
+		// symbol, so the shared 5% default would clip every position
+		Name:        "max_position_size_pct",
+		Type:        quant.FloatParam,
+		Default:     0,
+		Min:         0,
+		Max:         1,
+		Description: "Largest position as a fraction of equity (0 disables the limit)",
+	},
+}
+
+// schedules maps the rebalance parameter to a rebalance schedule.
+var schedules = []string{
+	quant.RebalanceNever,
+	quant.RebalanceDaily,
+	quant.RebalanceWeekly,
+	quant.RebalanceMonthly,
+	quant.RebalanceQuarterly,
+}
+
+// rotation keeps the closes of a strategy that holds a changing selection of
+// its symbols, and rebalances it into target weights on a schedule.
+type rotation struct {
+	Symbols  []string
+	Schedule string
+	Targets  quant.TargetWeights
+
+	keep    int // closes kept per symbol
+	history map[string][]float64
+	last    time.Time // when the strategy last rebalanced
+}
+
+// newRotation rebalances monthly until configured otherwise. keep is the
+// most closes the strategy needs of any symbol.
+func newRotation(symbols []string, keep int) rotation {
+	return rotation{
+		Symbols:  symbols,
+		Schedule: quant.RebalanceMonthly,
+		keep:     keep,
+		history:  make(map[string][]float64),
+	}
+}
+
+// configure applies the rotation parameters, and rounds to whole shares
+// when the sizing parameters ask for it. The target weights size every
+// position, so any other sizing parameter is rejected rather than ignored.
+func (r *rotation) configure(params quant.Params) error {
+	for _, spec := range quant.SizingParams {
+		if spec.Name != "whole_shares" && params.Float(spec.Name) != spec.Default {
+			return fmt.Errorf(
+				"parameter %q is not supported: positions are sized by target weight",
+				spec.Name,
+			)
+		}
+	}
+
+	r.Schedule = schedules[params.Int("rebalance")]
+	r.Targets = quant.TargetWeights{
+		Band:        params.Float("rebalance_band"),
+		WholeShares: params.Int("whole_shares") == 1,
+	}
+	return nil
+}
+
+func (r *rotation) reset() {
+	r.history = make(map[string][]float64)
+	r.last = time.Time{}
+}
+
+// observe records the close of one of the strategy's symbols.
+func (r *rotation) observe(symbol string, bar marketdata.Bar) {
+	closes, ok := r.history[symbol]
+	if !ok && !r.trades(symbol) {
+		return
+	}
+	r.history[symbol] = tail(append(closes, bar.Close), r.keep)
+}
+
+func (r *rotation) trades(symbol string) bool {
+	for _, s := range r.Symbols {
+		if s == symbol {
+			return true
+		}
+	}
+	return false
+}
+
+// due reports whether the schedule calls for a rebalance at ts.
+func (r *rotation) due(ts time.Time) bool {
+	return quant.RebalanceDue(r.Schedule, r.last, ts)
+}
+
+// momentum is symbol's return over lookback bars, ending skip bars ago, and
+// whether there is enough history for it.
+func (r *rotation) momentum(symbol string, lookback, skip int) (float64, bool) {
+	closes := r.history[symbol]
+	end := len(closes) - 1 - skip
+	if end-lookback < 0 || closes[end-lookback] <= 0 {
+		return 0, false
+	}
+	return closes[end]/closes[end-lookback] - 1, true
+}
+
+// volatility is the standard deviation of symbol's last period bar-to-bar
+// returns, or zero without enough history.
+func (r *rotation) volatility(symbol string, period int) float64 {
+	closes := tail(r.history[symbol], period+1)
+	if len(closes) < 3 {
+		return 0
+	}
+	returns := make([]float64, 0, len(closes)-1)
+	var sum float64
+	for i := 1; i < len(closes); i++ {
+		ret := closes[i]/closes[i-1] - 1
+		returns = append(returns, ret)
+		sum += ret
+	}
+	mean := sum / float64(len(returns))
+	var variance float64
+	for _, ret := range returns {
+		variance += (ret - mean) * (ret - mean)
+	}
+	return math.Sqrt(variance / float64(len(returns)))
+}
+
+// rebalance submits the orders that move p to weights.
+func (r *rotation) rebalance(ts time.Time, weights map[string]float64, p *quant.Portfolio) {
+	r.Targets.Weights = weights
+	r.Targets.Submit(p)
+	r.last = ts
+}
+
+type rotationState struct {
+	History       map[string][]float64 `json:"history"`
+	LastRebalance time.Time            `json:"last_rebalance"`
+}
+
+func (r *rotation) MarshalState() ([]byte, error) {
+	return json.Marshal(rotationState{History: r.history, LastRebalance: r.last})
+}
+
+func (r *rotation) UnmarshalState(data []byte) error {
+	var state rotationState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	r.history = make(map[string][]float64, len(state.History))
+	for symbol, closes := range state.History {
+		if r.trades(symbol) {
+			r.history[symbol] = append([]float64(nil), tail(closes, r.keep)...)
+		}
+	}
+	r.last = state.LastRebalance
+	return nil
+}
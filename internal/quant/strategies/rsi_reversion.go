@@ -1,17 +1,93 @@
 package strategies
 
 import (
+	"encoding/json"
+	"fmt"
+
 	"citadel/internal/quant"
 	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
 )
 
+func init() {
+	quant.RegisterStrategy(quant.StrategySpec{
+		ID:          "rsi_reversion",
+		Name:        "RSI Reversion",
+		Description: "Buys when RSI drops below the oversold level and sells when it rises above overbought",
+		Params: append([]quant.ParamSpec{
+			{
+				Name:        "period",
+				Type:        quant.IntParam,
+				Default:     14,
+				Min:         2,
+				Max:         100,
+				Description: "Bars in the RSI lookback",
+			},
+			{
+				Name:        "oversold",
+				Type:        quant.FloatParam,
+				Default:     30,
+				Min:         0,
+				Max:         100,
+				Description: "RSI level below which to enter",
+			},
+			{
+				Name:        "overbought",
+				Type:        quant.FloatParam,
+				Default:     70,
+				Min:         0,
+				Max:         100,
+				Description: "RSI level above which to exit",
+			},
+			{
+				Name:        "trend_minutes",
+				Type:        quant.IntParam,
+				Default:     0,
+				Min:         0,
+				Max:         390,
+				Description: "Minutes per trend bar; entries require price above its SMA (0 disables)",
+			},
+			{
+				Name:        "trend_period",
+				Type:        quant.IntParam,
+				Default:     20,
+				Min:         2,
+				Max:         200,
+				Description: "Trend bars in the SMA used by the trend filter",
+			},
+		}, exitParams...),
+		Factory: func(symbols []string, params quant.Params) (quant.Strategy, error) {
+			oversold, overbought := params.Float("oversold"), params.Float("overbought")
+			if oversold >= overbought {
+				return nil, fmt.Errorf("oversold must be less than overbought")
+			}
+			s := NewRSIReversion(symbols[0], params.Int("period"), oversold, overbought)
+			s.Exits = exitsFromParams(params)
+			s.Sizer = quant.NewSizer(params)
+			if m := params.Int("trend_minutes"); m > 0 {
+				s.TrendTimeframe = marketdata.NewTimeFrame(m, marketdata.Min)
+				s.TrendPeriod = params.Int("trend_period")
+			}
+			return s, nil
+		},
+	})
+}
+
 type RSIReversion struct {
 	Symbol     string
 	Period     int
 	Oversold   float64
 	Overbought float64
 
+	// TrendTimeframe enables a trend filter on coarser bars: entries need the
+	// price above the TrendPeriod SMA of that timeframe. Zero disables it.
+	TrendTimeframe marketdata.TimeFrame
+	TrendPeriod    int
+
+	Exits Exits
+	Sizer quant.Sizer
+
 	history []float64
+	trend   []float64
 	avgGain float64
 	avgLoss float64
 }
@@ -22,6 +98,7 @@ func NewRSIReversion(symbol string, period int, oversold, overbought float64) *R
 		Period:     period,
 		Oversold:   oversold,
 		Overbought: overbought,
+		Sizer:      quant.AllIn{},
 		history:    make([]float64, 0),
 	}
 }
@@ -32,14 +109,17 @@ func (s *RSIReversion) Name() string {
 
 func (s *RSIReversion) Initialize(p *quant.Portfolio) {
 	s.history = make([]float64, 0)
+	s.trend = nil
 	s.avgGain = 0
 	s.avgLoss = 0
+	s.Sizer.Reset()
 }
 
 func (s *RSIReversion) OnBar(symbol string, bar marketdata.Bar, p *quant.Portfolio) {
 	if symbol != s.Symbol {
 		return
 	}
+	s.Sizer.Observe(symbol, bar)
 
 	s.history = append(s.history, bar.Close)
 
@@ -81,12 +161,86 @@ func (s *RSIReversion) OnBar(symbol string, bar marketdata.Bar, p *quant.Portfol
 
 	currentPosition := p.Positions[s.Symbol]
 
-	if rsi < s.Oversold && currentPosition == 0 {
-		qty := p.Cash / bar.Close
-		if qty > 0 {
-			p.Buy(s.Symbol, qty, bar.Close, bar.Timestamp)
+	if rsi < s.Oversold && currentPosition == 0 && !p.HasOrders(s.Symbol) &&
+		s.trendUp(bar.Close) {
+		qty := s.Sizer.Size(s.Symbol, bar.Close, p.Cash, p)
+		if entry, ok := s.Exits.buy(s.Symbol, qty, bar.Close); ok {
+			p.SubmitOrder(entry)
 		}
 	} else if rsi > s.Overbought && currentPosition > 0 {
-		p.Sell(s.Symbol, currentPosition, bar.Close, bar.Timestamp)
+		s.Exits.sell(p, s.Symbol, currentPosition)
+	}
+}
+
+func (s *RSIReversion) Timeframes() []marketdata.TimeFrame {
+	if s.TrendTimeframe.N == 0 {
+		return nil
+	}
+	return []marketdata.TimeFrame{s.TrendTimeframe}
+}
+
+func (s *RSIReversion) OnTimeframeBar(
+	symbol string,
+	tf marketdata.TimeFrame,
+	bar marketdata.Bar,
+	p *quant.Portfolio,
+) {
+	if symbol != s.Symbol || tf != s.TrendTimeframe {
+		return
+	}
+	s.trend = append(s.trend, bar.Close)
+	if len(s.trend) > s.TrendPeriod {
+		s.trend = s.trend[1:]
+	}
+}
+
+// trendUp reports whether price is above the trend SMA. It holds off entries
+// until enough trend bars have completed.
+func (s *RSIReversion) trendUp(price float64) bool {
+	if s.TrendTimeframe.N == 0 {
+		return true
+	}
+	if len(s.trend) < s.TrendPeriod {
+		return false
+	}
+	sum := 0.0
+	for _, c := range s.trend {
+		sum += c
+	}
+	return price > sum/float64(len(s.trend))
+}
+
+type rsiReversionState struct {
+	History []float64 `json:"history"`
+	Trend   []float64 `json:"trend"`
+	AvgGain float64   `json:"avg_gain"`
+	AvgLoss float64   `json:"avg_loss"`
+
+	Sizer json.RawMessage `json:"sizer,omitempty"`
+}
+
+func (s *RSIReversion) MarshalState() ([]byte, error) {
+	sizer, err := sizerState(s.Sizer)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(rsiReversionState{
+		History: tail(s.history, s.Period+1),
+		Trend:   s.trend,
+		AvgGain: s.avgGain,
+		AvgLoss: s.avgLoss,
+		Sizer:   sizer,
+	})
+}
+
+func (s *RSIReversion) UnmarshalState(data []byte) error {
+	var state rsiReversionState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
 	}
+	s.history = append(make([]float64, 0, len(state.History)), state.History...)
+	s.trend = state.Trend
+	s.avgGain = state.AvgGain
+	s.avgLoss = state.AvgLoss
+	return restoreSizer(s.Sizer, state.Sizer)
 }
@@ -0,0 +1,184 @@
+package strategies
+
+import (
+	"sort"
+	"time"
+
+	"citadel/internal/quant"
+
+	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
+)
+
+// Weightings of the symbols sector rotation holds.
+const (
+	WeightEqual = iota
+	WeightInverseVolatility
+)
+
+func init() {
+	quant.RegisterStrategy(quant.StrategySpec{
+		ID:          "sector_rotation",
+		Name:        "Sector Rotation",
+		Description: "Holds the symbols with the best momentum that are above their trend, in cash otherwise",
+		MinSymbols:  2,
+		Params: append([]quant.ParamSpec{
+			{
+				Name:        "lookback",
+				Type:        quant.IntParam,
+				Default:     126,
+				Min:         2,
+				Max:         756,
+				Description: "Bars of return momentum is measured over",
+			},
+			{
+				Name:        "skip",
+				Type:        quant.IntParam,
+				Default:     0,
+				Min:         0,
+				Max:         63,
+				Description: "Most recent bars left out of momentum, e.g. 21 to ignore the last month's reversal",
+			},
+			{
+				Name:        "top",
+				Type:        quant.IntParam,
+				Default:     3,
+				Min:         1,
+				Max:         50,
+				Description: "Symbols held at once",
+			},
+			{
+				Name:        "trend_period",
+				Type:        quant.IntParam,
+				Default:     200,
+				Min:         0,
+				Max:         500,
+				Description: "Bars in the moving average a symbol must close above to be held; 0 disables the filter",
+			},
+			{
+				Name:        "weighting",
+				Type:        quant.IntParam,
+				Default:     WeightEqual,
+				Min:         WeightEqual,
+				Max:         WeightInverseVolatility,
+				Description: "How holdings are weighted: 0 equally, 1 by inverse volatility over the lookback",
+			},
+		}, rotationParams...),
+		Factory: func(symbols []string, params quant.Params) (quant.Strategy, error) {
+			s := NewSectorRotation(
+				symbols,
+				params.Int("lookback"),
+				params.Int("skip"),
+				params.Int("top"),
+				params.Int("trend_period"),
+			)
+			s.Weighting = params.Int("weighting")
+			if err := s.configure(params); err != nil {
+				return nil, err
+			}
+			return s, nil
+		},
+	})
+}
+
+// SectorRotation ranks its symbols by their return over Lookback bars,
+// ending Skip bars ago, and holds the best Top of them. A symbol closing
+// below its TrendPeriod moving average isn't held, and its slot stays in
+// cash.
+type SectorRotation struct {
+	rotation
+	Lookback    int
+	Skip        int
+	Top         int
+	TrendPeriod int
+	Weighting   int
+}
+
+func NewSectorRotation(symbols []string, lookback, skip, top, trendPeriod int) *SectorRotation {
+	return &SectorRotation{
+		rotation:    newRotation(symbols, max(lookback+skip+1, trendPeriod)),
+		Lookback:    lookback,
+		Skip:        skip,
+		Top:         top,
+		TrendPeriod: trendPeriod,
+	}
+}
+
+func (s *SectorRotation) Name() string {
+	return "Sector Rotation"
+}
+
+func (s *SectorRotation) Initialize(p *quant.Portfolio) {
+	s.reset()
+}
+
+func (s *SectorRotation) OnBar(symbol string, bar marketdata.Bar, p *quant.Portfolio) {
+	s.observe(symbol, bar)
+}
+
+func (s *SectorRotation) OnBarSlice(
+	ts time.Time,
+	bars map[string]marketdata.Bar,
+	p *quant.Portfolio,
+) {
+	if !s.due(ts) {
+		return
+	}
+
+	type ranked struct {
+		symbol string
+		ret    float64
+	}
+	var candidates []ranked
+	for _, symbol := range s.Symbols {
+		ret, ok := s.momentum(symbol, s.Lookback, s.Skip)
+		if ok && len(s.history[symbol]) >= s.TrendPeriod {
+			candidates = append(candidates, ranked{symbol, ret})
+		}
+	}
+	if len(candidates) == 0 {
+		return // still warming up
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].ret > candidates[j].ret
+	})
+
+	// Every slot is worth the same; those below trend are left in cash
+	slots := min(s.Top, len(s.Symbols))
+	var held []string
+	for _, c := range candidates[:min(slots, len(candidates))] {
+		if s.aboveTrend(c.symbol) {
+			held = append(held, c.symbol)
+		}
+	}
+
+	scores := make([]float64, len(held))
+	var sum float64
+	for i, symbol := range held {
+		scores[i] = 1
+		if s.Weighting == WeightInverseVolatility {
+			if vol := s.volatility(symbol, s.Lookback); vol > 0 {
+				scores[i] = 1 / vol
+			}
+		}
+		sum += scores[i]
+	}
+	invested := float64(len(held)) / float64(slots)
+	weights := make(map[string]float64, len(held))
+	for i, symbol := range held {
+		weights[symbol] = invested * scores[i] / sum
+	}
+	s.rebalance(ts, weights, p)
+}
+
+// aboveTrend reports whether symbol last closed above its moving average.
+func (s *SectorRotation) aboveTrend(symbol string) bool {
+	if s.TrendPeriod == 0 {
+		return true
+	}
+	closes := tail(s.history[symbol], s.TrendPeriod)
+	var sum float64
+	for _, c := range closes {
+		sum += c
+	}
+	return closes[len(closes)-1] > sum/float64(len(closes))
+}
@@ -1,14 +1,53 @@
 package strategies
 
 import (
+	"encoding/json"
+	"fmt"
+
 	"citadel/internal/quant"
 	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
 )
 
+func init() {
+	quant.RegisterStrategy(quant.StrategySpec{
+		ID:          "sma_crossover",
+		Name:        "SMA Crossover",
+		Description: "Goes long when the short SMA crosses above the long SMA and exits on the cross back down",
+		Params: []quant.ParamSpec{
+			{
+				Name:        "short_period",
+				Type:        quant.IntParam,
+				Default:     10,
+				Min:         2,
+				Max:         200,
+				Description: "Bars in the fast moving average",
+			},
+			{
+				Name:        "long_period",
+				Type:        quant.IntParam,
+				Default:     50,
+				Min:         3,
+				Max:         500,
+				Description: "Bars in the slow moving average",
+			},
+		},
+		Factory: func(symbols []string, params quant.Params) (quant.Strategy, error) {
+			short, long := params.Int("short_period"), params.Int("long_period")
+			if short >= long {
+				return nil, fmt.Errorf("short_period must be less than long_period")
+			}
+			s := NewSMACrossover(symbols[0], short, long)
+			s.Sizer = quant.NewSizer(params)
+			return s, nil
+		},
+	})
+}
+
 type SMACrossover struct {
 	Symbol      string
 	ShortPeriod int
 	LongPeriod  int
+	Sizer       quant.Sizer
 
 	history []float64
 }
@@ -18,6 +57,7 @@ func NewSMACrossover(symbol string, shortPeriod, longPeriod int) *SMACrossover {
 		Symbol:      symbol,
 		ShortPeriod: shortPeriod,
 		LongPeriod:  longPeriod,
+		Sizer:       quant.AllIn{},
 		history:     make([]float64, 0),
 	}
 }
@@ -28,12 +68,14 @@ func (s *SMACrossover) Name() string {
 
 func (s *SMACrossover) Initialize(p *quant.Portfolio) {
 	s.history = make([]float64, 0)
+	s.Sizer.Reset()
 }
 
 func (s *SMACrossover) OnBar(symbol string, bar marketdata.Bar, p *quant.Portfolio) {
 	if symbol != s.Symbol {
 		return // Only process bars for the symbol we care about
 	}
+	s.Sizer.Observe(symbol, bar)
 
 	s.history = append(s.history, bar.Close)
 
@@ -72,14 +114,46 @@ func (s *SMACrossover) OnBar(symbol string, bar marketdata.Bar, p *quant.Portfol
 
 	currentPosition := p.Positions[s.Symbol]
 
-	if crossoverUp && currentPosition == 0 {
-		// Buy! Let's go all in
-		qty := p.Cash / bar.Close
+	if crossoverUp && currentPosition == 0 && !p.HasOrders(s.Symbol) {
+		// Buy! As much as the sizer says the cash allows
+		qty := s.Sizer.Size(s.Symbol, bar.Close, p.Cash, p)
 		if qty > 0 {
-			p.Buy(s.Symbol, qty, bar.Close, bar.Timestamp)
+			p.SubmitOrder(quant.OrderIntent{
+				Symbol:   s.Symbol,
+				Side:     quant.Buy,
+				Type:     quant.Market,
+				Quantity: qty,
+			})
 		}
 	} else if crossoverDown && currentPosition > 0 {
 		// Sell! Liquidate position
-		p.Sell(s.Symbol, currentPosition, bar.Close, bar.Timestamp)
+		p.SubmitOrder(quant.OrderIntent{
+			Symbol:   s.Symbol,
+			Side:     quant.Sell,
+			Type:     quant.Market,
+			Quantity: currentPosition,
+		})
+	}
+}
+
+type smaCrossoverState struct {
+	History []float64       `json:"history"`
+	Sizer   json.RawMessage `json:"sizer,omitempty"`
+}
+
+func (s *SMACrossover) MarshalState() ([]byte, error) {
+	sizer, err := sizerState(s.Sizer)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(smaCrossoverState{History: tail(s.history, s.LongPeriod+1), Sizer: sizer})
+}
+
+func (s *SMACrossover) UnmarshalState(data []byte) error {
+	var state smaCrossoverState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
 	}
+	s.history = append(make([]float64, 0, len(state.History)), state.History...)
+	return restoreSizer(s.Sizer, state.Sizer)
 }
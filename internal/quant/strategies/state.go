@@ -0,0 +1,43 @@
+package strategies
+
+import (
+	"encoding/json"
+
+	"citadel/internal/quant"
+)
+
+// tail returns the last n values of xs, which is all a strategy needs to keep
+// of its history when saving state.
+func tail(xs []float64, n int) []float64 {
+	if len(xs) <= n {
+		return xs
+	}
+	return xs[len(xs)-n:]
+}
+
+// sizerState returns the history s keeps, if any, to save with the strategy.
+func sizerState(s quant.Sizer) (json.RawMessage, error) {
+	if ss, ok := s.(quant.StatefulSizer); ok {
+		return ss.MarshalState()
+	}
+	return nil, nil
+}
+
+// restoreSizer gives s back the history saved by sizerState.
+func restoreSizer(s quant.Sizer, data json.RawMessage) error {
+	if ss, ok := s.(quant.StatefulSizer); ok && len(data) > 0 {
+		return ss.UnmarshalState(data)
+	}
+	return nil
+}
+
+var (
+	_ quant.StatefulStrategy = (*SMACrossover)(nil)
+	_ quant.StatefulStrategy = (*RSIReversion)(nil)
+	_ quant.StatefulStrategy = (*BollingerBands)(nil)
+	_ quant.StatefulStrategy = (*PairsTrading)(nil)
+	_ quant.StatefulStrategy = (*DualMomentum)(nil)
+	_ quant.StatefulStrategy = (*SectorRotation)(nil)
+	_ quant.SliceStrategy    = (*DualMomentum)(nil)
+	_ quant.SliceStrategy    = (*SectorRotation)(nil)
+)
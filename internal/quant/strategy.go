@@ -1,6 +1,10 @@
 package quant
 
 import (
+	"fmt"
+	"time"
+
+	"citadel/internal/broker"
 	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
 )
 
@@ -9,3 +13,126 @@ type Strategy interface {
 	Initialize(p *Portfolio)
 	OnBar(symbol string, bar marketdata.Bar, p *Portfolio)
 }
+
+// MultiTimeframeStrategy is a Strategy that also wants coarser bars built
+// from the ones passed to OnBar, e.g. an hourly trend filter on minute bars.
+// Each coarser bar is delivered once it is complete.
+type MultiTimeframeStrategy interface {
+	Strategy
+	Timeframes() []marketdata.TimeFrame
+	OnTimeframeBar(symbol string, tf marketdata.TimeFrame, bar marketdata.Bar, p *Portfolio)
+}
+
+// SliceStrategy is a Strategy that decides across its symbols at once, e.g.
+// by ranking them. Once OnBar has seen every symbol's bar for a time,
+// OnBarSlice gets them together. In a live session a symbol that has no bar
+// for a time is left out of the slice once a later bar arrives. Slices are
+// not delivered during a backtest's warmup, where OnBar alone builds history,
+// since any decision made there would be discarded.
+type SliceStrategy interface {
+	Strategy
+	OnBarSlice(ts time.Time, bars map[string]marketdata.Bar, p *Portfolio)
+}
+
+// StatefulStrategy is a Strategy whose internal state, such as its price
+// history, can be saved and restored, so a live session picks up where it
+// left off after a restart instead of warming up again. UnmarshalState is
+// called after Initialize.
+type StatefulStrategy interface {
+	Strategy
+	MarshalState() ([]byte, error)
+	UnmarshalState(data []byte) error
+}
+
+// barFeed resamples a symbol's incoming bars into the extra timeframes a
+// MultiTimeframeStrategy asked for.
+type barFeed struct {
+	strategy   MultiTimeframeStrategy
+	base       time.Duration
+	frames     []marketdata.TimeFrame
+	resamplers map[string][]*broker.Resampler
+}
+
+// newBarFeed returns nil when s doesn't consume extra timeframes. base is the
+// timeframe of the bars that will be passed to dispatch.
+func newBarFeed(s Strategy, base marketdata.TimeFrame) (*barFeed, error) {
+	mts, ok := s.(MultiTimeframeStrategy)
+	if !ok || len(mts.Timeframes()) == 0 {
+		return nil, nil
+	}
+
+	for _, tf := range mts.Timeframes() {
+		if !broker.Finer(base, tf) {
+			return nil, fmt.Errorf(
+				"strategy timeframe %s must be coarser than the %s bars it is built from",
+				tf,
+				base,
+			)
+		}
+	}
+
+	return &barFeed{
+		strategy:   mts,
+		base:       broker.Duration(base),
+		frames:     mts.Timeframes(),
+		resamplers: make(map[string][]*broker.Resampler),
+	}, nil
+}
+
+// ValidateTimeframes checks that the extra timeframes s consumes, if any, can
+// be built from bars of the base timeframe.
+func ValidateTimeframes(s Strategy, base marketdata.TimeFrame) error {
+	_, err := newBarFeed(s, base)
+	return err
+}
+
+func (f *barFeed) dispatch(symbol string, bar marketdata.Bar, p *Portfolio) {
+	rs, ok := f.resamplers[symbol]
+	if !ok {
+		for _, tf := range f.frames {
+			rs = append(rs, broker.NewResampler(tf, f.base))
+		}
+		f.resamplers[symbol] = rs
+	}
+
+	for _, r := range rs {
+		for _, done := range r.Add(bar) {
+			f.strategy.OnTimeframeBar(symbol, r.Timeframe, done, p)
+		}
+	}
+}
+
+// sliceFeed gathers the bars that share a timestamp for a SliceStrategy.
+type sliceFeed struct {
+	ts   time.Time
+	bars map[string]marketdata.Bar
+}
+
+// add gathers bar when s wants slices, starting a new slice when bar is from
+// a different time than the one being gathered.
+func (f *sliceFeed) add(s Strategy, symbol string, bar marketdata.Bar) {
+	if _, ok := s.(SliceStrategy); !ok {
+		return
+	}
+	if f.bars == nil || !bar.Timestamp.Equal(f.ts) {
+		f.ts = bar.Timestamp
+		f.bars = make(map[string]marketdata.Bar)
+	}
+	f.bars[symbol] = bar
+}
+
+// stale reports whether the slice being gathered is from before ts.
+func (f *sliceFeed) stale(ts time.Time) bool {
+	return len(f.bars) > 0 && f.ts.Before(ts)
+}
+
+// deliver passes the gathered slice to s, if there is one.
+func (f *sliceFeed) deliver(s Strategy, p *Portfolio) {
+	ss, ok := s.(SliceStrategy)
+	if !ok || len(f.bars) == 0 {
+		return
+	}
+	bars := f.bars
+	f.bars = nil
+	ss.OnBarSlice(f.ts, bars, p)
+}
@@ -0,0 +1,191 @@
+package quant
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"citadel/internal/database"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+// Live sessions share one brokerage account. Each runs in a virtual
+// sub-account: its orders carry a client order ID naming the session, its
+// fills are booked only to its own portfolio, and it can only sell shares
+// and spend cash that it holds.
+
+// NewClientOrderID returns a unique client order ID for an order placed by
+// the session, in the form "<session ID>:<random>".
+func NewClientOrderID(sessionID string) string {
+	return sessionID + ":" + strings.ReplaceAll(uuid.New().String(), "-", "")
+}
+
+// SessionFromClientOrderID returns the session that placed an order with the
+// client order ID, or "" when the order wasn't placed by a session.
+func SessionFromClientOrderID(clientOrderID string) string {
+	sessionID, _, ok := strings.Cut(clientOrderID, ":")
+	if !ok {
+		return ""
+	}
+	return sessionID
+}
+
+// checkSubAccount limits intent to what the session itself holds. A sell is
+// capped at the session's position less its open sells, since selling more
+// would sell shares another session bought (or short the account). A buy is
+// capped at what the session's cash, less its open buys, can pay for at the
+// latest price. Orders being canceled and exits still held don't count, and
+// exits that cancel each other count once.
+func (e *LiveEngine) checkSubAccount(intent OrderIntent) (OrderIntent, error) {
+	sellable := e.Portfolio.Positions[intent.Symbol]
+	cash := e.Portfolio.Cash
+	exits := make(map[string]float64) // the largest open sell of each group
+	for _, o := range e.orders {
+		if !o.open || o.held || o.canceling {
+			continue
+		}
+		remaining := math.Max(o.qty-o.filled, 0)
+		switch {
+		case o.side == Sell && o.symbol == intent.Symbol:
+			exits[o.group] = math.Max(exits[o.group], remaining)
+		case o.side == Buy:
+			price := o.price
+			if price == 0 {
+				price = e.latestPrices[o.symbol]
+			}
+			cash -= remaining * price
+		}
+	}
+
+	for _, qty := range exits {
+		sellable -= qty
+	}
+
+	switch intent.Side {
+	case Sell:
+		if sellable <= 1e-9 {
+			return intent, fmt.Errorf("session holds no %s shares to sell", intent.Symbol)
+		}
+		intent.Quantity = math.Min(intent.Quantity, sellable)
+	case Buy:
+		price := e.latestPrices[intent.Symbol]
+		if intent.LimitPrice != nil {
+			price = *intent.LimitPrice
+		} else if intent.StopPrice != nil {
+			price = *intent.StopPrice
+		}
+		if price <= 0 || intent.Quantity*price <= cash {
+			return intent, nil
+		}
+		qty := math.Floor(cash / price)
+		if qty <= 0 {
+			return intent, fmt.Errorf(
+				"session has $%.2f available, not enough for one %s share",
+				cash,
+				intent.Symbol,
+			)
+		}
+		intent.Quantity = qty
+	}
+	return intent, nil
+}
+
+// SubAccountPosition is one holding of a session's sub-account.
+type SubAccountPosition struct {
+	Symbol        string  `json:"symbol"`
+	Qty           float64 `json:"qty"`
+	AvgPrice      float64 `json:"avg_price"`
+	CurrentPrice  float64 `json:"current_price"`
+	MarketValue   float64 `json:"market_value"`
+	UnrealizedPnL float64 `json:"unrealized_pnl"`
+}
+
+// SubAccount is a session's share of the brokerage account. Realized P&L is
+// from the session's closed round trips; unrealized P&L marks its positions
+// to the latest known prices.
+type SubAccount struct {
+	SessionID       string               `json:"session_id"`
+	StartingCapital float64              `json:"starting_capital"`
+	Cash            float64              `json:"cash"`
+	MarketValue     float64              `json:"market_value"`
+	Equity          float64              `json:"equity"`
+	RealizedPnL     float64              `json:"realized_pnl"`
+	UnrealizedPnL   float64              `json:"unrealized_pnl"`
+	Positions       []SubAccountPosition `json:"positions"`
+}
+
+// SubAccount returns the running session's sub-account, marked to the last
+// bar it received.
+func (e *LiveEngine) SubAccount() *SubAccount {
+	var account *SubAccount
+	e.do(func() {
+		account = newSubAccount(e.SessionID, e.StartingCapital, e.Portfolio, e.latestPrices)
+	})
+	return account
+}
+
+// LoadSubAccount rebuilds a session's sub-account from its order history.
+// Positions are marked to prices, falling back to the last fill price of a
+// symbol missing from it.
+func LoadSubAccount(
+	ctx context.Context,
+	db *sqlx.DB,
+	session *database.TradingSession,
+	prices map[string]float64,
+) (*SubAccount, error) {
+	orders, err := database.GetTradingSessionOrders(ctx, db, session.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	p, _ := replayOrders(session.StartingCapital, orders)
+	return newSubAccount(session.SessionID, session.StartingCapital, p, prices), nil
+}
+
+func newSubAccount(
+	sessionID string,
+	startingCapital float64,
+	p *Portfolio,
+	prices map[string]float64,
+) *SubAccount {
+	account := &SubAccount{
+		SessionID:       sessionID,
+		StartingCapital: startingCapital,
+		Cash:            p.Cash,
+		Positions:       []SubAccountPosition{},
+	}
+	for _, rt := range p.Ledger.RoundTrips {
+		account.RealizedPnL += rt.PnL
+	}
+
+	marks := p.markPrices()
+	for symbol, qty := range p.Positions {
+		if qty == 0 {
+			continue
+		}
+		price, ok := prices[symbol]
+		if !ok || price <= 0 {
+			price = marks[symbol]
+		}
+		avg := p.Ledger.AvgEntryPrice(symbol)
+		pos := SubAccountPosition{
+			Symbol:        symbol,
+			Qty:           qty,
+			AvgPrice:      avg,
+			CurrentPrice:  price,
+			MarketValue:   qty * price,
+			UnrealizedPnL: qty * (price - avg),
+		}
+		account.Positions = append(account.Positions, pos)
+		account.MarketValue += pos.MarketValue
+		account.UnrealizedPnL += pos.UnrealizedPnL
+	}
+	sort.Slice(account.Positions, func(i, j int) bool {
+		return account.Positions[i].Symbol < account.Positions[j].Symbol
+	})
+	account.Equity = account.Cash + account.MarketValue
+	return account
+}
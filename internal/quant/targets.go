@@ -0,0 +1,71 @@
+package quant
+
+import (
+	"math"
+	"sort"
+)
+
+// TargetWeights turns the share of equity a strategy wants in each symbol
+// into the orders that move its current positions there.
+type TargetWeights struct {
+	// Weights is the fraction of equity to hold in each symbol, negative for
+	// a short. Symbols held without a weight are closed.
+	Weights map[string]float64
+	// Band skips trades worth less than this fraction of equity, so small
+	// drifts don't churn the book. Closing a position is never skipped.
+	Band float64
+	// WholeShares rounds each target position toward zero to whole shares.
+	WholeShares bool
+}
+
+// Orders returns the market orders that take p to the target weights at the
+// prices it was last marked at. Sells come first, so when the orders fill in
+// turn they free the cash the buys need. Symbols without a price are left
+// alone.
+func (t TargetWeights) Orders(p *Portfolio) []OrderIntent {
+	prices := p.markPrices()
+	equity := p.Equity()
+
+	symbols := make([]string, 0, len(t.Weights)+len(p.Positions))
+	for symbol := range t.Weights {
+		symbols = append(symbols, symbol)
+	}
+	for symbol, qty := range p.Positions {
+		if _, ok := t.Weights[symbol]; !ok && qty != 0 {
+			symbols = append(symbols, symbol)
+		}
+	}
+	sort.Strings(symbols)
+
+	var sells, buys []OrderIntent
+	for _, symbol := range symbols {
+		price := prices[symbol]
+		if price <= 0 {
+			continue
+		}
+		target := t.Weights[symbol] * equity / price
+		if t.WholeShares {
+			target = math.Trunc(target + math.Copysign(1e-9, target))
+		}
+		delta := target - p.Positions[symbol]
+		if math.Abs(delta) < 1e-9 || target != 0 && math.Abs(delta)*price < t.Band*equity {
+			continue
+		}
+
+		intent := OrderIntent{Symbol: symbol, Side: Buy, Type: Market, Quantity: delta}
+		if delta < 0 {
+			intent.Side, intent.Quantity = Sell, -delta
+			sells = append(sells, intent)
+		} else {
+			buys = append(buys, intent)
+		}
+	}
+	return append(sells, buys...)
+}
+
+// Submit queues the orders that take p to the target weights.
+func (t TargetWeights) Submit(p *Portfolio) {
+	for _, intent := range t.Orders(p) {
+		p.SubmitOrder(intent)
+	}
+}
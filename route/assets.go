@@ -8,7 +8,7 @@ import (
 	"citadel/internal/broker"
 )
 
-func SearchAssets(logger *slog.Logger, b *broker.Client) http.HandlerFunc {
+func SearchAssets(logger *slog.Logger, b broker.Broker) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		q := r.URL.Query().Get("q")
 
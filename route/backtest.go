@@ -10,7 +10,7 @@ import (
 	"citadel/internal/broker"
 	"citadel/internal/database"
 	"citadel/internal/quant"
-	"citadel/internal/quant/strategies"
+	_ "citadel/internal/quant/strategies"
 	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
@@ -23,13 +23,29 @@ type BacktestRequest struct {
 	Strategy        string                 `json:"strategy"`
 	StartingCapital float64                `json:"starting_capital"`
 	Parameters      map[string]interface{} `json:"parameters"`
+	Fills           quant.FillConfig       `json:"fills"`
+	Margin          quant.MarginConfig     `json:"margin"`
+	LotMatching     quant.LotMatching      `json:"lot_matching"`
+	RiskFreeRate    float64                `json:"risk_free_rate"`
+	Benchmark       string                 `json:"benchmark"`
+	Timeframe       string                 `json:"timeframe"` // e.g. 1Min, 15Min, 1Hour; default 1Day
+	Risk            json.RawMessage        `json:"risk"`      // quant.RiskConfig over the risk parameters
+
+	// Sleeves backtests several strategies as one book instead of Strategy,
+	// Symbols, Parameters and Risk, with capital split as Allocation says.
+	Sleeves    []quant.SleeveSpec     `json:"sleeves"`
+	Allocation quant.AllocationConfig `json:"allocation"`
 }
 
 type BacktestResponse struct {
 	Portfolio *quant.Portfolio `json:"portfolio"`
 }
 
-func RunBacktest(logger *slog.Logger, b *broker.Client, db *sqlx.DB) http.HandlerFunc {
+func RunBacktest(
+	logger *slog.Logger,
+	data broker.MarketDataSource,
+	db *sqlx.DB,
+) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req BacktestRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -55,6 +71,47 @@ func RunBacktest(logger *slog.Logger, b *broker.Client, db *sqlx.DB) http.Handle
 			return
 		}
 
+		if req.Timeframe == "" {
+			req.Timeframe = marketdata.OneDay.String()
+		}
+		timeframe, err := broker.ParseTimeFrame(req.Timeframe)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+
+		if err := req.LotMatching.Validate(); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+
+		if err := req.Fills.Validate(); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+
+		if err := req.Margin.Validate(); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+
+		if req.StartingCapital <= 0 {
+			req.StartingCapital = 100000.0 // Default if not provided
+		}
+
+		if len(req.Sleeves) > 0 {
+			runPortfolioBacktest(w, r, logger, data, db, &req, timeframe, start, end)
+			return
+		}
+
 		if len(req.Symbols) == 0 {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusBadRequest)
@@ -62,13 +119,31 @@ func RunBacktest(logger *slog.Logger, b *broker.Client, db *sqlx.DB) http.Handle
 			return
 		}
 
-		// Fetch historical data for all symbols
-		barsMap := make(map[string][]marketdata.Bar)
 		for i, sym := range req.Symbols {
-			sym = strings.ToUpper(sym)
-			req.Symbols[i] = sym
+			req.Symbols[i] = strings.ToUpper(sym)
+		}
+
+		// Select strategy
+		strategy, params, err := quant.NewStrategy(req.Strategy, req.Symbols, req.Parameters)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
 
-			bars, err := b.GetHistoricalBars(sym, start, end)
+		rm, err := quant.NewRiskManager(params, req.Risk)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+
+		// Fetch historical data for all symbols
+		barsMap := make(map[string][]marketdata.Bar)
+		for _, sym := range req.Symbols {
+			bars, err := data.GetBars(r.Context(), sym, timeframe, start, end)
 			if err != nil {
 				logger.Error(
 					"failed to get historical bars for backtest",
@@ -86,6 +161,15 @@ func RunBacktest(logger *slog.Logger, b *broker.Client, db *sqlx.DB) http.Handle
 			barsMap[sym] = bars
 		}
 
+		benchmark, err := loadBenchmark(r, logger, data, &req, timeframe, start, end)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).
+				Encode(map[string]string{"error": "failed to fetch market data for " + req.Benchmark})
+			return
+		}
+
 		logger.Info(
 			"fetched backtest data",
 			"symbols",
@@ -94,120 +178,38 @@ func RunBacktest(logger *slog.Logger, b *broker.Client, db *sqlx.DB) http.Handle
 			start,
 			"end",
 			end,
+			"timeframe",
+			req.Timeframe,
 		)
 
-		// Select strategy
-		var strategy quant.Strategy
-		switch req.Strategy {
-		case "sma_crossover":
-			shortPeriod := 10
-			longPeriod := 50
-			if req.Parameters != nil {
-				if v, ok := req.Parameters["short_period"].(float64); ok {
-					shortPeriod = int(v)
-				}
-				if v, ok := req.Parameters["long_period"].(float64); ok {
-					longPeriod = int(v)
-				}
-			}
-			strategy = strategies.NewSMACrossover(req.Symbols[0], shortPeriod, longPeriod)
-		case "rsi_reversion":
-			period := 14
-			oversold := 30.0
-			overbought := 70.0
-			if req.Parameters != nil {
-				if v, ok := req.Parameters["period"].(float64); ok {
-					period = int(v)
-				}
-				if v, ok := req.Parameters["oversold"].(float64); ok {
-					oversold = v
-				}
-				if v, ok := req.Parameters["overbought"].(float64); ok {
-					overbought = v
-				}
-			}
-			strategy = strategies.NewRSIReversion(req.Symbols[0], period, oversold, overbought)
-		case "bollinger_bands":
-			period := 20
-			stdDev := 2.0
-			if req.Parameters != nil {
-				if v, ok := req.Parameters["period"].(float64); ok {
-					period = int(v)
-				}
-				if v, ok := req.Parameters["std_dev"].(float64); ok {
-					stdDev = v
-				}
-			}
-			strategy = strategies.NewBollingerBands(req.Symbols[0], period, stdDev)
-		case "pairs_trading":
-			if len(req.Symbols) < 2 {
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusBadRequest)
-				json.NewEncoder(w).
-					Encode(map[string]string{"error": "pairs trading requires at least 2 symbols"})
-				return
-			}
-			period := 20
-			entryZ := 2.0
-			exitZ := 0.0
-			if req.Parameters != nil {
-				if v, ok := req.Parameters["period"].(float64); ok {
-					period = int(v)
-				}
-				if v, ok := req.Parameters["entry_z"].(float64); ok {
-					entryZ = v
-				}
-				if v, ok := req.Parameters["exit_z"].(float64); ok {
-					exitZ = v
-				}
-			}
-			strategy = strategies.NewPairsTrading(
-				req.Symbols[0],
-				req.Symbols[1],
-				period,
-				entryZ,
-				exitZ,
-			)
-		default:
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "unknown strategy"})
-			return
-		}
-
-		if req.StartingCapital <= 0 {
-			req.StartingCapital = 100000.0 // Default if not provided
-		}
-
-		maxPosPct := 0.05
-		dailyStopPct := 0.02
-		if req.Parameters != nil {
-			if v, ok := req.Parameters["max_position_size_pct"].(float64); ok {
-				maxPosPct = v
-			}
-			if v, ok := req.Parameters["daily_stop_loss_pct"].(float64); ok {
-				dailyStopPct = v
-			}
-		}
-
-		rm := quant.NewDefaultRiskManager(maxPosPct, dailyStopPct)
-
 		// Run simulation
 		engine := quant.NewEngine(req.StartingCapital, strategy, rm)
+		engine.Timeframe = timeframe
+		engine.FillModel = quant.NewFillModel(req.Fills)
+		engine.Portfolio.Margin = req.Margin
+		engine.Portfolio.Ledger = quant.NewLedger(req.LotMatching)
 		if err := engine.Run(barsMap); err != nil {
 			logger.Error("backtest engine failed", "error", err)
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": "engine failed"})
+			json.NewEncoder(w).Encode(map[string]string{"error": "engine failed: " + err.Error()})
 			return
 		}
 
-		engine.Portfolio.CalculateMetrics()
+		engine.Portfolio.CalculateMetricsWith(quant.AnalyticsOptions{
+			RiskFreeRate: req.RiskFreeRate,
+			Benchmark:    benchmark,
+		})
 
 		// Save backtest results
-		paramsJSON, _ := json.Marshal(req.Parameters)
+		paramsJSON, _ := json.Marshal(params)
 		symbolsJSON, _ := json.Marshal(req.Symbols)
 		metricsJSON, _ := json.Marshal(engine.Portfolio.Metrics)
+		ledgerJSON, _ := json.Marshal(engine.Portfolio.Ledger.RoundTrips)
+		ledger := string(ledgerJSON)
+		fills, margin := runConfigs(&req)
+		riskJSON, _ := json.Marshal(rm.Config())
+		risk := string(riskJSON)
 
 		record := database.BacktestRecord{
 			BacktestID:      uuid.NewString(),
@@ -218,6 +220,11 @@ func RunBacktest(logger *slog.Logger, b *broker.Client, db *sqlx.DB) http.Handle
 			StartingCapital: req.StartingCapital,
 			Parameters:      string(paramsJSON),
 			Metrics:         string(metricsJSON),
+			Ledger:          &ledger,
+			Timeframe:       req.Timeframe,
+			FillConfig:      &fills,
+			MarginConfig:    &margin,
+			RiskConfig:      &risk,
 		}
 
 		if err := database.SaveBacktest(r.Context(), db, record); err != nil {
@@ -233,6 +240,153 @@ func RunBacktest(logger *slog.Logger, b *broker.Client, db *sqlx.DB) http.Handle
 	}
 }
 
+// loadBenchmark fetches the bars of req's benchmark, if it has one.
+func loadBenchmark(
+	r *http.Request,
+	logger *slog.Logger,
+	data broker.MarketDataSource,
+	req *BacktestRequest,
+	timeframe marketdata.TimeFrame,
+	start, end time.Time,
+) ([]marketdata.Bar, error) {
+	if req.Benchmark == "" {
+		return nil, nil
+	}
+	req.Benchmark = strings.ToUpper(req.Benchmark)
+	benchmark, err := data.GetBars(r.Context(), req.Benchmark, timeframe, start, end)
+	if err != nil {
+		logger.Error(
+			"failed to get benchmark bars for backtest",
+			"error",
+			err,
+			"symbol",
+			req.Benchmark,
+		)
+	}
+	return benchmark, err
+}
+
+// runPortfolioBacktest backtests req's sleeves as one book, saves it as a
+// backtest of the "portfolio" strategy and writes the quant.PortfolioResult.
+func runPortfolioBacktest(
+	w http.ResponseWriter,
+	r *http.Request,
+	logger *slog.Logger,
+	data broker.MarketDataSource,
+	db *sqlx.DB,
+	req *BacktestRequest,
+	timeframe marketdata.TimeFrame,
+	start, end time.Time,
+) {
+	book, err := quant.NewPortfolioEngine(req.StartingCapital, req.Sleeves, req.Allocation)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	for _, s := range book.Sleeves {
+		s.Engine.Timeframe = timeframe
+		s.Engine.FillModel = quant.NewFillModel(req.Fills)
+		s.Engine.Portfolio.Margin = req.Margin
+		s.Engine.Portfolio.Ledger = quant.NewLedger(req.LotMatching)
+	}
+
+	symbols := book.Symbols()
+	barsMap, err := quant.LoadBars(r.Context(), data, symbols, timeframe, start, end)
+	if err != nil {
+		logger.Error("failed to get historical bars for backtest", "error", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	benchmark, err := loadBenchmark(r, logger, data, req, timeframe, start, end)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).
+			Encode(map[string]string{"error": "failed to fetch market data for " + req.Benchmark})
+		return
+	}
+
+	if err := book.Run(barsMap); err != nil {
+		logger.Error("portfolio backtest failed", "error", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "engine failed: " + err.Error()})
+		return
+	}
+	result := book.Result(quant.AnalyticsOptions{
+		RiskFreeRate: req.RiskFreeRate,
+		Benchmark:    benchmark,
+	})
+
+	// The parameters saved are the allocation and each sleeve's resolved
+	// parameters
+	type savedSleeve struct {
+		Name       string       `json:"name"`
+		Strategy   string       `json:"strategy"`
+		Symbols    []string     `json:"symbols"`
+		Parameters quant.Params `json:"parameters"`
+	}
+	sleeves := make([]savedSleeve, 0, len(book.Sleeves))
+	for _, s := range book.Sleeves {
+		sleeves = append(sleeves, savedSleeve{s.Name, s.Strategy, s.Symbols, s.Parameters})
+	}
+	paramsJSON, _ := json.Marshal(map[string]interface{}{
+		"allocation": req.Allocation,
+		"sleeves":    sleeves,
+	})
+	symbolsJSON, _ := json.Marshal(symbols)
+	metricsJSON, _ := json.Marshal(result.Portfolio.Metrics)
+	ledgerJSON, _ := json.Marshal(result.Portfolio.Ledger.RoundTrips)
+	ledger := string(ledgerJSON)
+	fills, margin := runConfigs(req)
+
+	// Each sleeve has its own risk manager, so the risk saved is keyed by
+	// sleeve name
+	risks := make(map[string]quant.RiskConfig, len(book.Sleeves))
+	for _, s := range book.Sleeves {
+		if rm, ok := s.Engine.RiskManager.(*quant.RuleRiskManager); ok {
+			risks[s.Name] = rm.Config()
+		}
+	}
+	riskJSON, _ := json.Marshal(risks)
+	risk := string(riskJSON)
+
+	record := database.BacktestRecord{
+		BacktestID:      uuid.NewString(),
+		Strategy:        "portfolio",
+		Symbols:         string(symbolsJSON),
+		StartDate:       req.Start,
+		EndDate:         req.End,
+		StartingCapital: req.StartingCapital,
+		Parameters:      string(paramsJSON),
+		Metrics:         string(metricsJSON),
+		Ledger:          &ledger,
+		Timeframe:       req.Timeframe,
+		FillConfig:      &fills,
+		MarginConfig:    &margin,
+		RiskConfig:      &risk,
+	}
+	if err := database.SaveBacktest(r.Context(), db, record); err != nil {
+		logger.Error("failed to save backtest", "error", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// runConfigs returns the JSON fill and margin configs of req, saved with the
+// backtest so the run can be told apart and reproduced.
+func runConfigs(req *BacktestRequest) (fills, margin string) {
+	fillsJSON, _ := json.Marshal(req.Fills)
+	marginJSON, _ := json.Marshal(req.Margin)
+	return string(fillsJSON), string(marginJSON)
+}
+
 func ListBacktests(logger *slog.Logger, db *sqlx.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		records, err := database.ListBacktests(r.Context(), db)
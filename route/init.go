@@ -10,6 +10,7 @@ import (
 	"citadel/internal/email"
 	"citadel/internal/middleware"
 	"citadel/internal/parser"
+	"citadel/internal/quant"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/rs/cors"
@@ -22,10 +23,19 @@ type Config struct {
 	Parser     *parser.Claude
 	Email      *email.Client
 	SigningKey string
-	Broker     *broker.Client
+	Broker     broker.Broker
+	MarketData broker.MarketDataSource // historical bars for backtests; defaults to Broker
+	Engines    *quant.EngineManager    // live trading sessions; defaults to a new manager
 }
 
 func Initialize(ctx context.Context, config Config) http.Handler {
+	if config.MarketData == nil && config.Broker != nil {
+		config.MarketData = config.Broker
+	}
+	if config.Engines == nil {
+		config.Engines = quant.NewEngineManager(config.DB)
+	}
+
 	baseChain := middleware.New(
 		middleware.Logger(config.Logger),
 	)
@@ -189,6 +199,10 @@ func Initialize(ctx context.Context, config Config) http.Handler {
 		"GET /trading/account",
 		adminChain.Wrap(GetTradingAccount(config.Logger, config.Broker)),
 	)
+	mux.Handle(
+		"GET /trading/market/clock",
+		adminChain.Wrap(GetMarketClock(config.Logger, config.Broker)),
+	)
 	mux.Handle(
 		"GET /trading/positions",
 		adminChain.Wrap(GetPositions(config.Logger, config.Broker)),
@@ -213,17 +227,27 @@ func Initialize(ctx context.Context, config Config) http.Handler {
 		"GET /trading/assets/search",
 		adminChain.Wrap(SearchAssets(config.Logger, config.Broker)),
 	)
+	mux.Handle(
+		"GET /trading/strategies",
+		adminChain.Wrap(ListStrategies()),
+	)
 	mux.Handle(
 		"POST /trading/backtest",
-		adminChain.Wrap(RunBacktest(config.Logger, config.Broker, config.DB)),
+		adminChain.Wrap(RunBacktest(config.Logger, config.MarketData, config.DB)),
 	)
 	mux.Handle(
 		"POST /trading/live/start",
-		adminChain.Wrap(StartLiveEngine(config.Logger, config.Broker, config.DB)),
+		adminChain.Wrap(StartLiveEngine(config.Logger, config.Broker, config.DB, config.Engines)),
+	)
+	mux.Handle(
+		"POST /trading/live/replay",
+		adminChain.Wrap(
+			ReplayLiveEngine(config.Logger, config.MarketData, config.DB, config.Engines),
+		),
 	)
 	mux.Handle(
 		"POST /trading/live/stop",
-		adminChain.Wrap(StopLiveEngine(config.Logger)),
+		adminChain.Wrap(StopLiveEngine(config.Logger, config.Engines)),
 	)
 	mux.Handle(
 		"GET /trading/sessions",
@@ -233,10 +257,56 @@ func Initialize(ctx context.Context, config Config) http.Handler {
 		"GET /trading/sessions/{id}",
 		adminChain.Wrap(GetTradingSessionDetails(config.Logger, config.DB)),
 	)
+	mux.Handle(
+		"GET /trading/sessions/{id}/positions",
+		adminChain.Wrap(
+			GetSessionPositions(config.Logger, config.Broker, config.DB, config.Engines),
+		),
+	)
+	mux.Handle(
+		"GET /trading/sessions/{id}/events",
+		adminChain.Wrap(StreamSessionEvents(config.Logger, config.DB, config.Engines)),
+	)
+	mux.Handle(
+		"POST /trading/sessions/{id}/pause",
+		adminChain.Wrap(PauseLiveSession(config.Logger, config.DB, config.Engines)),
+	)
+	mux.Handle(
+		"POST /trading/sessions/{id}/resume",
+		adminChain.Wrap(ResumeLiveSession(config.Logger, config.DB, config.Engines)),
+	)
+	mux.Handle(
+		"POST /trading/sessions/{id}/liquidate",
+		adminChain.Wrap(LiquidateLiveSession(config.Logger, config.DB, config.Engines)),
+	)
+	mux.Handle(
+		"PATCH /trading/sessions/{id}/parameters",
+		adminChain.Wrap(UpdateSessionParameters(config.Logger, config.Engines)),
+	)
+	mux.Handle(
+		"PATCH /trading/sessions/{id}/risk",
+		adminChain.Wrap(UpdateSessionRisk(config.Logger, config.Engines)),
+	)
+	mux.Handle(
+		"GET /trading/sessions/{id}/rejections",
+		adminChain.Wrap(ListSessionRejections(config.Logger, config.DB)),
+	)
+	mux.Handle(
+		"GET /trading/sessions/{id}/audit",
+		adminChain.Wrap(ListSessionAudit(config.Logger, config.DB)),
+	)
 	mux.Handle(
 		"GET /trading/backtests",
 		adminChain.Wrap(ListBacktests(config.Logger, config.DB)),
 	)
+	mux.Handle(
+		"GET /trading/optimizations",
+		adminChain.Wrap(ListOptimizations(config.Logger, config.DB)),
+	)
+	mux.Handle(
+		"GET /trading/optimizations/{id}",
+		adminChain.Wrap(GetOptimizationDetails(config.Logger, config.DB)),
+	)
 
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"https://julian-one.com", "http://localhost:3000"},
@@ -8,9 +8,10 @@ import (
 	"time"
 
 	"citadel/internal/broker"
+	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
 )
 
-func GetHistoricalBars(logger *slog.Logger, b *broker.Client) http.HandlerFunc {
+func GetHistoricalBars(logger *slog.Logger, b broker.Broker) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		symbol := strings.ToUpper(r.URL.Query().Get("symbol"))
 		if symbol == "" {
@@ -52,7 +53,19 @@ func GetHistoricalBars(logger *slog.Logger, b *broker.Client) http.HandlerFunc {
 			end = time.Now()
 		}
 
-		bars, err := b.GetHistoricalBars(symbol, start, end)
+		tfStr := r.URL.Query().Get("timeframe")
+		if tfStr == "" {
+			tfStr = marketdata.OneDay.String()
+		}
+		timeframe, err := broker.ParseTimeFrame(tfStr)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+
+		bars, err := b.GetBars(r.Context(), symbol, timeframe, start, end)
 		if err != nil {
 			logger.Error("failed to get historical bars", "symbol", symbol, "error", err)
 			w.Header().Set("Content-Type", "application/json")
@@ -11,7 +11,7 @@ import (
 	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata/stream"
 )
 
-func StreamMarketData(logger *slog.Logger, b *broker.Client) http.HandlerFunc {
+func StreamMarketData(logger *slog.Logger, b broker.Broker) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		symbol := r.URL.Query().Get("symbol")
 		if symbol == "" {
@@ -44,17 +44,14 @@ func StreamMarketData(logger *slog.Logger, b *broker.Client) http.HandlerFunc {
 			}
 		}
 
-		err := b.Stream.SubscribeToTrades(handler, symbol)
+		sub, err := b.SubscribeTrades(handler, symbol)
 		if err != nil {
 			logger.Error("failed to subscribe to trades", "symbol", symbol, "error", err)
 			return
 		}
-
-		// Note: we purposely omit UnsubscribeFromTrades on client disconnect here
-		// because the Alpaca SDK manages a single handler map per symbol.
-		// If a user refreshes the page, the new request subscribes, and the old request's
-		// cancel context runs right after, which would accidentally unsubscribe the new request.
-		// For a single-user system, leaving the subscription active is fine.
+		// The broker's hub keeps the upstream subscription while any client
+		// still wants the symbol
+		defer sub.Close()
 
 		ctx := r.Context()
 		for {
@@ -0,0 +1,71 @@
+package route
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"citadel/internal/database"
+	"github.com/jmoiron/sqlx"
+)
+
+func ListOptimizations(logger *slog.Logger, db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		opts, err := database.ListOptimizations(r.Context(), db)
+		if err != nil {
+			logger.Error("failed to list optimizations", "error", err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).
+				Encode(map[string]string{"error": "Failed to retrieve optimizations"})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(opts)
+	}
+}
+
+func GetOptimizationDetails(logger *slog.Logger, db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		optimizationID := r.PathValue("id")
+
+		opt, err := database.GetOptimization(r.Context(), db, optimizationID)
+		if err != nil {
+			logger.Error(
+				"failed to get optimization",
+				"error",
+				err,
+				"optimization_id",
+				optimizationID,
+			)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Optimization not found"})
+			return
+		}
+
+		backtests, err := database.GetOptimizationBacktests(r.Context(), db, optimizationID)
+		if err != nil {
+			logger.Error(
+				"failed to get optimization backtests",
+				"error",
+				err,
+				"optimization_id",
+				optimizationID,
+			)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).
+				Encode(map[string]string{"error": "Failed to retrieve optimization backtests"})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"optimization": opt,
+			"backtests":    backtests,
+		})
+	}
+}
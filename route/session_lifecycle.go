@@ -0,0 +1,234 @@
+package route
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"citadel/internal/database"
+	"citadel/internal/quant"
+	"citadel/internal/session"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// actor returns the user making the request, for a session's audit trail.
+func actor(r *http.Request) string {
+	if s, ok := r.Context().Value(session.ContextKey).(*session.Session); ok && s != nil {
+		return s.User
+	}
+	return ""
+}
+
+// writeLifecycleError maps an engine manager error to a response: unknown
+// sessions are 404, transitions the session's status doesn't allow are 409
+// and anything else, such as invalid parameters, is 400.
+func writeLifecycleError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	switch {
+	case errors.Is(err, quant.ErrEngineNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, quant.ErrInvalidTransition):
+		status = http.StatusConflict
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// sessionTransition handles a lifecycle action on a running session and
+// responds with the status the session is left in.
+func sessionTransition(
+	logger *slog.Logger,
+	db *sqlx.DB,
+	action func(ctx context.Context, sessionID, actor string) error,
+	message string,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessionID := r.PathValue("id")
+		if err := action(r.Context(), sessionID, actor(r)); err != nil {
+			writeLifecycleError(w, err)
+			return
+		}
+
+		s, err := database.GetTradingSession(r.Context(), db, sessionID)
+		if err != nil {
+			logger.Error("failed to get trading session", "error", err, "session_id", sessionID)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).
+				Encode(map[string]string{"error": "Failed to retrieve trading session"})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"message":    message,
+			"session_id": sessionID,
+			"status":     s.Status,
+		})
+	}
+}
+
+// PauseLiveSession stops a running session's strategy from trading while it
+// keeps following the market.
+func PauseLiveSession(
+	logger *slog.Logger,
+	db *sqlx.DB,
+	engines *quant.EngineManager,
+) http.HandlerFunc {
+	return sessionTransition(logger, db, engines.Pause, "Session paused")
+}
+
+// ResumeLiveSession lets a paused session trade again.
+func ResumeLiveSession(
+	logger *slog.Logger,
+	db *sqlx.DB,
+	engines *quant.EngineManager,
+) http.HandlerFunc {
+	return sessionTransition(logger, db, engines.Unpause, "Session resumed")
+}
+
+// LiquidateLiveSession cancels a session's open orders and closes its
+// positions; the session stops once it is flat.
+func LiquidateLiveSession(
+	logger *slog.Logger,
+	db *sqlx.DB,
+	engines *quant.EngineManager,
+) http.HandlerFunc {
+	return sessionTransition(logger, db, engines.Liquidate, "Session liquidating")
+}
+
+type UpdateParametersRequest struct {
+	Parameters map[string]interface{} `json:"parameters"`
+}
+
+// UpdateSessionParameters applies new strategy and risk parameters to a
+// running or paused session. Parameters not given keep their values.
+func UpdateSessionParameters(logger *slog.Logger, engines *quant.EngineManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req UpdateParametersRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid request body"})
+			return
+		}
+		if len(req.Parameters) == 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "parameters required"})
+			return
+		}
+
+		sessionID := r.PathValue("id")
+		params, err := engines.UpdateParameters(r.Context(), sessionID, req.Parameters, actor(r))
+		if err != nil {
+			logger.Warn(
+				"failed to update session parameters",
+				"error",
+				err,
+				"session_id",
+				sessionID,
+			)
+			writeLifecycleError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"session_id": sessionID,
+			"parameters": params,
+		})
+	}
+}
+
+// UpdateSessionRisk changes a running or paused session's risk rules. The
+// body holds the quant.RiskConfig fields to change, such as
+// {"kill_switch": true}; fields not given keep their values.
+func UpdateSessionRisk(logger *slog.Logger, engines *quant.EngineManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid request body"})
+			return
+		}
+		if len(req) == 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "risk settings required"})
+			return
+		}
+
+		sessionID := r.PathValue("id")
+		risk, err := engines.UpdateRisk(r.Context(), sessionID, req, actor(r))
+		if err != nil {
+			logger.Warn("failed to update session risk", "error", err, "session_id", sessionID)
+			writeLifecycleError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"session_id": sessionID,
+			"risk":       risk,
+		})
+	}
+}
+
+// ListSessionRejections returns the orders a session's risk rules, the
+// market hours or the broker turned away, oldest first.
+func ListSessionRejections(logger *slog.Logger, db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessionID := r.PathValue("id")
+		if _, err := database.GetTradingSession(r.Context(), db, sessionID); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Trading session not found"})
+			return
+		}
+
+		rejections, err := database.ListOrderRejections(r.Context(), db, sessionID)
+		if err != nil {
+			logger.Error("failed to list order rejections", "error", err, "session_id", sessionID)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).
+				Encode(map[string]string{"error": "Failed to retrieve order rejections"})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rejections)
+	}
+}
+
+// ListSessionAudit returns a session's lifecycle transitions, oldest first.
+func ListSessionAudit(logger *slog.Logger, db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessionID := r.PathValue("id")
+		if _, err := database.GetTradingSession(r.Context(), db, sessionID); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Trading session not found"})
+			return
+		}
+
+		audit, err := database.ListSessionAudit(r.Context(), db, sessionID)
+		if err != nil {
+			logger.Error("failed to list session audit", "error", err, "session_id", sessionID)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).
+				Encode(map[string]string{"error": "Failed to retrieve session audit"})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(audit)
+	}
+}
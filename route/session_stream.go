@@ -0,0 +1,79 @@
+package route
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"citadel/internal/database"
+	"citadel/internal/quant"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// StreamSessionEvents streams a session's engine events as Server-Sent
+// Events: bars, signals, orders, rejections, fills, risk halts and equity
+// updates, and status changes. The stream ends when the session stops or the
+// client goes away.
+func StreamSessionEvents(
+	logger *slog.Logger,
+	db *sqlx.DB,
+	engines *quant.EngineManager,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessionID := r.PathValue("id")
+		if _, err := database.GetTradingSession(r.Context(), db, sessionID); err != nil {
+			logger.Error("failed to get trading session", "error", err, "session_id", sessionID)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Trading session not found"})
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "streaming unsupported"})
+			return
+		}
+
+		events, unsubscribe := engines.Events.Subscribe(sessionID, 256)
+		defer unsubscribe()
+
+		// SSE headers
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		ctx := r.Context()
+		ping := time.NewTicker(15 * time.Second)
+		defer ping.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return // Client disconnected
+			case event := <-events:
+				data, err := json.Marshal(event)
+				if err != nil {
+					logger.Error("failed to encode session event", "error", err, "type", event.Type)
+					continue
+				}
+				w.Write([]byte("event: " + string(event.Type) + "\n"))
+				w.Write([]byte("data: "))
+				w.Write(data)
+				w.Write([]byte("\n\n"))
+				flusher.Flush()
+				if c, ok := event.Data.(quant.StatusChange); ok && quant.FinalStatus(c.Status) {
+					return // the session is over
+				}
+			case <-ping.C:
+				w.Write([]byte(": ping\n\n"))
+				flusher.Flush()
+			}
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package route
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"citadel/internal/quant"
+)
+
+// ListStrategies returns every registered strategy with its parameter schema,
+// including the risk parameters every strategy accepts.
+func ListStrategies() http.HandlerFunc {
+	type strategyResponse struct {
+		quant.StrategySpec
+		RiskParams   []quant.ParamSpec `json:"risk_parameters"`
+		SizingParams []quant.ParamSpec `json:"sizing_parameters"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		specs := quant.Strategies()
+		resp := make([]strategyResponse, 0, len(specs))
+		for _, spec := range specs {
+			resp = append(resp, strategyResponse{
+				StrategySpec: spec,
+				RiskParams:   quant.RiskParams,
+				SizingParams: quant.SizingParams,
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
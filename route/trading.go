@@ -1,24 +1,24 @@
 package route
 
 import (
-	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
 	"strings"
-	"sync"
+	"time"
 
 	"citadel/internal/broker"
 	"citadel/internal/database"
 	"citadel/internal/quant"
-	"citadel/internal/quant/strategies"
+	_ "citadel/internal/quant/strategies"
 
-	"github.com/alpacahq/alpaca-trade-api-go/v3/alpaca"
+	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
 	"github.com/jmoiron/sqlx"
-	"github.com/shopspring/decimal"
 )
 
-func GetTradingAccount(logger *slog.Logger, b *broker.Client) http.HandlerFunc {
+func GetTradingAccount(logger *slog.Logger, b broker.Broker) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		account, err := b.GetAccount()
 		if err != nil {
@@ -36,19 +36,89 @@ func GetTradingAccount(logger *slog.Logger, b *broker.Client) http.HandlerFunc {
 	}
 }
 
-var (
-	activeEngines = make(map[string]*quant.LiveEngine)
-	enginesMutex  sync.RWMutex
-)
+// GetMarketClock reports whether the market is open and when it next opens
+// and closes.
+func GetMarketClock(logger *slog.Logger, b broker.Broker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clock, err := b.GetClock()
+		if err != nil {
+			logger.Error("failed to get market clock", "error", err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to retrieve market clock"})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(clock)
+	}
+}
 
 type StartLiveRequest struct {
 	Symbols         []string               `json:"symbols"`
 	Strategy        string                 `json:"strategy"`
 	StartingCapital float64                `json:"starting_capital"`
 	Parameters      map[string]interface{} `json:"parameters"`
+	Timeframe       string                 `json:"timeframe"` // bars passed to the strategy; default 1Min
+	Risk            json.RawMessage        `json:"risk"`      // quant.RiskConfig over the risk parameters
 }
 
-func StartLiveEngine(logger *slog.Logger, b *broker.Client, db *sqlx.DB) http.HandlerFunc {
+// buildLiveEngine validates req and builds an engine for it. Any error is a
+// problem with the request.
+func buildLiveEngine(
+	req *StartLiveRequest,
+	b broker.Broker,
+	db *sqlx.DB,
+) (*quant.LiveEngine, error) {
+	if len(req.Symbols) == 0 {
+		return nil, errors.New("symbols required")
+	}
+
+	for i, sym := range req.Symbols {
+		req.Symbols[i] = strings.ToUpper(sym)
+	}
+
+	spec, ok := quant.LookupStrategy(req.Strategy)
+	if !ok {
+		return nil, errors.New("unknown strategy")
+	}
+
+	strategy, params, err := spec.Build(req.Symbols, req.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Timeframe == "" {
+		req.Timeframe = marketdata.OneMin.String()
+	}
+	timeframe, err := broker.ParseTimeFrame(req.Timeframe)
+	if err != nil {
+		return nil, err
+	}
+	if err := quant.ValidateTimeframes(strategy, timeframe); err != nil {
+		return nil, err
+	}
+
+	rm, err := quant.NewRiskManager(params, req.Risk)
+	if err != nil {
+		return nil, err
+	}
+	engine := quant.NewLiveEngine(db, b, req.StartingCapital, strategy, req.Symbols, params, rm)
+	engine.StrategyID = spec.ID
+	engine.Timeframe = timeframe
+	if len(req.Risk) > 0 && string(req.Risk) != "null" {
+		engine.Risk = string(req.Risk)
+	}
+	return engine, nil
+}
+
+func StartLiveEngine(
+	logger *slog.Logger,
+	b broker.Broker,
+	db *sqlx.DB,
+	engines *quant.EngineManager,
+) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req StartLiveRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -58,128 +128,128 @@ func StartLiveEngine(logger *slog.Logger, b *broker.Client, db *sqlx.DB) http.Ha
 			return
 		}
 
-		if len(req.Symbols) == 0 {
+		engine, err := buildLiveEngine(&req, b, db)
+		if err != nil {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "symbols required"})
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 			return
 		}
 
-		for i, sym := range req.Symbols {
-			req.Symbols[i] = strings.ToUpper(sym)
+		engine.StartedBy = actor(r)
+		if err := engines.Start(r.Context(), logger, engine); err != nil {
+			logger.Error("failed to start live engine", "error", err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
 		}
 
-		var strategy quant.Strategy
-		switch req.Strategy {
-		case "sma_crossover":
-			shortPeriod := 10
-			longPeriod := 50
-			if req.Parameters != nil {
-				if v, ok := req.Parameters["short_period"].(float64); ok {
-					shortPeriod = int(v)
-				}
-				if v, ok := req.Parameters["long_period"].(float64); ok {
-					longPeriod = int(v)
-				}
-			}
-			strategy = strategies.NewSMACrossover(req.Symbols[0], shortPeriod, longPeriod)
-		case "rsi_reversion":
-			period := 14
-			oversold := 30.0
-			overbought := 70.0
-			if req.Parameters != nil {
-				if v, ok := req.Parameters["period"].(float64); ok {
-					period = int(v)
-				}
-				if v, ok := req.Parameters["oversold"].(float64); ok {
-					oversold = v
-				}
-				if v, ok := req.Parameters["overbought"].(float64); ok {
-					overbought = v
-				}
-			}
-			strategy = strategies.NewRSIReversion(req.Symbols[0], period, oversold, overbought)
-		case "bollinger_bands":
-			period := 20
-			stdDev := 2.0
-			if req.Parameters != nil {
-				if v, ok := req.Parameters["period"].(float64); ok {
-					period = int(v)
-				}
-				if v, ok := req.Parameters["std_dev"].(float64); ok {
-					stdDev = v
-				}
-			}
-			strategy = strategies.NewBollingerBands(req.Symbols[0], period, stdDev)
-		case "pairs_trading":
-			if len(req.Symbols) < 2 {
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusBadRequest)
-				json.NewEncoder(w).Encode(map[string]string{"error": "requires 2 symbols"})
-				return
-			}
-			period := 20
-			entryZ := 2.0
-			exitZ := 0.0
-			if req.Parameters != nil {
-				if v, ok := req.Parameters["period"].(float64); ok {
-					period = int(v)
-				}
-				if v, ok := req.Parameters["entry_z"].(float64); ok {
-					entryZ = v
-				}
-				if v, ok := req.Parameters["exit_z"].(float64); ok {
-					exitZ = v
-				}
-			}
-			strategy = strategies.NewPairsTrading(
-				req.Symbols[0],
-				req.Symbols[1],
-				period,
-				entryZ,
-				exitZ,
-			)
-		default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"message":    "Live engine started",
+			"session_id": engine.SessionID,
+		})
+	}
+}
+
+type ReplayRequest struct {
+	StartLiveRequest
+	Start string  `json:"start_date"`
+	End   string  `json:"end_date"`
+	Speed float64 `json:"speed"` // 60 replays an hour of bars per minute; 0 is as fast as possible
+}
+
+// ReplayLiveEngine starts a live engine session over stored minute bars
+// instead of the market. It returns once the replay has started; the session
+// is marked completed when it ends.
+func ReplayLiveEngine(
+	logger *slog.Logger,
+	data broker.MarketDataSource,
+	db *sqlx.DB,
+	engines *quant.EngineManager,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ReplayRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "unknown strategy"})
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid request body"})
 			return
 		}
 
-		maxPosPct := 0.05
-		dailyStopPct := 0.02
-		if req.Parameters != nil {
-			if v, ok := req.Parameters["max_position_size_pct"].(float64); ok {
-				maxPosPct = v
-			}
-			if v, ok := req.Parameters["daily_stop_loss_pct"].(float64); ok {
-				dailyStopPct = v
-			}
+		start, err := time.Parse(time.RFC3339, req.Start)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid start_date format"})
+			return
 		}
 
-		rm := quant.NewDefaultRiskManager(maxPosPct, dailyStopPct)
-		engine := quant.NewLiveEngine(db, b, req.StartingCapital, strategy, req.Symbols, req.Parameters, rm)
-		if err := engine.Start(r.Context(), logger); err != nil {
-			logger.Error("failed to start live engine", "error", err)
+		end, err := time.Parse(time.RFC3339, req.End)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid end_date format"})
+			return
+		}
+
+		if req.StartingCapital <= 0 || req.Speed < 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "starting_capital must be positive and speed not negative",
+			})
+			return
+		}
+
+		engine, err := buildLiveEngine(&req.StartLiveRequest, nil, db)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+
+		bars, err := quant.LoadBars(r.Context(), data, req.Symbols, marketdata.OneMin, start, end)
+		if err != nil {
+			logger.Error("failed to get bars for replay", "error", err)
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusInternalServerError)
 			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 			return
 		}
 
-		enginesMutex.Lock()
-		activeEngines[engine.SessionID] = engine
-		enginesMutex.Unlock()
+		total := 0
+		for _, b := range bars {
+			total += len(b)
+		}
+		if total == 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).
+				Encode(map[string]string{"error": "no bars in the requested range"})
+			return
+		}
+
+		engine.StartedBy = actor(r)
+		if err := engines.StartReplay(r.Context(), logger, engine, bars, req.Speed); err != nil {
+			logger.Error("failed to start replay", "error", err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{
-			"message":    "Live engine started",
+			"message":    "Replay started",
 			"session_id": engine.SessionID,
 		})
 	}
 }
 
-func StopLiveEngine(logger *slog.Logger) http.HandlerFunc {
+func StopLiveEngine(logger *slog.Logger, engines *quant.EngineManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		sessionID := r.URL.Query().Get("session_id")
 		if sessionID == "" {
@@ -189,23 +259,13 @@ func StopLiveEngine(logger *slog.Logger) http.HandlerFunc {
 			return
 		}
 
-		enginesMutex.Lock()
-		engine, ok := activeEngines[sessionID]
-		if ok {
-			delete(activeEngines, sessionID)
-		}
-		enginesMutex.Unlock()
-
-		if !ok {
+		if err := engines.Stop(r.Context(), sessionID, actor(r)); err != nil {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusNotFound)
-			json.NewEncoder(w).
-				Encode(map[string]string{"error": "session not found or already stopped"})
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 			return
 		}
 
-		engine.Stop(r.Context())
-
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{"message": "Live engine stopped"})
 	}
@@ -263,15 +323,112 @@ func GetTradingSessionDetails(logger *slog.Logger, db *sqlx.DB) http.HandlerFunc
 			return
 		}
 
+		// Sessions that never handled a bar or fill have no state yet
+		state, err := database.GetSessionState(r.Context(), db, sessionID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			logger.Error("failed to get session state", "error", err, "session_id", sessionID)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).
+				Encode(map[string]string{"error": "Failed to retrieve session state"})
+			return
+		}
+
+		positions, err := database.GetSessionPositions(r.Context(), db, sessionID)
+		if err != nil {
+			logger.Error("failed to get session positions", "error", err, "session_id", sessionID)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).
+				Encode(map[string]string{"error": "Failed to retrieve session positions"})
+			return
+		}
+
+		performance, err := quant.LoadPerformance(r.Context(), db, session)
+		if err != nil {
+			logger.Error(
+				"failed to load session performance",
+				"error",
+				err,
+				"session_id",
+				sessionID,
+			)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).
+				Encode(map[string]string{"error": "Failed to retrieve session performance"})
+			return
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"session": session,
-			"orders":  orders,
+			"session":   session,
+			"orders":    orders,
+			"state":     state,
+			"positions": positions,
+			"equity":    performance.EquityLog,
+			"metrics":   performance.Metrics,
 		})
 	}
 }
 
-func GetPositions(logger *slog.Logger, b *broker.Client) http.HandlerFunc {
+// GetSessionPositions returns a session's virtual sub-account: its cash,
+// positions and P&L within the shared brokerage account. A running session
+// reports its own marks; otherwise the session is rebuilt from its orders and
+// marked to the broker's current prices where it has them.
+func GetSessionPositions(
+	logger *slog.Logger,
+	b broker.Broker,
+	db *sqlx.DB,
+	engines *quant.EngineManager,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessionID := r.PathValue("id")
+
+		if engine, ok := engines.Get(sessionID); ok {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(engine.SubAccount())
+			return
+		}
+
+		session, err := database.GetTradingSession(r.Context(), db, sessionID)
+		if err != nil {
+			logger.Error("failed to get trading session", "error", err, "session_id", sessionID)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Trading session not found"})
+			return
+		}
+
+		prices := make(map[string]float64)
+		if b != nil && session.Mode != quant.ModeReplay {
+			positions, err := b.GetPositions()
+			if err != nil {
+				logger.Warn("failed to get broker prices", "error", err, "session_id", sessionID)
+			}
+			for _, p := range positions {
+				if p.CurrentPrice != nil {
+					prices[p.Symbol] = p.CurrentPrice.InexactFloat64()
+				}
+			}
+		}
+
+		account, err := quant.LoadSubAccount(r.Context(), db, session, prices)
+		if err != nil {
+			logger.Error("failed to load sub-account", "error", err, "session_id", sessionID)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).
+				Encode(map[string]string{"error": "Failed to retrieve session positions"})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(account)
+	}
+}
+
+func GetPositions(logger *slog.Logger, b broker.Broker) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		positions, err := b.GetPositions()
 		if err != nil {
@@ -288,7 +445,7 @@ func GetPositions(logger *slog.Logger, b *broker.Client) http.HandlerFunc {
 	}
 }
 
-func GetPortfolioHistory(logger *slog.Logger, b *broker.Client) http.HandlerFunc {
+func GetPortfolioHistory(logger *slog.Logger, b broker.Broker) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		period := r.URL.Query().Get("period")
 		if period == "" {
@@ -316,14 +473,49 @@ func GetPortfolioHistory(logger *slog.Logger, b *broker.Client) http.HandlerFunc
 }
 
 type PlaceOrderRequestPayload struct {
-	Symbol   string  `json:"symbol"`
-	Quantity float64 `json:"quantity"`
-	Side     string  `json:"side"` // "buy" or "sell"
-	Type     string  `json:"type"` // "market" or "limit"
-	Limit    float64 `json:"limit,omitempty"`
+	Symbol       string  `json:"symbol"`
+	Quantity     float64 `json:"quantity"`
+	Side         string  `json:"side"` // "buy" or "sell"
+	Type         string  `json:"type"` // "market", "limit", "stop" or "trailing_stop"
+	Limit        float64 `json:"limit,omitempty"`
+	Stop         float64 `json:"stop,omitempty"`
+	TrailPrice   float64 `json:"trail_price,omitempty"`
+	TrailPercent float64 `json:"trail_percent,omitempty"`
+	TimeInForce  string  `json:"time_in_force,omitempty"` // default day
+
+	// Exits: a take-profit limit price and a stop-loss stop price. With
+	// both the order is a bracket and with one an OTO, unless OrderClass
+	// says "oco", which places the exits alone for a position already held.
+	OrderClass string  `json:"order_class,omitempty"`
+	TakeProfit float64 `json:"take_profit,omitempty"`
+	StopLoss   float64 `json:"stop_loss,omitempty"`
+}
+
+// intent is the order the payload describes.
+func (req PlaceOrderRequestPayload) intent() quant.OrderIntent {
+	price := func(f float64) *float64 {
+		if f == 0 {
+			return nil
+		}
+		return &f
+	}
+	return quant.OrderIntent{
+		Symbol:        strings.ToUpper(req.Symbol),
+		Side:          quant.TradeSide(strings.ToLower(req.Side)),
+		Type:          quant.OrderType(strings.ToLower(req.Type)),
+		Quantity:      req.Quantity,
+		LimitPrice:    price(req.Limit),
+		StopPrice:     price(req.Stop),
+		TrailingPrice: price(req.TrailPrice),
+		TrailingPct:   price(req.TrailPercent),
+		TimeInForce:   strings.ToLower(req.TimeInForce),
+		OrderClass:    quant.OrderClass(strings.ToLower(req.OrderClass)),
+		TakeProfit:    price(req.TakeProfit),
+		StopLoss:      price(req.StopLoss),
+	}
 }
 
-func PlaceManualOrder(logger *slog.Logger, b *broker.Client) http.HandlerFunc {
+func PlaceManualOrder(logger *slog.Logger, b broker.Broker) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req PlaceOrderRequestPayload
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -333,28 +525,23 @@ func PlaceManualOrder(logger *slog.Logger, b *broker.Client) http.HandlerFunc {
 			return
 		}
 
-		if req.Symbol == "" || req.Quantity <= 0 || req.Side == "" || req.Type == "" {
+		if req.Symbol == "" || req.Quantity <= 0 || req.Side == "" ||
+			(req.Type == "" && !strings.EqualFold(req.OrderClass, string(quant.ClassOCO))) {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusBadRequest)
 			json.NewEncoder(w).Encode(map[string]string{"error": "missing required fields"})
 			return
 		}
 
-		qty := decimal.NewFromFloat(req.Quantity)
-		alpacaReq := alpaca.PlaceOrderRequest{
-			Symbol:      strings.ToUpper(req.Symbol),
-			Qty:         &qty,
-			Side:        alpaca.Side(strings.ToLower(req.Side)),
-			Type:        alpaca.OrderType(strings.ToLower(req.Type)),
-			TimeInForce: alpaca.Day,
-		}
-
-		if req.Type == "limit" && req.Limit > 0 {
-			limitPrice := decimal.NewFromFloat(req.Limit)
-			alpacaReq.LimitPrice = &limitPrice
+		intent := req.intent()
+		if err := intent.Validate(); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
 		}
 
-		order, err := b.PlaceOrder(alpacaReq)
+		order, err := b.PlaceOrder(quant.NewOrderRequest(intent))
 		if err != nil {
 			logger.Error("failed to place manual order", "error", err)
 			w.Header().Set("Content-Type", "application/json")
@@ -368,126 +555,3 @@ func PlaceManualOrder(logger *slog.Logger, b *broker.Client) http.HandlerFunc {
 		json.NewEncoder(w).Encode(order)
 	}
 }
-
-func ResumeLiveEngines(ctx context.Context, logger *slog.Logger, b *broker.Client, db *sqlx.DB) {
-	sessions, err := database.ListTradingSessions(ctx, db)
-	if err != nil {
-		logger.Error("failed to list trading sessions for resume", "error", err)
-		return
-	}
-
-	for _, session := range sessions {
-		if session.Status != "running" {
-			continue
-		}
-
-		var symbols []string
-		if err := json.Unmarshal([]byte(session.Symbols), &symbols); err != nil {
-			logger.Error("failed to parse symbols for session", "error", err, "session", session.SessionID)
-			continue
-		}
-
-		var params map[string]interface{}
-		if session.Parameters != "" {
-			if err := json.Unmarshal([]byte(session.Parameters), &params); err != nil {
-				logger.Error("failed to parse parameters for session", "error", err, "session", session.SessionID)
-				continue
-			}
-		}
-
-		var strategy quant.Strategy
-		strategyID := strings.ToLower(strings.ReplaceAll(session.Strategy, " ", "_"))
-		switch strategyID {
-		case "sma_crossover":
-			shortPeriod := 10
-			longPeriod := 50
-			if params != nil {
-				if v, ok := params["short_period"].(float64); ok {
-					shortPeriod = int(v)
-				}
-				if v, ok := params["long_period"].(float64); ok {
-					longPeriod = int(v)
-				}
-			}
-			strategy = strategies.NewSMACrossover(symbols[0], shortPeriod, longPeriod)
-		case "rsi_reversion":
-			period := 14
-			oversold := 30.0
-			overbought := 70.0
-			if params != nil {
-				if v, ok := params["period"].(float64); ok {
-					period = int(v)
-				}
-				if v, ok := params["oversold"].(float64); ok {
-					oversold = v
-				}
-				if v, ok := params["overbought"].(float64); ok {
-					overbought = v
-				}
-			}
-			strategy = strategies.NewRSIReversion(symbols[0], period, oversold, overbought)
-		case "bollinger_bands":
-			period := 20
-			stdDev := 2.0
-			if params != nil {
-				if v, ok := params["period"].(float64); ok {
-					period = int(v)
-				}
-				if v, ok := params["std_dev"].(float64); ok {
-					stdDev = v
-				}
-			}
-			strategy = strategies.NewBollingerBands(symbols[0], period, stdDev)
-		case "pairs_trading":
-			period := 20
-			entryZ := 2.0
-			exitZ := 0.0
-			if params != nil {
-				if v, ok := params["period"].(float64); ok {
-					period = int(v)
-				}
-				if v, ok := params["entry_z"].(float64); ok {
-					entryZ = v
-				}
-				if v, ok := params["exit_z"].(float64); ok {
-					exitZ = v
-				}
-			}
-			if len(symbols) >= 2 {
-				strategy = strategies.NewPairsTrading(symbols[0], symbols[1], period, entryZ, exitZ)
-			} else {
-				logger.Error("pairs_trading requires 2 symbols", "session", session.SessionID)
-				continue
-			}
-		default:
-			logger.Error("unknown strategy", "strategy", session.Strategy)
-			continue
-		}
-
-		maxPosPct := 0.05
-		dailyStopPct := 0.02
-		if params != nil {
-			if v, ok := params["max_position_size_pct"].(float64); ok {
-				maxPosPct = v
-			}
-			if v, ok := params["daily_stop_loss_pct"].(float64); ok {
-				dailyStopPct = v
-			}
-		}
-
-		rm := quant.NewDefaultRiskManager(maxPosPct, dailyStopPct)
-		engine := quant.NewLiveEngine(db, b, session.StartingCapital, strategy, symbols, params, rm)
-		engine.SessionID = session.SessionID
-
-		if err := engine.Resume(ctx, logger); err != nil {
-			logger.Error("failed to resume live engine", "error", err, "session", session.SessionID)
-			continue
-		}
-
-		enginesMutex.Lock()
-		activeEngines[engine.SessionID] = engine
-		enginesMutex.Unlock()
-
-		logger.Info("successfully resumed live engine", "session", session.SessionID)
-	}
-}
@@ -115,6 +115,9 @@ CREATE TABLE IF NOT EXISTS trading_sessions (
   symbols TEXT NOT NULL,
   starting_capital REAL NOT NULL,
   parameters TEXT,
+  timeframe TEXT NOT NULL DEFAULT '1Min',
+  mode TEXT NOT NULL DEFAULT 'live',
+  risk_config TEXT,
   started_at DATETIME DEFAULT CURRENT_TIMESTAMP,
   ended_at DATETIME
 );
@@ -130,11 +133,70 @@ CREATE TABLE IF NOT EXISTS trading_orders (
   filled_qty REAL DEFAULT 0,
   avg_price REAL,
   status TEXT NOT NULL,
+  parent_order_id TEXT,
   created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
   updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
   FOREIGN KEY (session_id) REFERENCES trading_sessions (session_id) ON DELETE CASCADE
 );
 
+CREATE TABLE IF NOT EXISTS trading_session_state (
+  session_id TEXT PRIMARY KEY,
+  cash REAL NOT NULL,
+  strategy_state TEXT,
+  discrepancies TEXT,
+  updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  FOREIGN KEY (session_id) REFERENCES trading_sessions (session_id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS trading_session_positions (
+  session_id TEXT NOT NULL,
+  symbol TEXT NOT NULL,
+  qty REAL NOT NULL,
+  avg_price REAL NOT NULL,
+  updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (session_id, symbol),
+  FOREIGN KEY (session_id) REFERENCES trading_sessions (session_id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS trading_equity_snapshots (
+  session_id TEXT NOT NULL,
+  timestamp DATETIME NOT NULL,
+  equity REAL NOT NULL,
+  PRIMARY KEY (session_id, timestamp),
+  FOREIGN KEY (session_id) REFERENCES trading_sessions (session_id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS trading_session_audit (
+  audit_id TEXT PRIMARY KEY,
+  session_id TEXT NOT NULL,
+  action TEXT NOT NULL,
+  from_status TEXT,
+  to_status TEXT NOT NULL,
+  detail TEXT,
+  user_id TEXT,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  FOREIGN KEY (session_id) REFERENCES trading_sessions (session_id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_trading_session_audit_session
+ON trading_session_audit (session_id, created_at);
+
+CREATE TABLE IF NOT EXISTS trading_order_rejections (
+  rejection_id TEXT PRIMARY KEY,
+  session_id TEXT NOT NULL,
+  symbol TEXT NOT NULL,
+  side TEXT NOT NULL,
+  type TEXT NOT NULL,
+  qty REAL NOT NULL,
+  reason TEXT NOT NULL,
+  message TEXT NOT NULL,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  FOREIGN KEY (session_id) REFERENCES trading_sessions (session_id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_trading_order_rejections_session
+ON trading_order_rejections (session_id, created_at);
+
 CREATE TABLE IF NOT EXISTS trading_backtests (
   backtest_id TEXT PRIMARY KEY,
   strategy TEXT NOT NULL,
@@ -144,5 +206,50 @@ CREATE TABLE IF NOT EXISTS trading_backtests (
   starting_capital REAL NOT NULL,
   parameters TEXT,
   metrics TEXT,
+  ledger TEXT,
+  optimization_id TEXT,
+  sample TEXT,
+  window_index INTEGER,
+  timeframe TEXT NOT NULL DEFAULT '1Day',
+  fill_config TEXT,
+  margin_config TEXT,
+  risk_config TEXT,
   created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 );
+
+CREATE TABLE IF NOT EXISTS trading_optimizations (
+  optimization_id TEXT PRIMARY KEY,
+  name TEXT NOT NULL,
+  strategy TEXT NOT NULL,
+  spec TEXT NOT NULL,
+  status TEXT NOT NULL,
+  best_parameters TEXT,
+  best_objective REAL,
+  windows TEXT,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  completed_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS market_bars (
+  symbol TEXT NOT NULL,
+  timeframe TEXT NOT NULL,
+  feed TEXT NOT NULL,
+  timestamp DATETIME NOT NULL,
+  open REAL NOT NULL,
+  high REAL NOT NULL,
+  low REAL NOT NULL,
+  close REAL NOT NULL,
+  volume INTEGER NOT NULL,
+  trade_count INTEGER NOT NULL,
+  vwap REAL NOT NULL,
+  PRIMARY KEY (symbol, timeframe, feed, timestamp)
+);
+
+CREATE TABLE IF NOT EXISTS market_bar_coverage (
+  symbol TEXT NOT NULL,
+  timeframe TEXT NOT NULL,
+  feed TEXT NOT NULL,
+  range_start DATETIME NOT NULL,
+  range_end DATETIME NOT NULL,
+  PRIMARY KEY (symbol, timeframe, feed, range_start)
+);
@@ -10,6 +10,8 @@ import (
 	"path/filepath"
 	"testing"
 
+	"citadel/internal/broker"
+	"citadel/internal/quant"
 	"citadel/route"
 
 	"github.com/jmoiron/sqlx"
@@ -19,6 +21,11 @@ import (
 var (
 	server *httptest.Server
 	td     *TestData
+	testDB *sqlx.DB
+	paper  *broker.Paper
+
+	// engines runs the server's live sessions
+	engines *quant.EngineManager
 )
 
 func TestMain(m *testing.M) {
@@ -27,6 +34,10 @@ func TestMain(m *testing.M) {
 	ctx := context.Background()
 
 	db := sqlx.MustConnect("sqlite3", ":memory:?_foreign_keys=on")
+	// Every connection to :memory: is a separate, empty database, so keep
+	// one for the engines and handlers that query concurrently
+	db.SetMaxOpenConns(1)
+	testDB = db
 
 	schemaSQL, err := os.ReadFile(filepath.Join("..", "schema", "model.sql"))
 	if err != nil {
@@ -42,9 +53,20 @@ func TestMain(m *testing.M) {
 	logger := slog.New(slog.NewJSONHandler(logOutput, nil))
 
 	// Initialize the server with the test database and logger
+	// Backtests read the bar files under testdata and trading routes use the
+	// in-process paper broker, so everything runs offline
+	files := broker.NewFileSource(filepath.Join("testdata", "bars"))
+	paper = broker.NewPaper(100000)
+	paper.Data = files
+
+	engines = quant.NewEngineManager(db)
+
 	handler := route.Initialize(ctx, route.Config{
-		DB:     db,
-		Logger: logger,
+		DB:         db,
+		Logger:     logger,
+		Broker:     paper,
+		MarketData: files,
+		Engines:    engines,
 	})
 	server = httptest.NewServer(handler)
 
@@ -0,0 +1,3874 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"citadel/internal/broker"
+	"citadel/internal/database"
+	"citadel/internal/quant"
+	"citadel/internal/session"
+
+	"github.com/alpacahq/alpaca-trade-api-go/v3/alpaca"
+	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata"
+	"github.com/alpacahq/alpaca-trade-api-go/v3/marketdata/stream"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ---------- Strategy Registry Tests ----------
+
+func TestListStrategies(t *testing.T) {
+	req, err := http.NewRequest("GET", server.URL+"/trading/strategies", nil)
+	require.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: session.CookieName, Value: td.Admin.Session})
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var result []struct {
+		ID           string            `json:"id"`
+		Params       []quant.ParamSpec `json:"parameters"`
+		RiskParams   []quant.ParamSpec `json:"risk_parameters"`
+		SizingParams []quant.ParamSpec `json:"sizing_parameters"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+
+	ids := make([]string, 0, len(result))
+	for _, s := range result {
+		ids = append(ids, s.ID)
+		assert.NotEmpty(t, s.Params)
+		assert.NotEmpty(t, s.RiskParams)
+		assert.NotEmpty(t, s.SizingParams)
+	}
+	assert.Subset(
+		t,
+		ids,
+		[]string{
+			"bollinger_bands",
+			"dual_momentum",
+			"pairs_trading",
+			"rsi_reversion",
+			"sector_rotation",
+			"sma_crossover",
+		},
+	)
+}
+
+func TestListStrategies_NotAdmin(t *testing.T) {
+	req, err := http.NewRequest("GET", server.URL+"/trading/strategies", nil)
+	require.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: session.CookieName, Value: td.User.Session})
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestRunBacktest_InvalidParameters(t *testing.T) {
+	cases := map[string]string{
+		"unknown strategy":          `"strategy": "nope"`,
+		"unknown parameter":         `"strategy": "sma_crossover", "parameters": {"bogus": 1}`,
+		"out of range":              `"strategy": "rsi_reversion", "parameters": {"oversold": 150}`,
+		"not an integer":            `"strategy": "bollinger_bands", "parameters": {"period": 2.5}`,
+		"too few symbols":           `"strategy": "pairs_trading"`,
+		"bad timeframe":             `"strategy": "sma_crossover", "timeframe": "7Parsecs"`,
+		"bad lot matching":          `"strategy": "sma_crossover", "lot_matching": "hifo"`,
+		"bad fill timing":           `"strategy": "sma_crossover", "fills": {"timing": "next-open"}`,
+		"negative slippage":         `"strategy": "sma_crossover", "fills": {"slippage_pct": -0.01}`,
+		"negative fee":              `"strategy": "sma_crossover", "fills": {"commission_per_order": -1}`,
+		"negative margin":           `"strategy": "sma_crossover", "margin": {"initial_margin": -0.5}`,
+		"initial margin above 1":    `"strategy": "sma_crossover", "margin": {"initial_margin": 1.5}`,
+		"maintenance above initial": `"strategy": "sma_crossover", "margin": {"initial_margin": 0.25, "maintenance_margin": 0.5}`,
+		"negative borrow fee":       `"strategy": "sma_crossover", "margin": {"borrow_fee_rate": -0.02}`,
+	}
+
+	for name, fields := range cases {
+		t.Run(name, func(t *testing.T) {
+			payload := `{
+				"symbols": ["AAPL"],
+				"start_date": "2024-01-01T00:00:00Z",
+				"end_date": "2024-06-01T00:00:00Z",
+				` + fields + `
+			}`
+			req, err := http.NewRequest(
+				"POST",
+				server.URL+"/trading/backtest",
+				strings.NewReader(payload),
+			)
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			req.AddCookie(&http.Cookie{Name: session.CookieName, Value: td.Admin.Session})
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+			var result map[string]string
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+			assert.NotEmpty(t, result["error"])
+		})
+	}
+}
+
+// ---------- Optimization Tests ----------
+
+func TestListOptimizations(t *testing.T) {
+	req, err := http.NewRequest("GET", server.URL+"/trading/optimizations", nil)
+	require.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: session.CookieName, Value: td.Admin.Session})
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestGetOptimization_NotFound(t *testing.T) {
+	req, err := http.NewRequest("GET", server.URL+"/trading/optimizations/does-not-exist", nil)
+	require.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: session.CookieName, Value: td.Admin.Session})
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestGetHistoricalBars_InvalidTimeframe(t *testing.T) {
+	req, err := http.NewRequest(
+		"GET",
+		server.URL+"/trading/stocks/bars?symbol=AAPL&timeframe=Min",
+		nil,
+	)
+	require.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: session.CookieName, Value: td.Admin.Session})
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+// ---------- Backtest Regression Tests ----------
+
+func runFileBacktest(t *testing.T, payload string) quant.Metrics {
+	t.Helper()
+
+	req, err := http.NewRequest("POST", server.URL+"/trading/backtest", strings.NewReader(payload))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(&http.Cookie{Name: session.CookieName, Value: td.Admin.Session})
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var result struct {
+		Portfolio struct {
+			Metrics quant.Metrics `json:"metrics"`
+		} `json:"portfolio"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	return result.Portfolio.Metrics
+}
+
+// TestRunBacktest_FromFiles pins each strategy's results on the synthetic
+// bars in testdata, so behavior changes show up as failures here.
+func TestRunBacktest_FromFiles(t *testing.T) {
+	cases := map[string]struct {
+		fields      string
+		fills       int
+		trades      int
+		totalReturn float64
+	}{
+		"sma_crossover": {
+			fields:      `"symbols": ["AAA"], "parameters": {"short_period": 5, "long_period": 20}`,
+			fills:       9,
+			trades:      4,
+			totalReturn: 0.0194400744,
+		},
+		"rsi_reversion": {
+			fields:      `"symbols": ["AAA"], "parameters": {"period": 7}`,
+			fills:       10,
+			trades:      5,
+			totalReturn: -0.0058974195,
+		},
+		"bollinger_bands": {
+			fields:      `"symbols": ["AAA"], "parameters": {"period": 10}`,
+			fills:       10,
+			trades:      5,
+			totalReturn: -0.0084987384,
+		},
+		"pairs_trading": {
+			fields:      `"symbols": ["AAA", "BBB"]`,
+			fills:       9,
+			trades:      4,
+			totalReturn: 0.0139037679,
+		},
+		"dual_momentum": {
+			fields:      `"symbols": ["AAA", "BBB"], "parameters": {"lookback": 20, "max_position_size_pct": 0}`,
+			fills:       21,
+			trades:      10,
+			totalReturn: 0.0451610591,
+		},
+		"sector_rotation": {
+			fields:      `"symbols": ["AAA", "BBB"], "parameters": {"lookback": 20, "top": 1, "trend_period": 50, "max_position_size_pct": 0}`,
+			fills:       10,
+			trades:      5,
+			totalReturn: -0.3258769742,
+		},
+	}
+
+	for strategy, tc := range cases {
+		t.Run(strategy, func(t *testing.T) {
+			payload := `{
+				"strategy": "` + strategy + `",
+				"start_date": "2023-01-01T00:00:00Z",
+				"end_date": "2024-03-01T00:00:00Z",
+				"benchmark": "BBB",
+				` + tc.fields + `
+			}`
+
+			first := runFileBacktest(t, payload)
+			second := runFileBacktest(t, payload)
+
+			assert.Equal(t, first, second, "backtests over the same files must be deterministic")
+			assert.Equal(t, tc.fills, first.TotalFills)
+			assert.Equal(t, tc.trades, first.TotalTrades)
+			assert.InDelta(t, tc.totalReturn, first.TotalReturn, 1e-9)
+			assert.NotNil(t, first.Benchmark)
+		})
+	}
+}
+
+func TestRunBacktest_Sizer(t *testing.T) {
+	allIn := runFileBacktest(t, `{
+		"strategy": "sma_crossover",
+		"start_date": "2023-01-01T00:00:00Z",
+		"end_date": "2024-03-01T00:00:00Z",
+		"symbols": ["AAA"],
+		"parameters": {"short_period": 5, "long_period": 20, "max_position_size_pct": 0}
+	}`)
+	notional := runFileBacktest(t, `{
+		"strategy": "sma_crossover",
+		"start_date": "2023-01-01T00:00:00Z",
+		"end_date": "2024-03-01T00:00:00Z",
+		"symbols": ["AAA"],
+		"parameters": {
+			"short_period": 5,
+			"long_period": 20,
+			"max_position_size_pct": 0,
+			"sizer": 1,
+			"size_notional": 7500
+		}
+	}`)
+
+	// Same signals, but each entry risks $7,500 instead of everything
+	assert.Equal(t, allIn.TotalFills, notional.TotalFills)
+	assert.Less(t, math.Abs(notional.TotalReturn), math.Abs(allIn.TotalReturn)/5)
+
+	// The sizer is saved with the rest of the parameters
+	records, err := database.ListBacktests(context.Background(), testDB)
+	require.NoError(t, err)
+	var saved quant.Params
+	for _, r := range records {
+		var params quant.Params
+		require.NoError(t, json.Unmarshal([]byte(r.Parameters), &params))
+		if params["size_notional"] == 7500 {
+			saved = params
+			break
+		}
+	}
+	require.NotNil(t, saved)
+	assert.Equal(t, float64(quant.SizeFixedNotional), saved["sizer"])
+}
+
+func TestRunBacktest_SavesRunConfig(t *testing.T) {
+	runFileBacktest(t, `{
+		"strategy": "sma_crossover",
+		"symbols": ["AAA"],
+		"parameters": {"short_period": 5, "long_period": 20},
+		"timeframe": "1Min",
+		"start_date": "2023-06-01T00:00:00Z",
+		"end_date": "2023-06-03T00:00:00Z",
+		"fills": {"timing": "next_open", "slippage_pct": 0.0005, "commission_per_order": 1.37},
+		"margin": {"allow_short": true, "initial_margin": 0.5, "maintenance_margin": 0.25},
+		"risk": {"max_open_positions": 3, "max_order_notional": 2500}
+	}`)
+
+	// The timeframe, fills, margin and risk the run used are saved with it,
+	// so the result can be reproduced and told apart from a cost-free run
+	records, err := database.ListBacktests(context.Background(), testDB)
+	require.NoError(t, err)
+	var saved *database.BacktestRecord
+	for i, r := range records {
+		if r.FillConfig != nil && strings.Contains(*r.FillConfig, "1.37") {
+			saved = &records[i]
+			break
+		}
+	}
+	require.NotNil(t, saved)
+	assert.Equal(t, "1Min", saved.Timeframe)
+
+	var fills quant.FillConfig
+	require.NoError(t, json.Unmarshal([]byte(*saved.FillConfig), &fills))
+	assert.Equal(t, 0.0005, fills.SlippagePct)
+	assert.Equal(t, 1.37, fills.CommissionPerOrder)
+
+	require.NotNil(t, saved.MarginConfig)
+	var margin quant.MarginConfig
+	require.NoError(t, json.Unmarshal([]byte(*saved.MarginConfig), &margin))
+	assert.True(t, margin.AllowShort)
+	assert.Equal(t, 0.25, margin.MaintenanceMargin)
+
+	// The risk saved is the resolved config, the strategy's risk parameters
+	// with the request's overrides on top
+	require.NotNil(t, saved.RiskConfig)
+	var risk quant.RiskConfig
+	require.NoError(t, json.Unmarshal([]byte(*saved.RiskConfig), &risk))
+	assert.Equal(t, 3, risk.MaxOpenPositions)
+	assert.Equal(t, 2500.0, risk.MaxOrderNotional)
+	assert.Equal(t, 0.05, risk.MaxPositionPct)
+}
+
+func TestAllocators(t *testing.T) {
+	returns := [][]float64{
+		{0.01, -0.01, 0.01, -0.01},
+		{0.02, -0.02, 0.02, -0.02},
+		{},
+	}
+
+	assert.InDeltaSlice(
+		t,
+		[]float64{1.0 / 3, 1.0 / 3, 1.0 / 3},
+		quant.EqualWeight{}.Weights(returns),
+		1e-9,
+	)
+	assert.InDeltaSlice(
+		t,
+		[]float64{0.5, 0.25, 0.25},
+		quant.FixedWeights{Targets: []float64{2, 1, 1}}.Weights(returns),
+		1e-9,
+	)
+
+	// Half the volatility gets twice the weight, and the sleeve without any
+	// returns yet gets the average of the others
+	assert.InDeltaSlice(
+		t,
+		[]float64{0.4444444444, 0.2222222222, 0.3333333333},
+		quant.RiskParity{Lookback: 60}.Weights(returns),
+		1e-9,
+	)
+	assert.InDeltaSlice(
+		t,
+		[]float64{0.5, 0.5},
+		quant.RiskParity{Lookback: 60}.Weights(make([][]float64, 2)),
+		1e-9,
+	)
+
+	sleeves := []quant.SleeveSpec{{Weight: 3}, {Weight: 1}}
+	a, err := quant.NewAllocator(quant.AllocationConfig{Method: quant.AllocateFixed}, sleeves)
+	require.NoError(t, err)
+	assert.InDeltaSlice(t, []float64{0.75, 0.25}, a.Weights(make([][]float64, 2)), 1e-9)
+
+	_, err = quant.NewAllocator(quant.AllocationConfig{Method: "momentum"}, sleeves)
+	assert.Error(t, err)
+}
+
+func TestRunBacktest_Portfolio(t *testing.T) {
+	payload := `{
+		"start_date": "2023-01-01T00:00:00Z",
+		"end_date": "2024-03-01T00:00:00Z",
+		"starting_capital": 100000,
+		"sleeves": [
+			{"name": "bands", "strategy": "bollinger_bands", "symbols": ["AAA"], "parameters": {"period": 10}},
+			{"strategy": "rsi_reversion", "symbols": ["BBB"], "parameters": {"period": 7}}
+		],
+		"allocation": {"method": "risk_parity", "rebalance": "monthly"}
+	}`
+	req, err := http.NewRequest("POST", server.URL+"/trading/backtest", strings.NewReader(payload))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(&http.Cookie{Name: session.CookieName, Value: td.Admin.Session})
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var result quant.PortfolioResult
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+
+	require.Len(t, result.Sleeves, 2)
+	assert.Equal(t, "bands", result.Sleeves[0].Name)
+	assert.Equal(t, "rsi_reversion BBB", result.Sleeves[1].Name)
+	assert.Equal(t, 7.0, result.Sleeves[1].Parameters["period"])
+
+	// Every fill in the book belongs to one of the sleeves
+	book := result.Portfolio.Metrics
+	assert.Equal(
+		t,
+		result.Sleeves[0].Portfolio.Metrics.TotalFills+result.Sleeves[1].Portfolio.Metrics.TotalFills,
+		book.TotalFills,
+	)
+	assert.NotZero(t, book.TotalFills)
+
+	// Rebalance resizes are booked as trades but are neither fills nor
+	// round trips: every trip ends on a strategy's own fill
+	for _, s := range result.Sleeves {
+		fills := map[time.Time]bool{}
+		rebalances := 0
+		for _, tr := range s.Portfolio.Trades {
+			if tr.Rebalance {
+				rebalances++
+			} else {
+				fills[tr.Timestamp] = true
+			}
+		}
+		assert.NotZero(t, rebalances)
+		assert.Equal(t, len(s.Portfolio.Trades)-rebalances, s.Portfolio.Metrics.TotalFills)
+		require.NotNil(t, s.Portfolio.Ledger)
+		for _, trip := range s.Portfolio.Ledger.RoundTrips {
+			assert.True(t, fills[trip.ExitTime], "round trip exits at %s", trip.ExitTime)
+		}
+	}
+
+	// The sleeves' capital adds up to the book's equity
+	equity := result.Portfolio.EquityLog
+	require.NotEmpty(t, equity)
+	for _, s := range result.Sleeves {
+		require.Len(t, s.Capital, len(equity))
+	}
+	for i, snap := range equity {
+		assert.InDelta(
+			t,
+			snap.Equity,
+			result.Sleeves[0].Capital[i].Equity+result.Sleeves[1].Capital[i].Equity,
+			1e-6,
+		)
+	}
+	assert.InDelta(t, 100000, equity[0].Equity, 100000*0.01)
+
+	// Monthly rebalances, each summing to the whole book
+	assert.GreaterOrEqual(t, len(result.Rebalances), 12)
+	for _, r := range result.Rebalances {
+		require.Len(t, r.Weights, 2)
+		assert.InDelta(t, 1, r.Weights[0]+r.Weights[1], 1e-9)
+	}
+
+	require.Len(t, result.Correlation, 2)
+	assert.Equal(t, 1.0, result.Correlation[0][0])
+	assert.Equal(t, result.Correlation[0][1], result.Correlation[1][0])
+	assert.True(t, math.Abs(result.Correlation[0][1]) < 1)
+
+	// Saved as one backtest of the whole book
+	records, err := database.ListBacktests(context.Background(), testDB)
+	require.NoError(t, err)
+	var saved *database.BacktestRecord
+	for i, r := range records {
+		if r.Strategy == "portfolio" {
+			saved = &records[i]
+			break
+		}
+	}
+	require.NotNil(t, saved)
+	assert.JSONEq(t, `["AAA","BBB"]`, saved.Symbols)
+	assert.Contains(t, saved.Parameters, `"method":"risk_parity"`)
+	assert.Equal(t, "1Day", saved.Timeframe)
+	require.NotNil(t, saved.RiskConfig)
+	var risks map[string]quant.RiskConfig
+	require.NoError(t, json.Unmarshal([]byte(*saved.RiskConfig), &risks))
+	assert.Contains(t, risks, "bands")
+	assert.Contains(t, risks, "rsi_reversion BBB")
+}
+
+func TestRunBacktest_PortfolioInvalid(t *testing.T) {
+	cases := map[string]string{
+		"unknown method":    `"sleeves": [{"strategy": "sma_crossover", "symbols": ["AAA"]}], "allocation": {"method": "momentum"}`,
+		"unknown rebalance": `"sleeves": [{"strategy": "sma_crossover", "symbols": ["AAA"]}], "allocation": {"rebalance": "hourly"}`,
+		"unknown strategy":  `"sleeves": [{"strategy": "nope", "symbols": ["AAA"]}]`,
+		"no symbols":        `"sleeves": [{"strategy": "sma_crossover"}]`,
+		"bad margin":        `"sleeves": [{"strategy": "sma_crossover", "symbols": ["AAA"]}], "margin": {"initial_margin": 2}`,
+		"bad fills":         `"sleeves": [{"strategy": "sma_crossover", "symbols": ["AAA"]}], "fills": {"timing": "open"}`,
+	}
+	for name, fields := range cases {
+		t.Run(name, func(t *testing.T) {
+			payload := `{
+				"start_date": "2023-01-01T00:00:00Z",
+				"end_date": "2024-03-01T00:00:00Z",
+				` + fields + `
+			}`
+			req, err := http.NewRequest(
+				"POST",
+				server.URL+"/trading/backtest",
+				strings.NewReader(payload),
+			)
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			req.AddCookie(&http.Cookie{Name: session.CookieName, Value: td.Admin.Session})
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		})
+	}
+}
+
+func TestRunBacktest_MissingDataFile(t *testing.T) {
+	payload := `{
+		"strategy": "sma_crossover",
+		"symbols": ["NOPE"],
+		"start_date": "2023-01-01T00:00:00Z",
+		"end_date": "2024-03-01T00:00:00Z"
+	}`
+	req, err := http.NewRequest("POST", server.URL+"/trading/backtest", strings.NewReader(payload))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(&http.Cookie{Name: session.CookieName, Value: td.Admin.Session})
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+}
+
+// TestFileSource_Parquet reads the Parquet fixtures: CCC has mixed-case
+// columns out of the usual order, a millisecond timestamp column and an
+// extra column, and DDD sits at the top level with date string timestamps.
+func TestFileSource_Parquet(t *testing.T) {
+	ctx := context.Background()
+	files := broker.NewFileSource(filepath.Join("testdata", "parquet"))
+
+	bars, err := files.GetBars(
+		ctx,
+		"ccc",
+		marketdata.OneHour,
+		time.Date(2023, 6, 1, 14, 0, 0, 0, time.UTC),
+		time.Date(2023, 6, 2, 0, 0, 0, 0, time.UTC),
+	)
+	require.NoError(t, err)
+	require.Len(t, bars, 2, "the 13:30 bar is before the range")
+	assert.Equal(t, time.Date(2023, 6, 1, 14, 30, 0, 0, time.UTC), bars[0].Timestamp)
+	assert.Equal(t, time.Date(2023, 6, 1, 15, 30, 0, 0, time.UTC), bars[1].Timestamp)
+	assert.Equal(t, 50.5, bars[0].Open)
+	assert.Equal(t, 51.25, bars[0].High)
+	assert.Equal(t, 50.25, bars[0].Low)
+	assert.Equal(t, 51.0, bars[0].Close)
+	assert.Equal(t, uint64(900), bars[0].Volume)
+	assert.Equal(t, 50.8, bars[0].VWAP)
+	assert.Zero(t, bars[0].TradeCount, "trade_count is optional")
+
+	ny, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+	daily, err := files.GetBars(
+		ctx,
+		"DDD",
+		marketdata.OneDay,
+		time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC),
+	)
+	require.NoError(t, err)
+	require.Len(t, daily, 2)
+	assert.True(t, time.Date(2023, 1, 3, 0, 0, 0, 0, ny).Equal(daily[0].Timestamp))
+	assert.Equal(t, 21.75, daily[1].Close)
+	assert.Equal(t, uint64(4200), daily[1].Volume)
+}
+
+// ---------- Paper Broker Tests ----------
+
+func TestGetTradingAccount_Paper(t *testing.T) {
+	req, err := http.NewRequest("GET", server.URL+"/trading/account", nil)
+	require.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: session.CookieName, Value: td.Admin.Session})
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var account alpaca.Account
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&account))
+	assert.True(t, strings.HasPrefix(account.AccountNumber, "PA"))
+	assert.Equal(t, "ACTIVE", account.Status)
+}
+
+func TestGetMarketClock_Paper(t *testing.T) {
+	req, err := http.NewRequest("GET", server.URL+"/trading/market/clock", nil)
+	require.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: session.CookieName, Value: td.Admin.Session})
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var clock alpaca.Clock
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&clock))
+	assert.True(t, clock.NextClose.After(clock.Timestamp))
+	assert.Equal(t, clock.IsOpen, clock.NextOpen.After(clock.NextClose))
+}
+
+func TestNYSECalendar(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+	at := func(date string, hour, min int) time.Time {
+		d, err := time.ParseInLocation(time.DateOnly, date, ny)
+		require.NoError(t, err)
+		return d.Add(time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute)
+	}
+
+	for _, date := range []string{
+		"2023-01-02", // New Year's Day, observed on the Monday
+		"2024-03-29", // Good Friday
+		"2025-01-09", // National day of mourning
+		"2026-07-03", // Independence Day, observed on the Friday
+		"2027-06-18", // Juneteenth, observed on the Friday
+		"2027-12-24", // Christmas Day, observed on the Friday
+		"2024-06-15", // Saturday
+	} {
+		_, ok := broker.NYSE.Session(at(date, 12, 0))
+		assert.False(t, ok, date)
+	}
+
+	// New Year's Day on a Saturday isn't made up on the Friday before
+	s, ok := broker.NYSE.Session(at("2021-12-31", 12, 0))
+	require.True(t, ok)
+	assert.Equal(t, at("2021-12-31", 16, 0), s.Close)
+
+	for _, date := range []string{"2024-07-03", "2024-11-29", "2025-12-24"} {
+		s, ok := broker.NYSE.Session(at(date, 12, 0))
+		require.True(t, ok, date)
+		assert.Equal(t, at(date, 9, 30), s.Open, date)
+		assert.Equal(t, at(date, 13, 0), s.Close, date)
+	}
+	assert.True(t, broker.IsOpen(broker.NYSE, at("2024-07-03", 12, 59)))
+	assert.False(t, broker.IsOpen(broker.NYSE, at("2024-07-03", 13, 0)))
+	assert.False(t, broker.IsOpen(broker.NYSE, at("2024-07-02", 9, 29)))
+
+	// During an early close the next open is after the holiday
+	clock := broker.ClockAt(broker.NYSE, at("2024-07-03", 10, 0))
+	assert.True(t, clock.IsOpen)
+	assert.Equal(t, at("2024-07-03", 13, 0), clock.NextClose)
+	assert.Equal(t, at("2024-07-05", 9, 30), clock.NextOpen)
+
+	// Over a weekend both are on Monday
+	clock = broker.ClockAt(broker.NYSE, at("2024-06-15", 12, 0))
+	assert.False(t, clock.IsOpen)
+	assert.Equal(t, at("2024-06-17", 9, 30), clock.NextOpen)
+	assert.Equal(t, at("2024-06-17", 16, 0), clock.NextClose)
+}
+
+func TestRuleRiskManager_DailyReset(t *testing.T) {
+	rm := quant.NewRuleRiskManager(quant.RiskConfig{DailyLossLimitPct: 0.1})
+	p := quant.NewPortfolio(1000)
+	p.Positions["AAA"] = 10
+	p.Cash = 0
+	entry := quant.OrderIntent{Symbol: "AAA", Side: quant.Buy, Type: quant.Market, Quantity: 1}
+
+	require.NoError(t, rm.EvaluatePortfolio(p, map[string]float64{"AAA": 100}))
+	err := rm.EvaluatePortfolio(p, map[string]float64{"AAA": 85})
+	require.Error(t, err)
+	assert.Equal(t, quant.RejectDailyLoss, quant.RejectionReason(err))
+	_, err = rm.EvaluateOrder(entry, p, map[string]float64{"AAA": 85})
+	assert.Equal(t, quant.RejectDailyLoss, quant.RejectionReason(err))
+
+	// The next day starts from the previous close, not the old peak
+	rm.OnSessionOpen(broker.MarketSession{Date: "2024-06-17"})
+	_, err = rm.EvaluateOrder(entry, p, map[string]float64{"AAA": 85})
+	require.NoError(t, err)
+	require.NoError(t, rm.EvaluatePortfolio(p, map[string]float64{"AAA": 80}))
+	assert.Error(t, rm.EvaluatePortfolio(p, map[string]float64{"AAA": 76}))
+}
+
+func TestRuleRiskManager_Rules(t *testing.T) {
+	buy := func(symbol string, qty float64) quant.OrderIntent {
+		return quant.OrderIntent{Symbol: symbol, Side: quant.Buy, Type: quant.Market, Quantity: qty}
+	}
+	sell := func(symbol string, qty float64) quant.OrderIntent {
+		return quant.OrderIntent{
+			Symbol:   symbol,
+			Side:     quant.Sell,
+			Type:     quant.Market,
+			Quantity: qty,
+		}
+	}
+	// $100,000 of equity, $40,000 of it long AAA
+	holding := func() *quant.Portfolio {
+		p := quant.NewPortfolio(60000)
+		p.Positions["AAA"] = 400
+		return p
+	}
+	prices := map[string]float64{"AAA": 100, "BBB": 100, "CCC": 50}
+
+	t.Run("gross exposure", func(t *testing.T) {
+		rm := quant.NewRuleRiskManager(quant.RiskConfig{MaxGrossExposurePct: 0.5})
+		p := holding()
+		approved, err := rm.EvaluateOrder(buy("BBB", 200), p, prices)
+		require.NoError(t, err)
+		assert.InDelta(t, 100, approved.Quantity, 1e-9)
+
+		p.Positions["BBB"] = 100
+		p.Cash = 50000
+		_, err = rm.EvaluateOrder(sell("CCC", 10), p, prices)
+		assert.Equal(t, quant.RejectGrossExposure, quant.RejectionReason(err))
+	})
+
+	t.Run("net exposure", func(t *testing.T) {
+		rm := quant.NewRuleRiskManager(quant.RiskConfig{MaxNetExposurePct: 0.2})
+		_, err := rm.EvaluateOrder(buy("BBB", 10), holding(), prices)
+		assert.Equal(t, quant.RejectNetExposure, quant.RejectionReason(err))
+
+		// A short brings the net exposure back down
+		approved, err := rm.EvaluateOrder(sell("BBB", 100), holding(), prices)
+		require.NoError(t, err)
+		assert.Equal(t, 100.0, approved.Quantity)
+	})
+
+	t.Run("symbol and sector caps", func(t *testing.T) {
+		rm := quant.NewRuleRiskManager(quant.RiskConfig{
+			MaxPositionPct: 0.5,
+			SymbolCaps:     map[string]float64{"AAA": 0.4},
+			Sectors:        map[string]string{"AAA": "tech", "BBB": "tech"},
+			SectorCaps:     map[string]float64{"tech": 0.5},
+		})
+		_, err := rm.EvaluateOrder(buy("AAA", 1), holding(), prices)
+		assert.Equal(t, quant.RejectPositionSize, quant.RejectionReason(err))
+
+		approved, err := rm.EvaluateOrder(buy("BBB", 200), holding(), prices)
+		require.NoError(t, err)
+		assert.InDelta(t, 100, approved.Quantity, 1e-9)
+	})
+
+	t.Run("open positions", func(t *testing.T) {
+		rm := quant.NewRuleRiskManager(quant.RiskConfig{MaxOpenPositions: 1})
+		_, err := rm.EvaluateOrder(buy("BBB", 1), holding(), prices)
+		assert.Equal(t, quant.RejectOpenPositions, quant.RejectionReason(err))
+		_, err = rm.EvaluateOrder(buy("AAA", 1), holding(), prices)
+		assert.NoError(t, err)
+	})
+
+	t.Run("order notional", func(t *testing.T) {
+		rm := quant.NewRuleRiskManager(quant.RiskConfig{MaxOrderNotional: 5000})
+		approved, err := rm.EvaluateOrder(buy("BBB", 100), holding(), prices)
+		require.NoError(t, err)
+		assert.InDelta(t, 50, approved.Quantity, 1e-9)
+	})
+
+	t.Run("order rate", func(t *testing.T) {
+		rm := quant.NewRuleRiskManager(quant.RiskConfig{MaxOrdersPerMinute: 2})
+		start := time.Date(2024, 6, 17, 14, 0, 0, 0, time.UTC)
+		rm.ObserveBar("BBB", marketdata.Bar{Close: 100, Timestamp: start})
+		for range 2 {
+			_, err := rm.EvaluateOrder(buy("BBB", 1), holding(), prices)
+			require.NoError(t, err)
+		}
+		_, err := rm.EvaluateOrder(buy("BBB", 1), holding(), prices)
+		assert.Equal(t, quant.RejectOrderRate, quant.RejectionReason(err))
+
+		// Exits aren't counted or limited
+		_, err = rm.EvaluateOrder(sell("AAA", 1), holding(), prices)
+		assert.NoError(t, err)
+
+		rm.ObserveBar("BBB", marketdata.Bar{Close: 100, Timestamp: start.Add(time.Minute)})
+		_, err = rm.EvaluateOrder(buy("BBB", 1), holding(), prices)
+		assert.NoError(t, err)
+	})
+
+	t.Run("volatility sizing", func(t *testing.T) {
+		rm := quant.NewRuleRiskManager(quant.RiskConfig{
+			VolatilitySizing: quant.VolatilitySizing{RiskPct: 0.01, Lookback: 2},
+		})
+		start := time.Date(2024, 6, 17, 14, 0, 0, 0, time.UTC)
+		for i, close := range []float64{100, 110, 99} {
+			rm.ObserveBar(
+				"BBB",
+				marketdata.Bar{Close: close, Timestamp: start.Add(time.Duration(i) * time.Minute)},
+			)
+		}
+
+		// Returns of +10% and -10% have a standard deviation of 0.1, so
+		// $1,000 at risk allows 100 shares at $100
+		approved, err := rm.EvaluateOrder(buy("BBB", 500), holding(), prices)
+		require.NoError(t, err)
+		assert.InDelta(t, 100, approved.Quantity, 1e-6)
+
+		p := holding()
+		p.Positions["BBB"] = 120
+		_, err = rm.EvaluateOrder(buy("BBB", 1), p, prices)
+		assert.Equal(t, quant.RejectVolatility, quant.RejectionReason(err))
+	})
+
+	t.Run("stop-out cooldown", func(t *testing.T) {
+		rm := quant.NewRuleRiskManager(quant.RiskConfig{StopOutCooldownMinutes: 30})
+		start := time.Date(2024, 6, 17, 14, 0, 0, 0, time.UTC)
+		p := quant.NewPortfolio(100000)
+		p.Buy("BBB", 10, 100, start)
+		p.Sell("BBB", 10, 90, start.Add(time.Minute))
+
+		rm.ObserveBar("BBB", marketdata.Bar{Close: 90, Timestamp: start.Add(10 * time.Minute)})
+		_, err := rm.EvaluateOrder(buy("BBB", 1), p, prices)
+		assert.Equal(t, quant.RejectStopOutCooldown, quant.RejectionReason(err))
+		_, err = rm.EvaluateOrder(buy("AAA", 1), p, prices)
+		assert.NoError(t, err)
+
+		rm.ObserveBar("BBB", marketdata.Bar{Close: 90, Timestamp: start.Add(31 * time.Minute)})
+		_, err = rm.EvaluateOrder(buy("BBB", 1), p, prices)
+		assert.NoError(t, err)
+	})
+
+	t.Run("kill switch", func(t *testing.T) {
+		rm := quant.NewRuleRiskManager(quant.RiskConfig{KillSwitch: true})
+		_, err := rm.EvaluateOrder(buy("BBB", 1), holding(), prices)
+		assert.Equal(t, quant.RejectKillSwitch, quant.RejectionReason(err))
+		_, err = rm.EvaluateOrder(sell("AAA", 400), holding(), prices)
+		assert.NoError(t, err)
+
+		rm.Configure(quant.RiskConfig{})
+		_, err = rm.EvaluateOrder(buy("BBB", 1), holding(), prices)
+		assert.NoError(t, err)
+	})
+}
+
+func TestEngine_RiskBatch(t *testing.T) {
+	// Four entries on one bar that fill at the next open, so none of them is
+	// a position yet when the others are checked
+	start := time.Date(2024, 3, 4, 21, 0, 0, 0, time.UTC)
+	symbols := []string{"AAA", "BBB", "CCC", "DDD"}
+	run := func(t *testing.T, cfg quant.RiskConfig) *quant.Portfolio {
+		e := quant.NewEngine(100000, &sliceStrategy{invested: 0.8}, quant.NewRuleRiskManager(cfg))
+		e.FillModel = quant.NewFillModel(quant.FillConfig{Timing: quant.FillOnNextOpen})
+		bars := make(map[string][]marketdata.Bar)
+		for _, symbol := range symbols {
+			bars[symbol] = dailyBars(start,
+				[4]float64{100, 100, 100, 100},
+				[4]float64{100, 100, 100, 100},
+			)
+		}
+		require.NoError(t, e.Run(bars))
+		return e.Portfolio
+	}
+
+	t.Run("open positions", func(t *testing.T) {
+		p := run(t, quant.RiskConfig{MaxOpenPositions: 3})
+		open := 0
+		for _, qty := range p.Positions {
+			if qty != 0 {
+				open++
+			}
+		}
+		assert.Equal(t, 3, open)
+	})
+
+	t.Run("gross exposure", func(t *testing.T) {
+		p := run(t, quant.RiskConfig{MaxGrossExposurePct: 0.5})
+		gross := 0.0
+		for _, qty := range p.Positions {
+			gross += math.Abs(qty) * 100
+		}
+		assert.InDelta(t, 50000, gross, 1e-6)
+	})
+
+	t.Run("sector exposure", func(t *testing.T) {
+		p := run(t, quant.RiskConfig{
+			Sectors:    map[string]string{"AAA": "tech", "BBB": "tech", "CCC": "tech"},
+			SectorCaps: map[string]float64{"tech": 0.3},
+		})
+		tech := (p.Positions["AAA"] + p.Positions["BBB"] + p.Positions["CCC"]) * 100
+		assert.InDelta(t, 30000, tech, 1e-6)
+		assert.InDelta(t, 200, p.Positions["DDD"], 1e-6)
+	})
+}
+
+// refusingRisk records every order it is asked about and refuses it.
+type refusingRisk struct {
+	intents []quant.OrderIntent
+}
+
+func (r *refusingRisk) EvaluateOrder(
+	intent quant.OrderIntent,
+	p *quant.Portfolio,
+	prices map[string]float64,
+) (quant.OrderIntent, error) {
+	r.intents = append(r.intents, intent)
+	return intent, &quant.RiskRejection{Reason: quant.RejectRiskLimit, Message: "refused"}
+}
+
+func (r *refusingRisk) EvaluatePortfolio(p *quant.Portfolio, prices map[string]float64) error {
+	return nil
+}
+
+func TestStrategies_OrdersGoThroughRisk(t *testing.T) {
+	// A seeded random walk crosses every strategy's entry signals
+	walk := func(seed int64) []marketdata.Bar {
+		rng := rand.New(rand.NewSource(seed))
+		start := time.Date(2023, 1, 2, 21, 0, 0, 0, time.UTC)
+		bars := make([]marketdata.Bar, 500)
+		price := 100.0
+		for i := range bars {
+			price *= 1 + 0.02*rng.NormFloat64()
+			bars[i] = marketdata.Bar{
+				Timestamp: start.AddDate(0, 0, i),
+				Open:      price,
+				High:      price,
+				Low:       price,
+				Close:     price,
+			}
+		}
+		return bars
+	}
+
+	cases := map[string][]string{
+		"sma_crossover":   {"AAA"},
+		"bollinger_bands": {"AAA"},
+		"rsi_reversion":   {"AAA"},
+		"pairs_trading":   {"AAA", "BBB"},
+	}
+	for id, symbols := range cases {
+		t.Run(id, func(t *testing.T) {
+			strategy, _, err := quant.NewStrategy(id, symbols, nil)
+			require.NoError(t, err)
+			bars := make(map[string][]marketdata.Bar)
+			for i, symbol := range symbols {
+				bars[symbol] = walk(int64(i + 1))
+			}
+
+			// Every order is submitted for the risk manager to approve, so
+			// refusing them all leaves the book untouched
+			rm := &refusingRisk{}
+			e := quant.NewEngine(100000, strategy, rm)
+			require.NoError(t, e.Run(bars))
+			assert.NotEmpty(t, rm.intents)
+			assert.Empty(t, e.Portfolio.Trades)
+			assert.Equal(t, 100000.0, e.Portfolio.Cash)
+		})
+	}
+}
+
+func TestParseRiskConfig(t *testing.T) {
+	params := quant.Params{"max_position_size_pct": 0.05, "daily_stop_loss_pct": 0.02}
+
+	cfg, err := quant.ParseRiskConfig(params, []byte(`{"max_gross_exposure_pct": 1.5}`))
+	require.NoError(t, err)
+	assert.Equal(t, 0.05, cfg.MaxPositionPct)
+	assert.Equal(t, 0.02, cfg.DailyLossLimitPct)
+	assert.Equal(t, 1.5, cfg.MaxGrossExposurePct)
+
+	cfg, err = quant.ParseRiskConfig(params, []byte(`{"max_position_pct": 0}`))
+	require.NoError(t, err)
+	assert.Zero(t, cfg.MaxPositionPct)
+
+	_, err = quant.ParseRiskConfig(params, []byte(`{"max_gross": 1}`))
+	assert.Error(t, err)
+	_, err = quant.ParseRiskConfig(params, []byte(`{"max_order_notional": -1}`))
+	assert.Error(t, err)
+}
+
+func TestPlaceManualOrder_PaperFill(t *testing.T) {
+	// The paper broker is shared by the whole test server, so the fill is
+	// checked against the position held before the order
+	position := func() alpaca.Position {
+		req, err := http.NewRequest("GET", server.URL+"/trading/positions", nil)
+		require.NoError(t, err)
+		req.AddCookie(&http.Cookie{Name: session.CookieName, Value: td.Admin.Session})
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var positions []alpaca.Position
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&positions))
+		for _, p := range positions {
+			if p.Symbol == "CCC" {
+				return p
+			}
+		}
+		return alpaca.Position{Symbol: "CCC"}
+	}
+	before := position()
+
+	payload := `{"symbol": "ccc", "quantity": 10, "side": "buy", "type": "market"}`
+	req, err := http.NewRequest("POST", server.URL+"/trading/orders", strings.NewReader(payload))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(&http.Cookie{Name: session.CookieName, Value: td.Admin.Session})
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var order alpaca.Order
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&order))
+	assert.Equal(t, "CCC", order.Symbol)
+	assert.Equal(t, "new", order.Status)
+
+	// The order rests until the next bar, then fills at its open
+	paper.Publish(stream.Bar{
+		Symbol:    "CCC",
+		Open:      50,
+		High:      52,
+		Low:       49,
+		Close:     51,
+		Timestamp: time.Date(2024, 1, 2, 14, 30, 0, 0, time.UTC),
+	})
+
+	after := position()
+	qty := before.Qty.Add(decimal.NewFromInt(10))
+	cost := before.Qty.Mul(before.AvgEntryPrice).Add(decimal.NewFromInt(10 * 50))
+	assert.Equal(t, qty.String(), after.Qty.String())
+	assert.Equal(t, cost.Div(qty).String(), after.AvgEntryPrice.String())
+	assert.Equal(t, qty.Mul(decimal.NewFromInt(51)).String(), after.MarketValue.String())
+}
+
+// alwaysOpen is a calendar with the market open around the clock, for
+// feeding daily bars to a live engine.
+type alwaysOpen struct{}
+
+func (alwaysOpen) Session(t time.Time) (broker.MarketSession, bool) {
+	y, m, d := t.Date()
+	open := time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	return broker.MarketSession{
+		Date:  open.Format(time.DateOnly),
+		Open:  open,
+		Close: open.AddDate(0, 0, 1),
+	}, true
+}
+
+// TestResumeLiveEngines_Paper resumes a running session against its own
+// paper broker and replays the AAA test bars through it, exercising the live
+// order path end to end.
+func TestResumeLiveEngines_Paper(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sessionID := uuid.New().String()
+	require.NoError(t, database.CreateTradingSession(ctx, testDB, &database.TradingSession{
+		SessionID:       sessionID,
+		Strategy:        "sma_crossover",
+		Status:          "running",
+		Symbols:         `["AAA"]`,
+		StartingCapital: 100000,
+		Parameters:      `{"short_period": 5, "long_period": 20}`,
+		Timeframe:       "1Min",
+		Mode:            quant.ModeLive,
+		StartedAt:       time.Now(),
+	}))
+
+	b := broker.NewPaper(100000)
+	b.TradingCalendar = alwaysOpen{} // the bars are daily
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	engines.Resume(ctx, logger, b)
+
+	// Trade updates connect in the background; wait so no fill is missed
+	require.Eventually(t, func() bool {
+		return b.TradeUpdateListeners() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	files := broker.NewFileSource(filepath.Join("testdata", "bars"))
+	bars, err := files.GetBars(
+		ctx,
+		"AAA",
+		marketdata.OneDay,
+		time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC),
+	)
+	require.NoError(t, err)
+	for _, bar := range bars {
+		b.Publish(stream.Bar{
+			Symbol:    "AAA",
+			Open:      bar.Open,
+			High:      bar.High,
+			Low:       bar.Low,
+			Close:     bar.Close,
+			Volume:    bar.Volume,
+			Timestamp: bar.Timestamp,
+		})
+	}
+
+	orders, err := database.GetTradingSessionOrders(ctx, testDB, sessionID)
+	require.NoError(t, err)
+	require.NotEmpty(t, orders)
+
+	filled := 0.0
+	for _, o := range orders {
+		if o.Status == "filled" {
+			require.NotNil(t, o.AvgPrice)
+			assert.Positive(t, *o.AvgPrice)
+			if o.Side == "buy" {
+				filled += o.FilledQty
+			} else {
+				filled -= o.FilledQty
+			}
+		}
+	}
+	assert.NotZero(t, filled)
+
+	positions, err := b.GetPositions()
+	require.NoError(t, err)
+	require.Len(t, positions, 1)
+	assert.InDelta(t, filled, positions[0].Qty.InexactFloat64(), 1e-6)
+
+	// Stopping goes through the same route as a live session
+	req, err := http.NewRequest("POST", server.URL+"/trading/live/stop?session_id="+sessionID, nil)
+	require.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: session.CookieName, Value: td.Admin.Session})
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	stopped, err := database.GetTradingSession(ctx, testDB, sessionID)
+	require.NoError(t, err)
+	assert.Equal(t, "stopped", stopped.Status)
+}
+
+// TestResumeLiveEngines_RestoresState runs a session, drops it without
+// stopping as a crash would, and resumes it: the portfolio must come back
+// from the order history, and a position the session didn't trade must be
+// reported as a broker discrepancy.
+func TestResumeLiveEngines_RestoresState(t *testing.T) {
+	sessionID := uuid.New().String()
+	require.NoError(
+		t,
+		database.CreateTradingSession(context.Background(), testDB, &database.TradingSession{
+			SessionID:       sessionID,
+			Strategy:        "sma_crossover",
+			Status:          "running",
+			Symbols:         `["BBB"]`,
+			StartingCapital: 100000,
+			Parameters:      `{"short_period": 5, "long_period": 20}`,
+			Timeframe:       "1Min",
+			Mode:            quant.ModeLive,
+			StartedAt:       time.Now(),
+		}),
+	)
+
+	b := broker.NewPaper(100000)
+	b.TradingCalendar = alwaysOpen{} // the bars are daily
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	files := broker.NewFileSource(filepath.Join("testdata", "bars"))
+	bars, err := files.GetBars(
+		context.Background(),
+		"BBB",
+		marketdata.OneDay,
+		time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	)
+	require.NoError(t, err)
+	publish := func(bars []marketdata.Bar) {
+		for _, bar := range bars {
+			b.Publish(stream.Bar{
+				Symbol:    "BBB",
+				Open:      bar.Open,
+				High:      bar.High,
+				Low:       bar.Low,
+				Close:     bar.Close,
+				Timestamp: bar.Timestamp,
+			})
+		}
+	}
+
+	// First run, cut off without Stop
+	ctx, cancel := context.WithCancel(context.Background())
+	engines.Resume(ctx, logger, b)
+	require.Eventually(t, func() bool {
+		return b.TradeUpdateListeners() == 1
+	}, time.Second, 10*time.Millisecond)
+	publish(bars[:150])
+	cancel()
+	require.Eventually(t, func() bool {
+		_, running := engines.Get(sessionID)
+		return b.TradeUpdateListeners() == 0 && !running
+	}, time.Second, 10*time.Millisecond)
+
+	orders, err := database.GetTradingSessionOrders(context.Background(), testDB, sessionID)
+	require.NoError(t, err)
+	require.NotEmpty(t, orders)
+
+	// Fills are booked, so the strategy stops buying once it holds the stock
+	held := 0.0
+	for _, o := range orders {
+		if o.Side == "buy" {
+			held += o.FilledQty
+		} else {
+			held -= o.FilledQty
+		}
+	}
+	positions, err := b.GetPositions()
+	require.NoError(t, err)
+	brokerQty := 0.0
+	if len(positions) > 0 {
+		brokerQty = positions[0].Qty.InexactFloat64()
+	}
+	assert.InDelta(t, held, brokerQty, 1e-6)
+
+	state, err := database.GetSessionState(context.Background(), testDB, sessionID)
+	require.NoError(t, err)
+	require.NotNil(t, state.StrategyState)
+	assert.Nil(t, state.Discrepancies)
+
+	// Shares bought outside the session show up as a broker discrepancy
+	_, err = b.PlaceOrder(alpaca.PlaceOrderRequest{
+		Symbol:      "BBB",
+		Qty:         func() *decimal.Decimal { d := decimal.NewFromInt(5); return &d }(),
+		Side:        alpaca.Buy,
+		Type:        alpaca.Market,
+		TimeInForce: alpaca.Day,
+	})
+	require.NoError(t, err)
+	publish(bars[150:151])
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	engines.Resume(ctx, logger, b)
+
+	state, err = database.GetSessionState(ctx, testDB, sessionID)
+	require.NoError(t, err)
+	require.NotNil(t, state.Discrepancies)
+
+	var discrepancies []quant.Discrepancy
+	require.NoError(t, json.Unmarshal([]byte(*state.Discrepancies), &discrepancies))
+	require.Len(t, discrepancies, 1)
+	assert.Equal(t, "broker", discrepancies[0].Source)
+	assert.Equal(t, "BBB", discrepancies[0].Symbol)
+	assert.InDelta(t, held, discrepancies[0].Expected, 1e-6)
+	assert.InDelta(t, held+5, discrepancies[0].Actual, 1e-6)
+
+	snapshot, err := database.GetSessionPositions(ctx, testDB, sessionID)
+	require.NoError(t, err)
+	if held != 0 {
+		require.Len(t, snapshot, 1)
+		assert.InDelta(t, held, snapshot[0].Qty, 1e-6)
+	}
+
+	req, err := http.NewRequest("POST", server.URL+"/trading/live/stop?session_id="+sessionID, nil)
+	require.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: session.CookieName, Value: td.Admin.Session})
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+// ---------- Replay Tests ----------
+
+func TestReplayLiveEngine(t *testing.T) {
+	payload := `{
+		"strategy": "sma_crossover",
+		"symbols": ["AAA"],
+		"starting_capital": 100000,
+		"parameters": {"short_period": 5, "long_period": 20},
+		"start_date": "2023-06-01T00:00:00Z",
+		"end_date": "2023-06-03T00:00:00Z"
+	}`
+	req, err := http.NewRequest(
+		"POST",
+		server.URL+"/trading/live/replay",
+		strings.NewReader(payload),
+	)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(&http.Cookie{Name: session.CookieName, Value: td.Admin.Session})
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var started struct {
+		SessionID string `json:"session_id"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&started))
+	require.NotEmpty(t, started.SessionID)
+
+	ctx := context.Background()
+	require.Eventually(t, func() bool {
+		s, err := database.GetTradingSession(ctx, testDB, started.SessionID)
+		return err == nil && s.Status == "completed"
+	}, 5*time.Second, 20*time.Millisecond)
+
+	replayed, err := database.GetTradingSession(ctx, testDB, started.SessionID)
+	require.NoError(t, err)
+	assert.Equal(t, quant.ModeReplay, replayed.Mode)
+	assert.Equal(t, "1Min", replayed.Timeframe)
+
+	orders, err := database.GetTradingSessionOrders(ctx, testDB, started.SessionID)
+	require.NoError(t, err)
+	require.NotEmpty(t, orders)
+
+	// Orders are stamped with the replayed bar times, and only one placed on
+	// the final bar can still be waiting for a fill
+	start := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2023, 6, 3, 0, 0, 0, 0, time.UTC)
+	filled := 0
+	for _, o := range orders {
+		assert.True(t, !o.CreatedAt.Before(start) && o.CreatedAt.Before(end), o.CreatedAt)
+		if o.Status == "filled" {
+			filled++
+		}
+	}
+	assert.GreaterOrEqual(t, filled, len(orders)-1)
+	assert.Positive(t, filled)
+
+	// The session records equity on every bar, which gives it the same
+	// metrics as a backtest
+	req, err = http.NewRequest("GET", server.URL+"/trading/sessions/"+started.SessionID, nil)
+	require.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: session.CookieName, Value: td.Admin.Session})
+	detailsResp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer detailsResp.Body.Close()
+	require.Equal(t, http.StatusOK, detailsResp.StatusCode)
+
+	var details struct {
+		Equity  []quant.EquitySnapshot `json:"equity"`
+		Metrics quant.Metrics          `json:"metrics"`
+	}
+	require.NoError(t, json.NewDecoder(detailsResp.Body).Decode(&details))
+	require.Len(t, details.Equity, 780)
+	assert.Equal(t, filled, details.Metrics.TotalFills)
+
+	backtest := runFileBacktest(t, `{
+		"strategy": "sma_crossover",
+		"symbols": ["AAA"],
+		"parameters": {"short_period": 5, "long_period": 20},
+		"timeframe": "1Min",
+		"start_date": "2023-06-01T00:00:00Z",
+		"end_date": "2023-06-03T00:00:00Z"
+	}`)
+	// Replay fills market orders at the next bar's open like the backtest,
+	// so the same parameters give the same results
+	assert.Equal(t, backtest.TotalFills, details.Metrics.TotalFills)
+	assert.Equal(t, backtest.TotalTrades, details.Metrics.TotalTrades)
+	assert.InDelta(t, backtest.TotalReturn, details.Metrics.TotalReturn, 1e-9)
+	assert.InDelta(t, backtest.MaxDrawdown, details.Metrics.MaxDrawdown, 1e-9)
+	assert.InDelta(t, backtest.SharpeRatio, details.Metrics.SharpeRatio, 1e-6)
+}
+
+func TestReplayLiveEngine_InvalidRequest(t *testing.T) {
+	cases := map[string]string{
+		"missing dates": `{"strategy": "sma_crossover", "symbols": ["AAA"], "starting_capital": 1000}`,
+		"no capital": `{"strategy": "sma_crossover", "symbols": ["AAA"],
+			"start_date": "2023-06-01T00:00:00Z", "end_date": "2023-06-03T00:00:00Z"}`,
+		"no bars": `{"strategy": "sma_crossover", "symbols": ["AAA"], "starting_capital": 1000,
+			"start_date": "2023-07-01T00:00:00Z", "end_date": "2023-07-03T00:00:00Z"}`,
+		"trend finer than session": `{"strategy": "rsi_reversion", "symbols": ["AAA"],
+			"starting_capital": 1000, "timeframe": "1Day", "parameters": {"trend_minutes": 30},
+			"start_date": "2023-06-01T00:00:00Z", "end_date": "2023-06-03T00:00:00Z"}`,
+	}
+
+	for name, payload := range cases {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest(
+				"POST",
+				server.URL+"/trading/live/replay",
+				strings.NewReader(payload),
+			)
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			req.AddCookie(&http.Cookie{Name: session.CookieName, Value: td.Admin.Session})
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		})
+	}
+}
+
+// ---------- Sub-account Tests ----------
+
+// sellerStrategy buys qty shares on its first bar and then tries to sell
+// more than that on every bar, to exercise the session sub-account limits.
+type sellerStrategy struct {
+	symbol string
+	qty    float64
+	bars   int
+}
+
+func (s *sellerStrategy) Name() string { return "Test Seller" }
+
+func (s *sellerStrategy) Initialize(p *quant.Portfolio) {}
+
+func (s *sellerStrategy) OnBar(symbol string, bar marketdata.Bar, p *quant.Portfolio) {
+	s.bars++
+	side := quant.Sell
+	qty := s.qty * 3
+	if s.bars == 1 {
+		side, qty = quant.Buy, s.qty
+	}
+	p.SubmitOrder(quant.OrderIntent{Symbol: symbol, Side: side, Type: quant.Market, Quantity: qty})
+}
+
+func init() {
+	quant.RegisterStrategy(quant.StrategySpec{
+		ID:   "test_seller",
+		Name: "Test Seller",
+		Params: []quant.ParamSpec{
+			{Name: "qty", Type: quant.FloatParam, Default: 10, Min: 1, Max: 1000},
+		},
+		Factory: func(symbols []string, params quant.Params) (quant.Strategy, error) {
+			return &sellerStrategy{symbol: symbols[0], qty: params.Float("qty")}, nil
+		},
+	})
+}
+
+func getSubAccount(t *testing.T, sessionID string) quant.SubAccount {
+	t.Helper()
+	req, err := http.NewRequest(
+		"GET",
+		server.URL+"/trading/sessions/"+sessionID+"/positions",
+		nil,
+	)
+	require.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: session.CookieName, Value: td.Admin.Session})
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var account quant.SubAccount
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&account))
+	return account
+}
+
+func TestSessionSubAccount_SharedAccount(t *testing.T) {
+	sessionID := uuid.New().String()
+	require.NoError(
+		t,
+		database.CreateTradingSession(context.Background(), testDB, &database.TradingSession{
+			SessionID:       sessionID,
+			Strategy:        "test_seller",
+			Status:          "running",
+			Symbols:         `["DDD"]`,
+			StartingCapital: 100000,
+			Parameters:      `{"qty": 10, "max_position_size_pct": 0}`,
+			Timeframe:       "1Min",
+			Mode:            quant.ModeLive,
+			StartedAt:       time.Now(),
+		}),
+	)
+
+	// Another holder of DDD in the same account
+	b := broker.NewPaper(100000)
+	_, err := b.PlaceOrder(alpaca.PlaceOrderRequest{
+		Symbol:      "DDD",
+		Qty:         func() *decimal.Decimal { d := decimal.NewFromInt(50); return &d }(),
+		Side:        alpaca.Buy,
+		Type:        alpaca.Market,
+		TimeInForce: alpaca.Day,
+	})
+	require.NoError(t, err)
+
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	engines.Resume(ctx, logger, b)
+	require.Eventually(t, func() bool {
+		return b.TradeUpdateListeners() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	start := time.Date(2023, 6, 1, 14, 0, 0, 0, time.UTC)
+	publish := func(i int) {
+		price := 100 + 2*float64(i)
+		b.Publish(stream.Bar{
+			Symbol:    "DDD",
+			Open:      price,
+			High:      price + 1,
+			Low:       price - 1,
+			Close:     price,
+			Timestamp: start.Add(time.Duration(i) * time.Minute),
+		})
+	}
+
+	// Bar 0 buys 10, filled at bar 1's open of 102
+	publish(0)
+	publish(1)
+	account := getSubAccount(t, sessionID)
+	require.Len(t, account.Positions, 1)
+	assert.Equal(t, "DDD", account.Positions[0].Symbol)
+	assert.InDelta(t, 10, account.Positions[0].Qty, 1e-9)
+	assert.InDelta(t, 102, account.Positions[0].AvgPrice, 1e-9)
+	assert.InDelta(t, 100000-1020, account.Cash, 1e-6)
+
+	// The sell of 30 is capped at the session's 10 and filled at 104; later
+	// sells are refused rather than selling the other holder's shares
+	publish(2)
+	publish(3)
+	publish(4)
+	account = getSubAccount(t, sessionID)
+	assert.Empty(t, account.Positions)
+	assert.InDelta(t, 20, account.RealizedPnL, 1e-6)
+	assert.InDelta(t, 100020, account.Equity, 1e-6)
+
+	positions, err := b.GetPositions()
+	require.NoError(t, err)
+	require.Len(t, positions, 1)
+	assert.InDelta(t, 50, positions[0].Qty.InexactFloat64(), 1e-9)
+
+	orders, err := database.GetTradingSessionOrders(ctx, testDB, sessionID)
+	require.NoError(t, err)
+	require.Len(t, orders, 2)
+	for _, o := range orders {
+		require.NotNil(t, o.ClientOrderID)
+		assert.Equal(t, sessionID, quant.SessionFromClientOrderID(*o.ClientOrderID))
+		assert.InDelta(t, 10, o.FilledQty, 1e-9)
+	}
+
+	req, err := http.NewRequest("POST", server.URL+"/trading/live/stop?session_id="+sessionID, nil)
+	require.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: session.CookieName, Value: td.Admin.Session})
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Stopped sessions are rebuilt from their orders
+	account = getSubAccount(t, sessionID)
+	assert.Empty(t, account.Positions)
+	assert.InDelta(t, 20, account.RealizedPnL, 1e-6)
+	assert.InDelta(t, 100020, account.Cash, 1e-6)
+}
+
+// ---------- Session Event Tests ----------
+
+func TestStreamSessionEvents(t *testing.T) {
+	// Slow enough to subscribe before the interesting part: 10ms per bar
+	payload := `{
+		"strategy": "sma_crossover",
+		"symbols": ["AAA"],
+		"starting_capital": 100000,
+		"parameters": {"short_period": 5, "long_period": 20},
+		"start_date": "2023-06-01T00:00:00Z",
+		"end_date": "2023-06-03T00:00:00Z",
+		"speed": 6000
+	}`
+	req, err := http.NewRequest(
+		"POST",
+		server.URL+"/trading/live/replay",
+		strings.NewReader(payload),
+	)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(&http.Cookie{Name: session.CookieName, Value: td.Admin.Session})
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	var started struct {
+		SessionID string `json:"session_id"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&started))
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	req, err = http.NewRequest(
+		"GET",
+		server.URL+"/trading/sessions/"+started.SessionID+"/events",
+		nil,
+	)
+	require.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: session.CookieName, Value: td.Admin.Session})
+	client := &http.Client{Timeout: 20 * time.Second}
+	stream, err := client.Do(req)
+	require.NoError(t, err)
+	defer stream.Body.Close()
+	require.Equal(t, http.StatusOK, stream.StatusCode)
+	assert.Equal(t, "text/event-stream", stream.Header.Get("Content-Type"))
+
+	stop := func() {
+		req, err := http.NewRequest(
+			"POST",
+			server.URL+"/trading/live/stop?session_id="+started.SessionID,
+			nil,
+		)
+		require.NoError(t, err)
+		req.AddCookie(&http.Cookie{Name: session.CookieName, Value: td.Admin.Session})
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	// Read until the session has filled an order, then stop it; the stream
+	// ends with its status
+	seen := make(map[quant.EventType]int)
+	var last quant.Event
+	scanner := bufio.NewScanner(stream.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var event quant.Event
+		require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+		assert.Equal(t, started.SessionID, event.SessionID)
+		seen[event.Type]++
+		last = event
+		if event.Type == quant.EventFill && seen[quant.EventFill] == 1 {
+			stop()
+		}
+	}
+	require.NoError(t, scanner.Err())
+
+	assert.Equal(t, quant.EventStatus, last.Type)
+	assert.Equal(t, map[string]interface{}{"status": "stopped", "action": "stop"}, last.Data)
+	for _, typ := range []quant.EventType{
+		quant.EventBar,
+		quant.EventEquity,
+		quant.EventSignal,
+		quant.EventOrder,
+		quant.EventFill,
+	} {
+		assert.Positive(t, seen[typ], typ)
+	}
+}
+
+func TestStreamSessionEvents_NotFound(t *testing.T) {
+	req, err := http.NewRequest("GET", server.URL+"/trading/sessions/missing/events", nil)
+	require.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: session.CookieName, Value: td.Admin.Session})
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+// ---------- Market Data Hub Tests ----------
+
+// fakeStream is an upstream with one handler per channel, like Alpaca's.
+type fakeStream struct {
+	mu           sync.Mutex
+	handler      func(stream.Bar)
+	subscribed   map[string]int // upstream subscribe calls per symbol
+	unsubscribed map[string]int
+}
+
+func (f *fakeStream) SubscribeToBars(handler func(stream.Bar), symbols ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.handler = handler
+	for _, s := range symbols {
+		f.subscribed[s]++
+	}
+	return nil
+}
+
+func (f *fakeStream) UnsubscribeFromBars(symbols ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, s := range symbols {
+		f.unsubscribed[s]++
+	}
+	return nil
+}
+
+func (f *fakeStream) SubscribeToTrades(handler func(stream.Trade), symbols ...string) error {
+	return nil
+}
+
+func (f *fakeStream) UnsubscribeFromTrades(symbols ...string) error {
+	return nil
+}
+
+func TestHub_FanOut(t *testing.T) {
+	src := &fakeStream{subscribed: map[string]int{}, unsubscribed: map[string]int{}}
+	hub := broker.NewHub(src)
+
+	var fast atomic.Int64
+	release := make(chan struct{})
+	first, err := hub.SubscribeBars(func(stream.Bar) { fast.Add(1) }, "SPY")
+	require.NoError(t, err)
+	second, err := hub.SubscribeBars(func(stream.Bar) { <-release }, "spy")
+	require.NoError(t, err)
+	assert.Equal(t, 1, src.subscribed["SPY"], "one upstream subscription per symbol")
+	assert.Equal(t, 2, hub.Subscribers("SPY"))
+
+	// The blocked subscriber fills its queue and drops the rest without
+	// holding up the other one
+	const sent = 3000
+	for i := 1; i <= sent; i++ {
+		src.handler(stream.Bar{Symbol: "SPY", Close: float64(i)})
+		if i%500 == 0 {
+			require.Eventually(t, func() bool {
+				return fast.Load() == int64(i)
+			}, 5*time.Second, time.Millisecond)
+		}
+	}
+	assert.Zero(t, first.Dropped())
+	assert.Positive(t, second.Dropped())
+	assert.Less(t, second.Dropped(), uint64(sent))
+	close(release)
+	hub.Flush()
+
+	// Upstream ends with the last consumer only
+	second.Close()
+	assert.Zero(t, src.unsubscribed["SPY"])
+	src.handler(stream.Bar{Symbol: "SPY"})
+	hub.Flush()
+	assert.EqualValues(t, sent+1, fast.Load())
+
+	first.Close()
+	assert.Equal(t, 1, src.unsubscribed["SPY"])
+	assert.Zero(t, hub.Subscribers("SPY"))
+}
+
+func TestLiveEngines_ShareSymbol(t *testing.T) {
+	var sessionIDs []string
+	for i := 0; i < 2; i++ {
+		sessionID := uuid.New().String()
+		sessionIDs = append(sessionIDs, sessionID)
+		require.NoError(
+			t,
+			database.CreateTradingSession(context.Background(), testDB, &database.TradingSession{
+				SessionID:       sessionID,
+				Strategy:        "sma_crossover",
+				Status:          "running",
+				Symbols:         `["EEE"]`,
+				StartingCapital: 10000,
+				Parameters:      `{"short_period": 5, "long_period": 20}`,
+				Timeframe:       "1Min",
+				Mode:            quant.ModeLive,
+				StartedAt:       time.Now(),
+			}),
+		)
+	}
+
+	b := broker.NewPaper(100000)
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	engines.Resume(ctx, logger, b)
+	require.Eventually(t, func() bool {
+		return b.TradeUpdateListeners() == 2
+	}, time.Second, 10*time.Millisecond)
+
+	start := time.Date(2023, 6, 1, 14, 0, 0, 0, time.UTC)
+	publish := func(from, to int) {
+		for i := from; i < to; i++ {
+			b.Publish(stream.Bar{
+				Symbol:    "EEE",
+				Open:      50,
+				High:      51,
+				Low:       49,
+				Close:     50,
+				Timestamp: start.Add(time.Duration(i) * time.Minute),
+			})
+		}
+	}
+	equityPoints := func(sessionID string) int {
+		snapshots, err := database.GetEquitySnapshots(context.Background(), testDB, sessionID)
+		require.NoError(t, err)
+		return len(snapshots)
+	}
+
+	// One point per bar time, each saved once a later bar closes it
+	publish(0, 5)
+	assert.Equal(t, 4, equityPoints(sessionIDs[0]))
+	assert.Equal(t, 4, equityPoints(sessionIDs[1]))
+
+	// Stopping one session leaves the other's feed alone
+	req, err := http.NewRequest(
+		"POST",
+		server.URL+"/trading/live/stop?session_id="+sessionIDs[0],
+		nil,
+	)
+	require.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: session.CookieName, Value: td.Admin.Session})
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Stopping saves the open point
+	publish(5, 10)
+	assert.Equal(t, 5, equityPoints(sessionIDs[0]))
+	assert.Equal(t, 9, equityPoints(sessionIDs[1]))
+
+	req, err = http.NewRequest(
+		"POST",
+		server.URL+"/trading/live/stop?session_id="+sessionIDs[1],
+		nil,
+	)
+	require.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: session.CookieName, Value: td.Admin.Session})
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+// TestEngineManager_Shutdown shuts a manager down mid-session: the session's
+// state is flushed, it stays running so the next start resumes it, and the
+// manager takes no new sessions.
+func TestEngineManager_Shutdown(t *testing.T) {
+	ctx := context.Background()
+	sessionID := uuid.New().String()
+	require.NoError(t, database.CreateTradingSession(ctx, testDB, &database.TradingSession{
+		SessionID:       sessionID,
+		Strategy:        "sma_crossover",
+		Status:          "running",
+		Symbols:         `["FFF"]`,
+		StartingCapital: 100000,
+		Parameters:      `{"short_period": 5, "long_period": 20}`,
+		Timeframe:       "1Min",
+		Mode:            quant.ModeLive,
+		StartedAt:       time.Now(),
+	}))
+	defer database.UpdateTradingSessionStatus(ctx, testDB, sessionID, "stopped")
+
+	b := broker.NewPaper(100000)
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	m := quant.NewEngineManager(testDB)
+	m.Resume(ctx, logger, b)
+	_, running := m.Get(sessionID)
+	require.True(t, running)
+	require.Eventually(t, func() bool {
+		return b.TradeUpdateListeners() == len(m.List())
+	}, time.Second, 10*time.Millisecond)
+
+	resumed, err := database.GetSessionState(ctx, testDB, sessionID)
+	require.NoError(t, err)
+
+	// Fewer bars than snapshotEvery, so only the shutdown saves them
+	start := time.Date(2023, 6, 1, 14, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		price := 50 + float64(i)
+		b.Publish(stream.Bar{
+			Symbol:    "FFF",
+			Open:      price,
+			High:      price + 1,
+			Low:       price - 1,
+			Close:     price,
+			Timestamp: start.Add(time.Duration(i) * time.Minute),
+		})
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	require.NoError(t, m.Shutdown(shutdownCtx))
+	assert.Empty(t, m.List())
+	assert.Zero(t, b.TradeUpdateListeners())
+
+	flushed, err := database.GetSessionState(ctx, testDB, sessionID)
+	require.NoError(t, err)
+	require.NotNil(t, flushed.StrategyState)
+	assert.NotEqual(t, resumed.StrategyState, flushed.StrategyState)
+	assert.True(t, flushed.UpdatedAt.After(resumed.UpdatedAt))
+
+	stillRunning, err := database.GetTradingSession(ctx, testDB, sessionID)
+	require.NoError(t, err)
+	assert.Equal(t, "running", stillRunning.Status)
+
+	spec, ok := quant.LookupStrategy("sma_crossover")
+	require.True(t, ok)
+	strategy, params, err := spec.Build([]string{"FFF"}, nil)
+	require.NoError(t, err)
+	engine := quant.NewLiveEngine(testDB, b, 100000, strategy, []string{"FFF"}, params, nil)
+	assert.ErrorIs(t, m.Start(ctx, logger, engine), quant.ErrShuttingDown)
+}
+
+// buyerStrategy buys qty shares on every bar. The bars it has seen are its
+// state, to show what survives a parameter change.
+type buyerStrategy struct {
+	qty  float64
+	bars int
+}
+
+func (s *buyerStrategy) Name() string { return "Test Buyer" }
+
+func (s *buyerStrategy) Initialize(p *quant.Portfolio) { s.bars = 0 }
+
+func (s *buyerStrategy) OnBar(symbol string, bar marketdata.Bar, p *quant.Portfolio) {
+	s.bars++
+	p.SubmitOrder(
+		quant.OrderIntent{Symbol: symbol, Side: quant.Buy, Type: quant.Market, Quantity: s.qty},
+	)
+}
+
+func (s *buyerStrategy) MarshalState() ([]byte, error) {
+	return json.Marshal(map[string]int{"bars": s.bars})
+}
+
+func (s *buyerStrategy) UnmarshalState(data []byte) error {
+	var state map[string]int
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	s.bars = state["bars"]
+	return nil
+}
+
+func init() {
+	quant.RegisterStrategy(quant.StrategySpec{
+		ID:   "test_buyer",
+		Name: "Test Buyer",
+		Params: []quant.ParamSpec{
+			{Name: "qty", Type: quant.FloatParam, Default: 1, Min: 1, Max: 1000},
+		},
+		Factory: func(symbols []string, params quant.Params) (quant.Strategy, error) {
+			return &buyerStrategy{qty: params.Float("qty")}, nil
+		},
+	})
+}
+
+func sessionRequest(t *testing.T, method, path string, body interface{}) *http.Response {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		require.NoError(t, err)
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, server.URL+path, reader)
+	require.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: session.CookieName, Value: td.Admin.Session})
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestLiveSessionLifecycle(t *testing.T) {
+	ctx := context.Background()
+	sessionID := uuid.New().String()
+	require.NoError(t, database.CreateTradingSession(ctx, testDB, &database.TradingSession{
+		SessionID:       sessionID,
+		Strategy:        "test_buyer",
+		Status:          "running",
+		Symbols:         `["GGG"]`,
+		StartingCapital: 100000,
+		Parameters:      `{"qty": 1, "max_position_size_pct": 0}`,
+		Timeframe:       "1Min",
+		Mode:            quant.ModeLive,
+		StartedAt:       time.Now(),
+	}))
+
+	b := broker.NewPaper(100000)
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	engines.Resume(runCtx, logger, b)
+	_, running := engines.Get(sessionID)
+	require.True(t, running)
+
+	start := time.Date(2023, 6, 1, 14, 0, 0, 0, time.UTC)
+	publish := func(i int) {
+		b.Publish(stream.Bar{
+			Symbol:    "GGG",
+			Open:      20,
+			High:      21,
+			Low:       19,
+			Close:     20,
+			Timestamp: start.Add(time.Duration(i) * time.Minute),
+		})
+	}
+	orders := func() []database.TradingOrder {
+		orders, err := database.GetTradingSessionOrders(ctx, testDB, sessionID)
+		require.NoError(t, err)
+		return orders
+	}
+	path := "/trading/sessions/" + sessionID
+
+	publish(0)
+	publish(1)
+	require.Len(t, orders(), 2)
+
+	// Paused, the strategy sees bars but its orders are dropped
+	resp := sessionRequest(t, "POST", path+"/pause", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var body map[string]string
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Equal(t, quant.StatusPaused, body["status"])
+
+	publish(2)
+	publish(3)
+	assert.Len(t, orders(), 2)
+	assert.Equal(t, http.StatusConflict, sessionRequest(t, "POST", path+"/pause", nil).StatusCode)
+
+	// New parameters are validated and take over the strategy's state
+	resp = sessionRequest(t, "PATCH", path+"/parameters", map[string]interface{}{
+		"parameters": map[string]interface{}{"qty": 0},
+	})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = sessionRequest(t, "PATCH", path+"/parameters", map[string]interface{}{
+		"parameters": map[string]interface{}{"qty": 3},
+	})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var updated struct {
+		Parameters quant.Params `json:"parameters"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&updated))
+	assert.Equal(t, 3.0, updated.Parameters["qty"])
+	assert.Equal(t, 0.0, updated.Parameters["max_position_size_pct"])
+
+	state, err := database.GetSessionState(ctx, testDB, sessionID)
+	require.NoError(t, err)
+	require.NotNil(t, state.StrategyState)
+	assert.JSONEq(t, `{"bars": 4}`, *state.StrategyState)
+	stored, err := database.GetTradingSession(ctx, testDB, sessionID)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"qty": 3,
+		"max_position_size_pct": 0,
+		"daily_stop_loss_pct": 0.02,
+		"flatten_minutes_before_close": 0,
+		"queue_off_hours_orders": 0,
+		"sizer": 0,
+		"size_notional": 10000,
+		"size_fraction": 0.1,
+		"vol_target": 0.01,
+		"vol_period": 20,
+		"kelly_fraction": 0.5,
+		"kelly_min_trades": 20,
+		"whole_shares": 0
+	}`, stored.Parameters)
+
+	require.Equal(t, http.StatusOK, sessionRequest(t, "POST", path+"/resume", nil).StatusCode)
+	publish(4)
+	all := orders() // newest first
+	require.Len(t, all, 3)
+	assert.Equal(t, 3.0, all[0].Qty)
+
+	// Liquidating cancels the open buy, sells the 2 shares held and stops
+	resp = sessionRequest(t, "POST", path+"/liquidate", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Equal(t, quant.StatusLiquidating, body["status"])
+
+	var sell *database.TradingOrder
+	require.Eventually(t, func() bool {
+		for _, o := range orders() {
+			if o.Side == "sell" {
+				sell = &o
+				return true
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2.0, sell.Qty)
+	for _, o := range orders() {
+		if o.Side == "buy" && o.Qty == 3 {
+			assert.Equal(t, "canceled", o.Status)
+		}
+	}
+
+	publish(5)
+	require.Eventually(t, func() bool {
+		_, running := engines.Get(sessionID)
+		return !running
+	}, time.Second, 10*time.Millisecond)
+	stored, err = database.GetTradingSession(ctx, testDB, sessionID)
+	require.NoError(t, err)
+	assert.Equal(t, quant.StatusStopped, stored.Status)
+	positions, err := b.GetPositions()
+	require.NoError(t, err)
+	assert.Empty(t, positions)
+	assert.Equal(t, http.StatusNotFound, sessionRequest(t, "POST", path+"/resume", nil).StatusCode)
+
+	resp = sessionRequest(t, "GET", path+"/audit", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var audit []database.SessionAudit
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&audit))
+	var actions []string
+	for _, a := range audit {
+		actions = append(actions, a.Action+":"+a.ToStatus)
+	}
+	assert.Equal(t, []string{
+		"restart:running",
+		"pause:paused",
+		"update_parameters:paused",
+		"resume:running",
+		"liquidate:liquidating",
+		"liquidated:stopped",
+	}, actions)
+	require.NotNil(t, audit[1].UserID)
+	assert.Equal(t, td.Admin.ID, *audit[1].UserID)
+	assert.Nil(t, audit[0].UserID)
+	require.NotNil(t, audit[2].Detail)
+	assert.Contains(t, *audit[2].Detail, `"qty":3`)
+}
+
+func TestLiveSession_MarketHours(t *testing.T) {
+	ctx := context.Background()
+	sessionID := uuid.New().String()
+	require.NoError(t, database.CreateTradingSession(ctx, testDB, &database.TradingSession{
+		SessionID:       sessionID,
+		Strategy:        "test_buyer",
+		Status:          "running",
+		Symbols:         `["HHH"]`,
+		StartingCapital: 100000,
+		Parameters:      `{"qty": 1, "max_position_size_pct": 0, "flatten_minutes_before_close": 5}`,
+		Timeframe:       "1Min",
+		Mode:            quant.ModeLive,
+		StartedAt:       time.Now(),
+	}))
+
+	b := broker.NewPaper(100000)
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	events, unsubscribe := engines.Events.Subscribe(sessionID, 256)
+	defer unsubscribe()
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	engines.Resume(runCtx, logger, b)
+	defer engines.Stop(ctx, sessionID, "")
+	require.Eventually(t, func() bool {
+		return b.TradeUpdateListeners() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// 2023-06-01 and 02 are trading days; the regular session is 13:30 to
+	// 20:00 UTC
+	publish := func(ts time.Time) {
+		b.Publish(stream.Bar{Symbol: "HHH", Open: 20, High: 21, Low: 19, Close: 20, Timestamp: ts})
+	}
+	orders := func() []database.TradingOrder {
+		orders, err := database.GetTradingSessionOrders(ctx, testDB, sessionID)
+		require.NoError(t, err)
+		return orders
+	}
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2023, 6, day, hour, min, 0, 0, time.UTC)
+	}
+
+	// Before the open the strategy's orders are rejected
+	publish(at(1, 12, 0))
+	assert.Empty(t, orders())
+	rejections, err := database.ListOrderRejections(ctx, testDB, sessionID)
+	require.NoError(t, err)
+	require.Len(t, rejections, 1)
+	assert.Equal(t, quant.RejectMarketClosed, rejections[0].Reason)
+
+	publish(at(1, 13, 30))
+	publish(at(1, 13, 31))
+	require.Len(t, orders(), 2)
+
+	// Inside the window before the close, the open buy fills and the
+	// session sells what it holds instead of buying more
+	publish(at(1, 19, 55))
+	var sells []database.TradingOrder
+	for _, o := range orders() {
+		if o.Side == "sell" {
+			sells = append(sells, o)
+		}
+	}
+	require.Len(t, orders(), 3)
+	require.Len(t, sells, 1)
+	assert.Equal(t, 2.0, sells[0].Qty)
+	// The closing order is stamped with the bar's time, not the wall clock
+	var placed []time.Time
+	for len(events) > 0 {
+		if event := <-events; event.Type == quant.EventOrder {
+			placed = append(placed, event.Time)
+		}
+	}
+	require.Len(t, placed, 3)
+	assert.Equal(t, at(1, 19, 55), placed[2])
+	publish(at(1, 19, 56))
+	positions, err := b.GetPositions()
+	require.NoError(t, err)
+	assert.Empty(t, positions)
+	assert.Len(t, orders(), 3)
+
+	// Queued, an order after the close waits for the next open
+	resp := sessionRequest(t, "PATCH", "/trading/sessions/"+sessionID+"/parameters",
+		map[string]interface{}{"parameters": map[string]interface{}{"queue_off_hours_orders": 1}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	publish(at(1, 21, 0))
+	assert.Len(t, orders(), 3)
+
+	publish(at(2, 13, 30))
+	assert.Len(t, orders(), 5)
+}
+
+func TestLiveSession_EntryGuard(t *testing.T) {
+	ctx := context.Background()
+	sessionID := uuid.New().String()
+	require.NoError(t, database.CreateTradingSession(ctx, testDB, &database.TradingSession{
+		SessionID:       sessionID,
+		Strategy:        "bollinger_bands",
+		Status:          "running",
+		Symbols:         `["GGG"]`,
+		StartingCapital: 100000,
+		Parameters:      `{"period": 10, "max_position_size_pct": 0, "queue_off_hours_orders": 1}`,
+		Timeframe:       "1Min",
+		Mode:            quant.ModeLive,
+		StartedAt:       time.Now(),
+	}))
+
+	b := broker.NewPaper(100000)
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	engines.Resume(runCtx, logger, b)
+	defer engines.Stop(ctx, sessionID, "")
+	require.Eventually(t, func() bool {
+		return b.TradeUpdateListeners() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	publish := func(ts time.Time, close float64) {
+		b.Publish(stream.Bar{
+			Symbol:    "GGG",
+			Open:      close,
+			High:      close,
+			Low:       close,
+			Close:     close,
+			Timestamp: ts,
+		})
+	}
+
+	// After the close, two bars in a row below the lower band. The first
+	// entry is held for the open, so the second bar doesn't enter again.
+	evening := time.Date(2023, 6, 1, 21, 0, 0, 0, time.UTC)
+	closes := []float64{100, 100, 100, 100, 100, 100, 100, 100, 100, 70, 60}
+	for i, c := range closes {
+		publish(evening.Add(time.Duration(i)*time.Minute), c)
+	}
+
+	// Nor does the opening bar, while the held entry is being placed
+	publish(time.Date(2023, 6, 2, 13, 30, 0, 0, time.UTC), 55)
+	orders, err := database.GetTradingSessionOrders(ctx, testDB, sessionID)
+	require.NoError(t, err)
+	require.Len(t, orders, 1)
+	assert.Equal(t, "buy", orders[0].Side)
+}
+
+func TestGetSession_Performance(t *testing.T) {
+	ctx := context.Background()
+	sessionID := uuid.New().String()
+	require.NoError(t, database.CreateTradingSession(ctx, testDB, &database.TradingSession{
+		SessionID:       sessionID,
+		Strategy:        "test_buyer",
+		Status:          "running",
+		Symbols:         `["JJJ"]`,
+		StartingCapital: 100000,
+		Parameters:      `{"qty": 1, "max_position_size_pct": 0, "daily_stop_loss_pct": 0}`,
+		Timeframe:       "1Min",
+		Mode:            quant.ModeLive,
+		StartedAt:       time.Now(),
+	}))
+
+	b := broker.NewPaper(100000)
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	engines.Resume(runCtx, logger, b)
+	require.Eventually(t, func() bool {
+		return b.TradeUpdateListeners() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// A share is bought on every bar and fills at the next bar's open
+	start := time.Date(2023, 6, 1, 14, 0, 0, 0, time.UTC)
+	for i, price := range []float64{10, 12, 15} {
+		b.Publish(stream.Bar{
+			Symbol:    "JJJ",
+			Open:      price,
+			High:      price,
+			Low:       price,
+			Close:     price,
+			Timestamp: start.Add(time.Duration(i) * time.Minute),
+		})
+	}
+	engines.Stop(ctx, sessionID, "")
+
+	resp := sessionRequest(t, "GET", "/trading/sessions/"+sessionID, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var details struct {
+		Equity  []quant.EquitySnapshot `json:"equity"`
+		Metrics quant.Metrics          `json:"metrics"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&details))
+
+	// Bought at 12 and 15, both marked at 15 on the last bar
+	require.Len(t, details.Equity, 3)
+	for i, want := range []float64{100000, 100000, 100003} {
+		assert.True(t, start.Add(time.Duration(i)*time.Minute).Equal(details.Equity[i].Timestamp))
+		assert.InDelta(t, want, details.Equity[i].Equity, 1e-9)
+	}
+	assert.Equal(t, 2, details.Metrics.TotalFills)
+	assert.InDelta(t, 0.00003, details.Metrics.TotalReturn, 1e-12)
+}
+
+func TestLiveSession_RiskRules(t *testing.T) {
+	ctx := context.Background()
+	sessionID := uuid.New().String()
+	risk := `{"max_order_notional": 30}`
+	require.NoError(t, database.CreateTradingSession(ctx, testDB, &database.TradingSession{
+		SessionID:       sessionID,
+		Strategy:        "test_buyer",
+		Status:          "running",
+		Symbols:         `["III"]`,
+		StartingCapital: 100000,
+		Parameters:      `{"qty": 2, "max_position_size_pct": 0}`,
+		RiskConfig:      &risk,
+		Timeframe:       "1Min",
+		Mode:            quant.ModeLive,
+		StartedAt:       time.Now(),
+	}))
+
+	b := broker.NewPaper(100000)
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	engines.Resume(runCtx, logger, b)
+	defer engines.Stop(ctx, sessionID, "")
+	require.Eventually(t, func() bool {
+		return b.TradeUpdateListeners() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	orders := func() []database.TradingOrder {
+		orders, err := database.GetTradingSessionOrders(ctx, testDB, sessionID)
+		require.NoError(t, err)
+		return orders
+	}
+	start := time.Date(2023, 6, 1, 14, 0, 0, 0, time.UTC)
+	b.Publish(stream.Bar{Symbol: "III", Open: 20, High: 21, Low: 19, Close: 20, Timestamp: start})
+
+	// The saved risk config came back with the session: $30 buys 1.5 shares
+	require.Len(t, orders(), 1)
+	assert.Equal(t, 1.5, orders()[0].Qty)
+
+	resp := sessionRequest(t, "PATCH", "/trading/sessions/"+sessionID+"/risk",
+		map[string]interface{}{"kill_switch": true})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var updated struct {
+		Risk quant.RiskConfig `json:"risk"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&updated))
+	assert.True(t, updated.Risk.KillSwitch)
+	assert.Equal(t, 30.0, updated.Risk.MaxOrderNotional)
+
+	b.Publish(
+		stream.Bar{
+			Symbol:    "III",
+			Open:      20,
+			High:      21,
+			Low:       19,
+			Close:     20,
+			Timestamp: start.Add(time.Minute),
+		},
+	)
+	assert.Len(t, orders(), 1)
+
+	resp = sessionRequest(t, "GET", "/trading/sessions/"+sessionID+"/rejections", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var rejections []database.OrderRejection
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&rejections))
+	require.Len(t, rejections, 1)
+	assert.Equal(t, quant.RejectKillSwitch, rejections[0].Reason)
+	assert.Equal(t, "III", rejections[0].Symbol)
+	assert.Equal(t, "buy", rejections[0].Side)
+
+	s, err := database.GetTradingSession(ctx, testDB, sessionID)
+	require.NoError(t, err)
+	require.NotNil(t, s.RiskConfig)
+	assert.JSONEq(t, `{"max_order_notional": 30, "kill_switch": true}`, *s.RiskConfig)
+
+	audit, err := database.ListSessionAudit(ctx, testDB, sessionID)
+	require.NoError(t, err)
+	require.NotEmpty(t, audit)
+	assert.Equal(t, quant.ActionUpdateRisk, audit[len(audit)-1].Action)
+
+	// Unknown settings are refused
+	resp = sessionRequest(t, "PATCH", "/trading/sessions/"+sessionID+"/risk",
+		map[string]interface{}{"kill": true})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+// ---------- Protective Exit Tests ----------
+
+// entryStrategy submits intent on its first bar.
+type entryStrategy struct {
+	intent quant.OrderIntent
+	sent   bool
+}
+
+func (s *entryStrategy) Name() string { return "Test Entry" }
+
+func (s *entryStrategy) Initialize(p *quant.Portfolio) { s.sent = false }
+
+func (s *entryStrategy) OnBar(symbol string, bar marketdata.Bar, p *quant.Portfolio) {
+	if !s.sent {
+		s.sent = true
+		p.SubmitOrder(s.intent)
+	}
+}
+
+func init() {
+	quant.RegisterStrategy(quant.StrategySpec{
+		ID:   "test_bracket",
+		Name: "Test Bracket",
+		Params: []quant.ParamSpec{
+			{Name: "qty", Type: quant.FloatParam, Default: 1, Min: 1, Max: 1000},
+			{Name: "take_profit", Type: quant.FloatParam, Default: 110, Min: 1, Max: 1000},
+			{Name: "stop_loss", Type: quant.FloatParam, Default: 95, Min: 1, Max: 1000},
+		},
+		Factory: func(symbols []string, params quant.Params) (quant.Strategy, error) {
+			tp, sl := params.Float("take_profit"), params.Float("stop_loss")
+			return &entryStrategy{intent: quant.OrderIntent{
+				Symbol:     symbols[0],
+				Side:       quant.Buy,
+				Type:       quant.Market,
+				Quantity:   params.Float("qty"),
+				TakeProfit: &tp,
+				StopLoss:   &sl,
+			}}, nil
+		},
+	})
+}
+
+func price(v float64) *float64 { return &v }
+
+func dailyBars(start time.Time, ohlc ...[4]float64) []marketdata.Bar {
+	bars := make([]marketdata.Bar, len(ohlc))
+	for i, b := range ohlc {
+		bars[i] = marketdata.Bar{
+			Timestamp: start.AddDate(0, 0, i),
+			Open:      b[0],
+			High:      b[1],
+			Low:       b[2],
+			Close:     b[3],
+		}
+	}
+	return bars
+}
+
+func TestOrderIntent_Validate(t *testing.T) {
+	entry := quant.OrderIntent{Symbol: "AAA", Side: quant.Buy, Type: quant.Market, Quantity: 10}
+	with := func(f func(o *quant.OrderIntent)) quant.OrderIntent {
+		o := entry
+		f(&o)
+		return o
+	}
+
+	valid := map[string]quant.OrderIntent{
+		"simple": entry,
+		"bracket": with(func(o *quant.OrderIntent) {
+			o.TakeProfit, o.StopLoss = price(110), price(95)
+		}),
+		"oto": with(func(o *quant.OrderIntent) { o.StopLoss = price(95) }),
+		"oco": with(func(o *quant.OrderIntent) {
+			o.Side, o.Type, o.OrderClass = quant.Sell, "", quant.ClassOCO
+			o.TakeProfit, o.StopLoss = price(110), price(95)
+		}),
+		"trailing stop": with(func(o *quant.OrderIntent) {
+			o.Side, o.Type, o.TrailingPct = quant.Sell, quant.TrailingStop, price(0.05)
+		}),
+	}
+	for name, o := range valid {
+		assert.NoError(t, o.Validate(), name)
+	}
+	assert.Equal(t, quant.ClassBracket, valid["bracket"].Class())
+	assert.Equal(t, quant.ClassOTO, valid["oto"].Class())
+
+	invalid := map[string]quant.OrderIntent{
+		"no quantity":         with(func(o *quant.OrderIntent) { o.Quantity = 0 }),
+		"limit without price": with(func(o *quant.OrderIntent) { o.Type = quant.Limit }),
+		"exits on a simple order": with(func(o *quant.OrderIntent) {
+			o.OrderClass, o.StopLoss = quant.ClassSimple, price(95)
+		}),
+		"bracket missing a leg": with(func(o *quant.OrderIntent) {
+			o.OrderClass, o.StopLoss = quant.ClassBracket, price(95)
+		}),
+		"stop above take profit": with(func(o *quant.OrderIntent) {
+			o.TakeProfit, o.StopLoss = price(95), price(110)
+		}),
+		"stop entry": with(func(o *quant.OrderIntent) {
+			o.Type, o.StopPrice, o.StopLoss = quant.Stop, price(101), price(95)
+		}),
+		"oco missing a leg": with(func(o *quant.OrderIntent) {
+			o.Side, o.OrderClass, o.TakeProfit = quant.Sell, quant.ClassOCO, price(110)
+		}),
+	}
+	for name, o := range invalid {
+		assert.Error(t, o.Validate(), name)
+	}
+}
+
+func TestEngine_BracketExits(t *testing.T) {
+	start := time.Date(2024, 3, 4, 21, 0, 0, 0, time.UTC)
+	bracket := quant.OrderIntent{
+		Symbol:     "XYZ",
+		Side:       quant.Buy,
+		Type:       quant.Market,
+		Quantity:   10,
+		TakeProfit: price(110),
+		StopLoss:   price(95),
+	}
+
+	t.Run("stop loss cancels take profit", func(t *testing.T) {
+		e := quant.NewEngine(100000, &entryStrategy{intent: bracket}, nil)
+		require.NoError(t, e.Run(map[string][]marketdata.Bar{"XYZ": dailyBars(start,
+			[4]float64{100, 100, 100, 100},
+			[4]float64{99, 100, 94, 96},
+			[4]float64{96, 112, 96, 111},
+		)}))
+
+		trades := e.Portfolio.Trades
+		require.Len(t, trades, 2)
+		assert.Equal(t, 100.0, trades[0].Price)
+		assert.Equal(t, quant.Sell, trades[1].Side)
+		assert.Equal(t, 95.0, trades[1].Price)
+		assert.Zero(t, e.Portfolio.Positions["XYZ"])
+		assert.Empty(t, e.Portfolio.OpenOrders)
+	})
+
+	t.Run("bar reaching both exits stops out", func(t *testing.T) {
+		e := quant.NewEngine(100000, &entryStrategy{intent: bracket}, nil)
+		require.NoError(t, e.Run(map[string][]marketdata.Bar{"XYZ": dailyBars(start,
+			[4]float64{100, 100, 100, 100},
+			[4]float64{100, 111, 94, 100},
+		)}))
+
+		require.Len(t, e.Portfolio.Trades, 2)
+		assert.Equal(t, 95.0, e.Portfolio.Trades[1].Price)
+	})
+
+	t.Run("oco closes an existing position", func(t *testing.T) {
+		oco := quant.OrderIntent{
+			Symbol:      "XYZ",
+			Side:        quant.Sell,
+			Quantity:    10,
+			TimeInForce: "gtc",
+			OrderClass:  quant.ClassOCO,
+			TakeProfit:  price(110),
+			StopLoss:    price(95),
+		}
+		e := quant.NewEngine(100000, &entryStrategy{intent: oco}, nil)
+		e.Portfolio.Positions["XYZ"] = 10
+		require.NoError(t, e.Run(map[string][]marketdata.Bar{"XYZ": dailyBars(start,
+			[4]float64{100, 100, 100, 100},
+			[4]float64{100, 104, 99, 102},
+			[4]float64{108, 112, 108, 111},
+			[4]float64{100, 100, 90, 92},
+		)}))
+
+		require.Len(t, e.Portfolio.Trades, 1)
+		assert.Equal(t, 110.0, e.Portfolio.Trades[0].Price)
+		assert.Zero(t, e.Portfolio.Positions["XYZ"])
+	})
+}
+
+func TestStrategyExits_WholeShares(t *testing.T) {
+	// Nine flat closes, then a drop below the lower band that enters
+	closes := []float64{100, 100, 100, 100, 100, 100, 100, 100, 100, 70}
+	entries := func(t *testing.T, notional float64) []quant.OrderIntent {
+		strategy, _, err := quant.NewStrategy("bollinger_bands", []string{"XYZ"},
+			map[string]interface{}{
+				"period":        10,
+				"stop_loss_pct": 0.05,
+				"sizer":         quant.SizeFixedNotional,
+				"size_notional": notional,
+			})
+		require.NoError(t, err)
+		p := quant.NewPortfolio(100000)
+		strategy.Initialize(p)
+		for i, c := range closes {
+			strategy.OnBar("XYZ", marketdata.Bar{
+				Timestamp: time.Date(2024, 3, 4+i, 21, 0, 0, 0, time.UTC),
+				Open:      c,
+				High:      c,
+				Low:       c,
+				Close:     c,
+			}, p)
+		}
+		return p.PendingOrders
+	}
+
+	// 150 buys 2.14 shares, rounded down for the bracket
+	orders := entries(t, 150)
+	require.Len(t, orders, 1)
+	assert.Equal(t, 2.0, orders[0].Quantity)
+	require.NotNil(t, orders[0].StopLoss)
+	assert.Equal(t, 66.5, *orders[0].StopLoss)
+
+	// 50 doesn't buy a whole share, so there is no entry at all
+	assert.Empty(t, entries(t, 50))
+}
+
+func TestPaper_BracketOrder(t *testing.T) {
+	b := broker.NewPaper(100000)
+	var mu sync.Mutex
+	var events []alpaca.TradeUpdate
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.ConnectTradeUpdates(ctx, func(u alpaca.TradeUpdate) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, u)
+	})
+	require.Eventually(t, func() bool {
+		return b.TradeUpdateListeners() == 1
+	}, time.Second, 10*time.Millisecond)
+	status := func(id string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		s := ""
+		for _, u := range events {
+			if u.Order.ID == id {
+				s = u.Order.Status
+			}
+		}
+		return s
+	}
+
+	start := time.Date(2024, 1, 2, 14, 30, 0, 0, time.UTC)
+	bar := func(i int, open, high, low, close float64) {
+		b.Publish(stream.Bar{
+			Symbol:    "XYZ",
+			Open:      open,
+			High:      high,
+			Low:       low,
+			Close:     close,
+			Timestamp: start.Add(time.Duration(i) * time.Minute),
+		})
+	}
+	bar(0, 100, 100, 100, 100)
+
+	order, err := b.PlaceOrder(quant.NewOrderRequest(quant.OrderIntent{
+		Symbol:      "XYZ",
+		Side:        quant.Buy,
+		Type:        quant.Market,
+		Quantity:    10,
+		TimeInForce: "gtc",
+		TakeProfit:  price(110),
+		StopLoss:    price(95),
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, alpaca.Bracket, order.OrderClass)
+	require.Len(t, order.Legs, 2)
+	stop, take := order.Legs[0], order.Legs[1]
+	assert.Equal(t, "held", stop.Status)
+	assert.Equal(t, "95", stop.StopPrice.String())
+	assert.Equal(t, "110", take.LimitPrice.String())
+
+	// Held exits can't fill before the entry does
+	bar(1, 100, 111, 100, 101)
+	assert.Equal(t, "filled", status(order.ID))
+	assert.Equal(t, "new", status(take.ID))
+	assert.Equal(t, "new", status(stop.ID))
+
+	bar(2, 105, 112, 104, 111)
+	assert.Equal(t, "filled", status(take.ID))
+	assert.Equal(t, "canceled", status(stop.ID))
+
+	positions, err := b.GetPositions()
+	require.NoError(t, err)
+	assert.Empty(t, positions)
+
+	// A trailing stop follows the high and fires on a pullback from it
+	_, err = b.PlaceOrder(quant.NewOrderRequest(
+		quant.OrderIntent{Symbol: "XYZ", Side: quant.Buy, Type: quant.Market, Quantity: 5},
+	))
+	require.NoError(t, err)
+	bar(3, 110, 110, 110, 110)
+	trail, err := b.PlaceOrder(quant.NewOrderRequest(quant.OrderIntent{
+		Symbol:      "XYZ",
+		Side:        quant.Sell,
+		Type:        quant.TrailingStop,
+		Quantity:    5,
+		TrailingPct: price(10),
+	}))
+	require.NoError(t, err)
+	bar(4, 110, 120, 109, 119)
+	assert.Equal(t, "new", status(trail.ID))
+	bar(5, 115, 116, 107, 108)
+	require.Equal(t, "filled", status(trail.ID))
+
+	mu.Lock()
+	defer mu.Unlock()
+	last := events[len(events)-1]
+	assert.Equal(t, "108", last.Price.String())
+}
+
+func TestPlaceManualOrder_Bracket(t *testing.T) {
+	resp := sessionRequest(t, "POST", "/trading/orders", map[string]interface{}{
+		"symbol":      "ddd",
+		"quantity":    4,
+		"side":        "buy",
+		"type":        "market",
+		"take_profit": 60,
+		"stop_loss":   45,
+	})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var order alpaca.Order
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&order))
+	assert.Equal(t, alpaca.Bracket, order.OrderClass)
+	assert.Len(t, order.Legs, 2)
+
+	resp = sessionRequest(t, "POST", "/trading/orders", map[string]interface{}{
+		"symbol":      "ddd",
+		"quantity":    4,
+		"side":        "buy",
+		"type":        "market",
+		"take_profit": 45,
+		"stop_loss":   60,
+	})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestLiveSession_BracketLegs(t *testing.T) {
+	ctx := context.Background()
+	sessionID := uuid.New().String()
+	require.NoError(t, database.CreateTradingSession(ctx, testDB, &database.TradingSession{
+		SessionID:       sessionID,
+		Strategy:        "test_bracket",
+		Status:          "running",
+		Symbols:         `["JJJ"]`,
+		StartingCapital: 100000,
+		Parameters:      `{"qty": 10, "take_profit": 110, "stop_loss": 95}`,
+		Timeframe:       "1Min",
+		Mode:            quant.ModeLive,
+		StartedAt:       time.Now(),
+	}))
+
+	b := broker.NewPaper(100000)
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	engines.Resume(runCtx, logger, b)
+	defer engines.Stop(ctx, sessionID, "")
+	require.Eventually(t, func() bool {
+		return b.TradeUpdateListeners() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	orders := func() map[string]database.TradingOrder {
+		orders, err := database.GetTradingSessionOrders(ctx, testDB, sessionID)
+		require.NoError(t, err)
+		byType := make(map[string]database.TradingOrder)
+		for _, o := range orders {
+			byType[o.Type] = o
+		}
+		return byType
+	}
+	start := time.Date(2023, 6, 1, 14, 0, 0, 0, time.UTC)
+	bar := func(i int, open, high, low, close float64) {
+		b.Publish(stream.Bar{
+			Symbol:    "JJJ",
+			Open:      open,
+			High:      high,
+			Low:       low,
+			Close:     close,
+			Timestamp: start.Add(time.Duration(i) * time.Minute),
+		})
+	}
+	bar(0, 100, 100, 100, 100)
+
+	// The exits are saved alongside the entry, held until it fills
+	saved := orders()
+	require.Len(t, saved, 3)
+	entry := saved["market"]
+	for _, typ := range []string{"limit", "stop"} {
+		require.NotNil(t, saved[typ].ParentOrderID, typ)
+		assert.Equal(t, entry.OrderID, *saved[typ].ParentOrderID)
+		assert.Equal(t, "held", saved[typ].Status)
+	}
+
+	bar(1, 100, 101, 99, 100)
+	bar(2, 99, 100, 93, 94)
+	saved = orders()
+	assert.Equal(t, "filled", saved["market"].Status)
+	assert.Equal(t, "filled", saved["stop"].Status)
+	assert.Equal(t, "canceled", saved["limit"].Status)
+
+	// Both fills were booked, leaving the session flat
+	account := getSubAccount(t, sessionID)
+	assert.Empty(t, account.Positions)
+	assert.InDelta(t, 100000-50, account.Cash, 1e-9)
+}
+
+// ---------- Position Sizing Tests ----------
+
+func TestSizers(t *testing.T) {
+	// $100,000 of equity, $40,000 of it long AAA
+	p := quant.NewPortfolio(60000)
+	p.Positions["AAA"] = 400
+	p.Mark("AAA", 100)
+
+	assert.Equal(t, 500.0, quant.AllIn{}.Size("BBB", 100, 50000, p))
+	assert.Equal(t, 100.0, quant.FixedNotional{Notional: 10000}.Size("BBB", 100, 50000, p))
+	assert.Equal(t, 50.0, quant.FixedNotional{Notional: 10000}.Size("BBB", 100, 5000, p))
+	assert.InDelta(t, 200, quant.FixedFraction{Fraction: 0.1}.Size("BBB", 50, 50000, p), 1e-9)
+
+	t.Run("volatility target", func(t *testing.T) {
+		atr := &quant.VolatilityTarget{Target: 0.01, Period: 3}
+		stdev := &quant.VolatilityTarget{Target: 0.01, Period: 3, StdDev: true}
+		start := time.Date(2024, 1, 2, 21, 0, 0, 0, time.UTC)
+		for i, c := range []float64{100, 102, 100, 102} {
+			bar := marketdata.Bar{
+				Timestamp: start.AddDate(0, 0, i),
+				Open:      c,
+				High:      c + 1,
+				Low:       c - 1,
+				Close:     c,
+			}
+			atr.Observe("BBB", bar)
+			stdev.Observe("BBB", bar)
+			if i < 3 {
+				assert.Zero(t, atr.Size("BBB", c, 100000, p), "sized before the ATR was ready")
+			}
+		}
+
+		// Every true range is 3, so $1,000 of risk buys 333 shares
+		assert.InDelta(t, 1000.0/3, atr.Size("BBB", 102, 100000, p), 1e-9)
+		// The closes move +2, -2, +2
+		assert.InDelta(t, 1000/math.Sqrt(32.0/9), stdev.Size("BBB", 102, 100000, p), 1e-9)
+		// Never more than the budget
+		assert.InDelta(t, 100, atr.Size("BBB", 100, 10000, p), 1e-9)
+
+		// History survives a save and restore, here through whole-share rounding
+		saved, err := quant.WholeShares{Sizer: atr}.MarshalState()
+		require.NoError(t, err)
+		restored := quant.WholeShares{Sizer: &quant.VolatilityTarget{Target: 0.01, Period: 3}}
+		require.NoError(t, restored.UnmarshalState(saved))
+		assert.Equal(t, 333.0, restored.Size("BBB", 102, 100000, p))
+
+		atr.Reset()
+		assert.Zero(t, atr.Size("BBB", 102, 100000, p))
+	})
+
+	t.Run("kelly", func(t *testing.T) {
+		kelly := quant.Kelly{Fraction: 0.5, MinTrades: 4, Fallback: 0.1}
+		p.Ledger.RoundTrips = []quant.RoundTrip{
+			{ReturnPct: 0.1},
+			{ReturnPct: 0.1},
+			{ReturnPct: -0.05},
+		}
+		assert.InDelta(
+			t,
+			100,
+			kelly.Size("BBB", 100, 100000, p),
+			1e-9,
+			"falls back before MinTrades",
+		)
+
+		// Wins 75% of the time at twice the size of the losses: Kelly bets 62.5%
+		p.Ledger.RoundTrips = append(p.Ledger.RoundTrips, quant.RoundTrip{ReturnPct: 0.1})
+		assert.InDelta(t, 312.5, kelly.Size("BBB", 100, 100000, p), 1e-9)
+
+		// No edge, no bet
+		p.Ledger.RoundTrips = []quant.RoundTrip{
+			{ReturnPct: 0.05},
+			{ReturnPct: -0.1},
+			{ReturnPct: -0.1},
+			{ReturnPct: 0.05},
+		}
+		assert.Zero(t, kelly.Size("BBB", 100, 100000, p))
+	})
+
+	t.Run("from params", func(t *testing.T) {
+		spec, ok := quant.LookupStrategy("sma_crossover")
+		require.True(t, ok)
+		params, err := spec.Resolve(
+			map[string]interface{}{"sizer": quant.SizeKelly, "whole_shares": 1},
+		)
+		require.NoError(t, err)
+		sizer := quant.NewSizer(params)
+		require.IsType(t, quant.WholeShares{}, sizer)
+		assert.IsType(t, quant.Kelly{}, sizer.(quant.WholeShares).Sizer)
+
+		params, err = spec.Resolve(nil)
+		require.NoError(t, err)
+		assert.IsType(t, quant.AllIn{}, quant.NewSizer(params))
+
+		_, err = spec.Resolve(map[string]interface{}{"sizer": 9})
+		assert.Error(t, err)
+	})
+}
+
+// ---------- Cross-Sectional Strategy Tests ----------
+
+// sliceStrategy invests invested of equity equally in every symbol in its
+// slices, rebalancing on each one, and records what it saw.
+type sliceStrategy struct {
+	invested float64
+	seen     []string // symbols passed to OnBar since the last slice
+	slices   []map[string]marketdata.Bar
+	early    bool // a slice arrived before OnBar saw all of its bars
+}
+
+func (s *sliceStrategy) Name() string { return "Test Slice" }
+
+func (s *sliceStrategy) Initialize(p *quant.Portfolio) { s.seen, s.slices = nil, nil }
+
+func (s *sliceStrategy) OnBar(symbol string, bar marketdata.Bar, p *quant.Portfolio) {
+	s.seen = append(s.seen, symbol)
+}
+
+func (s *sliceStrategy) OnBarSlice(
+	ts time.Time,
+	bars map[string]marketdata.Bar,
+	p *quant.Portfolio,
+) {
+	s.early = s.early || len(s.seen) < len(bars)
+	s.seen = nil
+	s.slices = append(s.slices, bars)
+
+	weights := make(map[string]float64)
+	for symbol := range bars {
+		weights[symbol] = s.invested / float64(len(bars))
+	}
+	quant.TargetWeights{Weights: weights}.Submit(p)
+}
+
+func init() {
+	quant.RegisterStrategy(quant.StrategySpec{
+		ID:         "test_slice",
+		Name:       "Test Slice",
+		MinSymbols: 2,
+		Params: []quant.ParamSpec{
+			{Name: "invested", Type: quant.FloatParam, Default: 1, Min: 0, Max: 1},
+		},
+		Factory: func(symbols []string, params quant.Params) (quant.Strategy, error) {
+			return &sliceStrategy{invested: params.Float("invested")}, nil
+		},
+	})
+}
+
+func TestTargetWeights(t *testing.T) {
+	// $100,000 of equity: $20,000 cash, $50,000 of AAA and $30,000 of CCC
+	p := quant.NewPortfolio(20000)
+	p.Positions["AAA"] = 500
+	p.Positions["CCC"] = 300
+	p.Mark("AAA", 100)
+	p.Mark("BBB", 50)
+	p.Mark("CCC", 100)
+
+	orders := quant.TargetWeights{
+		Weights: map[string]float64{"AAA": 0.25, "BBB": 0.7},
+	}.Orders(p)
+
+	// Sells first, so their proceeds pay for the buys; CCC has no weight
+	require.Len(t, orders, 3)
+	assert.Equal(
+		t,
+		quant.OrderIntent{Symbol: "AAA", Side: quant.Sell, Type: quant.Market, Quantity: 250},
+		orders[0],
+	)
+	assert.Equal(
+		t,
+		quant.OrderIntent{Symbol: "CCC", Side: quant.Sell, Type: quant.Market, Quantity: 300},
+		orders[1],
+	)
+	assert.Equal(
+		t,
+		quant.OrderIntent{Symbol: "BBB", Side: quant.Buy, Type: quant.Market, Quantity: 1400},
+		orders[2],
+	)
+
+	// Within the band only closing CCC is worth doing
+	orders = quant.TargetWeights{
+		Weights: map[string]float64{"AAA": 0.52, "BBB": 0.01},
+		Band:    0.05,
+	}.Orders(p)
+	require.Len(t, orders, 1)
+	assert.Equal(t, "CCC", orders[0].Symbol)
+
+	// Whole shares round toward zero, shorts included
+	orders = quant.TargetWeights{
+		Weights:     map[string]float64{"AAA": 0.5, "BBB": -0.0333, "CCC": 0.3},
+		WholeShares: true,
+	}.Orders(p)
+	require.Len(t, orders, 1)
+	assert.Equal(
+		t,
+		quant.OrderIntent{Symbol: "BBB", Side: quant.Sell, Type: quant.Market, Quantity: 66},
+		orders[0],
+	)
+
+	// Symbols without a price are left alone
+	assert.Empty(t, quant.TargetWeights{
+		Weights: map[string]float64{"AAA": 0.5, "CCC": 0.3, "ZZZ": 0.2},
+	}.Orders(p))
+
+	jan31 := time.Date(2024, 1, 31, 21, 0, 0, 0, time.UTC)
+	feb1 := time.Date(2024, 2, 1, 21, 0, 0, 0, time.UTC)
+	assert.True(t, quant.RebalanceDue(quant.RebalanceMonthly, time.Time{}, jan31))
+	assert.False(t, quant.RebalanceDue(quant.RebalanceMonthly, jan31.AddDate(0, 0, -20), jan31))
+	assert.True(t, quant.RebalanceDue(quant.RebalanceMonthly, jan31, feb1))
+	assert.False(t, quant.RebalanceDue(quant.RebalanceQuarterly, jan31, feb1))
+	assert.False(t, quant.RebalanceDue(quant.RebalanceNever, jan31, feb1))
+}
+
+func TestEngine_SliceStrategy(t *testing.T) {
+	start := time.Date(2024, 3, 4, 21, 0, 0, 0, time.UTC)
+	aaa := dailyBars(start,
+		[4]float64{100, 100, 100, 100},
+		[4]float64{100, 100, 100, 100},
+		[4]float64{110, 110, 110, 110},
+	)
+	// BBB doesn't trade on the second day
+	bbb := dailyBars(start,
+		[4]float64{50, 50, 50, 50},
+		[4]float64{50, 50, 50, 50},
+		[4]float64{40, 40, 40, 40},
+	)
+	bbb = append(bbb[:1], bbb[2])
+
+	s := &sliceStrategy{invested: 1}
+	e := quant.NewEngine(100000, s, nil)
+	require.NoError(t, e.Run(map[string][]marketdata.Bar{"AAA": aaa, "BBB": bbb}))
+
+	require.Len(t, s.slices, 3)
+	assert.False(t, s.early, "a slice was delivered before OnBar saw its bars")
+	assert.Len(t, s.slices[0], 2)
+	assert.Len(t, s.slices[1], 1)
+	assert.Contains(t, s.slices[1], "AAA")
+	assert.Equal(t, 40.0, s.slices[2]["BBB"].Close)
+
+	// Split equally at the first close, all in AAA at the second, and
+	// equally again at the third once AAA has made $10,000
+	trades := e.Portfolio.Trades
+	require.Len(t, trades, 6)
+	assert.Equal(t, []float64{500, 1000}, []float64{trades[0].Quantity, trades[1].Quantity})
+	assert.Equal(t, quant.Sell, trades[2].Side)
+	assert.Equal(t, "BBB", trades[2].Symbol)
+	assert.Equal(t, 500.0, trades[3].Quantity)
+	assert.InDelta(t, 110000, e.Portfolio.EquityLog[2].Equity, 1e-6)
+	assert.InDelta(t, 500, e.Portfolio.Positions["AAA"], 1e-9)
+	assert.InDelta(t, 1375, e.Portfolio.Positions["BBB"], 1e-9)
+}
+
+func TestLiveSession_SliceStrategy(t *testing.T) {
+	ctx := context.Background()
+	sessionID := uuid.New().String()
+	require.NoError(t, database.CreateTradingSession(ctx, testDB, &database.TradingSession{
+		SessionID:       sessionID,
+		Strategy:        "test_slice",
+		Status:          "running",
+		Symbols:         `["KKK", "LLL"]`,
+		StartingCapital: 10000,
+		Parameters:      `{"max_position_size_pct": 0}`,
+		Timeframe:       "1Min",
+		Mode:            quant.ModeLive,
+		StartedAt:       time.Now(),
+	}))
+
+	b := broker.NewPaper(100000)
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	engines.Resume(runCtx, logger, b)
+	defer engines.Stop(ctx, sessionID, "")
+	require.Eventually(t, func() bool {
+		return b.TradeUpdateListeners() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	orders := func() []database.TradingOrder {
+		orders, err := database.GetTradingSessionOrders(ctx, testDB, sessionID)
+		require.NoError(t, err)
+		return orders
+	}
+	start := time.Date(2023, 6, 1, 14, 0, 0, 0, time.UTC)
+	bar := func(symbol string, i int, close float64) {
+		b.Publish(stream.Bar{
+			Symbol:    symbol,
+			Open:      close,
+			High:      close,
+			Low:       close,
+			Close:     close,
+			Timestamp: start.Add(time.Duration(i) * time.Minute),
+		})
+	}
+
+	// Nothing happens until both symbols have a bar for the minute
+	bar("KKK", 0, 100)
+	assert.Empty(t, orders())
+	bar("LLL", 0, 50)
+	saved := orders()
+	require.Len(t, saved, 2)
+	qty := map[string]float64{}
+	for _, o := range saved {
+		assert.Equal(t, "buy", o.Side)
+		qty[o.Symbol] = o.Qty
+	}
+	assert.Equal(t, map[string]float64{"KKK": 50, "LLL": 100}, qty)
+
+	// The buys fill on the next bars, leaving nothing to rebalance
+	bar("KKK", 1, 100)
+	bar("LLL", 1, 50)
+	assert.Len(t, orders(), 2)
+
+	// LLL misses a minute, so the slice goes ahead with KKK alone when the
+	// next minute starts, and sells LLL
+	bar("KKK", 2, 100)
+	assert.Len(t, orders(), 2)
+	bar("KKK", 3, 100)
+	var sells []database.TradingOrder
+	for _, o := range orders() {
+		if o.Side == "sell" {
+			sells = append(sells, o)
+		}
+	}
+	require.Len(t, sells, 1)
+	assert.Equal(t, "LLL", sells[0].Symbol)
+	assert.Equal(t, 100.0, sells[0].Qty)
+}
+
+func TestDualMomentum(t *testing.T) {
+	start := time.Date(2024, 1, 29, 21, 0, 0, 0, time.UTC)
+	// AAA is flat through January, rises on Feb 1 and falls back in March
+	bars := map[string][]marketdata.Bar{
+		"AAA": dailyBars(start,
+			[4]float64{100, 100, 100, 100},
+			[4]float64{100, 100, 100, 100},
+			[4]float64{100, 100, 100, 100},
+			[4]float64{110, 110, 110, 110},
+		),
+		"BBB": dailyBars(start,
+			[4]float64{50, 50, 50, 50},
+			[4]float64{50, 50, 50, 50},
+			[4]float64{50, 50, 50, 50},
+			[4]float64{50, 50, 50, 50},
+		),
+	}
+	march := dailyBars(start.AddDate(0, 1, 4),
+		[4]float64{100, 100, 100, 100},
+		[4]float64{90, 90, 90, 90},
+	)
+	bars["AAA"] = append(bars["AAA"], march...)
+	bars["BBB"] = append(bars["BBB"], dailyBars(start.AddDate(0, 1, 4),
+		[4]float64{50, 50, 50, 50},
+		[4]float64{50, 50, 50, 50},
+	)...)
+
+	strategy, params, err := quant.NewStrategy("dual_momentum", []string{"AAA", "BBB"},
+		map[string]interface{}{"lookback": 2, "daily_stop_loss_pct": 0})
+	require.NoError(t, err)
+	// Rotations default to no position limit so the risk manager built from
+	// their parameters doesn't clip their targets
+	assert.Zero(t, params.Float("max_position_size_pct"))
+	e := quant.NewEngine(100000, strategy, quant.NewRiskManagerFromParams(params))
+	require.NoError(t, e.Run(bars))
+
+	// No momentum on Jan 31, so the safe asset; AAA on Feb 1 as it is a new
+	// month; and back to safety on Mar 4 after the fall
+	var held []string
+	for _, tr := range e.Portfolio.Trades {
+		if tr.Side == quant.Buy {
+			held = append(held, tr.Timestamp.Format(time.DateOnly)+" "+tr.Symbol)
+		}
+	}
+	assert.Equal(t, []string{"2024-01-31 BBB", "2024-02-01 AAA", "2024-03-04 BBB"}, held)
+	assert.Zero(t, e.Portfolio.Positions["AAA"])
+	// All of the AAA bought at 110 and sold at 100 goes into BBB
+	assert.InDelta(t, 100000.0/110*100/50, e.Portfolio.Positions["BBB"], 1e-6)
+
+	// Positions are sized by target weight, so only whole_shares is taken
+	_, _, err = quant.NewStrategy("dual_momentum", []string{"AAA", "BBB"},
+		map[string]interface{}{"whole_shares": 1})
+	assert.NoError(t, err)
+	_, _, err = quant.NewStrategy("dual_momentum", []string{"AAA", "BBB"},
+		map[string]interface{}{"sizer": quant.SizeFixedFraction})
+	assert.Error(t, err)
+
+	// The closes it needs and the last rebalance survive a restart
+	state, err := strategy.(quant.StatefulStrategy).MarshalState()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"history": {"AAA": [110, 100, 90], "BBB": [50, 50, 50]},
+		"last_rebalance": "2024-03-04T21:00:00Z"
+	}`, string(state))
+	restored, _, err := quant.NewStrategy("dual_momentum", []string{"AAA", "BBB"},
+		map[string]interface{}{"lookback": 2})
+	require.NoError(t, err)
+	restored.Initialize(e.Portfolio)
+	require.NoError(t, restored.(quant.StatefulStrategy).UnmarshalState(state))
+	again, err := restored.(quant.StatefulStrategy).MarshalState()
+	require.NoError(t, err)
+	assert.JSONEq(t, string(state), string(again))
+
+	t.Run("warmup", func(t *testing.T) {
+		// History is enough to rebalance on Jan 4, inside the warmup, but the
+		// first rebalance of January has to wait for the first bar after it
+		jan := time.Date(2024, 1, 2, 21, 0, 0, 0, time.UTC)
+		flat := [4]float64{100, 100, 100, 100}
+		bars := map[string][]marketdata.Bar{
+			"AAA": dailyBars(jan, flat, flat, flat, flat, flat),
+			"BBB": dailyBars(jan, flat, flat, flat, flat, flat),
+		}
+		strategy, _, err := quant.NewStrategy("dual_momentum", []string{"AAA", "BBB"},
+			map[string]interface{}{"lookback": 2})
+		require.NoError(t, err)
+		e := quant.NewEngine(100000, strategy, nil)
+		e.WarmupUntil = jan.AddDate(0, 0, 3)
+		require.NoError(t, e.Run(bars))
+
+		require.NotEmpty(t, e.Portfolio.Trades)
+		assert.Equal(t, e.WarmupUntil, e.Portfolio.Trades[0].Timestamp)
+		assert.Equal(t, "BBB", e.Portfolio.Trades[0].Symbol)
+	})
+}
+
+func TestSectorRotation(t *testing.T) {
+	start := time.Date(2024, 1, 27, 21, 0, 0, 0, time.UTC)
+	closes := map[string][]float64{
+		"AAA": {100, 100, 110, 120, 90}, // best until the last bar, then below trend
+		"BBB": {100, 100, 105, 110, 130},
+		"CCC": {100, 100, 102, 104, 104},
+		"DDD": {100, 100, 100, 100, 106}, // only moves on the last bar
+	}
+	bars := make(map[string][]marketdata.Bar)
+	for symbol, cs := range closes {
+		var ohlc [][4]float64
+		for _, c := range cs {
+			ohlc = append(ohlc, [4]float64{c, c, c, c})
+		}
+		bars[symbol] = dailyBars(start, ohlc...)
+	}
+	symbols := []string{"AAA", "BBB", "CCC", "DDD"}
+
+	// weights runs the strategy and returns the weights it bought, by value
+	// at the last close, with the time of its first trade
+	weights := func(t *testing.T, params map[string]interface{}) (map[string]float64, time.Time) {
+		strategy, _, err := quant.NewStrategy("sector_rotation", symbols, params)
+		require.NoError(t, err)
+		e := quant.NewEngine(100000, strategy, nil)
+		require.NoError(t, e.Run(bars))
+		require.NotEmpty(t, e.Portfolio.Trades)
+
+		w := make(map[string]float64)
+		for symbol, qty := range e.Portfolio.Positions {
+			if qty != 0 {
+				w[symbol] = qty * closes[symbol][4] / 100000
+			}
+		}
+		return w, e.Portfolio.Trades[0].Timestamp
+	}
+
+	t.Run("skip and trend", func(t *testing.T) {
+		// Ranked on the closes a bar back, AAA leads BBB and CCC, but its slot
+		// stays in cash as it closed below its trend. The trend needs five
+		// closes, so nothing is held before the fifth bar.
+		w, first := weights(t, map[string]interface{}{
+			"lookback": 2, "skip": 1, "top": 3, "trend_period": 5,
+		})
+		assert.Equal(t, start.AddDate(0, 0, 4), first)
+		assert.Len(t, w, 2)
+		assert.InDelta(t, 1.0/3, w["BBB"], 1e-9)
+		assert.InDelta(t, 1.0/3, w["CCC"], 1e-9)
+	})
+
+	t.Run("no skip", func(t *testing.T) {
+		// On the latest closes AAA falls to last and DDD takes its place
+		w, _ := weights(t, map[string]interface{}{
+			"lookback": 2, "top": 3, "trend_period": 5,
+		})
+		assert.Len(t, w, 3)
+		for _, symbol := range []string{"BBB", "CCC", "DDD"} {
+			assert.InDelta(t, 1.0/3, w[symbol], 1e-9, symbol)
+		}
+	})
+
+	t.Run("inverse volatility", func(t *testing.T) {
+		// The two invested slots are split by the inverse of the standard
+		// deviation of each symbol's last two returns
+		w, _ := weights(t, map[string]interface{}{
+			"lookback": 2, "skip": 1, "top": 3, "trend_period": 5, "weighting": 1,
+		})
+		volB := math.Abs(110.0/105-130.0/110) / 2
+		volC := math.Abs(104.0/102-1) / 2
+		assert.Len(t, w, 2)
+		assert.InDelta(t, 2.0/3*(1/volB)/(1/volB+1/volC), w["BBB"], 1e-9)
+		assert.InDelta(t, 2.0/3*(1/volC)/(1/volB+1/volC), w["CCC"], 1e-9)
+	})
+}
+
+// ---------- Fill Model Tests ----------
+
+func TestFillModel(t *testing.T) {
+	model := quant.NewFillModel(quant.FillConfig{
+		SlippageFixed:      0.05,
+		SlippagePct:        0.01,
+		CommissionPerShare: 0.01,
+		CommissionPerOrder: 0.5,
+		CommissionMin:      1,
+	})
+	assert.InDelta(t, 101.05, model.Slippage(quant.Buy, 100), 1e-9)
+	assert.InDelta(t, 98.95, model.Slippage(quant.Sell, 100), 1e-9)
+	assert.Equal(t, 1.0, model.Commission(10, 100), "the minimum applies")
+	assert.InDelta(t, 2.5, model.Commission(200, 100), 1e-9)
+
+	assert.NoError(t, quant.FillConfig{}.Validate())
+	assert.NoError(t, quant.FillConfig{Timing: quant.FillOnNextOpen, SlippagePct: 0.01}.Validate())
+	assert.Error(t, quant.FillConfig{Timing: "open"}.Validate())
+	assert.Error(t, quant.FillConfig{CommissionMin: -1}.Validate())
+
+	start := time.Date(2024, 3, 4, 21, 0, 0, 0, time.UTC)
+	bars := map[string][]marketdata.Bar{"XYZ": dailyBars(start,
+		[4]float64{100, 101, 99, 100},
+		[4]float64{102, 104, 101, 103},
+	)}
+	run := func(config quant.FillConfig, intent quant.OrderIntent) quant.Trade {
+		t.Helper()
+		e := quant.NewEngine(100000, &entryStrategy{intent: intent}, nil)
+		e.FillModel = quant.NewFillModel(config)
+		require.NoError(t, e.Run(bars))
+		require.Len(t, e.Portfolio.Trades, 1)
+		return e.Portfolio.Trades[0]
+	}
+	market := quant.OrderIntent{Symbol: "XYZ", Side: quant.Buy, Type: quant.Market, Quantity: 10}
+	costs := quant.FillConfig{SlippageFixed: 0.05, SlippagePct: 0.01, CommissionMin: 1}
+
+	// Same bar: the close plus 0.05 and 1%
+	trade := run(costs, market)
+	assert.Equal(t, start, trade.Timestamp)
+	assert.InDelta(t, 101.05, trade.Price, 1e-9)
+	assert.Equal(t, 1.0, trade.Commission)
+
+	// Next bar: its open plus 0.05 and 1%
+	costs.Timing = quant.FillOnNextOpen
+	trade = run(costs, market)
+	assert.Equal(t, start.AddDate(0, 0, 1), trade.Timestamp)
+	assert.InDelta(t, 103.07, trade.Price, 1e-9)
+
+	// A limit fills at its price, or at the open when the bar gaps through
+	limit := quant.OrderIntent{
+		Symbol:      "XYZ",
+		Side:        quant.Buy,
+		Type:        quant.Limit,
+		Quantity:    10,
+		LimitPrice:  price(101.5),
+		TimeInForce: "gtc",
+	}
+	trade = run(quant.FillConfig{Timing: quant.FillOnNextOpen}, limit)
+	assert.Equal(t, 101.5, trade.Price)
+	limit.LimitPrice = price(105)
+	trade = run(quant.FillConfig{Timing: quant.FillOnNextOpen}, limit)
+	assert.Equal(t, 102.0, trade.Price)
+}
+
+// ---------- Margin Tests ----------
+
+func TestMargin(t *testing.T) {
+	p := quant.NewPortfolio(10000)
+	p.Margin = quant.MarginConfig{AllowShort: true, InitialMargin: 0.5, MaintenanceMargin: 0.25}
+	prices := map[string]float64{"XYZ": 100}
+
+	// Half margin doubles buying power
+	assert.Equal(t, 20000.0, p.BuyingPower(prices))
+	assert.InDelta(t, 200, p.MaxQuantity("XYZ", quant.Buy, 100, 0), 1e-9)
+	assert.InDelta(t, 199.98, p.MaxQuantity("XYZ", quant.Buy, 100, 1), 1e-9)
+
+	// A short credits the proceeds and leaves equity unchanged
+	require.True(
+		t,
+		p.ApplyFill(quant.Trade{Symbol: "XYZ", Side: quant.Sell, Quantity: 100, Price: 100}),
+	)
+	assert.Equal(t, 20000.0, p.Cash)
+	assert.Equal(t, 10000.0, p.CalculateEquity(prices))
+	assert.Equal(t, 10000.0, p.BuyingPower(prices))
+	assert.False(
+		t,
+		p.ApplyFill(quant.Trade{Symbol: "XYZ", Side: quant.Sell, Quantity: 101, Price: 100}),
+	)
+
+	// 10% a year on $10,000 short for a year
+	p.Margin.BorrowFeeRate = 0.1
+	assert.InDelta(t, 1000, p.ChargeBorrowFees(prices, 365*24*time.Hour), 1e-9)
+	assert.InDelta(t, 19000, p.Cash, 1e-9)
+
+	// Maintenance is a quarter of the short's value: $4,000 of equity covers
+	// $3,750 at 150, but at 160 $3,000 is $1,000 short of $4,000
+	assert.Zero(t, p.MarginDeficit(map[string]float64{"XYZ": 130}))
+	assert.Zero(t, p.MarginDeficit(map[string]float64{"XYZ": 150}))
+	assert.InDelta(t, 1000, p.MarginDeficit(map[string]float64{"XYZ": 160}), 1e-9)
+
+	// A cash account can't short
+	cash := quant.NewPortfolio(10000)
+	assert.Zero(t, cash.MaxQuantity("XYZ", quant.Sell, 100, 0))
+}
+
+func TestEngine_MarginCall(t *testing.T) {
+	start := time.Date(2024, 3, 4, 21, 0, 0, 0, time.UTC)
+	short := quant.OrderIntent{Symbol: "XYZ", Side: quant.Sell, Type: quant.Market, Quantity: 150}
+	e := quant.NewEngine(10000, &entryStrategy{intent: short}, nil)
+	e.Portfolio.Margin = quant.MarginConfig{
+		AllowShort:        true,
+		InitialMargin:     0.5,
+		MaintenanceMargin: 0.25,
+	}
+	require.NoError(t, e.Run(map[string][]marketdata.Bar{"XYZ": dailyBars(start,
+		[4]float64{100, 100, 100, 100},
+		[4]float64{130, 130, 130, 130},
+		[4]float64{140, 140, 140, 140},
+		[4]float64{150, 150, 150, 150},
+	)}))
+
+	// At 130 equity is $5,500 against $4,875 required. At 140 it is $4,000
+	// against $5,250, so the short is bought back at 140
+	assert.Equal(t, 1, e.Portfolio.MarginCalls)
+	trades := e.Portfolio.Trades
+	require.Len(t, trades, 2)
+	assert.Equal(t, quant.Buy, trades[1].Side)
+	assert.Equal(t, 150.0, trades[1].Quantity)
+	assert.Equal(t, 140.0, trades[1].Price)
+	assert.Zero(t, e.Portfolio.Positions["XYZ"])
+	assert.InDelta(t, 4000, e.Portfolio.Cash, 1e-9)
+	assert.InDelta(t, 4000, e.Portfolio.EquityLog[3].Equity, 1e-9)
+}
+
+// ---------- Ledger Tests ----------
+
+func TestLedger(t *testing.T) {
+	t0 := time.Date(2024, 3, 4, 21, 0, 0, 0, time.UTC)
+	fill := func(side quant.TradeSide, day int, qty, price, fee float64) quant.Trade {
+		return quant.Trade{
+			Timestamp:  t0.AddDate(0, 0, day),
+			Symbol:     "XYZ",
+			Side:       side,
+			Quantity:   qty,
+			Price:      price,
+			Commission: fee,
+		}
+	}
+	// Two lots of ten, a bar from 95 to 120, then fifteen sold at 115
+	book := func(matching quant.LotMatching) *quant.Ledger {
+		l := quant.NewLedger(matching)
+		l.Record(fill(quant.Buy, 0, 10, 100, 1))
+		l.Record(fill(quant.Buy, 1, 10, 110, 1))
+		l.Observe("XYZ", marketdata.Bar{High: 120, Low: 95})
+		l.Record(fill(quant.Sell, 2, 15, 115, 1.5))
+		return l
+	}
+
+	t.Run("fifo", func(t *testing.T) {
+		l := book(quant.FIFO)
+		require.Len(t, l.RoundTrips, 2)
+		first, second := l.RoundTrips[0], l.RoundTrips[1]
+
+		// $150 gross less ten cents a share each way
+		assert.Equal(t, 100.0, first.EntryPrice)
+		assert.Equal(t, 10.0, first.Quantity)
+		assert.InDelta(t, 2, first.Commission, 1e-9)
+		assert.InDelta(t, 148, first.PnL, 1e-9)
+		assert.InDelta(t, 0.148, first.ReturnPct, 1e-9)
+		assert.InDelta(t, -50, first.MAE, 1e-9)
+		assert.InDelta(t, 200, first.MFE, 1e-9)
+		assert.Equal(t, 2*24*3600.0, first.HoldingSeconds)
+
+		assert.Equal(t, 110.0, second.EntryPrice)
+		assert.Equal(t, 5.0, second.Quantity)
+		assert.InDelta(t, 24, second.PnL, 1e-9)
+		assert.InDelta(t, -75, second.MAE, 1e-9)
+		assert.InDelta(t, 50, second.MFE, 1e-9)
+		assert.Equal(t, 110.0, l.AvgEntryPrice("XYZ"))
+	})
+
+	t.Run("lifo", func(t *testing.T) {
+		l := book(quant.LIFO)
+		require.Len(t, l.RoundTrips, 2)
+		assert.Equal(t, 110.0, l.RoundTrips[0].EntryPrice)
+		assert.InDelta(t, 48, l.RoundTrips[0].PnL, 1e-9)
+		assert.Equal(t, 100.0, l.RoundTrips[1].EntryPrice)
+		assert.Equal(t, 5.0, l.RoundTrips[1].Quantity)
+		assert.InDelta(t, 74, l.RoundTrips[1].PnL, 1e-9)
+		assert.Equal(t, 100.0, l.AvgEntryPrice("XYZ"))
+	})
+
+	t.Run("flip to short", func(t *testing.T) {
+		l := quant.NewLedger(quant.FIFO)
+		l.Record(fill(quant.Buy, 0, 5, 110, 0))
+		l.Record(fill(quant.Sell, 1, 10, 100, 0))
+		l.Record(fill(quant.Buy, 2, 5, 90, 0))
+
+		require.Len(t, l.RoundTrips, 2)
+		assert.Equal(t, quant.Long, l.RoundTrips[0].Direction)
+		assert.InDelta(t, -50, l.RoundTrips[0].PnL, 1e-9)
+		assert.Equal(t, quant.Short, l.RoundTrips[1].Direction)
+		assert.InDelta(t, 50, l.RoundTrips[1].PnL, 1e-9)
+		assert.InDelta(t, 0.1, l.RoundTrips[1].ReturnPct, 1e-9)
+		assert.Zero(t, l.AvgEntryPrice("XYZ"))
+	})
+}
+
+func TestCalculateMetrics(t *testing.T) {
+	t0 := time.Date(2024, 1, 30, 21, 0, 0, 0, time.UTC)
+	// Daily returns of +10%, -10%, +10% and +20% across a month end
+	equity := []float64{100, 110, 99, 108.9, 130.68}
+	// A benchmark moving exactly half as much each day
+	closes := []float64{100, 105, 99.75, 104.7375, 115.21125}
+
+	p := quant.NewPortfolio(100)
+	var bench []marketdata.Bar
+	for i := range equity {
+		ts := t0.AddDate(0, 0, i)
+		p.EquityLog = append(p.EquityLog, quant.EquitySnapshot{Timestamp: ts, Equity: equity[i]})
+		bench = append(bench, marketdata.Bar{Timestamp: ts, Close: closes[i]})
+	}
+	p.Ledger.RoundTrips = []quant.RoundTrip{{PnL: 30}, {PnL: -10}, {PnL: 20}, {PnL: 0}}
+	p.CalculateMetricsWith(quant.AnalyticsOptions{Benchmark: bench})
+	m := p.Metrics
+
+	day := 24 * 3600.0
+	sd := math.Sqrt(0.0475 / 4) // population deviation of the returns around 0.075
+	cagr := math.Pow(1.3068, 365.25/4) - 1
+
+	assert.InDelta(t, 0.3068, m.TotalReturn, 1e-9)
+	assert.Equal(t, 252.0, m.PeriodsPerYear)
+	assert.InDelta(t, sd*math.Sqrt(252), m.Volatility, 1e-9)
+	assert.InDelta(t, 0.075/sd*math.Sqrt(252), m.SharpeRatio, 1e-9)
+	// Only the -10% day is downside: sqrt(0.01 / 4) = 0.05
+	assert.InDelta(t, 0.075/0.05*math.Sqrt(252), m.SortinoRatio, 1e-9)
+	assert.InDelta(t, cagr, m.CAGR, cagr*1e-9)
+
+	// 110 down to 99, underwater for three days, recovered two after the trough
+	assert.InDelta(t, 0.1, m.MaxDrawdown, 1e-9)
+	assert.Equal(t, 3*day, m.LongestDrawdownSeconds)
+	require.NotNil(t, m.TimeToRecoverySeconds)
+	assert.Equal(t, 2*day, *m.TimeToRecoverySeconds)
+	assert.InDelta(t, cagr/0.1, m.CalmarRatio, cagr*1e-8)
+
+	require.Len(t, m.MonthlyReturns, 2)
+	assert.Equal(t, 1, m.MonthlyReturns[0].Month)
+	assert.InDelta(t, 0.1, m.MonthlyReturns[0].Return, 1e-9)
+	assert.Equal(t, 2, m.MonthlyReturns[1].Month)
+	assert.InDelta(t, 0.188, m.MonthlyReturns[1].Return, 1e-9)
+
+	require.NotNil(t, m.Benchmark)
+	assert.InDelta(t, 0.1521125, m.Benchmark.TotalReturn, 1e-9)
+	assert.InDelta(t, 2, m.Benchmark.Beta, 1e-9)
+	assert.InDelta(t, 1, m.Benchmark.Correlation, 1e-9)
+	assert.InDelta(t, 0, m.Benchmark.Alpha, 1e-9)
+	te := sd / 2 * math.Sqrt(252)
+	assert.InDelta(t, te, m.Benchmark.TrackingError, 1e-9)
+	assert.InDelta(t, 0.0375*252/te, m.Benchmark.InformationRatio, 1e-9)
+
+	assert.Equal(t, 4, m.TotalTrades)
+	assert.Equal(t, 0.5, m.WinRate)
+	assert.InDelta(t, 10, m.Expectancy, 1e-9)
+	assert.InDelta(t, 25, m.AverageWin, 1e-9)
+	assert.InDelta(t, 10, m.AverageLoss, 1e-9)
+	assert.InDelta(t, 5, m.ProfitFactor, 1e-9)
+
+	t.Run("periods per year", func(t *testing.T) {
+		for _, tc := range []struct {
+			gap  time.Duration
+			want float64
+		}{
+			{time.Minute, 252 * 390},
+			{time.Hour, 252 * 6.5},
+			{7 * 24 * time.Hour, 52},
+			{30 * 24 * time.Hour, 12},
+		} {
+			p := quant.NewPortfolio(100)
+			for i, e := range []float64{100, 101, 102} {
+				p.EquityLog = append(p.EquityLog, quant.EquitySnapshot{
+					Timestamp: t0.Add(time.Duration(i) * tc.gap),
+					Equity:    e,
+				})
+			}
+			p.CalculateMetrics()
+			assert.InDelta(t, tc.want, p.Metrics.PeriodsPerYear, 1e-9, tc.gap)
+		}
+	})
+
+	t.Run("never recovered", func(t *testing.T) {
+		p := quant.NewPortfolio(100)
+		for i, e := range []float64{100, 120, 90, 96} {
+			p.EquityLog = append(p.EquityLog, quant.EquitySnapshot{
+				Timestamp: t0.AddDate(0, 0, i),
+				Equity:    e,
+			})
+		}
+		p.CalculateMetrics()
+		assert.InDelta(t, 0.25, p.Metrics.MaxDrawdown, 1e-9)
+		assert.Equal(t, 2*day, p.Metrics.LongestDrawdownSeconds)
+		assert.Nil(t, p.Metrics.TimeToRecoverySeconds)
+	})
+}
+
+func TestOptimizationCandidates(t *testing.T) {
+	spec := quant.OptimizationSpec{
+		Strategy: "sma_crossover",
+		Symbols:  []string{"aaa"},
+		Start:    "2024-01-01",
+		End:      "2024-02-01",
+		Parameters: map[string]quant.ParamRange{
+			"short_period": {Values: []float64{2, 3}},
+			"long_period":  {Min: 3, Max: 5, Step: 1},
+		},
+	}
+	require.NoError(t, spec.Validate())
+
+	// 3 x 2 combinations, nested in parameter name order, less short_period 3
+	// with long_period 3
+	candidates, err := spec.Candidates()
+	require.NoError(t, err)
+	var got [][2]float64
+	for _, c := range candidates {
+		got = append(got, [2]float64{c["short_period"].(float64), c["long_period"].(float64)})
+	}
+	assert.Equal(t, [][2]float64{{2, 3}, {2, 4}, {3, 4}, {2, 5}, {3, 5}}, got)
+
+	t.Run("random", func(t *testing.T) {
+		random := spec
+		random.Search = quant.RandomSearch
+		random.Samples = 20
+		random.Seed = 7
+		random.Parameters = map[string]quant.ParamRange{
+			"short_period": {Min: 2, Max: 4},
+			"long_period":  {Min: 10, Max: 30, Step: 5},
+		}
+		first, err := random.Candidates()
+		require.NoError(t, err)
+		require.Len(t, first, 20)
+		for _, c := range first {
+			short, long := c["short_period"].(float64), c["long_period"].(float64)
+			assert.Contains(t, []float64{2, 3, 4}, short)
+			assert.Contains(t, []float64{10, 15, 20, 25, 30}, long)
+		}
+
+		again, err := random.Candidates()
+		require.NoError(t, err)
+		assert.Equal(t, first, again, "same seed, same samples")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		bad := spec
+		bad.Parameters = map[string]quant.ParamRange{"period": {Values: []float64{5}}}
+		assert.ErrorContains(t, bad.Validate(), `unknown parameter "period"`)
+
+		bad.Parameters = map[string]quant.ParamRange{
+			"short_period": {Values: []float64{20}},
+			"long_period":  {Values: []float64{10}},
+		}
+		assert.ErrorContains(t, bad.Validate(), "no valid parameter combinations")
+	})
+}
+
+func TestRunOptimization(t *testing.T) {
+	start := time.Date(2024, 1, 1, 21, 0, 0, 0, time.UTC)
+	var ohlc [][4]float64
+	for i := range 31 {
+		c := 100 + 10*math.Sin(float64(i)/2)
+		ohlc = append(ohlc, [4]float64{c, c, c, c})
+	}
+	bars := map[string][]marketdata.Bar{"AAA": dailyBars(start, ohlc...)}
+
+	newSpec := func(wf *quant.WalkForward) *quant.OptimizationSpec {
+		spec := &quant.OptimizationSpec{
+			Strategy:  "sma_crossover",
+			Symbols:   []string{"AAA"},
+			Start:     "2024-01-01",
+			End:       "2024-02-01",
+			Objective: "total_return",
+			Parameters: map[string]quant.ParamRange{
+				"short_period": {Values: []float64{2, 3}},
+				"long_period":  {Values: []float64{4, 6}},
+			},
+			WalkForward: wf,
+		}
+		require.NoError(t, spec.Validate())
+		return spec
+	}
+
+	t.Run("full sample", func(t *testing.T) {
+		var trials []quant.Trial
+		results, err := quant.RunOptimization(
+			context.Background(),
+			newSpec(nil),
+			bars,
+			func(tr quant.Trial) { trials = append(trials, tr) },
+		)
+		require.NoError(t, err)
+		require.Len(t, trials, 4)
+		require.Len(t, results, 1)
+
+		best := results[0].Best
+		require.NotNil(t, best)
+		assert.Nil(t, results[0].OutOfSample)
+		for _, tr := range trials {
+			require.NoError(t, tr.Err)
+			assert.Equal(t, quant.SampleFull, tr.Sample)
+			assert.Equal(t, tr.Metrics.TotalReturn, tr.Objective)
+			assert.GreaterOrEqual(t, best.Objective, tr.Objective)
+		}
+	})
+
+	t.Run("walk forward", func(t *testing.T) {
+		// Ten days in sample, five out, stepping five: the last window's
+		// out-of-sample run is cut short at the end of the range
+		spec := newSpec(&quant.WalkForward{InSampleDays: 10, OutOfSampleDays: 5})
+		var trials []quant.Trial
+		results, err := quant.RunOptimization(
+			context.Background(),
+			spec,
+			bars,
+			func(tr quant.Trial) { trials = append(trials, tr) },
+		)
+		require.NoError(t, err)
+		require.Len(t, results, 5)
+		assert.Len(t, trials, 5*(4+1))
+
+		day := func(month time.Month, d int) time.Time {
+			return time.Date(2024, month, d, 0, 0, 0, 0, time.UTC)
+		}
+		boundaries := [][3]time.Time{
+			{day(1, 1), day(1, 11), day(1, 16)},
+			{day(1, 6), day(1, 16), day(1, 21)},
+			{day(1, 11), day(1, 21), day(1, 26)},
+			{day(1, 16), day(1, 26), day(1, 31)},
+			{day(1, 21), day(1, 31), day(2, 1)},
+		}
+		for i, r := range results {
+			assert.Equal(t, i, r.Index)
+			require.NotNil(t, r.Best)
+			require.NotNil(t, r.OutOfSample)
+			assert.Equal(t, quant.SampleInSample, r.Best.Sample)
+			assert.Equal(t, boundaries[i][0], r.Best.Start, "window %d", i)
+			assert.Equal(t, boundaries[i][1], r.Best.End, "window %d", i)
+
+			oos := r.OutOfSample
+			assert.Equal(t, quant.SampleOutOfSample, oos.Sample)
+			assert.Equal(t, boundaries[i][1], oos.Start, "window %d", i)
+			assert.Equal(t, boundaries[i][2], oos.End, "window %d", i)
+			assert.Equal(t, r.Best.Parameters, oos.Parameters)
+
+			for _, tr := range trials {
+				if tr.Window == i && tr.Sample == quant.SampleInSample {
+					assert.GreaterOrEqual(t, r.Best.Objective, tr.Objective)
+				}
+			}
+		}
+
+		params, _, ok := spec.BestParameters(results)
+		require.True(t, ok)
+		assert.Contains(t, []float64{2, 3}, params["short_period"])
+	})
+}
+
+func TestBarCache_Coverage(t *testing.T) {
+	ctx := context.Background()
+	day := func(d int) time.Time { return time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, d) }
+	key := database.BarKey{
+		Symbol:    "COVER",
+		Timeframe: marketdata.OneDay.String(),
+		Feed:      marketdata.IEX,
+	}
+
+	var fetched []database.BarRange
+	cache := broker.NewBarCache(
+		testDB,
+		func(symbol string, req marketdata.GetBarsRequest) ([]marketdata.Bar, error) {
+			fetched = append(fetched, database.BarRange{Start: req.Start, End: req.End})
+			return []marketdata.Bar{{Timestamp: req.Start, Close: 100}}, nil
+		},
+	)
+	syncRange := func(start, end int) []database.BarRange {
+		t.Helper()
+		fetched = nil
+		require.NoError(t, cache.Sync(ctx, key, marketdata.GetBarsRequest{
+			TimeFrame: marketdata.OneDay,
+			Feed:      marketdata.IEX,
+			Start:     day(start),
+			End:       day(end),
+		}))
+		return fetched
+	}
+	coverage := func() []database.BarRange {
+		t.Helper()
+		ranges, err := database.GetBarCoverage(ctx, testDB, key)
+		require.NoError(t, err)
+		for i := range ranges {
+			ranges[i].Start, ranges[i].End = ranges[i].Start.UTC(), ranges[i].End.UTC()
+		}
+		return ranges
+	}
+
+	// Overlapping, touching and out-of-order ranges merge into two
+	require.NoError(t, database.SaveBars(ctx, testDB, key, nil, []database.BarRange{
+		{Start: day(20), End: day(25)},
+		{Start: day(10), End: day(14)},
+		{Start: day(12), End: day(15)},
+		{Start: day(15), End: day(16)},
+		{Start: day(21), End: day(23)},
+	}))
+
+	// Only the gaps before, between and after the covered ranges are fetched
+	assert.Equal(t, []database.BarRange{
+		{Start: day(5), End: day(10)},
+		{Start: day(16), End: day(20)},
+		{Start: day(25), End: day(30)},
+	}, syncRange(5, 30))
+	assert.Equal(t, []database.BarRange{{Start: day(5), End: day(30)}}, coverage())
+
+	// Fully covered requests fetch nothing
+	assert.Empty(t, syncRange(12, 22))
+	assert.Empty(t, syncRange(5, 30))
+
+	// A request straddling one edge fetches just the uncovered part
+	assert.Equal(t, []database.BarRange{{Start: day(30), End: day(33)}}, syncRange(28, 33))
+	assert.Equal(t, []database.BarRange{{Start: day(0), End: day(5)}}, syncRange(0, 6))
+	assert.Equal(t, []database.BarRange{{Start: day(0), End: day(33)}}, coverage())
+
+	// A disjoint request is fetched whole and kept as its own range
+	assert.Equal(t, []database.BarRange{{Start: day(40), End: day(45)}}, syncRange(40, 45))
+	assert.Equal(t, []database.BarRange{
+		{Start: day(0), End: day(33)},
+		{Start: day(40), End: day(45)},
+	}, coverage())
+}
+
+func TestPaper_ReplayOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	start := time.Date(2024, 3, 4, 14, 30, 0, 0, time.UTC)
+	minute := func(n int, close float64) marketdata.Bar {
+		return marketdata.Bar{Timestamp: start.Add(time.Duration(n) * time.Minute), Close: close}
+	}
+	bars := map[string][]marketdata.Bar{
+		"CCC": {minute(0, 1), minute(1, 2)},
+		"AAA": {minute(0, 1), minute(1, 2)},
+		"BBB": {minute(1, 2)},
+	}
+
+	p := broker.NewPaper(1000)
+	var got []string
+	sub, err := p.SubscribeBars(func(b stream.Bar) {
+		got = append(got, b.Symbol+b.Timestamp.Format("@15:04"))
+	}, "AAA", "BBB", "CCC")
+	require.NoError(t, err)
+	defer sub.Close()
+	go p.ConnectTradeUpdates(ctx, func(alpaca.TradeUpdate) {})
+
+	require.NoError(t, p.Replay(ctx, bars, 0))
+	// Bars at the same minute go in symbol order, whatever the map order
+	assert.Equal(t, []string{"AAA@14:30", "CCC@14:30", "AAA@14:31", "BBB@14:31", "CCC@14:31"}, got)
+}